@@ -1,61 +1,149 @@
 package main
 
 import (
+	"context"
+	"crypto/ed25519"
+	"crypto/x509"
+	"errors"
 	"fmt"
-	"io"
+	"io/fs"
+	"net"
+	"net/http"
+	"net/url"
 	"os"
 	"path/filepath"
+	"sort"
+	"strings"
+	"time"
 
 	"github.com/charmbracelet/huh"
 
+	"github.com/andrew/ezproxy/internal/bundle"
+	"github.com/andrew/ezproxy/internal/certs"
 	"github.com/andrew/ezproxy/internal/config"
 	"github.com/andrew/ezproxy/internal/configurator"
+	"github.com/andrew/ezproxy/internal/credentials"
 	"github.com/andrew/ezproxy/internal/detect"
+	"github.com/andrew/ezproxy/internal/doctor"
 	"github.com/andrew/ezproxy/internal/fileutil"
+	"github.com/andrew/ezproxy/internal/noproxy"
+	"github.com/andrew/ezproxy/internal/pac"
+	"github.com/andrew/ezproxy/internal/policy"
+	"github.com/andrew/ezproxy/internal/privileged"
+	"github.com/andrew/ezproxy/internal/redact"
+	"github.com/andrew/ezproxy/internal/relay"
+	"github.com/andrew/ezproxy/internal/report"
+	"github.com/andrew/ezproxy/internal/state"
 )
 
+// rollbackOnError restores every file touched by a run when any tool fails.
+var rollbackOnError bool
+
+// relayOverride is set by --via-relay ("on") or --no-relay ("off") and
+// changes relay.enabled in config.yaml for this and later runs.
+var relayOverride string
+
 func main() {
 	if len(os.Args) < 2 {
 		fmt.Println("Usage: ezproxy <command> [args] [flags]")
 		fmt.Println()
 		fmt.Println("Commands:")
-		fmt.Println("  init              Interactive setup wizard")
+		fmt.Println("  init [profile]    Interactive setup wizard (optionally for a named profile)")
+		fmt.Println("                    --http, --https, --no-proxy, --ca-cert, --pac, --tools, --from answers.yaml: set up without prompts")
+		fmt.Println("                    --bundle <file or URL> [--bundle-key key.pub]: set up from a signed organisation bundle")
+		fmt.Println("  update            Fetch a newer organisation bundle, if there is one")
+		fmt.Println("  config show [--origin]      Show the effective config (--origin: which file each value came from)")
 		fmt.Println("  apply             Apply proxy config to all enabled tools")
 		fmt.Println("  remove            Remove proxy config from all tools")
-		fmt.Println("  status            Show current config status per tool")
+		fmt.Println("  status [--check]  Show current config status per tool (--check: exit 1 on drift)")
 		fmt.Println("  manage            Interactive tool manager (toggle tools on/off)")
 		fmt.Println("  enable <tool>     Enable a tool and apply its config")
 		fmt.Println("  disable <tool>    Disable a tool and remove its config")
+		fmt.Println("  switch <profile>  Activate a named profile and re-apply all tools")
+		fmt.Println("  rollback [id]     Restore files from a backup (latest if no id; 'list' to show all)")
+		fmt.Println("  doctor [--probe host:port]  Check proxy, CONNECT, CA, NO_PROXY and every tool")
+		fmt.Println("  serve [--listen addr]       Run the local authenticating relay proxy")
+		fmt.Println("  serve --login [--keyring|--file]  Store the proxy credentials for the relay and your tools")
 		fmt.Println()
 		fmt.Println("Flags:")
 		fmt.Println("  --dry-run         Preview changes without modifying files")
 		fmt.Println("  --yes, -y         Skip confirmations (for scripting)")
+		fmt.Println("  --rollback-on-error  Restore all files if any tool fails to apply")
+		fmt.Println("  --output json     Print a JSON result per tool (apply, remove, status)")
+		fmt.Println("  --via-relay       Point tools at the local relay instead of the upstream proxy (--no-relay to undo)")
 		os.Exit(1)
 	}
 
 	// Parse global flags from anywhere in args
 	var cleaned []string
-	for _, arg := range os.Args {
-		switch arg {
+	for i := 0; i < len(os.Args); i++ {
+		switch arg := os.Args[i]; arg {
+		case "--output", "--output=json", "--output=text":
+			format := strings.TrimPrefix(arg, "--output=")
+			if arg == "--output" {
+				if i+1 >= len(os.Args) {
+					fmt.Fprintln(os.Stderr, "--output requires a value (text or json)")
+					os.Exit(1)
+				}
+				i++
+				format = os.Args[i]
+			}
+			switch format {
+			case "json":
+				report.JSON = true
+			case "text":
+			default:
+				fmt.Fprintf(os.Stderr, "Unknown output format: %s (use text or json)\n", format)
+				os.Exit(1)
+			}
 		case "--dry-run":
 			fileutil.DryRun = true
 		case "--yes", "-y":
 			fileutil.AutoYes = true
+		case "--rollback-on-error":
+			rollbackOnError = true
+		case "--via-relay":
+			relayOverride = "on"
+		case "--no-relay":
+			relayOverride = "off"
 		default:
 			cleaned = append(cleaned, arg)
 		}
 	}
 	os.Args = cleaned
 
+	if report.JSON {
+		switch os.Args[1] {
+		case "apply", "remove", "status":
+		default:
+			fmt.Fprintf(os.Stderr, "--output json is not supported for %s\n", os.Args[1])
+			os.Exit(1)
+		}
+	}
+
 	switch os.Args[1] {
 	case "init":
-		cmdInit()
+		profile, answers, unattended, b, err := parseInitArgs(os.Args[2:])
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		cmdInit(profile, answers, unattended, b)
+	case "update":
+		cmdUpdate()
+	case "config":
+		if len(os.Args) < 3 || os.Args[2] != "show" {
+			fmt.Fprintln(os.Stderr, "Usage: ezproxy config show [--origin]")
+			os.Exit(1)
+		}
+		cmdConfigShow(len(os.Args) > 3 && os.Args[3] == "--origin")
 	case "apply":
 		cmdApply()
 	case "remove":
 		cmdRemove()
 	case "status":
-		cmdStatus()
+		check := len(os.Args) > 2 && os.Args[2] == "--check"
+		cmdStatus(check)
 	case "manage":
 		cmdManage()
 	case "enable":
@@ -70,6 +158,51 @@ func main() {
 			os.Exit(1)
 		}
 		cmdDisable(os.Args[2])
+	case "switch":
+		if len(os.Args) < 3 {
+			cmdListProfiles()
+			os.Exit(1)
+		}
+		cmdSwitch(os.Args[2])
+	case "rollback":
+		id := ""
+		if len(os.Args) > 2 {
+			id = os.Args[2]
+		}
+		cmdRollback(id)
+	case "doctor":
+		probe := ""
+		for i := 2; i < len(os.Args); i++ {
+			if arg, ok := strings.CutPrefix(os.Args[i], "--probe="); ok {
+				probe = arg
+			} else if os.Args[i] == "--probe" && i+1 < len(os.Args) {
+				i++
+				probe = os.Args[i]
+			}
+		}
+		cmdDoctor(probe)
+	case "serve":
+		listen, login, store := "", false, ""
+		for i := 2; i < len(os.Args); i++ {
+			switch arg := os.Args[i]; {
+			case arg == "--login":
+				login = true
+			case arg == "--keyring":
+				store = credentials.StoreKeyring
+			case arg == "--file":
+				store = credentials.StoreFile
+			case strings.HasPrefix(arg, "--listen="):
+				listen = strings.TrimPrefix(arg, "--listen=")
+			case arg == "--listen" && i+1 < len(os.Args):
+				i++
+				listen = os.Args[i]
+			}
+		}
+		if login {
+			cmdLogin(store)
+		} else {
+			cmdServe(listen)
+		}
 	default:
 		fmt.Fprintf(os.Stderr, "Unknown command: %s\n", os.Args[1])
 		os.Exit(1)
@@ -85,49 +218,444 @@ func configPath() string {
 	return filepath.Join(home, ".ezproxy", "config.yaml")
 }
 
+func backupsDir() string {
+	return filepath.Join(filepath.Dir(configPath()), "backups")
+}
+
+// beginSnapshot starts recording every file the command touches so that it
+// can be undone with "ezproxy rollback". Nothing is recorded in dry-run mode.
+func beginSnapshot(command string) *fileutil.Snapshot {
+	if fileutil.DryRun {
+		return nil
+	}
+	return fileutil.BeginSnapshot(backupsDir(), command)
+}
+
+// endSnapshot stops recording and tells the user how to undo the run.
+func endSnapshot(snap *fileutil.Snapshot) {
+	if snap == nil {
+		return
+	}
+	fileutil.EndSnapshot()
+	if snap.Len() > 0 {
+		report.Current().Backup = snap.ID
+		say("\nBackup of %d file(s) saved as %s (undo with 'ezproxy rollback %s').\n", snap.Len(), snap.ID, snap.ID)
+	}
+}
+
+// finishSnapshot ends the snapshot, restoring everything it recorded first
+// if the run had failures and --rollback-on-error was given. It returns
+// true if the run was rolled back.
+func finishSnapshot(snap *fileutil.Snapshot, failed int) bool {
+	if snap == nil || failed == 0 || !rollbackOnError {
+		endSnapshot(snap)
+		return false
+	}
+	fileutil.EndSnapshot()
+	report.Printf("\n%d tool(s) failed; rolling back %d file(s)...\n", failed, snap.Len())
+	if err := restoreSnapshot(snap); err != nil {
+		report.Errorf("Error during rollback: %v\n", err)
+		report.Errorf("Backup is kept as %s; retry with 'ezproxy rollback %s'.\n", snap.ID, snap.ID)
+		return true
+	}
+	report.Printf("All changes from this run were restored.\n")
+	return true
+}
+
+// restoreSnapshot puts back every file snap recorded, the ones only root
+// can write through package privileged.
+func restoreSnapshot(snap *fileutil.Snapshot) error {
+	err := snap.Restore()
+	if rootErr := privileged.AddRestore(snap); rootErr != nil {
+		return errors.Join(err, rootErr)
+	}
+	if privileged.Flush() > 0 {
+		return errors.Join(err, errors.New("the files that need root were not restored"))
+	}
+	return err
+}
+
+// say prints part of the text output. It is silent with --output json,
+// where the same information is carried by the report.
+func say(format string, args ...any) {
+	if !report.JSON {
+		fmt.Print(redact.String(fmt.Sprintf(format, args...)))
+	}
+}
+
+// startReport begins collecting per-tool results for command.
+func startReport(command string, cfg *config.Config) {
+	run := report.Start(command)
+	run.Profile = cfg.ActiveProfile
+	run.DryRun = fileutil.DryRun
+}
+
+// flushReport prints the JSON result in --output json mode.
+func flushReport() {
+	if err := report.Flush(os.Stdout); err != nil {
+		fmt.Fprintf(os.Stderr, "Error writing JSON output: %v\n", err)
+	}
+}
+
+// beginTool starts the report entry for c. It returns false, after
+// recording why, if c is disabled or not installed.
+func beginTool(c configurator.Configurator, cfg *config.Config, osInfo detect.OSInfo, action string) (*report.Tool, bool) {
+	t := report.BeginTool(c.Name())
+	tc, exists := cfg.Tools[c.Name()]
+	t.Enabled = !exists || tc.Enabled
+	t.Action = "skip"
+	if !t.Enabled {
+		t.Status = "disabled"
+		return t, false
+	}
+	t.Available = c.IsAvailable(osInfo)
+	if !t.Available {
+		t.Status = "not installed"
+		return t, false
+	}
+	t.Action = action
+	return t, true
+}
+
+// readConfig merges /etc/ezproxy/config.yaml, the user's config.yaml and
+// the nearest .ezproxy.yaml above the current directory.
+func readConfig() (*config.Config, error) {
+	wd, _ := os.Getwd()
+	return config.LoadLayers(configPath(), wd)
+}
+
 func loadConfig() *config.Config {
-	cfg, err := config.Load(configPath())
+	cfg, err := readConfig()
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Error loading config: %v\n", err)
 		fmt.Fprintf(os.Stderr, "Run 'ezproxy init' to create a config file.\n")
 		os.Exit(1)
 	}
+	loadState()
+	switch relayOverride {
+	case "on":
+		cfg.Relay.Enabled = true
+	case "off":
+		cfg.Relay.Enabled = false
+	}
+	if cfg.Relay.Enabled {
+		cfg.UseRelay()
+	}
+	cfg.CABundle = caBundlePath()
+	cfg.CAFile = caFilePath()
+	loadCredentials(cfg)
 	return cfg
 }
 
+// loadPolicy reads the organisation policy. A policy that can't be read
+// stops the command rather than being ignored.
+func loadPolicy() *policy.Policy {
+	pol, err := policy.Load(policy.Path)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error reading policy: %v\n", err)
+		os.Exit(1)
+	}
+	return pol
+}
+
+// refuse explains why the policy doesn't allow something and exits.
+func refuse(pol *policy.Policy, err error) {
+	fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+	if pol.Message != "" {
+		fmt.Fprintln(os.Stderr, pol.Message)
+	}
+	os.Exit(1)
+}
+
+// checkPolicy refuses settings that break the policy. It runs before
+// anything is written, so certInput holds the cert paths as given.
+func checkPolicy(pol *policy.Policy, proxy config.ProxyConfig, pacURL, certInput string, tools map[string]config.ToolConfig) {
+	refuseViolations(pol, &config.Config{Proxy: proxy, PACURL: pacURL, CACerts: config.SplitList(certInput), Tools: tools})
+}
+
+// refuseViolations lists every way cfg breaks the policy, if it does, and
+// exits.
+func refuseViolations(pol *policy.Policy, cfg *config.Config) {
+	violations := pol.Check(cfg)
+	if len(violations) == 0 {
+		return
+	}
+	for _, v := range violations {
+		fmt.Fprintf(os.Stderr, "Error: %s\n", v)
+	}
+	if pol.Message != "" {
+		fmt.Fprintln(os.Stderr, pol.Message)
+	}
+	os.Exit(1)
+}
+
+// policyLabel marks tools the policy decides in the tool pickers.
+func policyLabel(pol *policy.Policy, name string) string {
+	if rule := pol.Tool(name); rule != "" {
+		return " (" + string(rule) + " by policy)"
+	}
+	return ""
+}
+
+func caBundlePath() string {
+	return filepath.Join(filepath.Dir(configPath()), "ca-bundle.pem")
+}
+
+func caFilePath() string {
+	return filepath.Join(filepath.Dir(configPath()), "corp-cas.pem")
+}
+
+// caFiles returns the content of the two generated CA files: the corporate
+// CAs alone (cfg.CAFile) and combined with the system roots (cfg.CABundle).
+func caFiles(cfg *config.Config) (corp, bundle []byte, err error) {
+	cas, err := certs.Load(cfg.CACertPaths())
+	if err != nil {
+		return nil, nil, err
+	}
+	bundle, err = certs.Bundle(certs.SystemRootsPath(), cas)
+	if err != nil {
+		return nil, nil, err
+	}
+	return certs.EncodePEM(cas), bundle, nil
+}
+
+// applyCABundle rebuilds the corporate CA file and the combined CA bundle
+// if the configured CAs or the system roots have changed. If they can't be
+// built, tools are pointed at the configured cert files directly.
+func applyCABundle(cfg *config.Config) {
+	if !cfg.HasCACerts() {
+		return
+	}
+	t := report.BeginTool("ca_bundle")
+	defer report.EndTool()
+	t.Enabled, t.Available, t.Action = true, true, "apply"
+
+	if certs.SystemRootsPath() == "" {
+		report.Warnf("  Warning: no system root bundle found; %s holds only the corporate CAs.\n", cfg.CABundle)
+	}
+	corp, bundle, err := caFiles(cfg)
+	if err == nil && fileutil.DryRun {
+		for _, f := range []struct {
+			path    string
+			content []byte
+		}{{cfg.CAFile, corp}, {cfg.CABundle, bundle}} {
+			if !certs.UpToDate(f.path, f.content) {
+				report.Printf("\n  [dry-run] Would rebuild %s\n", f.path)
+			}
+		}
+		t.Status = configurator.StatusConfigured
+		return
+	}
+	changed := false
+	if err == nil {
+		changed, err = certs.WriteIfChanged(cfg.CAFile, corp)
+	}
+	if err == nil {
+		var c bool
+		c, err = certs.WriteIfChanged(cfg.CABundle, bundle)
+		changed = changed || c
+	}
+	if err != nil {
+		t.Status = "error"
+		t.Errors = append(t.Errors, err.Error())
+		say("  %-12s ERROR: %v (using the configured cert files directly)\n", "ca_bundle", err)
+		cfg.CABundle, cfg.CAFile = "", ""
+		return
+	}
+	t.Status = configurator.StatusConfigured
+	if changed {
+		say("  %-12s ✓ rebuilt %s\n", "ca_bundle", cfg.CABundle)
+	}
+}
+
+// removeCABundle deletes the generated CA files once no tool points at them.
+func removeCABundle(cfg *config.Config) {
+	for _, path := range []string{cfg.CABundle, cfg.CAFile} {
+		if _, err := os.Stat(path); err != nil {
+			continue
+		}
+		if fileutil.DryRun {
+			report.Printf("\n  [dry-run] Would delete %s\n", path)
+			continue
+		}
+		if err := fileutil.RemoveFile(path); err != nil {
+			report.Errorf("  %-12s ERROR: %v\n", "ca_bundle", err)
+			return
+		}
+	}
+	if !fileutil.DryRun {
+		say("  %-12s ✓ removed\n", "ca_bundle")
+	}
+}
+
+// caBundleStatus reports whether the generated CA files match what
+// applyCABundle would build now.
+func caBundleStatus(cfg *config.Config) string {
+	corp, bundle, err := caFiles(cfg)
+	if err != nil {
+		return fmt.Sprintf("error: %v", err)
+	}
+	if _, err := os.Stat(cfg.CABundle); err != nil {
+		return configurator.StatusNotConfigured
+	}
+	if !certs.UpToDate(cfg.CABundle, bundle) || !certs.UpToDate(cfg.CAFile, corp) {
+		return configurator.StatusStale
+	}
+	return configurator.StatusConfigured
+}
+
+func statePath() string {
+	return filepath.Join(filepath.Dir(configPath()), "state.json")
+}
+
+// loadState reads the manifest of what ezproxy has applied so configurators
+// can undo exactly their own changes.
+func loadState() {
+	m, err := state.Load(statePath())
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: ignoring unreadable %s: %v\n", statePath(), err)
+		return
+	}
+	configurator.State = m
+}
+
+func saveState() {
+	if fileutil.DryRun {
+		return
+	}
+	if err := state.Save(statePath(), configurator.State); err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: could not save %s: %v\n", statePath(), err)
+	}
+}
+
+// applyTool applies c with the settings its tools entry resolves to. For
+// a tool set to direct, ezproxy's proxy settings are removed instead.
+func applyTool(c configurator.Configurator, cfg *config.Config) error {
+	if cfg.Tools[c.Name()].Direct {
+		return removeTool(c)
+	}
+	return configurator.Apply(c, cfg.ForTool(c.Name()))
+}
+
+// toolStatus is c's Status against the settings its tools entry resolves
+// to. A tool set to direct has nothing to compare and reports "direct".
+func toolStatus(c configurator.Configurator, cfg *config.Config) (string, error) {
+	if cfg.Tools[c.Name()].Direct {
+		return configurator.StatusDirect, nil
+	}
+	return c.Status(cfg.ForTool(c.Name()))
+}
+
+// removeTool undoes a tool's configuration and forgets its recorded state.
+// The state is forgotten once the removals that need root have run, so if
+// they are declined the next remove still knows what ezproxy did.
+func removeTool(c configurator.Configurator) error {
+	if err := configurator.Remove(c); err != nil {
+		return err
+	}
+	name := c.Name()
+	privileged.Then(name, func() { configurator.State.Forget(name) })
+	return nil
+}
+
 func cmdApply() {
 	cfg := loadConfig()
 	osInfo := detect.DetectOS()
+	refuseViolations(loadPolicy(), cfg)
 
+	startReport("apply", cfg)
 	if fileutil.DryRun {
-		fmt.Println("DRY RUN: showing what would be configured (no files modified)")
+		say("DRY RUN: showing what would be configured (no files modified)\n")
+	} else {
+		say("Applying proxy configuration...\n")
+	}
+
+	snap := beginSnapshot("apply")
+	if relayOverride != "" {
+		saveRelaySetting(cfg)
+	}
+	failed := applyTools(cfg, osInfo)
+	failed += privileged.Flush()
+	saveState()
+	rolledBack := finishSnapshot(snap, failed)
+	printApplyDone()
+	flushReport()
+	if rolledBack {
+		os.Exit(1)
+	}
+}
+
+// saveConfig writes cfg to config.yaml, backing the file up into the
+// active snapshot first so that a rollback restores it along with the
+// tools.
+func saveConfig(cfg *config.Config) {
+	if err := fileutil.BackupFile(configPath()); err != nil {
+		fmt.Fprintf(os.Stderr, "Error backing up config: %v\n", err)
+		os.Exit(1)
+	}
+	if err := config.Save(configPath(), cfg); err != nil {
+		fmt.Fprintf(os.Stderr, "Error saving config: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+// saveRelaySetting stores the relay.enabled value from --via-relay or
+// --no-relay so later runs (and status) use the same proxy.
+func saveRelaySetting(cfg *config.Config) {
+	if cfg.Relay.Enabled {
+		say("Pointing tools at the local relay %s (start it with 'ezproxy serve').\n", cfg.Proxy.HTTP)
 	} else {
-		fmt.Println("Applying proxy configuration...")
+		say("Pointing tools at the upstream proxy %s.\n", cfg.Proxy.HTTP)
 	}
+	if fileutil.DryRun {
+		return
+	}
+	if err := fileutil.BackupFile(configPath()); err != nil {
+		fmt.Fprintf(os.Stderr, "Error backing up config: %v\n", err)
+		os.Exit(1)
+	}
+	if err := config.Save(configPath(), cfg); err != nil {
+		fmt.Fprintf(os.Stderr, "Error saving config: %v\n", err)
+		os.Exit(1)
+	}
+}
 
+// applyTools runs Apply for every enabled, installed configurator and
+// returns the number of tools that failed.
+func applyTools(cfg *config.Config, osInfo detect.OSInfo) int {
+	applyCABundle(cfg)
+	failed := 0
 	for _, c := range configurator.All() {
-		enabled, exists := cfg.Tools[c.Name()]
-		if exists && !enabled {
-			fmt.Printf("  %-12s skipped (disabled)\n", c.Name())
-			continue
-		}
-		if !c.IsAvailable(osInfo) {
-			fmt.Printf("  %-12s skipped (not installed)\n", c.Name())
+		t, ok := beginTool(c, cfg, osInfo, "apply")
+		if !ok {
+			say("  %-12s skipped (%s)\n", c.Name(), t.Status)
+			report.EndTool()
 			continue
 		}
-		if err := c.Apply(cfg); err != nil {
-			fmt.Printf("  %-12s ERROR: %v\n", c.Name(), err)
+		if err := applyTool(c, cfg); err != nil {
+			t.Status = "error"
+			t.Errors = append(t.Errors, err.Error())
+			say("  %-12s ERROR: %v\n", c.Name(), err)
+			failed++
+		} else if cfg.Tools[c.Name()].Direct {
+			t.Status = configurator.StatusDirect
+			say("  %-12s ✓ direct (no proxy)\n", c.Name())
 		} else {
-			fmt.Printf("  %-12s ✓ configured\n", c.Name())
+			t.Status = configurator.StatusConfigured
+			say("  %-12s ✓ configured\n", c.Name())
 		}
+		report.EndTool()
 	}
+	return failed
+}
 
+func printApplyDone() {
 	if !fileutil.DryRun {
 		profiles := detect.ShellProfiles()
 		if len(profiles) > 0 {
-			fmt.Printf("\nDone! Restart your shell or run 'source %s' to apply env vars.\n", profiles[0])
+			say("\nDone! Restart your shell or run 'source %s' to apply env vars.\n", profiles[0])
 		} else {
-			fmt.Println("\nDone! Restart your shell to apply env vars.")
+			say("\nDone! Restart your shell to apply env vars.\n")
 		}
 	}
 }
@@ -135,9 +663,14 @@ func cmdApply() {
 func cmdRemove() {
 	cfg := loadConfig()
 	osInfo := detect.DetectOS()
+	pol := loadPolicy()
 
+	startReport("remove", cfg)
 	if fileutil.DryRun {
-		fmt.Println("DRY RUN: showing what would be removed (no files modified)")
+		say("DRY RUN: showing what would be removed (no files modified)\n")
+	} else if report.JSON && !fileutil.AutoYes {
+		fmt.Fprintln(os.Stderr, "remove with --output json needs --yes (it can't ask for confirmation)")
+		os.Exit(1)
 	} else if !fileutil.AutoYes {
 		var confirm bool
 		err := huh.NewConfirm().
@@ -152,120 +685,659 @@ func cmdRemove() {
 			return
 		}
 	} else {
-		fmt.Println("Removing proxy configuration...")
+		say("Removing proxy configuration...\n")
 	}
 
+	snap := beginSnapshot("remove")
+	kept := 0
 	for _, c := range configurator.All() {
-		enabled, exists := cfg.Tools[c.Name()]
-		if exists && !enabled {
+		t, ok := beginTool(c, cfg, osInfo, "remove")
+		if !ok {
+			report.EndTool()
 			continue
 		}
-		if !c.IsAvailable(osInfo) {
+		// Tools the policy requires stay configured, and so does the CA
+		// bundle they may use.
+		if err := pol.CheckTool(c.Name(), false); err != nil {
+			t.Status = "kept"
+			report.Warnf("  %-12s kept: %v\n", c.Name(), err)
+			kept++
+			report.EndTool()
 			continue
 		}
-		if err := c.Remove(); err != nil {
-			fmt.Printf("  %-12s ERROR: %v\n", c.Name(), err)
+		if err := removeTool(c); err != nil {
+			t.Status = "error"
+			t.Errors = append(t.Errors, err.Error())
+			say("  %-12s ERROR: %v\n", c.Name(), err)
 		} else {
-			fmt.Printf("  %-12s ✓ removed\n", c.Name())
+			t.Status = "removed"
+			say("  %-12s ✓ removed\n", c.Name())
 		}
+		report.EndTool()
 	}
+	notRemoved := privileged.Flush()
+	if kept == 0 {
+		removeCABundle(cfg)
+	} else if pol.Message != "" {
+		say("  %s\n", pol.Message)
+	}
+	saveState()
+	endSnapshot(snap)
 
-	if !fileutil.DryRun {
-		fmt.Println("\nDone! Restart your shell to apply changes.")
+	if notRemoved > 0 {
+		say("\n%d tool(s) still have the changes that need root (see above).\n", notRemoved)
+	} else if !fileutil.DryRun {
+		say("\nDone! Restart your shell to apply changes.\n")
 	}
+	flushReport()
 }
 
-func cmdStatus() {
+// cmdStatus prints the status of every tool. With check set it exits 1 if
+// any enabled, installed tool has drifted from config.yaml.
+func cmdStatus(check bool) {
 	cfg := loadConfig()
 	osInfo := detect.DetectOS()
+	startReport("status", cfg)
 
-	fmt.Printf("Proxy:    %s\n", cfg.Proxy.HTTP)
+	if cfg.ActiveProfile != "" {
+		say("Profile:  %s\n", cfg.ActiveProfile)
+	}
+	say("Proxy:    %s\n", cfg.Proxy.HTTP)
 	if cfg.Proxy.HTTPS != cfg.Proxy.HTTP {
-		fmt.Printf("HTTPS:    %s\n", cfg.Proxy.HTTPS)
+		say("HTTPS:    %s\n", cfg.Proxy.HTTPS)
 	}
-	fmt.Printf("NO_PROXY: %s\n", cfg.Proxy.NoProxy)
-	if cfg.CACert != "" {
-		fmt.Printf("CA Cert:  %s\n", cfg.CACert)
+	say("NO_PROXY: %s\n", cfg.Proxy.NoProxy)
+	if paths := configuredCACerts(cfg.CACert, cfg.CACerts); len(paths) > 0 {
+		say("CA Cert:  %s\n", strings.Join(paths, ", "))
 	}
-	fmt.Println()
-	fmt.Printf("%-14s %-28s %s\n", "Tool", "Status", "Available")
-	fmt.Printf("%-14s %-28s %s\n", "────", "──────", "─────────")
-
-	for _, c := range configurator.All() {
-		enabled, exists := cfg.Tools[c.Name()]
-		if exists && !enabled {
-			fmt.Printf("%-14s %-28s %s\n", c.Name(), "disabled", "-")
-			continue
+	if line := credentialsLine(cfg); line != "" {
+		say("Auth:     %s\n", line)
+	}
+	if cfg.PasswordInURL() {
+		report.Warnf("Warning: config.yaml has a password in a proxy URL; run 'ezproxy serve --login' to move it to a credentials store.\n")
+	}
+	say("\n")
+	say("%-14s %-28s %s\n", "Tool", "Status", "Available")
+	say("%-14s %-28s %s\n", "────", "──────", "─────────")
+
+	var drifted, unhonoured, noAuth []string
+	if cfg.HasCACerts() {
+		t := report.BeginTool("ca_bundle")
+		t.Enabled, t.Available, t.Action = true, true, "status"
+		t.Status = caBundleStatus(cfg)
+		report.EndTool()
+		if configurator.IsDrift(t.Status) || strings.HasPrefix(t.Status, "error") {
+			drifted = append(drifted, t.Name)
 		}
-
-		available := c.IsAvailable(osInfo)
-		if !available {
-			fmt.Printf("%-14s %-28s %s\n", c.Name(), "skipped", "no (not installed)")
+		say("%-14s %-28s %s\n", t.Name, t.Status, "yes")
+	}
+	for _, c := range configurator.All() {
+		t, ok := beginTool(c, cfg, osInfo, "status")
+		if !ok {
+			if t.Enabled {
+				say("%-14s %-28s %s\n", c.Name(), "skipped", "no (not installed)")
+			} else {
+				say("%-14s %-28s %s\n", c.Name(), "disabled", "-")
+			}
+			report.EndTool()
 			continue
 		}
 
-		status, err := c.Status(cfg)
+		status, err := toolStatus(c, cfg)
 		if err != nil {
+			t.Errors = append(t.Errors, err.Error())
 			status = fmt.Sprintf("error: %v", err)
+			drifted = append(drifted, c.Name())
+		} else if configurator.IsDrift(status) {
+			drifted = append(drifted, c.Name())
+		}
+		t.Status = status
+		for _, w := range noProxyProblems(c, cfg) {
+			t.Warnings = append(t.Warnings, "NO_PROXY "+w)
+			unhonoured = append(unhonoured, fmt.Sprintf("%-12s %s", c.Name(), w))
+		}
+		if authMissing(c, cfg) {
+			t.Warnings = append(t.Warnings, "no proxy credentials: its settings are system-wide")
+			noAuth = append(noAuth, c.Name())
+		}
+		report.EndTool()
+		say("%-14s %-28s %s\n", c.Name(), status, "yes")
+	}
+
+	if len(unhonoured) > 0 {
+		say("\nNO_PROXY entries tools can't honour:\n")
+		for _, line := range unhonoured {
+			say("  %s\n", line)
+		}
+	}
+
+	if len(noAuth) > 0 {
+		say("\nTools without the proxy credentials (system-wide settings; use the relay):\n")
+		say("  %s\n", strings.Join(noAuth, ", "))
+	}
+
+	if lines := toolSettings(cfg); len(lines) > 0 {
+		say("\nPer-tool settings:\n")
+		for _, line := range lines {
+			say("  %s\n", line)
+		}
+	}
+
+	pol := loadPolicy()
+	violations := pol.Check(cfg)
+	if len(violations) > 0 {
+		say("\nPolicy violations (%s):\n", pol.Source)
+		for _, v := range violations {
+			report.Current().Policy = append(report.Current().Policy, v.String())
+			say("  ✗ %s\n", v)
+		}
+		if pol.Message != "" {
+			say("  %s\n", pol.Message)
+		}
+	}
+
+	if check && len(drifted) > 0 {
+		report.Errorf("\nDrift detected: %s\n", strings.Join(drifted, ", "))
+		if !report.JSON {
+			fmt.Fprintln(os.Stderr, "Run 'ezproxy apply' to bring them back in line.")
 		}
-		fmt.Printf("%-14s %-28s %s\n", c.Name(), status, "yes")
+	}
+	if check && len(violations) > 0 {
+		report.Errorf("\nConfig breaks the policy in %s.\n", pol.Source)
+	}
+	flushReport()
+	if check && (len(drifted) > 0 || len(violations) > 0) {
+		os.Exit(1)
 	}
 }
 
-func cmdManage() {
+// cmdDoctor checks each link between the tools and the internet: the
+// proxy itself, a CONNECT tunnel through it, the TLS certificate it
+// presents, direct access to NO_PROXY hosts and each tool's configuration.
+// It exits 1 if any check fails.
+func cmdDoctor(probe string) {
 	cfg := loadConfig()
 	osInfo := detect.DetectOS()
-	allConfigurators := configurator.All()
-
-	// Build options with current state
-	var toolOptions []huh.Option[string]
-	for _, c := range allConfigurators {
-		enabled := cfg.Tools[c.Name()]
-		label := c.Name()
+	ctx := context.Background()
 
-		// Add status info to label
-		if !c.IsAvailable(osInfo) {
-			label += " (not installed)"
+	checker := &doctor.Checker{Proxy: cfg.WithAuth(cfg.Proxy.HTTPS), ProbeHost: cfg.ProbeHost}
+	if checker.Proxy == "" {
+		checker.Proxy = cfg.WithAuth(cfg.Proxy.HTTP)
+	}
+	if probe != "" {
+		checker.ProbeHost = probe
+	}
+	var results []doctor.Result
+	if cfg.HasCACerts() {
+		cas, err := certs.Load(cfg.CACertPaths())
+		if err != nil {
+			results = append(results, doctor.Result{Step: "ca", Status: doctor.Fail, Detail: err.Error(),
+				Hint: "Fix ca_cert/ca_certs in ~/.ezproxy/config.yaml or re-run 'ezproxy init'."})
 		} else {
-			status, _ := c.Status(cfg)
-			if status != "" && status != "not configured" {
-				label += " [" + status + "]"
+			checker.Roots = x509.NewCertPool()
+			for _, ca := range cas {
+				checker.Roots.AddCert(ca.Cert)
 			}
 		}
+	} else if pool, err := certs.SystemPool(); err == nil {
+		// Without a corporate CA the proxy must not be intercepting TLS,
+		// so the probe host should verify against the system roots.
+		checker.Roots = pool
+	}
 
-		toolOptions = append(toolOptions,
-			huh.NewOption(label, c.Name()).Selected(enabled),
-		)
+	fmt.Printf("Checking %s (probe %s)\n\n", redact.URL(checker.Proxy), probeOrDefault(checker.ProbeHost))
+	results = append(results, checker.Run(ctx)...)
+	results = append(results, doctor.CheckNoProxy(ctx, cfg.Proxy.NoProxy, 0)...)
+	if cfg.PACURL != "" {
+		results = append(results, pacCheck(ctx, cfg, checker.ProbeHost)...)
 	}
 
-	var selected []string
-	form := huh.NewForm(
-		huh.NewGroup(
-			huh.NewMultiSelect[string]().
-				Title("Manage tools").
-				Description("Space to toggle, enter to apply changes.").
-				Options(toolOptions...).
-				Height(len(toolOptions)+2).
-				Value(&selected),
-		),
-	).WithTheme(huh.ThemeCharm())
+	for _, c := range configurator.All() {
+		if tc, exists := cfg.Tools[c.Name()]; (exists && !tc.Enabled) || !c.IsAvailable(osInfo) {
+			continue
+		}
+		results = append(results, toolCheck(c, cfg))
+	}
 
-	if err := form.Run(); err != nil {
-		fmt.Fprintf(os.Stderr, "Cancelled.\n")
+	for _, r := range results {
+		mark := map[string]string{doctor.Pass: "✓", doctor.Fail: "✗", doctor.Warn: "!", doctor.Skip: "-"}[r.Status]
+		fmt.Printf("  %s %-22s %s\n", mark, r.Step, redact.String(r.Detail))
+		if r.Hint != "" && r.Status != doctor.Pass {
+			fmt.Printf("    %-22s → %s\n", "", r.Hint)
+		}
+	}
+	if doctor.Failed(results) {
+		fmt.Println("\nSome checks failed; see the hints above.")
 		os.Exit(1)
 	}
+	fmt.Println("\nAll checks passed.")
+}
 
-	// Build new enabled set
-	newEnabled := make(map[string]bool, len(selected))
-	for _, name := range selected {
-		newEnabled[name] = true
+// pacCheck compares the upstream proxy settings with the PAC file they
+// were derived from.
+func pacCheck(ctx context.Context, cfg *config.Config, probe string) []doctor.Result {
+	script, err := pac.Load(ctx, config.ExpandPath(cfg.PACURL))
+	if err != nil {
+		return []doctor.Result{{Step: "pac", Status: doctor.Warn, Detail: err.Error(),
+			Hint: "Check pac_url in ~/.ezproxy/config.yaml; the PAC server may only be reachable on the corporate network."}}
+	}
+	up := cfg.Upstream()
+	proxy := up.HTTPS
+	if proxy == "" {
+		proxy = up.HTTP
 	}
+	return doctor.CheckPAC(script, proxy, up.NoProxy, probe)
+}
 
-	// Diff against current state and apply changes
-	var enabled, disabled []string
-	for _, c := range allConfigurators {
+// loadPAC loads the PAC file at location, or discovers it through WPAD
+// when location is "wpad".
+func loadPAC(ctx context.Context, location string) (*pac.Script, error) {
+	if strings.EqualFold(location, "wpad") {
+		return pac.Discover(ctx)
+	}
+	path := config.ExpandPath(location)
+	if !strings.Contains(path, "://") {
+		// Stored in config.yaml, so it must not depend on the directory.
+		if abs, err := filepath.Abs(path); err == nil {
+			path = abs
+		}
+	}
+	return pac.Load(ctx, path)
+}
+
+func probeOrDefault(probe string) string {
+	if probe == "" {
+		return doctor.DefaultProbeHost
+	}
+	return probe
+}
+
+// toolCheck turns a configurator's Status, plus its Diagnose if it has
+// one, into a doctor result.
+func toolCheck(c configurator.Configurator, cfg *config.Config) doctor.Result {
+	r := doctor.Result{Step: "tool " + c.Name()}
+	status, err := toolStatus(c, cfg)
+	switch {
+	case err != nil:
+		r.Status, r.Detail = doctor.Fail, err.Error()
+		r.Hint = "Fix the error above, then run 'ezproxy apply'."
+		return r
+	case status == configurator.StatusNotConfigured || strings.HasPrefix(status, configurator.StatusStale) ||
+		strings.HasPrefix(status, "not "):
+		r.Status, r.Detail = doctor.Fail, status
+		r.Hint = "Run 'ezproxy apply' (or 'ezproxy enable " + c.Name() + "')."
+		return r
+	case strings.HasPrefix(status, configurator.StatusConflicting):
+		r.Status, r.Detail = doctor.Warn, status
+		r.Hint = "Remove the duplicate settings outside the ezproxy block."
+		return r
+	}
+	if d, ok := c.(configurator.Diagnoser); ok {
+		if err := d.Diagnose(cfg.ForTool(c.Name())); err != nil {
+			r.Status, r.Detail = doctor.Fail, err.Error()
+			return r
+		}
+	}
+	r.Status, r.Detail = doctor.Pass, status
+	return r
+}
+
+func credentialsPath() string {
+	return filepath.Join(filepath.Dir(configPath()), "credentials.yaml")
+}
+
+// credentialsStore returns the store config.yaml names under credentials,
+// the credentials file if it names none.
+func credentialsStore(cfg *config.Config) (credentials.Store, error) {
+	return credentials.Open(cfg.Credentials, credentialsPath())
+}
+
+// loadCredentials reads the proxy credentials from their store so the
+// configurators can hand them to the tools. Only Basic credentials are
+// given out; tools can't do NTLM and need the relay for it. The password
+// is masked in all output from here on.
+func loadCredentials(cfg *config.Config) {
+	if cfg.Credentials == "" {
+		return
+	}
+	store, err := credentialsStore(cfg)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: %v\n", err)
+		return
+	}
+	creds, err := store.Load()
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		fmt.Fprintf(os.Stderr, "Warning: no proxy credentials in %s; run 'ezproxy serve --login'.\n", store)
+		return
+	case err != nil:
+		fmt.Fprintf(os.Stderr, "Warning: reading proxy credentials: %v\n", err)
+		return
+	}
+	redact.Secret(creds.Password)
+	if creds.Scheme == credentials.SchemeBasic {
+		cfg.Auth = &config.ProxyAuth{Host: creds.Proxy, Username: creds.Username, Password: creds.Password}
+	}
+}
+
+// saveCredentials puts creds in the store named kind and removes them from
+// the one named previous, so only one copy is kept. It returns the store.
+func saveCredentials(kind, previous string, creds *credentials.Credentials) (credentials.Store, error) {
+	store, err := credentials.Open(kind, credentialsPath())
+	if err != nil {
+		return nil, err
+	}
+	if err := store.Save(creds); err != nil {
+		return nil, err
+	}
+	if previous == "" {
+		previous = credentials.StoreFile
+	}
+	if previous != kind {
+		if old, err := credentials.Open(previous, credentialsPath()); err == nil {
+			if err := old.Delete(); err != nil {
+				fmt.Fprintf(os.Stderr, "Warning: removing the credentials from %s: %v\n", old, err)
+			}
+		}
+	}
+	return store, nil
+}
+
+// defaultCredentialsStore is the keyring where there is one, else the file.
+func defaultCredentialsStore() string {
+	if credentials.KeyringAvailable() {
+		return credentials.StoreKeyring
+	}
+	return credentials.StoreFile
+}
+
+// credentialsHost returns the host:port credentials for proxy are tied to:
+// the HTTP proxy's, or "" (the upstream proxy, whichever it is) when the
+// HTTP and HTTPS proxies differ.
+func credentialsHost(proxy config.ProxyConfig) string {
+	h, err1 := url.Parse(proxy.HTTP)
+	s, err2 := url.Parse(proxy.HTTPS)
+	if err1 != nil || err2 != nil || (proxy.HTTPS != "" && h.Host != s.Host) {
+		return ""
+	}
+	return h.Host
+}
+
+// moveURLCredentials takes a user name and password out of the proxy URLs
+// and returns them, or nil if there were none.
+func moveURLCredentials(proxy *config.ProxyConfig) *credentials.Credentials {
+	var user *url.Userinfo
+	for _, p := range []*string{&proxy.HTTP, &proxy.HTTPS} {
+		stripped, u := config.StripAuth(*p)
+		if u != nil {
+			*p = stripped
+			if user == nil {
+				user = u
+			}
+		}
+	}
+	if user == nil {
+		return nil
+	}
+	password, _ := user.Password()
+	return &credentials.Credentials{Scheme: credentials.SchemeBasic, Username: user.Username(), Password: password, Proxy: credentialsHost(*proxy)}
+}
+
+// cmdServe runs the local relay in the foreground until interrupted.
+func cmdServe(listen string) {
+	cfg := loadConfig()
+	if listen == "" {
+		listen = cfg.Relay.Addr()
+	}
+	if err := checkLoopback(listen); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	up := cfg.Upstream()
+	srv := &relay.Server{NoProxy: up.NoProxy}
+	var userinfo *url.Userinfo
+	for _, p := range []struct {
+		raw  string
+		dest **url.URL
+	}{{up.HTTP, &srv.HTTP}, {up.HTTPS, &srv.HTTPS}} {
+		if p.raw == "" {
+			continue
+		}
+		u, err := url.Parse(p.raw)
+		if err != nil || u.Host == "" {
+			fmt.Fprintf(os.Stderr, "Error: invalid upstream proxy URL %q\n", redact.URL(p.raw))
+			os.Exit(1)
+		}
+		if u.Host == listen {
+			fmt.Fprintf(os.Stderr, "Error: the upstream proxy is the relay itself (%s); set proxy.http to the real proxy\n", listen)
+			os.Exit(1)
+		}
+		if u.User != nil {
+			userinfo = u.User
+			u.User = nil
+		}
+		*p.dest = u
+	}
+
+	authDesc := "no authentication"
+	store, err := credentialsStore(cfg)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	creds, err := store.Load()
+	switch {
+	case err == nil:
+		redact.Secret(creds.Password)
+		switch creds.Scheme {
+		case credentials.SchemeNTLM:
+			host, _ := os.Hostname()
+			srv.Auth = &relay.NTLM{Domain: creds.Domain, Username: creds.Username, Password: creds.Password, Workstation: strings.ToUpper(host)}
+			authDesc = "NTLM as " + creds.Redacted()
+		default:
+			srv.Auth = &relay.Basic{Username: creds.Username, Password: creds.Password}
+			authDesc = "Basic as " + creds.Redacted()
+		}
+		authDesc += " from " + store.String()
+	case errors.Is(err, fs.ErrNotExist):
+		if userinfo != nil {
+			password, _ := userinfo.Password()
+			redact.Secret(password)
+			srv.Auth = &relay.Basic{Username: userinfo.Username(), Password: password}
+			authDesc = "Basic as " + userinfo.Username() + ":" + redact.Mask + " (from the proxy URL)"
+		}
+	default:
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	srv.Logf = func(format string, args ...any) {
+		fmt.Fprintf(os.Stderr, "%s %s\n", time.Now().Format("15:04:05"), redact.String(fmt.Sprintf(format, args...)))
+	}
+
+	upstream := "direct"
+	if u := srv.HTTPS; u != nil {
+		upstream = u.Host
+	} else if u := srv.HTTP; u != nil {
+		upstream = u.Host
+	}
+	fmt.Printf("ezproxy relay listening on http://%s\n", listen)
+	fmt.Printf("  upstream: %s (%s)\n", upstream, authDesc)
+	fmt.Printf("  direct:   %s\n", up.NoProxy)
+	if !cfg.Relay.Enabled {
+		fmt.Println("Run 'ezproxy apply --via-relay' to point your tools at the relay.")
+	}
+	if err := http.ListenAndServe(listen, srv); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+// checkLoopback refuses listen addresses other machines could reach: the
+// relay adds the user's credentials to everything it forwards.
+func checkLoopback(listen string) error {
+	host, _, err := net.SplitHostPort(listen)
+	if err != nil {
+		return fmt.Errorf("invalid listen address %q: %w", listen, err)
+	}
+	if host == "localhost" {
+		return nil
+	}
+	if ip := net.ParseIP(host); ip == nil || !ip.IsLoopback() {
+		return fmt.Errorf("relay must listen on a loopback address such as 127.0.0.1, not %q", host)
+	}
+	return nil
+}
+
+// cmdLogin asks for the upstream proxy credentials and stores them in the
+// keyring or the 0600 credentials file, kind or wherever they were
+// before. config.yaml records which; a password it held in a proxy URL is
+// moved out of it.
+func cmdLogin(kind string) {
+	cfg, err := readConfig()
+	if err != nil {
+		cfg = nil
+	}
+	previous := ""
+	if cfg != nil {
+		previous = cfg.Credentials
+	}
+	if kind == "" {
+		kind = previous
+	}
+	if kind == "" {
+		kind = defaultCredentialsStore()
+	}
+
+	creds := &credentials.Credentials{Scheme: credentials.SchemeBasic}
+	var fromURL *credentials.Credentials
+	if cfg != nil {
+		fromURL = moveURLCredentials(&cfg.Proxy)
+	}
+	if old, err := credentials.Open(previous, credentialsPath()); err == nil {
+		if existing, err := old.Load(); err == nil {
+			creds = existing
+			creds.Password = ""
+		}
+	}
+	if fromURL != nil {
+		creds = fromURL
+	}
+	form := huh.NewForm(
+		huh.NewGroup(
+			huh.NewSelect[string]().
+				Title("Proxy authentication").
+				Options(
+					huh.NewOption("Basic", credentials.SchemeBasic),
+					huh.NewOption("NTLM (Windows domain)", credentials.SchemeNTLM),
+				).
+				Value(&creds.Scheme),
+			huh.NewInput().
+				Title("Domain").
+				Description("NTLM only, e.g. CORP").
+				Value(&creds.Domain),
+			huh.NewInput().
+				Title("Username").
+				Value(&creds.Username).
+				Validate(huh.ValidateNotEmpty()),
+			huh.NewInput().
+				Title("Password").
+				EchoMode(huh.EchoModePassword).
+				Value(&creds.Password),
+		),
+	).WithTheme(huh.ThemeCharm())
+	if err := form.Run(); err != nil {
+		fmt.Fprintf(os.Stderr, "Cancelled.\n")
+		os.Exit(1)
+	}
+	if creds.Scheme != credentials.SchemeNTLM {
+		creds.Domain = ""
+	}
+	if cfg != nil {
+		creds.Proxy = credentialsHost(cfg.Proxy)
+	}
+	store, err := saveCredentials(kind, previous, creds)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error saving credentials: %v\n", err)
+		os.Exit(1)
+	}
+	fmt.Printf("Credentials for %s saved to %s.\n", creds.Redacted(), store)
+
+	if cfg == nil {
+		fmt.Println("Restart 'ezproxy serve' to use them.")
+		return
+	}
+	cfg.Credentials = kind
+	if err := config.Save(configPath(), cfg); err != nil {
+		fmt.Fprintf(os.Stderr, "Error saving config: %v\n", err)
+		os.Exit(1)
+	}
+	if fromURL != nil {
+		fmt.Printf("Removed the password from the proxy URL in %s.\n", configPath())
+	}
+	if creds.Scheme == credentials.SchemeNTLM {
+		fmt.Println("NTLM works through the relay only: run 'ezproxy serve' and 'ezproxy apply --via-relay'.")
+		return
+	}
+	fmt.Println("Run 'ezproxy apply' to pass them to your tools, and restart 'ezproxy serve' if it is running.")
+}
+
+func cmdManage() {
+	cfg := loadConfig()
+	osInfo := detect.DetectOS()
+	allConfigurators := configurator.All()
+	pol := loadPolicy()
+
+	// Build options with current state
+	var toolOptions []huh.Option[string]
+	for _, c := range allConfigurators {
+		enabled := cfg.Tools[c.Name()].Enabled
+		label := c.Name() + policyLabel(pol, c.Name())
+
+		// Add status info to label
+		if !c.IsAvailable(osInfo) {
+			label += " (not installed)"
+		} else {
+			status, _ := toolStatus(c, cfg)
+			if status != "" && status != "not configured" {
+				label += " [" + status + "]"
+			}
+		}
+
+		toolOptions = append(toolOptions,
+			huh.NewOption(label, c.Name()).Selected(enabled),
+		)
+	}
+
+	var selected []string
+	form := huh.NewForm(
+		huh.NewGroup(
+			huh.NewMultiSelect[string]().
+				Title("Manage tools").
+				Description("Space to toggle, enter to apply changes.").
+				Options(toolOptions...).
+				Height(len(toolOptions) + 2).
+				Validate(pol.CheckTools).
+				Value(&selected),
+		),
+	).WithTheme(huh.ThemeCharm())
+
+	if err := form.Run(); err != nil {
+		fmt.Fprintf(os.Stderr, "Cancelled.\n")
+		os.Exit(1)
+	}
+
+	// Build new enabled set
+	newEnabled := make(map[string]bool, len(selected))
+	for _, name := range selected {
+		newEnabled[name] = true
+	}
+
+	// Diff against current state and apply changes
+	var enabled, disabled []string
+	for _, c := range allConfigurators {
 		name := c.Name()
-		wasEnabled := cfg.Tools[name]
+		wasEnabled := cfg.Tools[name].Enabled
 		nowEnabled := newEnabled[name]
 
 		if wasEnabled && !nowEnabled {
@@ -281,12 +1353,15 @@ func cmdManage() {
 	}
 
 	// Update config
+	snap := beginSnapshot("manage")
+	defer endSnapshot(snap)
 	for _, c := range allConfigurators {
-		cfg.Tools[c.Name()] = newEnabled[c.Name()]
+		cfg.SetToolEnabled(c.Name(), newEnabled[c.Name()])
 	}
-	if err := config.Save(configPath(), cfg); err != nil {
-		fmt.Fprintf(os.Stderr, "Error saving config: %v\n", err)
-		os.Exit(1)
+	saveConfig(cfg)
+	defer saveState()
+	if len(enabled) > 0 {
+		applyCABundle(cfg)
 	}
 
 	// Apply newly enabled tools
@@ -296,7 +1371,7 @@ func cmdManage() {
 			fmt.Printf("  %-12s enabled (not installed, will configure when available)\n", name)
 			continue
 		}
-		if err := c.Apply(cfg); err != nil {
+		if err := applyTool(c, cfg); err != nil {
 			fmt.Printf("  %-12s enabled, ERROR applying: %v\n", name, err)
 		} else {
 			fmt.Printf("  %-12s ✓ enabled and configured\n", name)
@@ -309,12 +1384,15 @@ func cmdManage() {
 		if c == nil {
 			continue
 		}
-		if err := c.Remove(); err != nil {
+		if err := removeTool(c); err != nil {
 			fmt.Printf("  %-12s disabled, ERROR removing: %v\n", name, err)
 		} else {
 			fmt.Printf("  %-12s ✓ disabled and removed\n", name)
 		}
 	}
+	if n := privileged.Flush(); n > 0 {
+		fmt.Printf("\n%d tool(s) are missing the changes that need root.\n", n)
+	}
 
 	fmt.Printf("\n%d enabled, %d disabled.\n", len(enabled), len(disabled))
 }
@@ -341,25 +1419,33 @@ func cmdEnable(tool string) {
 		os.Exit(1)
 	}
 
-	if cfg.Tools[tool] {
+	if cfg.Tools[tool].Enabled {
 		fmt.Printf("%s is already enabled.\n", tool)
 		return
 	}
-
-	cfg.Tools[tool] = true
-	if err := config.Save(configPath(), cfg); err != nil {
-		fmt.Fprintf(os.Stderr, "Error saving config: %v\n", err)
-		os.Exit(1)
+	pol := loadPolicy()
+	if err := pol.CheckTool(tool, true); err != nil {
+		refuse(pol, err)
 	}
 
+	snap := beginSnapshot("enable " + tool)
+	defer endSnapshot(snap)
+	cfg.SetToolEnabled(tool, true)
+	saveConfig(cfg)
+
 	osInfo := detect.DetectOS()
 	if !c.IsAvailable(osInfo) {
 		fmt.Printf("Enabled %s (not installed, will be configured when available).\n", tool)
 		return
 	}
 
-	if err := c.Apply(cfg); err != nil {
+	defer saveState()
+	applyCABundle(cfg)
+
+	if err := applyTool(c, cfg); err != nil {
 		fmt.Printf("Enabled %s but failed to apply: %v\n", tool, err)
+	} else if privileged.Flush() > 0 {
+		fmt.Printf("Enabled %s but the changes that need root were not made.\n", tool)
 	} else {
 		fmt.Printf("Enabled and configured %s.\n", tool)
 	}
@@ -378,166 +1464,543 @@ func cmdDisable(tool string) {
 		os.Exit(1)
 	}
 
-	if enabled, exists := cfg.Tools[tool]; exists && !enabled {
+	if tc, exists := cfg.Tools[tool]; exists && !tc.Enabled {
 		fmt.Printf("%s is already disabled.\n", tool)
 		return
 	}
-
-	cfg.Tools[tool] = false
-	if err := config.Save(configPath(), cfg); err != nil {
-		fmt.Fprintf(os.Stderr, "Error saving config: %v\n", err)
-		os.Exit(1)
+	pol := loadPolicy()
+	if err := pol.CheckTool(tool, false); err != nil {
+		refuse(pol, err)
 	}
 
-	if err := c.Remove(); err != nil {
+	snap := beginSnapshot("disable " + tool)
+	defer endSnapshot(snap)
+	cfg.SetToolEnabled(tool, false)
+	saveConfig(cfg)
+	defer saveState()
+
+	err := removeTool(c)
+	notRemoved := privileged.Flush()
+	if err != nil {
 		fmt.Printf("Disabled %s but failed to remove config: %v\n", tool, err)
+	} else if notRemoved > 0 {
+		fmt.Printf("Disabled %s but the changes that need root were not undone.\n", tool)
 	} else {
 		fmt.Printf("Disabled and removed config for %s.\n", tool)
 	}
 }
 
-func cmdInit() {
-	defaultNoProxy := "localhost,127.0.0.1,.corp.com,10.0.0.0/8,172.16.0.0/12,192.168.0.0/16"
-
-	var (
-		httpProxy  string
-		httpsProxy string
-		noProxy    string = defaultNoProxy
-		certInput  string
-	)
-
-	// Pre-fill from existing config if present
-	if existing, err := config.Load(configPath()); err == nil {
-		httpProxy = existing.Proxy.HTTP
-		httpsProxy = existing.Proxy.HTTPS
-		noProxy = existing.Proxy.NoProxy
-		certInput = existing.CACert
-		fmt.Println("Existing config found - values pre-filled. Edit as needed.")
+// cmdConfigShow prints the effective settings merged from every config
+// layer and, with origin, the layer each one came from.
+func cmdConfigShow(origin bool) {
+	cfg, err := readConfig()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error loading config: %v\n", err)
+		fmt.Fprintf(os.Stderr, "Run 'ezproxy init' to create a config file.\n")
+		os.Exit(1)
+	}
+	if origin {
+		fmt.Println("Layers, lowest precedence first:")
+		for _, l := range cfg.Layers() {
+			note := ""
+			if !l.Exists {
+				note = " (not created yet)"
+			}
+			fmt.Printf("  %-8s %s%s\n", l.Name, l.Path, note)
+		}
 		fmt.Println()
 	}
+	origins := cfg.Origins()
+	width := 0
+	for _, o := range origins {
+		width = max(width, len(o.Key))
+	}
+	for _, o := range origins {
+		value := fmt.Sprint(o.Value)
+		if list, ok := o.Value.([]any); ok {
+			var items []string
+			for _, item := range list {
+				items = append(items, fmt.Sprint(item))
+			}
+			value = strings.Join(items, ", ")
+		}
+		if value == "" {
+			value = `""`
+		}
+		value = redact.URL(value)
+		if !origin {
+			fmt.Printf("%-*s  %s\n", width, o.Key, value)
+			continue
+		}
+		source := "default"
+		if len(o.Layers) > 0 {
+			source = strings.Join(o.Layers, " + ")
+		}
+		fmt.Printf("%-*s  %-40s  %s\n", width, o.Key, value, source)
+	}
+}
 
-	// Page 1: Proxy settings
-	proxyForm := huh.NewForm(
-		huh.NewGroup(
-			huh.NewInput().
-				Title("HTTP Proxy URL").
-				Description("e.g. http://proxy.corp.com:8080").
-				Value(&httpProxy).
-				Validate(huh.ValidateNotEmpty()),
-
-			huh.NewInput().
-				Title("HTTPS Proxy URL").
-				Description("Leave blank to use the same as HTTP proxy").
-				Value(&httpsProxy),
-
-			huh.NewInput().
-				Title("NO_PROXY").
-				Description("Comma-separated hosts/CIDRs to bypass the proxy").
-				Value(&noProxy),
-
-			huh.NewInput().
-				Title("CA Certificate Path").
-				Description("Path to PEM file (optional, leave blank to skip)").
-				Value(&certInput),
-		),
-	).WithTheme(huh.ThemeCharm())
+func cmdListProfiles() {
+	cfg := loadConfig()
+	names := cfg.ProfileNames()
+	if len(names) == 0 {
+		fmt.Fprintln(os.Stderr, "No profiles configured. Create one with 'ezproxy init <profile>'.")
+		return
+	}
+	fmt.Fprintln(os.Stderr, "Usage: ezproxy switch <profile>")
+	fmt.Fprintln(os.Stderr, "Profiles:")
+	for _, name := range names {
+		marker := " "
+		if name == cfg.ActiveProfile {
+			marker = "*"
+		}
+		fmt.Fprintf(os.Stderr, "  %s %s\n", marker, name)
+	}
+}
 
-	if err := proxyForm.Run(); err != nil {
-		fmt.Fprintf(os.Stderr, "Cancelled.\n")
+func cmdSwitch(profile string) {
+	if err := config.CheckProfileName(profile); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
 		os.Exit(1)
 	}
+	cfg := loadConfig()
+	osInfo := detect.DetectOS()
 
-	if httpsProxy == "" {
-		httpsProxy = httpProxy
+	if profile == cfg.ActiveProfile {
+		fmt.Printf("Profile %s is already active. Run 'ezproxy apply' to re-apply it.\n", profile)
+		return
 	}
 
-	// Copy CA cert if provided
-	home, _ := os.UserHomeDir()
-	ezproxyDir := filepath.Join(home, ".ezproxy")
-	if err := os.MkdirAll(ezproxyDir, 0755); err != nil {
-		fmt.Fprintf(os.Stderr, "Error creating directory %s: %v\n", ezproxyDir, err)
+	previousTools := cfg.Tools
+	if err := cfg.UseProfile(profile); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		fmt.Fprintf(os.Stderr, "Available profiles: %s\n", strings.Join(cfg.ProfileNames(), ", "))
 		os.Exit(1)
 	}
+	pol := loadPolicy()
+	for _, c := range configurator.All() {
+		if tc, exists := cfg.Tools[c.Name()]; exists && !tc.Enabled {
+			if err := pol.CheckTool(c.Name(), false); err != nil {
+				refuse(pol, err)
+			}
+		}
+	}
+	refuseViolations(pol, cfg)
 
-	caCertConfig := ""
-	if certInput != "" {
-		certInput = config.ExpandPath(certInput)
-		destCert := filepath.Join(ezproxyDir, "corp-ca.pem")
+	// The config change is part of the snapshot so a rollback also restores
+	// the previously active profile.
+	snap := beginSnapshot("switch " + profile)
+	failed := 0
 
-		src, err := os.Open(certInput)
-		if err != nil {
-			fmt.Fprintf(os.Stderr, "Error reading cert: %v\n", err)
+	if !fileutil.DryRun {
+		if err := fileutil.BackupFile(configPath()); err != nil {
+			fmt.Fprintf(os.Stderr, "Error backing up config: %v\n", err)
+			os.Exit(1)
+		}
+		if err := config.Save(configPath(), cfg); err != nil {
+			fmt.Fprintf(os.Stderr, "Error saving config: %v\n", err)
 			os.Exit(1)
 		}
-		defer src.Close()
+		fmt.Printf("Switched to profile %s.\n", profile)
+	} else {
+		fmt.Printf("DRY RUN: showing what switching to profile %s would configure (no files modified)\n", profile)
+	}
 
-		dst, err := os.Create(destCert)
+	// Tools enabled in the old profile but disabled in the new one are cleaned up.
+	for _, c := range configurator.All() {
+		name := c.Name()
+		if tc, exists := cfg.Tools[name]; !exists || tc.Enabled {
+			continue
+		}
+		if was, existed := previousTools[name]; existed && !was.Enabled {
+			continue
+		}
+		if !c.IsAvailable(osInfo) {
+			continue
+		}
+		if err := removeTool(c); err != nil {
+			fmt.Printf("  %-12s ERROR removing: %v\n", name, err)
+			failed++
+		} else {
+			fmt.Printf("  %-12s ✓ removed (disabled in %s)\n", name, profile)
+		}
+	}
+
+	failed += applyTools(cfg, osInfo)
+	failed += privileged.Flush()
+	saveState()
+	if finishSnapshot(snap, failed) {
+		os.Exit(1)
+	}
+	printApplyDone()
+}
+
+func cmdRollback(id string) {
+	root := backupsDir()
+	snaps, err := fileutil.ListSnapshots(root)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error reading backups: %v\n", err)
+		os.Exit(1)
+	}
+	if len(snaps) == 0 {
+		fmt.Println("No backups found.")
+		return
+	}
+
+	if id == "list" {
+		fmt.Printf("%-20s %-22s %s\n", "ID", "Command", "Files")
+		fmt.Printf("%-20s %-22s %s\n", "──", "───────", "─────")
+		for _, snap := range snaps {
+			fmt.Printf("%-20s %-22s %d\n", snap.ID, snap.Command, snap.Len())
+		}
+		return
+	}
+
+	snap := snaps[0]
+	if id != "" {
+		snap, err = fileutil.LoadSnapshot(root, id)
 		if err != nil {
-			fmt.Fprintf(os.Stderr, "Error creating cert copy: %v\n", err)
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			fmt.Fprintln(os.Stderr, "Run 'ezproxy rollback list' to see available backups.")
 			os.Exit(1)
 		}
-		defer dst.Close()
+	}
 
-		if _, err := io.Copy(dst, src); err != nil {
-			fmt.Fprintf(os.Stderr, "Error copying cert: %v\n", err)
-			os.Exit(1)
+	fmt.Printf("Backup %s (%s, %s):\n", snap.ID, snap.Command, snap.Created.Format("2006-01-02 15:04:05"))
+	for _, e := range snap.Entries {
+		asRoot := ""
+		if e.Root {
+			asRoot = " (as root)"
 		}
+		if e.Existed {
+			fmt.Printf("  restore %s%s\n", e.Path, asRoot)
+		} else {
+			fmt.Printf("  delete  %s (created by ezproxy)%s\n", e.Path, asRoot)
+		}
+	}
 
-		caCertConfig = "~/.ezproxy/corp-ca.pem"
-		fmt.Printf("  Copied cert to %s\n", destCert)
+	if fileutil.DryRun {
+		fmt.Println("\nDRY RUN: no files modified.")
+		return
+	}
+	if !fileutil.AutoYes {
+		var confirm bool
+		err := huh.NewConfirm().
+			Title("Restore these files?").
+			Affirmative("Yes, restore").
+			Negative("Cancel").
+			Value(&confirm).
+			Run()
+		if err != nil || !confirm {
+			fmt.Println("Cancelled.")
+			return
+		}
 	}
 
-	// Page 2: Tool selection via interactive checkboxes
-	osInfo := detect.DetectOS()
-	allConfigurators := configurator.All()
+	// The rollback itself is recorded so it can be undone too.
+	undo := beginSnapshot("rollback " + snap.ID)
+	err = restoreSnapshot(snap)
+	endSnapshot(undo)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	fmt.Printf("\nRestored %d file(s) from %s.\n", snap.Len(), snap.ID)
+}
 
-	var toolOptions []huh.Option[string]
-	for _, c := range allConfigurators {
-		installed := c.IsAvailable(osInfo)
-		label := c.Name()
-		if !installed {
-			label += " (not installed)"
+// parseInitArgs reads "init [profile] [flags]". Answers are taken from the
+// --bundle, then the --from file, then EZPROXY_* variables, then flags; if
+// any are given, init runs without the wizard. The bundle's signature is
+// checked here, before any of it is used.
+func parseInitArgs(args []string) (profile string, answers config.Answers, unattended bool, b *bundle.Bundle, err error) {
+	var flags config.Answers
+	var from, tools, bundleLocation, bundleKey string
+	toolsGiven := false
+	values := map[string]*string{
+		"--http":       &flags.HTTP,
+		"--https":      &flags.HTTPS,
+		"--no-proxy":   &flags.NoProxy,
+		"--ca-cert":    &flags.CACert,
+		"--pac":        &flags.PACURL,
+		"--tools":      &tools,
+		"--from":       &from,
+		"--bundle":     &bundleLocation,
+		"--bundle-key": &bundleKey,
+	}
+	for i := 0; i < len(args); i++ {
+		name, value, hasValue := strings.Cut(args[i], "=")
+		dst, isFlag := values[name]
+		switch {
+		case isFlag && hasValue:
+			*dst = value
+		case isFlag && i+1 < len(args):
+			i++
+			*dst = args[i]
+		case isFlag:
+			return "", answers, false, nil, fmt.Errorf("%s requires a value", name)
+		case strings.HasPrefix(args[i], "-"):
+			return "", answers, false, nil, fmt.Errorf("unknown flag for init: %s", args[i])
+		case profile == "":
+			profile = args[i]
+			continue
+		default:
+			return "", answers, false, nil, fmt.Errorf("unexpected argument: %s", args[i])
+		}
+		toolsGiven = toolsGiven || name == "--tools"
+	}
+	if profile != "" {
+		if err := config.CheckProfileName(profile); err != nil {
+			return "", answers, false, nil, err
 		}
-		toolOptions = append(toolOptions,
-			huh.NewOption(label, c.Name()).Selected(installed),
-		)
 	}
 
-	var enabledTools []string
-	toolForm := huh.NewForm(
-		huh.NewGroup(
-			huh.NewMultiSelect[string]().
-				Title("Tools to configure").
-				Description("Use arrow keys to navigate, space to toggle, enter to confirm.").
-				Options(toolOptions...).
-				Height(len(toolOptions)+2).
-				Value(&enabledTools),
-		),
-	).WithTheme(huh.ThemeCharm())
+	if bundleLocation != "" {
+		keys, err := bundleKeys(bundleKey)
+		if err != nil {
+			return "", answers, false, nil, err
+		}
+		if b, err = bundle.Open(context.Background(), config.ExpandPath(bundleLocation), keys); err != nil {
+			return "", answers, false, nil, err
+		}
+		fmt.Printf("Verified bundle %s (serial %d, key %s).\n\n", b.Source, b.Serial, bundle.KeyID(b.Key))
+		answers = b.Answers()
+	} else if bundleKey != "" {
+		return "", answers, false, nil, fmt.Errorf("--bundle-key needs --bundle")
+	}
+	if from != "" {
+		fileAnswers, err := config.LoadAnswers(config.ExpandPath(from))
+		if err != nil {
+			return "", answers, false, nil, err
+		}
+		answers.Merge(fileAnswers)
+	}
+	answers.Merge(config.AnswersFromEnv(os.Getenv))
+	if toolsGiven {
+		flags.Tools = append([]string{}, config.SplitList(tools)...)
+	}
+	answers.Merge(flags)
+	return profile, answers, b != nil || from != "" || !answers.IsZero(), b, nil
+}
 
-	if err := toolForm.Run(); err != nil {
-		fmt.Fprintf(os.Stderr, "Cancelled.\n")
-		os.Exit(1)
+// bundleKeys returns the keys a bundle may be signed with: the one given
+// with --bundle-key, else the one pinned by an earlier init, else the ones
+// pinned system-wide.
+func bundleKeys(flag string) ([]ed25519.PublicKey, error) {
+	if flag != "" {
+		key, err := bundle.ParseKey(flag)
+		if err != nil {
+			return nil, err
+		}
+		return []ed25519.PublicKey{key}, nil
+	}
+	if existing, err := readConfig(); err == nil && existing.Bundle != nil {
+		key, err := bundle.ParseKey(existing.Bundle.Key)
+		if err != nil {
+			return nil, fmt.Errorf("bundle key in config.yaml: %w", err)
+		}
+		return []ed25519.PublicKey{key}, nil
+	}
+	keys, err := bundle.SystemKeys()
+	if err != nil {
+		return nil, err
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("no bundle signing key is pinned; pass --bundle-key with the public key your IT team publishes, or install it as %s", bundle.SystemKeyPath)
+	}
+	return keys, nil
+}
+
+// bundleCAFile writes the bundle's CA certificates to a temporary file so
+// they go through the same checks and copying as --ca-cert. It returns ""
+// if the bundle has none.
+func bundleCAFile(b *bundle.Bundle) (string, func(), error) {
+	pem := b.CAPEM()
+	if len(pem) == 0 {
+		return "", func() {}, nil
+	}
+	dir, err := os.MkdirTemp("", "ezproxy-bundle-")
+	if err != nil {
+		return "", nil, err
+	}
+	cleanup := func() { os.RemoveAll(dir) }
+	path := filepath.Join(dir, "bundle-ca.pem")
+	if err := os.WriteFile(path, pem, 0644); err != nil {
+		cleanup()
+		return "", nil, err
+	}
+	return path, cleanup, nil
+}
+
+// validateOptionalProxyURL is config.ValidateProxyURL for fields that may
+// be left blank.
+func validateOptionalProxyURL(s string) error {
+	if strings.TrimSpace(s) == "" {
+		return nil
+	}
+	return config.ValidateProxyURL(s)
+}
+
+func cmdInit(profile string, answers config.Answers, unattended bool, b *bundle.Bundle) {
+	defaultNoProxy := "localhost,127.0.0.1,.corp.com,10.0.0.0/8,172.16.0.0/12,192.168.0.0/16"
+
+	var (
+		httpProxy  string
+		httpsProxy string
+		noProxy    string = defaultNoProxy
+		certInput  string
+		pacURL     string
+	)
+
+	// Pre-fill from existing config if present. When initialising a named
+	// profile, pre-fill from that profile if it already exists.
+	existing, err := readConfig()
+	if err != nil {
+		existing = nil
+	}
+	var keptTools map[string]config.ToolConfig
+	if existing != nil {
+		prefill := config.Profile{Proxy: existing.Proxy, PACURL: existing.PACURL, CACert: existing.CACert, CACerts: existing.CACerts, Tools: existing.Tools}
+		if p, ok := existing.Profiles[profile]; ok {
+			prefill = p
+		}
+		keptTools = prefill.Tools
+		pacURL = prefill.PACURL
+		httpProxy = prefill.Proxy.HTTP
+		httpsProxy = prefill.Proxy.HTTPS
+		noProxy = prefill.Proxy.NoProxy
+		certInput = strings.Join(configuredCACerts(prefill.CACert, prefill.CACerts), ", ")
+		if !unattended {
+			fmt.Println("Existing config found - values pre-filled. Edit as needed.")
+			fmt.Println()
+		}
+	}
+	if profile != "" {
+		fmt.Printf("Configuring profile %q.\n\n", profile)
+	}
+	pol := loadPolicy()
+	pol.Fill(&httpProxy, &httpsProxy, &noProxy, &pacURL)
+
+	if b != nil && len(answers.CACertPaths()) == 0 {
+		path, cleanup, err := bundleCAFile(b)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		defer cleanup()
+		answers.CACert = path
+	}
+
+	if unattended {
+		if pacURL, err = answerInit(answers, pacURL, &httpProxy, &httpsProxy, &noProxy, &certInput); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+	} else {
+		pacURL = runInitWizard(pol, pacURL, &httpProxy, &httpsProxy, &noProxy, &certInput)
 	}
 
-	// Build tools map from selection
-	tools := config.DefaultTools()
+	if httpsProxy == "" {
+		httpsProxy = httpProxy
+	}
+
+	osInfo := detect.DetectOS()
+	enabledTools := answers.Tools
+	if !unattended {
+		enabledTools = runToolsForm(pol, osInfo)
+	} else if enabledTools == nil {
+		// Like the wizard's pre-selection: every installed tool.
+		for _, c := range configurator.All() {
+			if c.IsAvailable(osInfo) {
+				enabledTools = append(enabledTools, c.Name())
+			}
+		}
+		enabledTools = pol.AdjustTools(enabledTools)
+	}
+
+	// Build tools map from selection, keeping each tool's own settings
 	enabledSet := make(map[string]bool, len(enabledTools))
 	for _, name := range enabledTools {
 		enabledSet[name] = true
 	}
-	for name := range tools {
-		tools[name] = enabledSet[name]
+	tools := make(map[string]config.ToolConfig)
+	for name := range config.DefaultTools() {
+		t := keptTools[name]
+		t.Enabled = enabledSet[name]
+		tools[name] = t
+	}
+
+	proxy := config.ProxyConfig{HTTP: httpProxy, HTTPS: httpsProxy, NoProxy: noProxy}
+	checkPolicy(pol, proxy, pacURL, certInput, tools)
+
+	// A user name and password typed into the proxy URL go to the
+	// credentials store; config.yaml only says which one.
+	credStore := ""
+	if existing != nil {
+		credStore = existing.Credentials
+	}
+	if creds := moveURLCredentials(&proxy); creds != nil {
+		previous := credStore
+		if credStore == "" {
+			credStore = defaultCredentialsStore()
+		}
+		store, err := saveCredentials(credStore, previous, creds)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error saving credentials: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Printf("  Moved the proxy credentials (%s) to %s\n", creds.Redacted(), store)
+	}
+
+	// Copy CA cert if provided
+	home, _ := os.UserHomeDir()
+	ezproxyDir := filepath.Join(home, ".ezproxy")
+	if err := os.MkdirAll(ezproxyDir, 0755); err != nil {
+		fmt.Fprintf(os.Stderr, "Error creating directory %s: %v\n", ezproxyDir, err)
+		os.Exit(1)
+	}
+
+	caCertConfig, caCertsConfig, err := copyCACerts(ezproxyDir, profile, config.SplitList(certInput))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
 	}
 
 	cfg := &config.Config{
-		Proxy: config.ProxyConfig{
-			HTTP:    httpProxy,
-			HTTPS:   httpsProxy,
-			NoProxy: noProxy,
-		},
-		CACert: caCertConfig,
-		Tools:  tools,
+		Proxy:       proxy,
+		PACURL:      pacURL,
+		CACert:      caCertConfig,
+		CACerts:     caCertsConfig,
+		Tools:       tools,
+		Credentials: credStore,
+	}
+	cfg.InheritLayers(existing)
+
+	// Keep other profiles. When creating the first named profile from a
+	// single-profile config, the old settings are kept as "default".
+	if existing != nil {
+		if profile != "" && existing.ActiveProfile == "" && profile != "default" {
+			existing.SaveProfile("default")
+			fmt.Println("  Saved previous settings as profile \"default\"")
+		}
+		cfg.Profiles = existing.Profiles
+		cfg.ActiveProfile = existing.ActiveProfile
+	}
+	if profile != "" {
+		cfg.ActiveProfile = profile
+	}
+	switch {
+	case b != nil:
+		cfg.Bundle = &config.BundleSource{
+			Name:    b.Name,
+			URL:     b.NextURL(),
+			Key:     bundle.EncodeKey(b.Key),
+			Serial:  b.Serial,
+			Profile: cfg.ActiveProfile,
+		}
+	case existing != nil && existing.Bundle != nil && existing.Bundle.Profile != cfg.ActiveProfile:
+		// Set up by hand: only the profile the bundle went into stops
+		// following it.
+		cfg.Bundle = existing.Bundle
 	}
 
 	cfgPath := configPath()
@@ -551,7 +2014,7 @@ func cmdInit() {
 	enabledCount := 0
 	disabledCount := 0
 	for _, v := range tools {
-		if v {
+		if v.Enabled {
 			enabledCount++
 		} else {
 			disabledCount++
@@ -565,3 +2028,448 @@ func cmdInit() {
 	fmt.Println("\nRun 'ezproxy apply' to configure all tools.")
 	fmt.Println("Run 'ezproxy apply --dry-run' to preview changes first.")
 }
+
+// cmdUpdate fetches the bundle init was run from and, if its serial is
+// newer, takes its proxy settings and CA certificates into the profile it
+// was set up in. The signature must match the key pinned at init. The
+// tool selection is left alone: a bundle's tools are only a default.
+func cmdUpdate() {
+	cfg, err := readConfig()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error loading config: %v\n", err)
+		fmt.Fprintf(os.Stderr, "Run 'ezproxy init' to create a config file.\n")
+		os.Exit(1)
+	}
+	src := cfg.Bundle
+	if src == nil {
+		fmt.Fprintln(os.Stderr, "Error: ezproxy was not set up from a bundle; run 'ezproxy init --bundle <file or URL>' first.")
+		os.Exit(1)
+	}
+	key, err := bundle.ParseKey(src.Key)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: bundle key in config.yaml: %v\n", err)
+		os.Exit(1)
+	}
+	b, err := bundle.Open(context.Background(), src.URL, []ed25519.PublicKey{key})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	if b.Serial <= src.Serial {
+		fmt.Printf("Bundle %s is up to date (serial %d).\n", src.URL, src.Serial)
+		return
+	}
+
+	// Before the first named profile, the settings live at the top level;
+	// init saves them as "default" when one is created.
+	profile := src.Profile
+	if profile == "" && cfg.ActiveProfile != "" {
+		profile = "default"
+	}
+	active := profile == cfg.ActiveProfile
+	prof := config.Profile{Proxy: cfg.Proxy, PACURL: cfg.PACURL, CACert: cfg.CACert, CACerts: cfg.CACerts}
+	if !active {
+		p, ok := cfg.Profiles[profile]
+		if !ok {
+			fmt.Fprintf(os.Stderr, "Error: profile %q the bundle was set up in no longer exists; run 'ezproxy init --bundle %s' again.\n", profile, src.URL)
+			os.Exit(1)
+		}
+		prof = p
+	}
+
+	if fileutil.DryRun {
+		fmt.Printf("[dry-run] Would update bundle %s from serial %d to %d.\n", src.URL, src.Serial, b.Serial)
+		return
+	}
+
+	answers := b.Answers()
+	answers.Tools = nil
+	caPath, cleanup, err := bundleCAFile(b)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	defer cleanup()
+	answers.CACert = caPath
+
+	httpProxy, httpsProxy, noProxy := prof.Proxy.HTTP, prof.Proxy.HTTPS, prof.Proxy.NoProxy
+	certInput := strings.Join(configuredCACerts(prof.CACert, prof.CACerts), ", ")
+	pacURL, err := answerInit(answers, prof.PACURL, &httpProxy, &httpsProxy, &noProxy, &certInput)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: bundle serial %d: %v\n", b.Serial, err)
+		os.Exit(1)
+	}
+	if httpsProxy == "" {
+		httpsProxy = httpProxy
+	}
+	prof.Proxy = config.ProxyConfig{HTTP: httpProxy, HTTPS: httpsProxy, NoProxy: noProxy}
+	prof.PACURL = pacURL
+	checkPolicy(loadPolicy(), prof.Proxy, pacURL, certInput, cfg.Tools)
+	snap := beginSnapshot("update")
+	if err := fileutil.BackupFile(configPath()); err != nil {
+		fmt.Fprintf(os.Stderr, "Error backing up config: %v\n", err)
+		os.Exit(1)
+	}
+	if caPath != "" {
+		ezproxyDir := filepath.Dir(configPath())
+		if prof.CACert, prof.CACerts, err = copyCACerts(ezproxyDir, profile, []string{caPath}); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	if active {
+		cfg.Proxy, cfg.PACURL, cfg.CACert, cfg.CACerts = prof.Proxy, prof.PACURL, prof.CACert, prof.CACerts
+	} else {
+		cfg.Profiles[profile] = prof
+	}
+	src.Name, src.URL, src.Serial = b.Name, b.NextURL(), b.Serial
+
+	if err := config.Save(configPath(), cfg); err != nil {
+		fmt.Fprintf(os.Stderr, "Error saving config: %v\n", err)
+		os.Exit(1)
+	}
+	fmt.Printf("Updated to bundle serial %d.\n", b.Serial)
+	endSnapshot(snap)
+	if active {
+		fmt.Println("\nRun 'ezproxy apply' to configure all tools.")
+	} else {
+		fmt.Printf("\nRun 'ezproxy switch %s' to use it.\n", profile)
+	}
+}
+
+// answerInit fills in the init fields from answers instead of the wizard
+// and runs the checks the wizard's forms do. A PAC file is evaluated first,
+// so explicit proxy answers override what it derives. It returns pac_url.
+func answerInit(answers config.Answers, pacURL string, httpProxy, httpsProxy, noProxy, certInput *string) (string, error) {
+	if answers.PACURL != "" {
+		var err error
+		if pacURL, err = derivePAC(answers.PACURL, httpProxy, httpsProxy, noProxy); err != nil {
+			if answers.HTTP == "" {
+				return "", fmt.Errorf("could not use PAC file: %w", err)
+			}
+			fmt.Fprintf(os.Stderr, "Warning: could not use PAC file: %v\n", err)
+		}
+	}
+	if answers.HTTP != "" {
+		*httpProxy = answers.HTTP
+		// Leaving out --https means "same as HTTP", as in the wizard.
+		*httpsProxy = answers.HTTPS
+	} else if answers.HTTPS != "" {
+		*httpsProxy = answers.HTTPS
+	}
+	if answers.NoProxy != "" {
+		*noProxy = answers.NoProxy
+	}
+	if paths := answers.CACertPaths(); len(paths) > 0 {
+		*certInput = strings.Join(paths, ", ")
+	}
+
+	if err := config.ValidateProxyURL(*httpProxy); err != nil {
+		return "", fmt.Errorf("HTTP proxy: %w (give --http or --pac)", err)
+	}
+	if err := validateOptionalProxyURL(*httpsProxy); err != nil {
+		return "", fmt.Errorf("HTTPS proxy: %w", err)
+	}
+	if err := validateCACerts(*certInput); err != nil {
+		return "", fmt.Errorf("CA certificate: %w", err)
+	}
+	if err := answers.ValidateTools(); err != nil {
+		return "", err
+	}
+	return pacURL, nil
+}
+
+// runInitWizard asks for the PAC file, then the proxy settings (pre-filled
+// from it). Values the policy doesn't allow are rejected in the form. It
+// returns pac_url.
+func runInitWizard(pol *policy.Policy, pacURL string, httpProxy, httpsProxy, noProxy, certInput *string) string {
+	// Page 1: optional PAC file to derive the proxy settings from
+	pacForm := huh.NewForm(
+		huh.NewGroup(
+			huh.NewInput().
+				Title("PAC File (optional)").
+				Description("URL or path of your network's proxy auto-config file, 'wpad' to discover it,\nor blank to enter the proxy by hand").
+				Value(&pacURL).
+				Validate(policyCheck(pol, policy.FieldPACURL, nil)),
+		),
+	).WithTheme(huh.ThemeCharm())
+
+	if err := pacForm.Run(); err != nil {
+		fmt.Fprintf(os.Stderr, "Cancelled.\n")
+		os.Exit(1)
+	}
+	if pacURL = strings.TrimSpace(pacURL); pacURL != "" {
+		var err error
+		if pacURL, err = derivePAC(pacURL, httpProxy, httpsProxy, noProxy); err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: could not use PAC file: %v\nEnter the proxy settings by hand.\n\n", err)
+		}
+	}
+
+	// Page 2: Proxy settings, pre-filled from the PAC file if there is one
+	proxyForm := huh.NewForm(
+		huh.NewGroup(
+			huh.NewInput().
+				Title("HTTP Proxy URL").
+				Description("e.g. http://proxy.corp.com:8080").
+				Value(httpProxy).
+				Validate(policyCheck(pol, policy.FieldHTTP, config.ValidateProxyURL)),
+
+			huh.NewInput().
+				Title("HTTPS Proxy URL").
+				Description("Leave blank to use the same as HTTP proxy").
+				Value(httpsProxy).
+				Validate(func(s string) error {
+					if err := validateOptionalProxyURL(s); err != nil || s == "" {
+						return err
+					}
+					return pol.CheckField(policy.FieldHTTPS, s)
+				}),
+
+			huh.NewInput().
+				Title("NO_PROXY").
+				Description("Comma-separated hosts/CIDRs to bypass the proxy").
+				Value(noProxy).
+				Validate(policyCheck(pol, policy.FieldNoProxy, nil)),
+
+			huh.NewInput().
+				Title("CA Certificate Path(s)").
+				Description("PEM, DER or bundle files, comma-separated (optional, leave blank to skip)").
+				Value(certInput).
+				Validate(func(s string) error {
+					if err := validateCACerts(s); err != nil {
+						return err
+					}
+					return pol.CheckCACerts(expandPaths(config.SplitList(s)))
+				}),
+		),
+	).WithTheme(huh.ThemeCharm())
+
+	if err := proxyForm.Run(); err != nil {
+		fmt.Fprintf(os.Stderr, "Cancelled.\n")
+		os.Exit(1)
+	}
+	return pacURL
+}
+
+// runToolsForm asks which tools to configure, with the installed ones
+// selected. Tools the policy requires or forbids are marked and checked.
+func runToolsForm(pol *policy.Policy, osInfo detect.OSInfo) []string {
+	// Page 3: Tool selection via interactive checkboxes
+	var toolOptions []huh.Option[string]
+	for _, c := range configurator.All() {
+		installed := c.IsAvailable(osInfo)
+		label := c.Name() + policyLabel(pol, c.Name())
+		if !installed {
+			label += " (not installed)"
+		}
+		selected := installed && pol.Tool(c.Name()) != policy.Forbidden || pol.Tool(c.Name()) == policy.Required
+		toolOptions = append(toolOptions,
+			huh.NewOption(label, c.Name()).Selected(selected),
+		)
+	}
+
+	var enabledTools []string
+	toolForm := huh.NewForm(
+		huh.NewGroup(
+			huh.NewMultiSelect[string]().
+				Title("Tools to configure").
+				Description("Use arrow keys to navigate, space to toggle, enter to confirm.").
+				Options(toolOptions...).
+				Height(len(toolOptions) + 2).
+				Validate(pol.CheckTools).
+				Value(&enabledTools),
+		),
+	).WithTheme(huh.ThemeCharm())
+
+	if err := toolForm.Run(); err != nil {
+		fmt.Fprintf(os.Stderr, "Cancelled.\n")
+		os.Exit(1)
+	}
+	return enabledTools
+}
+
+// derivePAC evaluates the PAC file at location and replaces the proxy
+// fields with what it derives, keeping NO_PROXY entries the script sends
+// direct. It returns the location to store as pac_url (the discovered URL
+// for "wpad").
+func derivePAC(location string, httpProxy, httpsProxy, noProxy *string) (string, error) {
+	script, err := loadPAC(context.Background(), location)
+	if err != nil {
+		return "", err
+	}
+	derived, err := script.Derive(config.SplitList(*noProxy))
+	if err != nil {
+		return "", err
+	}
+	*httpProxy = derived.Proxy.HTTP
+	*httpsProxy = derived.Proxy.HTTPS
+	*noProxy = derived.Proxy.NoProxy
+	fmt.Printf("Derived from %s:\n", script.Source)
+	fmt.Printf("  HTTP proxy:  %s\n  HTTPS proxy: %s\n  NO_PROXY:    %s\n\n", *httpProxy, *httpsProxy, *noProxy)
+	return script.Source, nil
+}
+
+// configuredCACerts returns ca_cert and ca_certs as one list.
+func configuredCACerts(caCert string, caCerts []string) []string {
+	var out []string
+	if caCert != "" {
+		out = append(out, caCert)
+	}
+	return append(out, caCerts...)
+}
+
+// noProxyProblems returns the NO_PROXY entries c's tool can't honour as
+// written, as its dialect renders them.
+func noProxyProblems(c configurator.Configurator, cfg *config.Config) []string {
+	r, ok := c.(configurator.NoProxyReader)
+	if !ok || cfg.Tools[c.Name()].Direct {
+		return nil
+	}
+	_, problems := r.NoProxyDialect().Render(noproxy.Parse(cfg.ForTool(c.Name()).Proxy.NoProxy))
+	var out []string
+	for _, p := range problems {
+		out = append(out, p.String())
+	}
+	return out
+}
+
+// credentialsLine describes the stored proxy credentials for status, with
+// the password masked, or returns "" if config.yaml names no store.
+func credentialsLine(cfg *config.Config) string {
+	if cfg.Credentials == "" {
+		return ""
+	}
+	store, err := credentialsStore(cfg)
+	if err != nil {
+		return err.Error()
+	}
+	creds, err := store.Load()
+	if err != nil {
+		return "none in " + store.String()
+	}
+	line := creds.Redacted() + " (" + store.String() + ")"
+	if creds.Scheme == credentials.SchemeNTLM {
+		line += ", NTLM: used by the relay only"
+	}
+	return line
+}
+
+// authMissing reports whether c's tool is left without credentials the
+// proxy it is given needs, because its settings are system-wide.
+func authMissing(c configurator.Configurator, cfg *config.Config) bool {
+	w, ok := c.(configurator.AuthWriter)
+	if !ok || w.AuthMethod() != "" || cfg.Tools[c.Name()].Direct {
+		return false
+	}
+	tc := cfg.ForTool(c.Name())
+	return tc.AuthFor(tc.Proxy.HTTP) != nil || tc.AuthFor(tc.Proxy.HTTPS) != nil
+}
+
+// toolSettings describes each enabled tool that doesn't use the top-level
+// proxy and CA settings, one line per tool.
+func toolSettings(cfg *config.Config) []string {
+	var names []string
+	for name, t := range cfg.Tools {
+		if t.Enabled && (t.Direct || t.HasOverrides()) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	var lines []string
+	for _, name := range names {
+		t := cfg.Tools[name]
+		if t.Direct {
+			lines = append(lines, fmt.Sprintf("%-12s direct (no proxy)", name))
+			continue
+		}
+		var parts []string
+		for _, f := range []struct{ key, value string }{
+			{"http", t.HTTP}, {"https", t.HTTPS}, {"no_proxy", t.NoProxy}, {"ca_cert", t.CACert},
+		} {
+			if f.value != "" {
+				parts = append(parts, f.key+" "+f.value)
+			}
+		}
+		lines = append(lines, fmt.Sprintf("%-12s %s", name, strings.Join(parts, ", ")))
+	}
+	return lines
+}
+
+// policyCheck runs check, if any, and then the policy's rule for field.
+func policyCheck(pol *policy.Policy, field string, check func(string) error) func(string) error {
+	return func(s string) error {
+		if check != nil {
+			if err := check(s); err != nil {
+				return err
+			}
+		}
+		return pol.CheckField(field, s)
+	}
+}
+
+// expandPaths applies config.ExpandPath to each path.
+func expandPaths(paths []string) []string {
+	out := make([]string, len(paths))
+	for i, p := range paths {
+		out[i] = config.ExpandPath(p)
+	}
+	return out
+}
+
+// validateCACerts checks that every comma-separated path holds only CA
+// certificates, so mistakes are caught in the wizard rather than on apply.
+func validateCACerts(input string) error {
+	_, err := certs.Load(expandPaths(config.SplitList(input)))
+	return err
+}
+
+// copyCACerts copies the given cert files into dir and returns the values
+// for ca_cert (a single file, as before) or ca_certs (several files). All
+// sources are read before anything is written, since re-running init
+// pre-fills the copies themselves and the order may change.
+func copyCACerts(dir, profile string, inputs []string) (string, []string, error) {
+	if len(inputs) == 0 {
+		return "", nil, nil
+	}
+	base := "corp-ca"
+	if profile != "" {
+		if err := config.CheckProfileName(profile); err != nil {
+			return "", nil, err
+		}
+		base += "-" + profile
+	}
+
+	contents := make([][]byte, len(inputs))
+	for i, in := range inputs {
+		data, err := os.ReadFile(config.ExpandPath(in))
+		if err != nil {
+			return "", nil, fmt.Errorf("reading cert: %w", err)
+		}
+		contents[i] = data
+	}
+
+	var names []string
+	for i, in := range inputs {
+		name := base + ".pem"
+		if len(inputs) > 1 {
+			ext := filepath.Ext(in)
+			if ext == "" {
+				ext = ".pem"
+			}
+			name = fmt.Sprintf("%s-%d%s", base, i+1, ext)
+		}
+		dest := filepath.Join(dir, name)
+		if config.ExpandPath(in) != dest {
+			if err := fileutil.AtomicWrite(dest, contents[i], 0644); err != nil {
+				return "", nil, fmt.Errorf("copying cert: %w", err)
+			}
+			fmt.Printf("  Copied cert to %s\n", dest)
+		}
+		names = append(names, "~/.ezproxy/"+name)
+	}
+	if len(names) == 1 {
+		return names[0], nil, nil
+	}
+	return "", names, nil
+}
@@ -0,0 +1,288 @@
+// Package bundle reads organisation config bundles: one signed file, kept
+// by IT, holding the proxy settings, the corporate CA certificates and the
+// default tool selection, so that engineers run
+// "ezproxy init --bundle corp.ezbundle" instead of typing values in.
+//
+// A bundle is a YAML document with a detached Ed25519 signature next to
+// it (corp.ezbundle.sig, raw or base64). The signature is checked against
+// a pinned public key before anything in the bundle is parsed, so CA
+// material from a tampered or spoofed bundle is never trusted.
+package bundle
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/andrew/ezproxy/internal/certs"
+	"github.com/andrew/ezproxy/internal/config"
+)
+
+// maxSize caps how much of a bundle or signature is read.
+const maxSize = 1 << 20
+
+// SystemKeyPath is where an administrator (or MDM) can pin the bundle
+// signing key for every user of the machine.
+var SystemKeyPath = "/etc/ezproxy/bundle.pub"
+
+// BuiltinKey is a signing key compiled into the binary, for organisations
+// that build their own ezproxy:
+//
+//	go build -ldflags "-X github.com/andrew/ezproxy/internal/bundle.BuiltinKey=<base64>"
+var BuiltinKey string
+
+// Bundle is a verified organisation bundle.
+type Bundle struct {
+	Name      string   `yaml:"name"`
+	Serial    int64    `yaml:"serial"`     // increases with every release; "ezproxy update" wants a higher one
+	UpdateURL string   `yaml:"update_url"` // where newer bundles are published
+	HTTP      string   `yaml:"http"`
+	HTTPS     string   `yaml:"https"`
+	NoProxy   string   `yaml:"no_proxy"`
+	PACURL    string   `yaml:"pac_url"`
+	CACerts   []string `yaml:"ca_certs"` // PEM certificates, inline
+	Tools     []string `yaml:"tools"`    // default tool selection
+
+	// Source is where the bundle was read from, and Key the pinned key
+	// its signature matched.
+	Source string            `yaml:"-"`
+	Key    ed25519.PublicKey `yaml:"-"`
+}
+
+// Open reads the bundle at location (an http(s) URL or a local path) and
+// the signature at location + ".sig", checks the signature against keys
+// and only then parses the bundle.
+func Open(ctx context.Context, location string, keys []ed25519.PublicKey) (*Bundle, error) {
+	if len(keys) == 0 {
+		return nil, errors.New("no public key to verify the bundle with")
+	}
+	if !isURL(location) {
+		location = strings.TrimPrefix(location, "file://")
+		if abs, err := filepath.Abs(location); err == nil {
+			location = abs
+		}
+	}
+	data, err := read(ctx, location)
+	if err != nil {
+		return nil, err
+	}
+	sig, err := read(ctx, location+".sig")
+	if err != nil {
+		return nil, fmt.Errorf("reading signature: %w", err)
+	}
+	key, err := Verify(data, sig, keys)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", location, err)
+	}
+	b, err := Parse(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", location, err)
+	}
+	b.Source, b.Key = location, key
+	return b, nil
+}
+
+// Verify checks sig, a raw or base64 Ed25519 signature, over data and
+// returns the key it matches.
+func Verify(data, sig []byte, keys []ed25519.PublicKey) (ed25519.PublicKey, error) {
+	if len(sig) != ed25519.SignatureSize {
+		decoded, err := base64.StdEncoding.DecodeString(string(bytes.TrimSpace(sig)))
+		if err != nil || len(decoded) != ed25519.SignatureSize {
+			return nil, errors.New("signature is not an Ed25519 signature")
+		}
+		sig = decoded
+	}
+	for _, key := range keys {
+		if ed25519.Verify(key, data, sig) {
+			return key, nil
+		}
+	}
+	return nil, errors.New("signature does not match the pinned key; refusing to use the bundle")
+}
+
+// Parse reads a bundle. It does not check a signature; use Open. Unknown
+// keys are an error, like in answers files.
+func Parse(data []byte) (*Bundle, error) {
+	var b Bundle
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(&b); err != nil && !errors.Is(err, io.EOF) {
+		return nil, err
+	}
+	if b.Serial <= 0 {
+		return nil, errors.New("serial must be a positive number")
+	}
+	for _, f := range []struct{ name, value string }{{"http", b.HTTP}, {"https", b.HTTPS}} {
+		if f.value == "" {
+			continue
+		}
+		if err := config.ValidateProxyURL(f.value); err != nil {
+			return nil, fmt.Errorf("%s: %w", f.name, err)
+		}
+	}
+	if err := (config.Answers{Tools: b.Tools}).ValidateTools(); err != nil {
+		return nil, err
+	}
+	for i, c := range b.CACerts {
+		if _, err := certs.ParseCertificates([]byte(c)); err != nil {
+			return nil, fmt.Errorf("ca_certs[%d]: %w", i, err)
+		}
+	}
+	return &b, nil
+}
+
+// Answers returns the bundle's settings as init answers. CA certificates
+// are left out; they are inline in the bundle, not paths (see CAPEM).
+func (b *Bundle) Answers() config.Answers {
+	return config.Answers{
+		HTTP:    b.HTTP,
+		HTTPS:   b.HTTPS,
+		NoProxy: b.NoProxy,
+		PACURL:  b.PACURL,
+		Tools:   b.Tools,
+	}
+}
+
+// CAPEM returns the bundle's CA certificates as one PEM file, or nil if it
+// has none.
+func (b *Bundle) CAPEM() []byte {
+	var out []byte
+	for _, c := range b.CACerts {
+		c = strings.TrimSpace(c)
+		if c == "" {
+			continue
+		}
+		out = append(out, c...)
+		out = append(out, '\n')
+	}
+	return out
+}
+
+// NextURL returns where to look for a newer bundle: update_url if the
+// bundle names one, otherwise where it was read from.
+func (b *Bundle) NextURL() string {
+	if b.UpdateURL != "" {
+		return b.UpdateURL
+	}
+	return b.Source
+}
+
+// ParseKey reads an Ed25519 public key given as a PEM "PUBLIC KEY" block
+// (as written by "openssl pkey -pubout") or as base64 of the 32 raw bytes.
+// A value naming an existing file is read from that file.
+func ParseKey(s string) (ed25519.PublicKey, error) {
+	s = strings.TrimSpace(s)
+	if data, err := os.ReadFile(config.ExpandPath(s)); err == nil {
+		s = strings.TrimSpace(string(data))
+	}
+	if block, _ := pem.Decode([]byte(s)); block != nil {
+		pub, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("bundle key: %w", err)
+		}
+		key, ok := pub.(ed25519.PublicKey)
+		if !ok {
+			return nil, errors.New("bundle key is not an Ed25519 key")
+		}
+		return key, nil
+	}
+	raw, err := base64.StdEncoding.DecodeString(s)
+	if err != nil || len(raw) != ed25519.PublicKeySize {
+		return nil, errors.New("bundle key must be a PEM public key or base64 of a 32-byte Ed25519 key")
+	}
+	return ed25519.PublicKey(raw), nil
+}
+
+// EncodeKey returns key as base64, the form stored in config.yaml.
+func EncodeKey(key ed25519.PublicKey) string {
+	return base64.StdEncoding.EncodeToString(key)
+}
+
+// KeyID returns a short fingerprint of key for messages.
+func KeyID(key ed25519.PublicKey) string {
+	sum := sha256.Sum256(key)
+	return hex.EncodeToString(sum[:8])
+}
+
+// SystemKeys returns the keys pinned outside config.yaml: the one in
+// SystemKeyPath and the one built into the binary.
+func SystemKeys() ([]ed25519.PublicKey, error) {
+	var keys []ed25519.PublicKey
+	if _, err := os.Stat(SystemKeyPath); err == nil {
+		key, err := ParseKey(SystemKeyPath)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", SystemKeyPath, err)
+		}
+		keys = append(keys, key)
+	}
+	if BuiltinKey != "" {
+		key, err := ParseKey(BuiltinKey)
+		if err != nil {
+			return nil, fmt.Errorf("built-in bundle key: %w", err)
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+// client fetches bundles. It uses the proxy environment variables: the
+// bundle server is usually internal and listed in NO_PROXY, and on a
+// fresh machine none are set yet.
+var client = &http.Client{Timeout: 30 * time.Second}
+
+// read returns the contents of an http(s) URL or a local path.
+func read(ctx context.Context, location string) ([]byte, error) {
+	if !isURL(location) {
+		f, err := os.Open(location)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		return readLimited(f, location)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, location, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetching %s: %s", location, resp.Status)
+	}
+	return readLimited(resp.Body, location)
+}
+
+func readLimited(r io.Reader, location string) ([]byte, error) {
+	data, err := io.ReadAll(io.LimitReader(r, maxSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > maxSize {
+		return nil, fmt.Errorf("%s is larger than %d bytes", location, maxSize)
+	}
+	return data, nil
+}
+
+func isURL(location string) bool {
+	u, err := url.Parse(location)
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https")
+}
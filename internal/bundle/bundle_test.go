@@ -0,0 +1,224 @@
+package bundle
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// caPEM returns a self-signed CA certificate as PEM.
+func caPEM(t *testing.T) string {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: "Corp Root"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}))
+}
+
+// corpBundle returns a bundle document with the given serial.
+func corpBundle(t *testing.T, serial string) []byte {
+	t.Helper()
+	indented := "    " + strings.ReplaceAll(strings.TrimSpace(caPEM(t)), "\n", "\n    ")
+	return []byte(`name: corp
+serial: ` + serial + `
+http: http://proxy.corp.example:8080
+no_proxy: localhost,.corp.example
+tools: [git, npm]
+ca_certs:
+  - |
+` + indented + "\n")
+}
+
+func newKey(t *testing.T) (ed25519.PublicKey, ed25519.PrivateKey) {
+	t.Helper()
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pub, priv
+}
+
+// writeSigned writes data to dir/corp.ezbundle with its signature next to it.
+func writeSigned(t *testing.T, dir string, data, sig []byte) string {
+	t.Helper()
+	path := filepath.Join(dir, "corp.ezbundle")
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path+".sig", sig, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestOpen_VerifiedFile(t *testing.T) {
+	pub, priv := newKey(t)
+	data := corpBundle(t, "3")
+	path := writeSigned(t, t.TempDir(), data, ed25519.Sign(priv, data))
+
+	b, err := Open(context.Background(), path, []ed25519.PublicKey{pub})
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	if b.Name != "corp" || b.Serial != 3 || b.HTTP != "http://proxy.corp.example:8080" {
+		t.Errorf("bundle = %+v", b)
+	}
+	if !b.Key.Equal(pub) || b.Source != path || b.NextURL() != path {
+		t.Errorf("Key/Source = %x, %q", b.Key, b.Source)
+	}
+	if a := b.Answers(); a.NoProxy != "localhost,.corp.example" || len(a.Tools) != 2 || a.CACert != "" {
+		t.Errorf("Answers = %+v", a)
+	}
+	if !strings.Contains(string(b.CAPEM()), "BEGIN CERTIFICATE") {
+		t.Errorf("CAPEM = %q", b.CAPEM())
+	}
+}
+
+func TestOpen_RejectsTamperedBundle(t *testing.T) {
+	pub, priv := newKey(t)
+	data := corpBundle(t, "3")
+	sig := ed25519.Sign(priv, data)
+	tampered := []byte(strings.Replace(string(data), "proxy.corp.example", "evil.example", 1))
+	path := writeSigned(t, t.TempDir(), tampered, sig)
+
+	if _, err := Open(context.Background(), path, []ed25519.PublicKey{pub}); err == nil || !strings.Contains(err.Error(), "does not match") {
+		t.Errorf("Open = %v, want a signature error", err)
+	}
+}
+
+func TestOpen_RejectsOtherKey(t *testing.T) {
+	pinned, _ := newKey(t)
+	_, attacker := newKey(t)
+	data := corpBundle(t, "3")
+	path := writeSigned(t, t.TempDir(), data, ed25519.Sign(attacker, data))
+
+	if _, err := Open(context.Background(), path, []ed25519.PublicKey{pinned}); err == nil {
+		t.Error("Open accepted a bundle signed by another key")
+	}
+	if _, err := Open(context.Background(), path, nil); err == nil {
+		t.Error("Open accepted a bundle with no pinned key")
+	}
+}
+
+func TestOpen_MissingSignature(t *testing.T) {
+	pub, _ := newKey(t)
+	path := filepath.Join(t.TempDir(), "corp.ezbundle")
+	if err := os.WriteFile(path, corpBundle(t, "1"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Open(context.Background(), path, []ed25519.PublicKey{pub}); err == nil || !strings.Contains(err.Error(), "signature") {
+		t.Errorf("Open = %v, want a missing signature error", err)
+	}
+}
+
+func TestOpen_URLWithBase64Signature(t *testing.T) {
+	pub, priv := newKey(t)
+	data := corpBundle(t, "7")
+	sig := base64.StdEncoding.EncodeToString(ed25519.Sign(priv, data)) + "\n"
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/corp.ezbundle":
+			w.Write(data)
+		case "/corp.ezbundle.sig":
+			w.Write([]byte(sig))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(srv.Close)
+
+	b, err := Open(context.Background(), srv.URL+"/corp.ezbundle", []ed25519.PublicKey{pub})
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	if b.Serial != 7 || b.Source != srv.URL+"/corp.ezbundle" {
+		t.Errorf("bundle = %+v", b)
+	}
+}
+
+func TestParse_Invalid(t *testing.T) {
+	for name, doc := range map[string]string{
+		"no serial":   "http: http://proxy:8080\n",
+		"unknown key": "serial: 1\nhtpp: http://proxy:8080\n",
+		"bad proxy":   "serial: 1\nhttp: proxy:8080\n",
+		"bad tool":    "serial: 1\ntools: [gti]\n",
+		"bad cert":    "serial: 1\nca_certs: [\"-----BEGIN CERTIFICATE-----\\nAAAA\\n-----END CERTIFICATE-----\\n\"]\n",
+	} {
+		if _, err := Parse([]byte(doc)); err == nil {
+			t.Errorf("%s: Parse accepted %q", name, doc)
+		}
+	}
+}
+
+func TestParseKey(t *testing.T) {
+	pub, _ := newKey(t)
+
+	key, err := ParseKey(EncodeKey(pub))
+	if err != nil || !key.Equal(pub) {
+		t.Fatalf("base64: %x, %v", key, err)
+	}
+
+	der, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "bundle.pub")
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0644); err != nil {
+		t.Fatal(err)
+	}
+	key, err = ParseKey(path)
+	if err != nil || !key.Equal(pub) {
+		t.Fatalf("PEM file: %x, %v", key, err)
+	}
+
+	if _, err := ParseKey("not a key"); err == nil {
+		t.Error("ParseKey accepted garbage")
+	}
+}
+
+func TestSystemKeys(t *testing.T) {
+	pub, _ := newKey(t)
+	oldPath, oldBuiltin := SystemKeyPath, BuiltinKey
+	t.Cleanup(func() { SystemKeyPath, BuiltinKey = oldPath, oldBuiltin })
+
+	SystemKeyPath = filepath.Join(t.TempDir(), "bundle.pub")
+	BuiltinKey = ""
+	if keys, err := SystemKeys(); err != nil || len(keys) != 0 {
+		t.Errorf("no keys: %v, %v", keys, err)
+	}
+	if err := os.WriteFile(SystemKeyPath, []byte(EncodeKey(pub)+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	BuiltinKey = EncodeKey(pub)
+	if keys, err := SystemKeys(); err != nil || len(keys) != 2 || !keys[0].Equal(pub) {
+		t.Errorf("keys = %v, %v", keys, err)
+	}
+}
@@ -0,0 +1,247 @@
+// Package certs builds the combined CA bundle ezproxy points tools at.
+//
+// Settings such as SSL_CERT_FILE, git's http.sslCAInfo or pip's cert
+// replace a tool's trust store rather than adding to it. Pointing them at
+// the corporate CA alone breaks TLS to every host with a public certificate
+// (anything on NO_PROXY). The bundle holds the system roots plus the
+// corporate CA(s), so both keep working.
+package certs
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/andrew/ezproxy/internal/fileutil"
+)
+
+// systemRootFiles are the usual locations of the system's PEM root bundle,
+// in the order crypto/x509 checks them.
+var systemRootFiles = []string{
+	"/etc/ssl/certs/ca-certificates.crt",                // Debian/Ubuntu/Gentoo etc.
+	"/etc/pki/tls/certs/ca-bundle.crt",                  // Fedora/RHEL 6
+	"/etc/ssl/ca-bundle.pem",                            // OpenSUSE
+	"/etc/pki/tls/cacert.pem",                           // OpenELEC
+	"/etc/pki/ca-trust/extracted/pem/tls-ca-bundle.pem", // CentOS/RHEL 7
+	"/etc/ssl/cert.pem",                                 // Alpine, macOS
+}
+
+// SystemRootsPath returns the first system root bundle that exists, or ""
+// if none is found. SSL_CERT_FILE is deliberately ignored since it may
+// point at the bundle ezproxy itself wrote.
+func SystemRootsPath() string {
+	for _, p := range systemRootFiles {
+		if info, err := os.Stat(p); err == nil && !info.IsDir() {
+			return p
+		}
+	}
+	return ""
+}
+
+// SystemPool returns the system roots as a cert pool. Like SystemRootsPath
+// it ignores SSL_CERT_FILE, which x509.SystemCertPool honours: once
+// env_vars points that at the bundle, the corporate CAs would always look
+// system-trusted.
+func SystemPool() (*x509.CertPool, error) {
+	path := SystemRootsPath()
+	if path == "" {
+		return x509.SystemCertPool()
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	pool.AppendCertsFromPEM(data)
+	return pool, nil
+}
+
+// CA is one corporate CA certificate, loaded from a PEM, DER or bundle file.
+type CA struct {
+	Cert   *x509.Certificate
+	Source string // file it was read from
+	Alias  string // name used in trust stores, e.g. "ezproxy-corp-root-1a2b3c4d"
+}
+
+// Fingerprint returns the hex SHA-256 of the certificate.
+func (ca *CA) Fingerprint() string {
+	sum := sha256.Sum256(ca.Cert.Raw)
+	return hex.EncodeToString(sum[:])
+}
+
+// PEM returns the certificate PEM-encoded.
+func (ca *CA) PEM() []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.Cert.Raw})
+}
+
+// Load reads every certificate from paths. Each file may hold a single PEM
+// or DER certificate or a PEM bundle. Every certificate must be a CA;
+// duplicates across files are dropped.
+func Load(paths []string) ([]*CA, error) {
+	var cas []*CA
+	seen := make(map[string]bool)
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		parsed, err := ParseCertificates(data)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		for _, cert := range parsed {
+			if err := checkCA(cert); err != nil {
+				return nil, fmt.Errorf("%s: %w", path, err)
+			}
+			if seen[string(cert.Raw)] {
+				continue
+			}
+			seen[string(cert.Raw)] = true
+			cas = append(cas, &CA{Cert: cert, Source: path, Alias: alias(cert)})
+		}
+	}
+	return cas, nil
+}
+
+// ParseCertificates parses PEM (one or more CERTIFICATE blocks) or DER data.
+func ParseCertificates(data []byte) ([]*x509.Certificate, error) {
+	if !bytes.Contains(data, []byte("-----BEGIN")) {
+		certs, err := x509.ParseCertificates(data)
+		if err != nil {
+			return nil, fmt.Errorf("not a PEM or DER certificate: %w", err)
+		}
+		if len(certs) == 0 {
+			return nil, fmt.Errorf("no certificates found")
+		}
+		return certs, nil
+	}
+	var certs []*x509.Certificate
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		certs = append(certs, cert)
+	}
+	if len(certs) == 0 {
+		return nil, fmt.Errorf("no PEM certificates found")
+	}
+	return certs, nil
+}
+
+// checkCA rejects leaf certificates, which are a common mistake (exporting
+// the proxy's server cert instead of its issuer). Old v1 roots without
+// basic constraints are accepted if they are self-signed.
+func checkCA(cert *x509.Certificate) error {
+	if cert.BasicConstraintsValid {
+		if !cert.IsCA {
+			return fmt.Errorf("%q is not a CA certificate (basic constraints CA:FALSE)", cert.Subject.String())
+		}
+		return nil
+	}
+	if cert.CheckSignatureFrom(cert) != nil {
+		return fmt.Errorf("%q is not a CA certificate (no basic constraints, not self-signed)", cert.Subject.String())
+	}
+	return nil
+}
+
+var aliasUnsafe = regexp.MustCompile(`[^a-z0-9]+`)
+
+// alias derives a stable trust store name from the certificate's common
+// name and fingerprint.
+func alias(cert *x509.Certificate) string {
+	name := cert.Subject.CommonName
+	if name == "" && len(cert.Subject.Organization) > 0 {
+		name = cert.Subject.Organization[0]
+	}
+	name = strings.Trim(aliasUnsafe.ReplaceAllString(strings.ToLower(name), "-"), "-")
+	if len(name) > 32 {
+		name = strings.TrimRight(name[:32], "-")
+	}
+	sum := sha256.Sum256(cert.Raw)
+	fp := hex.EncodeToString(sum[:4])
+	if name == "" {
+		return "ezproxy-" + fp
+	}
+	return "ezproxy-" + name + "-" + fp
+}
+
+// EncodePEM returns the certificates as a PEM bundle.
+func EncodePEM(cas []*CA) []byte {
+	var b bytes.Buffer
+	for _, ca := range cas {
+		b.Write(ca.PEM())
+	}
+	return b.Bytes()
+}
+
+// Bundle returns the PEM bundle of every certificate in rootsPath followed
+// by the corporate CAs, with duplicates dropped. rootsPath may be empty, in
+// which case the bundle holds only the corporate CAs.
+func Bundle(rootsPath string, cas []*CA) ([]byte, error) {
+	var b bytes.Buffer
+	b.WriteString("# Generated by ezproxy: system roots plus corporate CA(s).\n")
+	b.WriteString("# Do not edit; rebuilt by 'ezproxy apply'.\n")
+
+	seen := make(map[string]bool)
+	if rootsPath != "" {
+		data, err := os.ReadFile(rootsPath)
+		if err != nil {
+			return nil, fmt.Errorf("reading system roots: %w", err)
+		}
+		for {
+			var block *pem.Block
+			block, data = pem.Decode(data)
+			if block == nil {
+				break
+			}
+			if block.Type != "CERTIFICATE" || seen[string(block.Bytes)] {
+				continue
+			}
+			seen[string(block.Bytes)] = true
+			if err := pem.Encode(&b, &pem.Block{Type: "CERTIFICATE", Bytes: block.Bytes}); err != nil {
+				return nil, err
+			}
+		}
+	}
+	for _, ca := range cas {
+		if seen[string(ca.Cert.Raw)] {
+			continue
+		}
+		seen[string(ca.Cert.Raw)] = true
+		b.Write(ca.PEM())
+	}
+	return b.Bytes(), nil
+}
+
+// WriteIfChanged writes content to path unless the file already holds
+// exactly that content. It reports whether the file changed.
+func WriteIfChanged(path string, content []byte) (bool, error) {
+	if UpToDate(path, content) {
+		return false, nil
+	}
+	if err := fileutil.WriteFile(path, content, 0644); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// UpToDate reports whether path holds exactly content.
+func UpToDate(path string, content []byte) bool {
+	existing, err := os.ReadFile(path)
+	return err == nil && bytes.Equal(existing, content)
+}
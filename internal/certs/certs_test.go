@@ -0,0 +1,176 @@
+package certs
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// selfSigned returns the DER of a self-signed certificate named cn.
+func selfSigned(t *testing.T, cn string, isCA bool) []byte {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: cn},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  isCA,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return der
+}
+
+// writeCA writes a self-signed CA certificate in PEM form to dir/name.
+func writeCA(t *testing.T, dir, name string) string {
+	t.Helper()
+	der := selfSigned(t, name, true)
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func mustLoad(t *testing.T, paths ...string) []*CA {
+	t.Helper()
+	cas, err := Load(paths)
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	return cas
+}
+
+func TestBundleCombinesRootsAndCorporateCA(t *testing.T) {
+	dir := t.TempDir()
+	root1 := writeCA(t, dir, "root1.pem")
+	root2 := writeCA(t, dir, "root2.pem")
+	corp := writeCA(t, dir, "corp.pem")
+
+	// The system bundle already contains the corporate CA (e.g. after
+	// system_ca installed it); it must not appear twice.
+	r1, _ := os.ReadFile(root1)
+	r2, _ := os.ReadFile(root2)
+	c, _ := os.ReadFile(corp)
+	roots := filepath.Join(dir, "roots.pem")
+	os.WriteFile(roots, append(append(r1, r2...), c...), 0644)
+
+	bundle, err := Bundle(roots, mustLoad(t, corp))
+	if err != nil {
+		t.Fatalf("Bundle: %v", err)
+	}
+	if n := strings.Count(string(bundle), "BEGIN CERTIFICATE"); n != 3 {
+		t.Errorf("expected 3 certificates, got %d", n)
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(bundle) {
+		t.Fatal("bundle is not a valid PEM cert pool")
+	}
+}
+
+func TestBundleWithoutSystemRoots(t *testing.T) {
+	dir := t.TempDir()
+	corp := writeCA(t, dir, "corp.pem")
+
+	bundle, err := Bundle("", mustLoad(t, corp))
+	if err != nil {
+		t.Fatalf("Bundle: %v", err)
+	}
+	if n := strings.Count(string(bundle), "BEGIN CERTIFICATE"); n != 1 {
+		t.Errorf("expected 1 certificate, got %d", n)
+	}
+}
+
+func TestLoadRejectsNonCertificate(t *testing.T) {
+	dir := t.TempDir()
+	bad := filepath.Join(dir, "bad.pem")
+	os.WriteFile(bad, []byte("not a cert"), 0644)
+
+	if _, err := Load([]string{bad}); err == nil {
+		t.Error("expected error for a CA file without certificates")
+	}
+}
+
+func TestLoadRejectsLeafCertificate(t *testing.T) {
+	dir := t.TempDir()
+	leaf := filepath.Join(dir, "proxy.pem")
+	der := selfSigned(t, "proxy.corp.example.com", false)
+	os.WriteFile(leaf, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644)
+
+	_, err := Load([]string{leaf})
+	if err == nil || !strings.Contains(err.Error(), "not a CA certificate") {
+		t.Errorf("expected a not-a-CA error, got %v", err)
+	}
+}
+
+func TestLoadDERAndBundle(t *testing.T) {
+	dir := t.TempDir()
+	root := selfSigned(t, "Corp Root CA", true)
+	issuing := selfSigned(t, "Corp Issuing CA 2", true)
+
+	der := filepath.Join(dir, "root.cer")
+	os.WriteFile(der, root, 0644)
+
+	// The bundle repeats the root; it should only be loaded once.
+	bundle := filepath.Join(dir, "chain.pem")
+	os.WriteFile(bundle, append(
+		pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: issuing}),
+		pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: root})...,
+	), 0644)
+
+	cas := mustLoad(t, der, bundle)
+	if len(cas) != 2 {
+		t.Fatalf("expected 2 CAs, got %d", len(cas))
+	}
+	if cas[0].Source != der || cas[1].Source != bundle {
+		t.Errorf("sources = %q, %q", cas[0].Source, cas[1].Source)
+	}
+	if !strings.HasPrefix(cas[0].Alias, "ezproxy-corp-root-ca-") {
+		t.Errorf("alias = %q", cas[0].Alias)
+	}
+	if !strings.HasPrefix(cas[1].Alias, "ezproxy-corp-issuing-ca-2-") {
+		t.Errorf("alias = %q", cas[1].Alias)
+	}
+	if len(cas[0].Alias) != len("ezproxy-corp-root-ca-")+8 {
+		t.Errorf("alias %q should end in 8 hex digits of the fingerprint", cas[0].Alias)
+	}
+	if string(EncodePEM(cas)) != string(cas[0].PEM())+string(cas[1].PEM()) {
+		t.Error("EncodePEM should concatenate the CAs in order")
+	}
+}
+
+func TestWriteIfChanged(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "ca-bundle.pem")
+
+	changed, err := WriteIfChanged(path, []byte("a"))
+	if err != nil || !changed {
+		t.Fatalf("first write: changed=%v err=%v", changed, err)
+	}
+	changed, err = WriteIfChanged(path, []byte("a"))
+	if err != nil || changed {
+		t.Errorf("same content: changed=%v err=%v", changed, err)
+	}
+	changed, err = WriteIfChanged(path, []byte("b"))
+	if err != nil || !changed {
+		t.Errorf("new content: changed=%v err=%v", changed, err)
+	}
+}
@@ -0,0 +1,147 @@
+package config
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/andrew/ezproxy/internal/redact"
+)
+
+// Answers are the values "ezproxy init" asks for, given up front so init
+// can run unattended (Dockerfiles, cloud-init, provisioning scripts). They
+// come from an answers file, EZPROXY_* environment variables and command
+// line flags, in increasing order of precedence. Empty fields are not set.
+type Answers struct {
+	HTTP    string   `yaml:"http"`
+	HTTPS   string   `yaml:"https"`
+	NoProxy string   `yaml:"no_proxy"`
+	PACURL  string   `yaml:"pac_url"`
+	CACert  string   `yaml:"ca_cert"`  // one path or a comma-separated list
+	CACerts []string `yaml:"ca_certs"` // more paths, as a YAML list
+	Tools   []string `yaml:"tools"`    // nil means the installed tools
+}
+
+// answersEnv maps each EZPROXY_* variable to the field it sets.
+var answersEnv = []struct {
+	name string
+	set  func(a *Answers, v string)
+}{
+	{"EZPROXY_HTTP", func(a *Answers, v string) { a.HTTP = v }},
+	{"EZPROXY_HTTPS", func(a *Answers, v string) { a.HTTPS = v }},
+	{"EZPROXY_NO_PROXY", func(a *Answers, v string) { a.NoProxy = v }},
+	{"EZPROXY_PAC_URL", func(a *Answers, v string) { a.PACURL = v }},
+	{"EZPROXY_CA_CERT", func(a *Answers, v string) { a.CACert = v }},
+	{"EZPROXY_TOOLS", func(a *Answers, v string) { a.Tools = SplitList(v) }},
+}
+
+// LoadAnswers reads an answers file. Unknown keys are an error, so a typo
+// doesn't silently fall back to a default.
+func LoadAnswers(path string) (Answers, error) {
+	var a Answers
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return a, err
+	}
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(&a); err != nil && !errors.Is(err, io.EOF) {
+		return a, fmt.Errorf("%s: %w", path, err)
+	}
+	return a, nil
+}
+
+// AnswersFromEnv returns the answers set through EZPROXY_* variables.
+func AnswersFromEnv(getenv func(string) string) Answers {
+	var a Answers
+	for _, e := range answersEnv {
+		if v := strings.TrimSpace(getenv(e.name)); v != "" {
+			e.set(&a, v)
+		}
+	}
+	return a
+}
+
+// Merge overrides a's fields with the ones set in b.
+func (a *Answers) Merge(b Answers) {
+	for _, f := range []struct{ dst, src *string }{
+		{&a.HTTP, &b.HTTP}, {&a.HTTPS, &b.HTTPS}, {&a.NoProxy, &b.NoProxy},
+		{&a.PACURL, &b.PACURL},
+	} {
+		if *f.src != "" {
+			*f.dst = *f.src
+		}
+	}
+	if b.CACert != "" || len(b.CACerts) > 0 {
+		a.CACert, a.CACerts = b.CACert, b.CACerts
+	}
+	if b.Tools != nil {
+		a.Tools = b.Tools
+	}
+}
+
+// IsZero reports whether no answer is set.
+func (a Answers) IsZero() bool {
+	return a.HTTP == "" && a.HTTPS == "" && a.NoProxy == "" && a.PACURL == "" &&
+		a.CACert == "" && len(a.CACerts) == 0 && a.Tools == nil
+}
+
+// CACertPaths returns ca_cert and ca_certs as one list.
+func (a Answers) CACertPaths() []string {
+	return append(SplitList(a.CACert), a.CACerts...)
+}
+
+// ValidateTools checks that every tool name is one ezproxy knows.
+func (a Answers) ValidateTools() error {
+	known := DefaultTools()
+	var unknown []string
+	for _, name := range a.Tools {
+		if _, ok := known[name]; !ok {
+			unknown = append(unknown, name)
+		}
+	}
+	if len(unknown) == 0 {
+		return nil
+	}
+	var names []string
+	for name := range known {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return fmt.Errorf("unknown tool(s) %s (known: %s)", strings.Join(unknown, ", "), strings.Join(names, ", "))
+}
+
+// ValidateProxyURL checks that s is a proxy URL such as
+// http://proxy.corp.com:8080.
+func ValidateProxyURL(s string) error {
+	if strings.TrimSpace(s) == "" {
+		return fmt.Errorf("proxy URL is required")
+	}
+	u, err := url.Parse(s)
+	if err != nil || u.Scheme == "" || u.Host == "" {
+		return fmt.Errorf("%q is not a proxy URL (e.g. http://proxy.corp.com:8080)", redact.URL(s))
+	}
+	switch u.Scheme {
+	case "http", "https", "socks4", "socks5", "socks5h":
+		return nil
+	}
+	return fmt.Errorf("%q: unsupported proxy scheme %q (use http, https or socks)", redact.URL(s), u.Scheme)
+}
+
+// SplitList splits a comma-separated list, dropping blanks.
+func SplitList(s string) []string {
+	var out []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			out = append(out, item)
+		}
+	}
+	return out
+}
@@ -0,0 +1,97 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLoadAnswers(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "answers.yaml")
+	os.WriteFile(path, []byte(`http: http://proxy.corp.com:8080
+no_proxy: localhost,.corp.com
+ca_cert: /etc/corp/root.pem
+ca_certs:
+  - /etc/corp/issuing.pem
+tools: [git, npm]
+`), 0644)
+
+	a, err := LoadAnswers(path)
+	if err != nil {
+		t.Fatalf("LoadAnswers: %v", err)
+	}
+	if a.HTTP != "http://proxy.corp.com:8080" || a.NoProxy != "localhost,.corp.com" {
+		t.Errorf("got %+v", a)
+	}
+	if got := a.CACertPaths(); len(got) != 2 || got[1] != "/etc/corp/issuing.pem" {
+		t.Errorf("CACertPaths = %v", got)
+	}
+	if len(a.Tools) != 2 || a.Tools[1] != "npm" {
+		t.Errorf("Tools = %v", a.Tools)
+	}
+}
+
+func TestLoadAnswers_UnknownKey(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "answers.yaml")
+	os.WriteFile(path, []byte("http_proxy: http://proxy:8080\n"), 0644)
+
+	if _, err := LoadAnswers(path); err == nil || !strings.Contains(err.Error(), "http_proxy") {
+		t.Errorf("expected an error naming the unknown key, got %v", err)
+	}
+}
+
+func TestAnswersPrecedence(t *testing.T) {
+	a := Answers{HTTP: "http://file:1", NoProxy: "localhost", Tools: []string{"git"}}
+	env := AnswersFromEnv(func(name string) string {
+		return map[string]string{
+			"EZPROXY_HTTP":  "http://env:2",
+			"EZPROXY_TOOLS": "pip, npm",
+		}[name]
+	})
+	a.Merge(env)
+	a.Merge(Answers{HTTP: "http://flag:3"})
+
+	if a.HTTP != "http://flag:3" {
+		t.Errorf("HTTP = %q, want the flag value", a.HTTP)
+	}
+	if a.NoProxy != "localhost" {
+		t.Errorf("NoProxy = %q, want the file value", a.NoProxy)
+	}
+	if len(a.Tools) != 2 || a.Tools[0] != "pip" {
+		t.Errorf("Tools = %v, want the env value", a.Tools)
+	}
+
+	// An explicitly empty tool list is kept.
+	a.Merge(Answers{Tools: []string{}})
+	if a.Tools == nil || len(a.Tools) != 0 {
+		t.Errorf("Tools = %v, want empty", a.Tools)
+	}
+	if (Answers{}).IsZero() != true || a.IsZero() {
+		t.Error("IsZero is wrong")
+	}
+}
+
+func TestAnswersValidateTools(t *testing.T) {
+	if err := (Answers{Tools: []string{"git", "env_vars"}}).ValidateTools(); err != nil {
+		t.Errorf("ValidateTools: %v", err)
+	}
+	if err := (Answers{Tools: []string{"git", "gti"}}).ValidateTools(); err == nil || !strings.Contains(err.Error(), "gti") {
+		t.Errorf("expected an error naming gti, got %v", err)
+	}
+}
+
+func TestValidateProxyURL(t *testing.T) {
+	for _, ok := range []string{"http://proxy:8080", "https://u:p@proxy.corp.com", "socks5://127.0.0.1:1080"} {
+		if err := ValidateProxyURL(ok); err != nil {
+			t.Errorf("ValidateProxyURL(%q): %v", ok, err)
+		}
+	}
+	for _, bad := range []string{"", "proxy:8080", "proxy.corp.com", "ftp://proxy:21"} {
+		if err := ValidateProxyURL(bad); err == nil {
+			t.Errorf("ValidateProxyURL(%q) succeeded", bad)
+		}
+	}
+}
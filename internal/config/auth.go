@@ -0,0 +1,80 @@
+package config
+
+import "net/url"
+
+// ProxyAuth is a user name and password for a proxy.
+type ProxyAuth struct {
+	Host     string // host:port they are for; "" for the upstream proxy
+	Username string
+	Password string
+}
+
+// AuthFor returns the credentials a tool should use with proxyURL, or nil.
+// They are only handed out for the proxy they belong to, so a tool with a
+// proxy of its own, a project file's proxy or the local relay (which adds
+// them itself) never receives them. A URL that already carries
+// credentials keeps its own.
+func (c *Config) AuthFor(proxyURL string) *ProxyAuth {
+	if c.Auth == nil || proxyURL == "" {
+		return nil
+	}
+	u, err := url.Parse(proxyURL)
+	if err != nil || u.Host == "" || u.User != nil {
+		return nil
+	}
+	if c.Auth.Host != "" {
+		if u.Host != c.Auth.Host {
+			return nil
+		}
+		return c.Auth
+	}
+	up := c.Upstream()
+	for _, s := range []string{up.HTTP, up.HTTPS} {
+		if v, err := url.Parse(s); err == nil && v.Host == u.Host {
+			return c.Auth
+		}
+	}
+	return nil
+}
+
+// WithAuth returns proxyURL with the credentials AuthFor gives it, for
+// tools that only take them inside the URL.
+func (c *Config) WithAuth(proxyURL string) string {
+	a := c.AuthFor(proxyURL)
+	if a == nil {
+		return proxyURL
+	}
+	u, _ := url.Parse(proxyURL)
+	u.User = url.UserPassword(a.Username, a.Password)
+	return u.String()
+}
+
+// StripAuth splits the user name and password off a proxy URL. user is
+// nil if it had none.
+func StripAuth(proxyURL string) (stripped string, user *url.Userinfo) {
+	u, err := url.Parse(proxyURL)
+	if err != nil || u.User == nil {
+		return proxyURL, nil
+	}
+	user, u.User = u.User, nil
+	return u.String(), user
+}
+
+// PasswordInURL reports whether config.yaml holds a password inside a
+// proxy URL, at the top level or for a tool, rather than in a credentials
+// store.
+func (c *Config) PasswordInURL() bool {
+	up := c.Upstream()
+	urls := []string{up.HTTP, up.HTTPS}
+	for _, t := range c.Tools {
+		urls = append(urls, t.HTTP, t.HTTPS)
+	}
+	for _, s := range urls {
+		if _, user := StripAuth(s); user != nil {
+			if _, ok := user.Password(); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
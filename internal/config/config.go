@@ -1,11 +1,15 @@
 package config
 
 import (
+	"fmt"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
 
 	"gopkg.in/yaml.v3"
+
+	"github.com/andrew/ezproxy/internal/fileutil"
 )
 
 type ProxyConfig struct {
@@ -14,12 +18,116 @@ type ProxyConfig struct {
 	NoProxy string `yaml:"no_proxy"`
 }
 
+// Profile is a named set of proxy settings (e.g. "office", "vpn") that can
+// be activated with "ezproxy switch <name>".
+type Profile struct {
+	Proxy   ProxyConfig           `yaml:"proxy"`
+	PACURL  string                `yaml:"pac_url,omitempty"`
+	CACert  string                `yaml:"ca_cert,omitempty"`
+	CACerts []string              `yaml:"ca_certs,omitempty"`
+	Tools   map[string]ToolConfig `yaml:"tools,omitempty"`
+}
+
+// Config is the on-disk ezproxy configuration. The top-level Proxy, CACert,
+// CACerts and Tools fields always hold the settings of the active profile,
+// so configurators never need to know about profiles.
+//
+// CACert is the original single-cert setting; CACerts lists any number of
+// PEM, DER or bundle files. Both may be set and are used together.
 type Config struct {
-	Proxy  ProxyConfig     `yaml:"proxy"`
-	CACert string          `yaml:"ca_cert"`
-	Tools  map[string]bool `yaml:"tools"`
+	Proxy         ProxyConfig           `yaml:"proxy"`
+	CACert        string                `yaml:"ca_cert"`
+	CACerts       []string              `yaml:"ca_certs,omitempty"`
+	Tools         map[string]ToolConfig `yaml:"tools"`
+	ActiveProfile string                `yaml:"active_profile,omitempty"`
+	Profiles      map[string]Profile    `yaml:"profiles,omitempty"`
+
+	Relay RelayConfig `yaml:"relay,omitempty"`
+
+	// PACURL is the PAC file (URL or local path) Proxy was derived from.
+	// "ezproxy doctor" checks the static settings against it.
+	PACURL string `yaml:"pac_url,omitempty"`
+
+	// ProbeHost is the host:port "ezproxy doctor" tunnels to through the
+	// proxy. Empty means the built-in default.
+	ProbeHost string `yaml:"probe_host,omitempty"`
+
+	// Bundle is the organisation bundle init was run from, if any.
+	Bundle *BundleSource `yaml:"bundle,omitempty"`
+
+	// Credentials names the store holding the proxy user name and
+	// password: "file" (~/.ezproxy/credentials.yaml) or "keyring". They
+	// are never written to config.yaml; Auth holds them at runtime.
+	Credentials string     `yaml:"credentials,omitempty"`
+	Auth        *ProxyAuth `yaml:"-"`
+
+	// CABundle is the combined bundle of system roots plus the corporate
+	// CAs, and CAFile holds the corporate CAs alone as PEM. ezproxy
+	// maintains both; they are set at runtime, not stored in config.yaml.
+	CABundle string `yaml:"-"`
+	CAFile   string `yaml:"-"`
+
+	// upstream holds the real proxy settings while Proxy points at the
+	// local relay (see UseRelay).
+	upstream *ProxyConfig
+
+	// layers is set by LoadLayers.
+	layers *layers
+}
+
+// BundleSource records where an organisation bundle came from, so
+// "ezproxy update" can fetch a newer one and check it against the same key.
+type BundleSource struct {
+	Name    string `yaml:"name,omitempty"`
+	URL     string `yaml:"url"`
+	Key     string `yaml:"key"`    // pinned Ed25519 public key, base64
+	Serial  int64  `yaml:"serial"` // serial of the bundle last applied
+	Profile string `yaml:"profile,omitempty"`
+}
+
+// DefaultRelayListen is where "ezproxy serve" listens unless relay.listen
+// says otherwise.
+const DefaultRelayListen = "127.0.0.1:3128"
+
+// RelayConfig configures the local relay run by "ezproxy serve".
+type RelayConfig struct {
+	Listen string `yaml:"listen,omitempty"`
+	// Enabled points every tool at the relay instead of the upstream proxy.
+	Enabled bool `yaml:"enabled,omitempty"`
+}
+
+// Addr returns the relay's listen address.
+func (r RelayConfig) Addr() string {
+	if r.Listen == "" {
+		return DefaultRelayListen
+	}
+	return r.Listen
+}
+
+// UseRelay points Proxy at the local relay for configurators. The upstream
+// settings are kept for the relay itself and are what Save writes.
+func (c *Config) UseRelay() {
+	if c.upstream != nil {
+		return
+	}
+	up := c.Proxy
+	c.upstream = &up
+	relayURL := "http://" + c.Relay.Addr()
+	c.Proxy.HTTP = relayURL
+	c.Proxy.HTTPS = relayURL
 }
 
+// Upstream returns the proxy settings of the upstream proxy, whether or not
+// Proxy currently points at the relay.
+func (c *Config) Upstream() ProxyConfig {
+	if c.upstream != nil {
+		return *c.upstream
+	}
+	return c.Proxy
+}
+
+// DefaultTools returns every tool ezproxy knows with whether init enables
+// it by default.
 func DefaultTools() map[string]bool {
 	return map[string]bool{
 		"env_vars":  true,
@@ -56,18 +164,32 @@ func Load(path string) (*Config, error) {
 	if err := yaml.Unmarshal(data, &cfg); err != nil {
 		return nil, err
 	}
+	if err := cfg.checkProfileNames(); err != nil {
+		return nil, err
+	}
 	return &cfg, nil
 }
 
 func Save(path string, cfg *Config) error {
+	if cfg.ActiveProfile != "" {
+		cfg.SaveProfile(cfg.ActiveProfile)
+	}
 	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
 		return err
 	}
-	data, err := yaml.Marshal(cfg)
+	var data []byte
+	var err error
+	if cfg.layers != nil && cfg.layers.user.Path == path {
+		data, err = cfg.layers.userFile(cfg)
+	} else {
+		out := *cfg
+		out.Proxy = cfg.Upstream()
+		data, err = yaml.Marshal(&out)
+	}
 	if err != nil {
 		return err
 	}
-	return os.WriteFile(path, data, 0644)
+	return fileutil.AtomicWrite(path, data, 0644)
 }
 
 func ExpandPath(path string) string {
@@ -81,6 +203,139 @@ func ExpandPath(path string) string {
 	return path
 }
 
+// CACertPaths returns the expanded paths of every configured CA file,
+// ca_cert first, without duplicates.
+func (c *Config) CACertPaths() []string {
+	var paths []string
+	seen := make(map[string]bool)
+	for _, p := range append([]string{c.CACert}, c.CACerts...) {
+		if p == "" {
+			continue
+		}
+		p = ExpandPath(p)
+		if !seen[p] {
+			seen[p] = true
+			paths = append(paths, p)
+		}
+	}
+	return paths
+}
+
+// HasCACerts reports whether any CA file is configured.
+func (c *Config) HasCACerts() bool {
+	return len(c.CACertPaths()) > 0
+}
+
+// CorporateCAPath returns a single PEM file holding the corporate CAs, for
+// tools that add to their trust store (e.g. NODE_EXTRA_CA_CERTS). Without
+// a generated CAFile it falls back to the first configured cert.
+func (c *Config) CorporateCAPath() string {
+	paths := c.CACertPaths()
+	if len(paths) == 0 {
+		return ""
+	}
+	if c.CAFile != "" {
+		return ExpandPath(c.CAFile)
+	}
+	return paths[0]
+}
+
+// TrustBundlePath returns the file to give tools whose CA setting replaces
+// their trust store instead of adding to it: the combined bundle when there
+// is one, otherwise the corporate CAs. Empty if no cert is set.
+func (c *Config) TrustBundlePath() string {
+	if !c.HasCACerts() {
+		return ""
+	}
+	if c.CABundle != "" {
+		return ExpandPath(c.CABundle)
+	}
+	return c.CorporateCAPath()
+}
+
 func (c *Config) CACertAbsPath() string {
 	return ExpandPath(c.CACert)
 }
+
+// SaveProfile stores the current top-level settings as the named profile,
+// replacing any existing profile with that name.
+func (c *Config) SaveProfile(name string) {
+	if c.Profiles == nil {
+		c.Profiles = make(map[string]Profile)
+	}
+	c.Profiles[name] = Profile{
+		Proxy:   c.Upstream(),
+		PACURL:  c.PACURL,
+		CACert:  c.CACert,
+		CACerts: append([]string(nil), c.CACerts...),
+		Tools:   cloneTools(c.Tools),
+	}
+}
+
+// UseProfile makes the named profile active by copying its settings into
+// the top-level fields. The previously active profile is saved first so
+// that edits made to it (e.g. via enable/disable) are not lost. A profile
+// without a tools section keeps the current tool selection.
+func (c *Config) UseProfile(name string) error {
+	if err := CheckProfileName(name); err != nil {
+		return err
+	}
+	p, ok := c.Profiles[name]
+	if !ok {
+		return fmt.Errorf("unknown profile %q", name)
+	}
+	if c.ActiveProfile != "" && c.ActiveProfile != name {
+		c.SaveProfile(c.ActiveProfile)
+	}
+	c.Proxy = p.Proxy
+	if c.upstream != nil {
+		c.upstream = nil
+		c.UseRelay()
+	}
+	c.PACURL = p.PACURL
+	c.CACert = p.CACert
+	c.CACerts = append([]string(nil), p.CACerts...)
+	if p.Tools != nil {
+		c.Tools = cloneTools(p.Tools)
+	}
+	c.ActiveProfile = name
+	return nil
+}
+
+// CheckProfileName returns an error if name can't be used for a profile.
+// Names become part of file names in ~/.ezproxy (corp-ca-<name>.pem), so
+// they must not be empty or contain a path separator or "..".
+func CheckProfileName(name string) error {
+	if name == "" || strings.ContainsAny(name, `/\`) || strings.Contains(name, "..") {
+		return fmt.Errorf("invalid profile name %q: it must not be empty or contain /, \\ or ..", name)
+	}
+	return nil
+}
+
+// checkProfileNames checks the names of the profiles in c, the active one
+// and the one a bundle was set up in.
+func (c *Config) checkProfileNames() error {
+	names := c.ProfileNames()
+	if c.ActiveProfile != "" {
+		names = append(names, c.ActiveProfile)
+	}
+	if c.Bundle != nil && c.Bundle.Profile != "" {
+		names = append(names, c.Bundle.Profile)
+	}
+	for _, name := range names {
+		if err := CheckProfileName(name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ProfileNames returns the configured profile names in sorted order.
+func (c *Config) ProfileNames() []string {
+	names := make([]string, 0, len(c.Profiles))
+	for name := range c.Profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
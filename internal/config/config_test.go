@@ -37,13 +37,13 @@ tools:
 	if cfg.CACert != "/path/to/cert.pem" {
 		t.Errorf("got CACert %q", cfg.CACert)
 	}
-	if !cfg.Tools["env_vars"] {
+	if !cfg.Tools["env_vars"].Enabled {
 		t.Error("expected env_vars=true")
 	}
-	if !cfg.Tools["git"] {
+	if !cfg.Tools["git"].Enabled {
 		t.Error("expected git=true")
 	}
-	if cfg.Tools["pip"] {
+	if cfg.Tools["pip"].Enabled {
 		t.Error("expected pip=false")
 	}
 }
@@ -59,7 +59,7 @@ func TestSaveConfig(t *testing.T) {
 			NoProxy: "localhost",
 		},
 		CACert: "/tmp/ca.pem",
-		Tools:  map[string]bool{"git": true, "pip": false},
+		Tools:  ToolsEnabled(map[string]bool{"git": true, "pip": false}),
 	}
 
 	err := Save(configPath, cfg)
@@ -89,3 +89,182 @@ func TestExpandHome(t *testing.T) {
 		t.Errorf("ExpandPath absolute: got %q", result2)
 	}
 }
+
+func TestUseProfile(t *testing.T) {
+	cfg := &Config{
+		Proxy:         ProxyConfig{HTTP: "http://office:8080", HTTPS: "http://office:8080"},
+		CACert:        "~/.ezproxy/corp-ca-office.pem",
+		Tools:         ToolsEnabled(map[string]bool{"git": true, "docker": true}),
+		ActiveProfile: "office",
+		Profiles: map[string]Profile{
+			"home": {
+				Proxy: ProxyConfig{HTTP: "http://vpn:3128", HTTPS: "http://vpn:3128", NoProxy: "localhost"},
+				Tools: ToolsEnabled(map[string]bool{"git": true, "docker": false}),
+			},
+		},
+	}
+
+	if err := cfg.UseProfile("home"); err != nil {
+		t.Fatalf("UseProfile: %v", err)
+	}
+	if cfg.ActiveProfile != "home" {
+		t.Errorf("ActiveProfile = %q", cfg.ActiveProfile)
+	}
+	if cfg.Proxy.HTTP != "http://vpn:3128" {
+		t.Errorf("Proxy.HTTP = %q", cfg.Proxy.HTTP)
+	}
+	if cfg.CACert != "" {
+		t.Errorf("CACert = %q, want empty", cfg.CACert)
+	}
+	if cfg.Tools["docker"].Enabled {
+		t.Error("docker should be disabled in home profile")
+	}
+
+	// The previously active profile is preserved so we can switch back.
+	office, ok := cfg.Profiles["office"]
+	if !ok {
+		t.Fatal("office profile should have been saved")
+	}
+	if office.Proxy.HTTP != "http://office:8080" || !office.Tools["docker"].Enabled {
+		t.Errorf("office profile not saved correctly: %+v", office)
+	}
+
+	if err := cfg.UseProfile("missing"); err == nil {
+		t.Error("expected error for unknown profile")
+	}
+}
+
+func TestSaveSyncsActiveProfile(t *testing.T) {
+	dir := t.TempDir()
+	configPath := filepath.Join(dir, "config.yaml")
+
+	cfg := &Config{
+		Proxy:         ProxyConfig{HTTP: "http://office:8080"},
+		Tools:         ToolsEnabled(map[string]bool{"git": true}),
+		ActiveProfile: "office",
+	}
+	cfg.SetToolEnabled("git", false)
+	if err := Save(configPath, cfg); err != nil {
+		t.Fatalf("Save failed: %v", err)
+	}
+
+	loaded, err := Load(configPath)
+	if err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	if loaded.ActiveProfile != "office" {
+		t.Errorf("ActiveProfile = %q", loaded.ActiveProfile)
+	}
+	if loaded.Profiles["office"].Tools["git"].Enabled {
+		t.Error("edits to the active profile should be saved into profiles")
+	}
+	if names := loaded.ProfileNames(); len(names) != 1 || names[0] != "office" {
+		t.Errorf("ProfileNames = %v", names)
+	}
+}
+
+func TestCACertPaths(t *testing.T) {
+	home, _ := os.UserHomeDir()
+	cfg := &Config{
+		CACert:  "~/.ezproxy/corp-ca.pem",
+		CACerts: []string{"/etc/corp/issuing.cer", "~/.ezproxy/corp-ca.pem"},
+	}
+
+	paths := cfg.CACertPaths()
+	want := []string{filepath.Join(home, ".ezproxy/corp-ca.pem"), "/etc/corp/issuing.cer"}
+	if len(paths) != len(want) || paths[0] != want[0] || paths[1] != want[1] {
+		t.Errorf("CACertPaths = %q, want %q", paths, want)
+	}
+	if cfg.CorporateCAPath() != want[0] {
+		t.Errorf("CorporateCAPath without CAFile = %q", cfg.CorporateCAPath())
+	}
+
+	cfg.CAFile = "/tmp/corp-cas.pem"
+	cfg.CABundle = "/tmp/ca-bundle.pem"
+	if cfg.CorporateCAPath() != "/tmp/corp-cas.pem" {
+		t.Errorf("CorporateCAPath = %q", cfg.CorporateCAPath())
+	}
+	if cfg.TrustBundlePath() != "/tmp/ca-bundle.pem" {
+		t.Errorf("TrustBundlePath = %q", cfg.TrustBundlePath())
+	}
+
+	// The generated files mean nothing once no cert is configured.
+	empty := &Config{CAFile: "/tmp/corp-cas.pem", CABundle: "/tmp/ca-bundle.pem"}
+	if empty.HasCACerts() || empty.CorporateCAPath() != "" || empty.TrustBundlePath() != "" {
+		t.Error("config without certs should have no CA paths")
+	}
+}
+
+func TestUseProfileCopiesCACerts(t *testing.T) {
+	cfg := &Config{
+		CACerts:       []string{"/a.pem", "/b.pem"},
+		ActiveProfile: "office",
+		Profiles:      map[string]Profile{"home": {}},
+	}
+	if err := cfg.UseProfile("home"); err != nil {
+		t.Fatalf("UseProfile: %v", err)
+	}
+	if len(cfg.CACerts) != 0 {
+		t.Errorf("CACerts = %q, want none in home profile", cfg.CACerts)
+	}
+	if err := cfg.UseProfile("office"); err != nil {
+		t.Fatalf("UseProfile: %v", err)
+	}
+	if len(cfg.CACerts) != 2 || cfg.CACerts[1] != "/b.pem" {
+		t.Errorf("CACerts = %q after switching back", cfg.CACerts)
+	}
+}
+
+func TestUseRelay_SaveKeepsUpstream(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	cfg := &Config{
+		Proxy: ProxyConfig{HTTP: "http://proxy:8080", HTTPS: "http://proxy:8443", NoProxy: "localhost"},
+		Relay: RelayConfig{Enabled: true},
+	}
+	cfg.UseRelay()
+
+	if cfg.Proxy.HTTP != "http://127.0.0.1:3128" || cfg.Proxy.HTTPS != "http://127.0.0.1:3128" {
+		t.Errorf("Proxy = %+v, want the relay", cfg.Proxy)
+	}
+	if cfg.Proxy.NoProxy != "localhost" {
+		t.Errorf("NoProxy = %q, want it unchanged", cfg.Proxy.NoProxy)
+	}
+	if up := cfg.Upstream(); up.HTTPS != "http://proxy:8443" {
+		t.Errorf("Upstream = %+v", up)
+	}
+
+	if err := Save(path, cfg); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded.Proxy.HTTP != "http://proxy:8080" || !loaded.Relay.Enabled {
+		t.Errorf("saved config = %+v, want upstream proxy and relay enabled", loaded)
+	}
+}
+
+func TestCheckProfileName(t *testing.T) {
+	for _, name := range []string{"office", "home-vpn", "a.b"} {
+		if err := CheckProfileName(name); err != nil {
+			t.Errorf("%q: %v", name, err)
+		}
+	}
+	for _, name := range []string{"", "../../x", "a/b", `a\b`, "..", "x..y"} {
+		if err := CheckProfileName(name); err == nil {
+			t.Errorf("%q accepted", name)
+		}
+	}
+}
+
+func TestLoadRejectsBadProfileName(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	os.WriteFile(path, []byte("active_profile: ../x\n"), 0644)
+	if _, err := Load(path); err == nil {
+		t.Error("Load accepted a profile name with a path in it")
+	}
+	if _, err := LoadLayers(path, ""); err == nil {
+		t.Error("LoadLayers accepted a profile name with a path in it")
+	}
+}
@@ -0,0 +1,544 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// SystemPath is the config managed by IT, the lowest layer.
+var SystemPath = "/etc/ezproxy/config.yaml"
+
+// ProjectFile is the per-project override, found by walking up from the
+// current directory.
+const ProjectFile = ".ezproxy.yaml"
+
+// Layer names, lowest precedence first.
+const (
+	LayerSystem  = "system"
+	LayerUser    = "user"
+	LayerProject = "project"
+)
+
+// projectForbidden lists settings a project file may not set. It arrives
+// with whatever repository you cd into, so it must not be able to add
+// trusted CAs, change where bundles come from, touch profiles or pick
+// where credentials are read from. A tool's own ca_cert is refused as
+// well.
+var projectForbidden = []string{"ca_cert", "ca_certs", "bundle", "profiles", "active_profile", "credentials"}
+
+// sep joins the parts of a flattened key. Profile names may contain dots,
+// so a dot can't be used.
+const sep = "\x00"
+
+// Layer is one config file in the stack.
+type Layer struct {
+	Name   string // system, user or project
+	Path   string
+	Exists bool
+
+	data map[string]any // flattened
+}
+
+// Origin is one effective setting and the layers it came from; more than
+// one for a NO_PROXY extended with no_proxy_add.
+type Origin struct {
+	Key    string // dotted, e.g. "proxy.no_proxy" or "tools.git"
+	Value  any
+	Layers []string
+}
+
+// layers is the stack a Config was loaded from. Save writes back only the
+// user layer, and only the settings the command changed.
+type layers struct {
+	stack   []*Layer
+	user    *Layer
+	loaded  map[string]any // effective settings at load, flattened
+	saved   map[string]any // the same without the project layer
+	origins map[string][]string
+}
+
+// LoadLayers reads the system config, the user config at userPath and the
+// nearest .ezproxy.yaml at or above dir (none if dir is ""), and merges
+// them: each setting comes from the highest layer that sets it, except
+// no_proxy_add, which appends to the NO_PROXY of the layers below. Maps
+// (tools, profiles) merge key by key. Missing files are skipped; if none
+// exists the error is the user config's.
+func LoadLayers(userPath, dir string) (*Config, error) {
+	l := &layers{}
+	paths := []struct{ name, path string }{{LayerSystem, SystemPath}, {LayerUser, userPath}}
+	if dir != "" {
+		if p := FindProjectFile(dir); p != "" && p != userPath {
+			paths = append(paths, struct{ name, path string }{LayerProject, p})
+		}
+	}
+	var userErr error
+	for _, p := range paths {
+		layer, err := readLayer(p.name, p.path)
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return nil, err
+		}
+		if p.name == LayerUser {
+			l.user, userErr = layer, err
+		}
+		if layer.Exists {
+			l.stack = append(l.stack, layer)
+		}
+	}
+	if len(l.stack) == 0 {
+		return nil, userErr
+	}
+
+	merged, origins := merge(l.stack)
+	cfg, err := decode(merged)
+	if err != nil {
+		return nil, err
+	}
+	if err := cfg.checkProfileNames(); err != nil {
+		return nil, err
+	}
+	l.origins = origins
+	if l.loaded, err = flattenConfig(cfg); err != nil {
+		return nil, err
+	}
+	l.saved = l.loaded
+	if below := l.below(LayerProject); len(below) < len(l.stack) {
+		merged, _ := merge(below)
+		base, err := decode(merged)
+		if err != nil {
+			return nil, err
+		}
+		if l.saved, err = flattenConfig(base); err != nil {
+			return nil, err
+		}
+	}
+	cfg.layers = l
+	return cfg, nil
+}
+
+// FindProjectFile returns the nearest ProjectFile at or above dir, or "".
+func FindProjectFile(dir string) string {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return ""
+	}
+	for {
+		p := filepath.Join(dir, ProjectFile)
+		if info, err := os.Stat(p); err == nil && info.Mode().IsRegular() {
+			return p
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return ""
+		}
+		dir = parent
+	}
+}
+
+func readLayer(name, path string) (*Layer, error) {
+	layer := &Layer{Name: name, Path: path, data: map[string]any{}}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return layer, err
+	}
+	layer.Exists = true
+	var m map[string]any
+	if err := yaml.Unmarshal(data, &m); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	flatten(m, "", layer.data)
+	if name == LayerProject {
+		for _, key := range projectForbidden {
+			if _, ok := m[key]; ok {
+				return nil, fmt.Errorf("%s: %s can't be set in a project file", path, key)
+			}
+		}
+		for k := range layer.data {
+			if parts := strings.Split(k, sep); parts[0] == "tools" && parts[len(parts)-1] == "ca_cert" {
+				return nil, fmt.Errorf("%s: %s can't be set in a project file", path, strings.Join(parts, "."))
+			}
+		}
+	}
+	return layer, nil
+}
+
+// InheritLayers makes c save into the layers from was loaded from, as if
+// c had been loaded with it. init uses it for the config it builds.
+func (c *Config) InheritLayers(from *Config) {
+	if from != nil {
+		c.layers = from.layers
+	}
+}
+
+// Layers returns the config files c was merged from, lowest first,
+// including the user config even if it doesn't exist yet. Nil for a
+// config read with Load.
+func (c *Config) Layers() []Layer {
+	if c.layers == nil {
+		return nil
+	}
+	var out []Layer
+	for _, l := range c.layers.stack {
+		out = append(out, *l)
+	}
+	if !c.layers.user.Exists {
+		out = append(out, *c.layers.user)
+	}
+	return out
+}
+
+// Origins returns every effective setting as loaded, sorted by key, with
+// the layers it came from.
+func (c *Config) Origins() []Origin {
+	if c.layers == nil {
+		return nil
+	}
+	var out []Origin
+	for _, k := range sortedKeys(c.layers.loaded) {
+		out = append(out, Origin{
+			Key:    strings.ReplaceAll(k, sep, "."),
+			Value:  c.layers.loaded[k],
+			Layers: c.layers.origins[k],
+		})
+	}
+	return out
+}
+
+// userFile returns the new contents of the user config for cfg: the user
+// layer with every setting the command changed since load. A changed
+// setting that now matches the system layer is dropped, so it follows IT's
+// value again, and a NO_PROXY that only adds to the system one is written
+// as no_proxy_add. Values from a project file stay out of it.
+func (l *layers) userFile(cfg *Config) ([]byte, error) {
+	now, err := l.withoutProject(cfg)
+	if err != nil {
+		return nil, err
+	}
+	base, _ := merge(l.below(LayerUser))
+
+	user := make(map[string]any, len(l.user.data))
+	for k, v := range l.user.data {
+		user[k] = v
+	}
+	keys := make(map[string]bool)
+	for k := range now {
+		keys[k] = true
+	}
+	for k := range l.saved {
+		keys[k] = true
+	}
+	for k := range keys {
+		v, inNow := now[k]
+		if old, ok := l.saved[k]; ok && inNow && reflect.DeepEqual(v, old) {
+			continue
+		}
+		if !inNow {
+			delete(user, k)
+			continue
+		}
+		b, inBase := base[k]
+		if isNoProxy(k) {
+			delete(user, k+"_add")
+			if bs, ok := b.(string); ok && inBase {
+				if extras, ok := addedEntries(bs, fmt.Sprint(v)); ok {
+					delete(user, k)
+					if len(extras) > 0 {
+						user[k+"_add"] = extras
+					}
+					continue
+				}
+			}
+		} else if inBase && reflect.DeepEqual(v, b) {
+			delete(user, k)
+			continue
+		}
+		user[k] = v
+	}
+
+	out := unflatten(user)
+	compactTools(out)
+	data, err := yaml.Marshal(out)
+	if err != nil {
+		return nil, err
+	}
+	if l.loaded, err = flattenConfig(cfg); err != nil {
+		return nil, err
+	}
+	l.user.data, l.user.Exists, l.saved = user, true, now
+	return data, nil
+}
+
+// withoutProject returns cfg's settings flattened, with the ones still
+// as a project file set them put back to the value of the layers below,
+// also in the copy Save makes for the active profile.
+func (l *layers) withoutProject(cfg *Config) (map[string]any, error) {
+	now, err := flattenConfig(cfg)
+	if err != nil || len(l.below(LayerProject)) == len(l.stack) {
+		return now, err
+	}
+	for k, origins := range l.origins {
+		if !contains(origins, LayerProject) || !reflect.DeepEqual(now[k], l.loaded[k]) {
+			continue
+		}
+		if v, ok := l.saved[k]; ok {
+			now[k] = v
+		} else {
+			delete(now, k)
+		}
+	}
+	c, err := decode(now)
+	if err != nil {
+		return nil, err
+	}
+	if c.ActiveProfile != "" {
+		c.SaveProfile(c.ActiveProfile)
+	}
+	return flattenConfig(c)
+}
+
+// below returns the layers under the named one.
+func (l *layers) below(name string) []*Layer {
+	rank := map[string]int{LayerSystem: 0, LayerUser: 1, LayerProject: 2}
+	var out []*Layer
+	for _, layer := range l.stack {
+		if rank[layer.Name] < rank[name] {
+			out = append(out, layer)
+		}
+	}
+	return out
+}
+
+func contains(list []string, s string) bool {
+	for _, e := range list {
+		if e == s {
+			return true
+		}
+	}
+	return false
+}
+
+// merge combines flattened layers, lowest first, and records which layers
+// each setting came from.
+func merge(stack []*Layer) (map[string]any, map[string][]string) {
+	merged := make(map[string]any)
+	origins := make(map[string][]string)
+	for _, layer := range stack {
+		// Sorted, so a layer's no_proxy is set before its no_proxy_add.
+		for _, k := range sortedKeys(layer.data) {
+			v := layer.data[k]
+			if target, ok := strings.CutSuffix(k, "_add"); ok && isNoProxy(target) {
+				merged[target] = strings.Join(appendEntries(merged[target], v), ",")
+				origins[target] = append(origins[target], layer.Name)
+				continue
+			}
+			merged[k] = v
+			origins[k] = []string{layer.Name}
+		}
+	}
+	return merged, origins
+}
+
+// isNoProxy reports whether a flattened key is a proxy's no_proxy, at the
+// top level or in a profile.
+func isNoProxy(k string) bool {
+	return k == "proxy"+sep+"no_proxy" || strings.HasSuffix(k, sep+"proxy"+sep+"no_proxy")
+}
+
+// appendEntries adds the entries in add (a comma-separated string or a
+// list) to the NO_PROXY value cur, skipping ones already there.
+func appendEntries(cur, add any) []string {
+	var entries []string
+	if s, ok := cur.(string); ok {
+		entries = SplitList(s)
+	}
+	var adds []string
+	switch a := add.(type) {
+	case string:
+		adds = SplitList(a)
+	case []any:
+		for _, e := range a {
+			adds = append(adds, SplitList(fmt.Sprint(e))...)
+		}
+	}
+	for _, e := range adds {
+		if !containsFold(entries, e) {
+			entries = append(entries, e)
+		}
+	}
+	return entries
+}
+
+// addedEntries returns the entries of value not in base, if value keeps
+// every entry of base.
+func addedEntries(base, value string) ([]any, bool) {
+	entries := SplitList(value)
+	for _, e := range SplitList(base) {
+		if !containsFold(entries, e) {
+			return nil, false
+		}
+	}
+	var extras []any
+	for _, e := range entries {
+		if !containsFold(SplitList(base), e) {
+			extras = append(extras, e)
+		}
+	}
+	return extras, true
+}
+
+func containsFold(list []string, s string) bool {
+	for _, e := range list {
+		if strings.EqualFold(e, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// flatten turns nested mappings into keys joined by sep. Lists and
+// scalars are leaves; nulls and empty mappings are dropped. Tool entries
+// are expanded to their mapping form first, so that a layer setting
+// "git: false" and one giving git a proxy merge like any other mapping.
+func flatten(m map[string]any, prefix string, out map[string]any) {
+	for k, v := range m {
+		key := prefix + k
+		if isToolKey(key) {
+			v = expandTool(v)
+		}
+		switch v := v.(type) {
+		case map[string]any:
+			flatten(v, key+sep, out)
+		case nil:
+		default:
+			out[key] = v
+		}
+	}
+}
+
+// isToolKey reports whether a flattened key is a tool's entry, at the top
+// level or in a profile.
+func isToolKey(k string) bool {
+	parts := strings.Split(k, sep)
+	return len(parts) == 2 && parts[0] == "tools" ||
+		len(parts) == 4 && parts[0] == "profiles" && parts[2] == "tools"
+}
+
+// expandTool returns a tool entry as a mapping with enabled set: true or
+// false becomes enabled, direct becomes enabled and direct. Anything else
+// is left for decoding to reject.
+func expandTool(v any) any {
+	switch v := v.(type) {
+	case bool:
+		return map[string]any{"enabled": v}
+	case string:
+		if v == direct {
+			return map[string]any{"enabled": true, "direct": true}
+		}
+	case map[string]any:
+		out := map[string]any{"enabled": true}
+		for k, e := range v {
+			out[k] = e
+		}
+		return out
+	}
+	return v
+}
+
+// compactTools turns tool mappings in an unflattened config back into the
+// short forms where they fit, for writing.
+func compactTools(m map[string]any) {
+	var all []map[string]any
+	if tools, ok := m["tools"].(map[string]any); ok {
+		all = append(all, tools)
+	}
+	profiles, _ := m["profiles"].(map[string]any)
+	for _, p := range profiles {
+		if p, ok := p.(map[string]any); ok {
+			if tools, ok := p["tools"].(map[string]any); ok {
+				all = append(all, tools)
+			}
+		}
+	}
+	for _, tools := range all {
+		for name, t := range tools {
+			t, ok := t.(map[string]any)
+			if !ok {
+				continue
+			}
+			switch enabled, hasEnabled := t["enabled"]; {
+			case len(t) == 1 && hasEnabled:
+				tools[name] = enabled
+			case len(t) == 2 && enabled == true && t["direct"] == true:
+				tools[name] = direct
+			case enabled == true:
+				delete(t, "enabled") // implied by the mapping
+			}
+		}
+	}
+}
+
+func unflatten(flat map[string]any) map[string]any {
+	out := make(map[string]any)
+	for k, v := range flat {
+		parts := strings.Split(k, sep)
+		m := out
+		for _, p := range parts[:len(parts)-1] {
+			next, ok := m[p].(map[string]any)
+			if !ok {
+				next = make(map[string]any)
+				m[p] = next
+			}
+			m = next
+		}
+		m[parts[len(parts)-1]] = v
+	}
+	return out
+}
+
+// decode turns merged settings into a Config.
+func decode(flat map[string]any) (*Config, error) {
+	data, err := yaml.Marshal(unflatten(flat))
+	if err != nil {
+		return nil, err
+	}
+	var cfg Config
+	if err := yaml.Unmarshal(data, &cfg); err != nil {
+		return nil, err
+	}
+	return &cfg, nil
+}
+
+// flattenConfig returns cfg's settings as written to config.yaml,
+// flattened. Values go through YAML so they compare equal to ones read
+// from a file.
+func flattenConfig(cfg *Config) (map[string]any, error) {
+	out := *cfg
+	out.Proxy = cfg.Upstream()
+	data, err := yaml.Marshal(&out)
+	if err != nil {
+		return nil, err
+	}
+	var m map[string]any
+	if err := yaml.Unmarshal(data, &m); err != nil {
+		return nil, err
+	}
+	flat := make(map[string]any)
+	flatten(m, "", flat)
+	return flat, nil
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
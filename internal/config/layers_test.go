@@ -0,0 +1,270 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// layerFiles sets up a system config, a user config and a project
+// directory with a .ezproxy.yaml. Empty contents leave a file out.
+func layerFiles(t *testing.T, system, user, project string) (userPath, projectDir string) {
+	t.Helper()
+	dir := t.TempDir()
+	old := SystemPath
+	SystemPath = filepath.Join(dir, "etc", "config.yaml")
+	t.Cleanup(func() { SystemPath = old })
+
+	userPath = filepath.Join(dir, "home", ".ezproxy", "config.yaml")
+	projectDir = filepath.Join(dir, "src", "repo", "sub")
+	for path, content := range map[string]string{
+		SystemPath: system,
+		userPath:   user,
+		filepath.Join(dir, "src", "repo", ProjectFile): project,
+	} {
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if content != "" {
+			if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err := os.MkdirAll(projectDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	return userPath, projectDir
+}
+
+const systemLayer = `proxy:
+  http: http://proxy.corp.com:8080
+  https: http://proxy.corp.com:8080
+  no_proxy: localhost,.corp.com
+ca_cert: /etc/pki/corp.pem
+tools:
+  git: true
+  npm: true
+`
+
+func mustLoadLayers(t *testing.T, userPath, dir string) *Config {
+	t.Helper()
+	cfg, err := LoadLayers(userPath, dir)
+	if err != nil {
+		t.Fatalf("LoadLayers: %v", err)
+	}
+	return cfg
+}
+
+func origin(cfg *Config, key string) string {
+	for _, o := range cfg.Origins() {
+		if o.Key == key {
+			return strings.Join(o.Layers, "+")
+		}
+	}
+	return ""
+}
+
+func TestLoadLayers_Precedence(t *testing.T) {
+	userPath, projectDir := layerFiles(t, systemLayer,
+		"proxy:\n  no_proxy_add: [.myteam.corp.com]\ntools:\n  npm: false\n  pip: true\n",
+		"proxy:\n  http: http://build-proxy:3128\n")
+
+	cfg := mustLoadLayers(t, userPath, projectDir)
+	if cfg.Proxy.HTTP != "http://build-proxy:3128" || cfg.Proxy.HTTPS != "http://proxy.corp.com:8080" {
+		t.Errorf("proxy = %+v", cfg.Proxy)
+	}
+	if cfg.Proxy.NoProxy != "localhost,.corp.com,.myteam.corp.com" {
+		t.Errorf("no_proxy = %q", cfg.Proxy.NoProxy)
+	}
+	if !cfg.Tools["git"].Enabled || cfg.Tools["npm"].Enabled || !cfg.Tools["pip"].Enabled {
+		t.Errorf("tools = %v", cfg.Tools)
+	}
+	if cfg.CACert != "/etc/pki/corp.pem" {
+		t.Errorf("ca_cert = %q", cfg.CACert)
+	}
+
+	for key, want := range map[string]string{
+		"proxy.http":        LayerProject,
+		"proxy.https":       LayerSystem,
+		"proxy.no_proxy":    LayerSystem + "+" + LayerUser,
+		"tools.npm.enabled": LayerUser,
+		"tools.git.enabled": LayerSystem,
+	} {
+		if got := origin(cfg, key); got != want {
+			t.Errorf("origin of %s = %q, want %q", key, got, want)
+		}
+	}
+
+	// Outside the project the user's settings apply.
+	cfg = mustLoadLayers(t, userPath, filepath.Dir(filepath.Dir(projectDir)))
+	if cfg.Proxy.HTTP != "http://proxy.corp.com:8080" {
+		t.Errorf("outside project: http = %q", cfg.Proxy.HTTP)
+	}
+}
+
+func TestLoadLayers_NoFiles(t *testing.T) {
+	userPath, _ := layerFiles(t, "", "", "")
+	if _, err := LoadLayers(userPath, ""); !os.IsNotExist(err) {
+		t.Errorf("err = %v, want not exist", err)
+	}
+}
+
+func TestLoadLayers_SystemOnly(t *testing.T) {
+	userPath, _ := layerFiles(t, systemLayer, "", "")
+	cfg := mustLoadLayers(t, userPath, "")
+	if cfg.Proxy.HTTP != "http://proxy.corp.com:8080" {
+		t.Errorf("http = %q", cfg.Proxy.HTTP)
+	}
+	layers := cfg.Layers()
+	if len(layers) != 2 || layers[1].Name != LayerUser || layers[1].Exists {
+		t.Errorf("layers = %+v", layers)
+	}
+}
+
+func TestLoadLayers_ProjectCannotAddCA(t *testing.T) {
+	userPath, projectDir := layerFiles(t, "", "tools:\n  git: true\n", "ca_cert: /tmp/evil.pem\n")
+	if _, err := LoadLayers(userPath, projectDir); err == nil || !strings.Contains(err.Error(), "ca_cert") {
+		t.Errorf("err = %v", err)
+	}
+}
+
+func TestSaveLayers_WritesOnlyUserChanges(t *testing.T) {
+	user := "# my settings\nproxy:\n  no_proxy_add: .myteam.corp.com\ntools:\n  npm: false\n"
+	userPath, projectDir := layerFiles(t, systemLayer, user, "proxy:\n  http: http://build-proxy:3128\n")
+
+	cfg := mustLoadLayers(t, userPath, projectDir)
+	cfg.SetToolEnabled("pip", true)
+	if err := Save(userPath, cfg); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+
+	data, _ := os.ReadFile(userPath)
+	got := string(data)
+	for _, unwanted := range []string{"build-proxy", "proxy.corp.com", "/etc/pki", "git:"} {
+		if strings.Contains(got, unwanted) {
+			t.Errorf("user config has %q from another layer:\n%s", unwanted, got)
+		}
+	}
+	for _, wanted := range []string{"no_proxy_add: .myteam.corp.com", "npm: false", "pip: true"} {
+		if !strings.Contains(got, wanted) {
+			t.Errorf("user config lacks %q:\n%s", wanted, got)
+		}
+	}
+}
+
+func TestSaveLayers_NoProxyAsAdditions(t *testing.T) {
+	userPath, _ := layerFiles(t, systemLayer, "", "")
+	existing := mustLoadLayers(t, userPath, "")
+
+	// As init does: a fresh config inheriting the layers.
+	cfg := &Config{
+		Proxy:  ProxyConfig{HTTP: "http://proxy.corp.com:8080", HTTPS: "http://proxy.corp.com:8080", NoProxy: "localhost,.corp.com,.lab.corp.com"},
+		CACert: "/etc/pki/corp.pem",
+		Tools:  ToolsEnabled(map[string]bool{"git": true, "npm": true, "pip": true}),
+	}
+	cfg.InheritLayers(existing)
+	if err := Save(userPath, cfg); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+	data, _ := os.ReadFile(userPath)
+	got := string(data)
+	if !strings.Contains(got, "no_proxy_add:\n        - .lab.corp.com") || strings.Contains(got, "http:") || strings.Contains(got, "ca_cert") {
+		t.Errorf("user config:\n%s", got)
+	}
+
+	// IT's later changes still reach the user.
+	os.WriteFile(SystemPath, []byte(strings.Replace(systemLayer, "localhost,.corp.com", "localhost,.corp.com,.new.corp.com", 1)), 0644)
+	cfg = mustLoadLayers(t, userPath, "")
+	if cfg.Proxy.NoProxy != "localhost,.corp.com,.new.corp.com,.lab.corp.com" || !cfg.Tools["pip"].Enabled {
+		t.Errorf("after system change: %q, %v", cfg.Proxy.NoProxy, cfg.Tools)
+	}
+}
+
+func TestSaveLayers_ChangeMatchingSystemFollowsIT(t *testing.T) {
+	userPath, _ := layerFiles(t, systemLayer, "proxy:\n  http: http://other:3128\n", "")
+	cfg := mustLoadLayers(t, userPath, "")
+	cfg.Proxy.HTTP = "http://proxy.corp.com:8080"
+	if err := Save(userPath, cfg); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+	data, _ := os.ReadFile(userPath)
+	if strings.Contains(string(data), "http:") {
+		t.Errorf("user config still pins http:\n%s", data)
+	}
+}
+
+func TestLoadLayers_ToolForms(t *testing.T) {
+	userPath, projectDir := layerFiles(t, systemLayer+"  maven: direct\n  pip: direct\n",
+		"tools:\n  git:\n    http: http://git-proxy:3128\n  pip: false\n",
+		"tools:\n  npm:\n    http: http://build-proxy:3128\n")
+
+	cfg := mustLoadLayers(t, userPath, projectDir)
+	for name, want := range map[string]ToolConfig{
+		"git":   {Enabled: true, HTTP: "http://git-proxy:3128"},
+		"maven": {Enabled: true, Direct: true},
+		"pip":   {Direct: true}, // user's false, IT's direct
+		"npm":   {Enabled: true, HTTP: "http://build-proxy:3128"},
+	} {
+		if got := cfg.Tools[name]; got != want {
+			t.Errorf("%s = %+v, want %+v", name, got, want)
+		}
+	}
+
+	// Disabling a tool keeps its settings, from whichever layer.
+	cfg.SetToolEnabled("maven", false)
+	cfg.SetToolEnabled("git", false)
+	if err := Save(userPath, cfg); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+	data, _ := os.ReadFile(userPath)
+	if strings.Contains(string(data), "build-proxy") || strings.Contains(string(data), "direct") || !strings.Contains(string(data), "maven: false") {
+		t.Errorf("user config:\n%s", data)
+	}
+	cfg = mustLoadLayers(t, userPath, "")
+	if got := cfg.Tools["maven"]; got.Enabled || !got.Direct {
+		t.Errorf("maven after disable = %+v", got)
+	}
+	if got := cfg.Tools["git"]; got.Enabled || got.HTTP != "http://git-proxy:3128" {
+		t.Errorf("git after disable = %+v", got)
+	}
+
+	// Enabling it again drops it from the user file: IT's setting applies.
+	cfg.SetToolEnabled("maven", true)
+	if err := Save(userPath, cfg); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+	if data, _ := os.ReadFile(userPath); strings.Contains(string(data), "maven") {
+		t.Errorf("user config still has maven:\n%s", data)
+	}
+	if got := mustLoadLayers(t, userPath, "").Tools["maven"]; !got.Enabled || !got.Direct {
+		t.Errorf("maven after enable = %+v", got)
+	}
+}
+
+func TestLoadLayers_ProjectCannotSetToolCA(t *testing.T) {
+	userPath, projectDir := layerFiles(t, "", "tools:\n  git: true\n", "tools:\n  git:\n    ca_cert: /tmp/evil.pem\n")
+	if _, err := LoadLayers(userPath, projectDir); err == nil || !strings.Contains(err.Error(), "tools.git.ca_cert") {
+		t.Errorf("err = %v", err)
+	}
+}
+
+func TestSaveLayers_KeepsToolForms(t *testing.T) {
+	user := "tools:\n  git: true\n  maven: direct\n  docker:\n    http: http://egress:3128\n"
+	userPath, _ := layerFiles(t, "", user, "")
+	cfg := mustLoadLayers(t, userPath, "")
+	cfg.SetToolEnabled("npm", false)
+	if err := Save(userPath, cfg); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+	data, _ := os.ReadFile(userPath)
+	for _, want := range []string{"git: true", "maven: direct", "docker:\n        http: http://egress:3128\n", "npm: false"} {
+		if !strings.Contains(string(data), want) {
+			t.Errorf("user config lacks %q:\n%s", want, data)
+		}
+	}
+	if strings.Contains(string(data), "enabled") {
+		t.Errorf("user config spells out enabled:\n%s", data)
+	}
+}
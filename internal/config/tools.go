@@ -0,0 +1,170 @@
+package config
+
+import (
+	"fmt"
+
+	"gopkg.in/yaml.v3"
+)
+
+// ToolConfig is a tool's entry under tools. Most are plain booleans; a
+// tool that needs other settings than the top-level ones gets a mapping,
+// and one that must not use a proxy at all is set to "direct":
+//
+//	tools:
+//	  git: true
+//	  docker:
+//	    http: http://egress.corp.com:3128
+//	  apt:
+//	    http: http://apt-cache.corp.com:3142
+//	    no_proxy: localhost,.corp.com
+//	  maven: direct
+//
+// A mapping enables the tool unless it says enabled: false.
+type ToolConfig struct {
+	Enabled bool
+	Direct  bool // no proxy: ezproxy's settings for the tool are removed
+
+	// Overrides of the top-level settings; empty means inherited. An HTTP
+	// override without HTTPS is used for both.
+	HTTP    string
+	HTTPS   string
+	NoProxy string
+	CACert  string // used as the tool's only CA file
+}
+
+// toolMapping is the mapping form of a ToolConfig.
+type toolMapping struct {
+	Enabled *bool  `yaml:"enabled,omitempty"`
+	Direct  bool   `yaml:"direct,omitempty"`
+	HTTP    string `yaml:"http,omitempty"`
+	HTTPS   string `yaml:"https,omitempty"`
+	NoProxy string `yaml:"no_proxy,omitempty"`
+	CACert  string `yaml:"ca_cert,omitempty"`
+}
+
+// direct is the scalar form of a tool that connects without a proxy.
+const direct = "direct"
+
+// HasOverrides reports whether the tool has settings of its own.
+func (t ToolConfig) HasOverrides() bool {
+	return t.HTTP != "" || t.HTTPS != "" || t.NoProxy != "" || t.CACert != ""
+}
+
+func (t *ToolConfig) UnmarshalYAML(node *yaml.Node) error {
+	switch node.Kind {
+	case yaml.ScalarNode:
+		if node.Value == direct {
+			*t = ToolConfig{Enabled: true, Direct: true}
+			return nil
+		}
+		var enabled bool
+		if err := node.Decode(&enabled); err != nil {
+			return fmt.Errorf("line %d: tool must be true, false, %s or a mapping, not %q", node.Line, direct, node.Value)
+		}
+		*t = ToolConfig{Enabled: enabled}
+		return nil
+	case yaml.MappingNode:
+		for i := 0; i < len(node.Content); i += 2 {
+			switch key := node.Content[i].Value; key {
+			case "enabled", "direct", "http", "https", "no_proxy", "ca_cert":
+			default:
+				return fmt.Errorf("line %d: unknown tool setting %q (known: enabled, direct, http, https, no_proxy, ca_cert)", node.Content[i].Line, key)
+			}
+		}
+		var m toolMapping
+		if err := node.Decode(&m); err != nil {
+			return err
+		}
+		for _, u := range []string{m.HTTP, m.HTTPS} {
+			if u == "" {
+				continue
+			}
+			if err := ValidateProxyURL(u); err != nil {
+				return fmt.Errorf("line %d: %w", node.Line, err)
+			}
+		}
+		*t = ToolConfig{
+			Enabled: m.Enabled == nil || *m.Enabled,
+			Direct:  m.Direct,
+			HTTP:    m.HTTP,
+			HTTPS:   m.HTTPS,
+			NoProxy: m.NoProxy,
+			CACert:  m.CACert,
+		}
+		return nil
+	}
+	return fmt.Errorf("line %d: tool must be true, false, %s or a mapping", node.Line, direct)
+}
+
+// MarshalYAML writes the shortest form that keeps every setting, so a
+// config without overrides looks as it always has.
+func (t ToolConfig) MarshalYAML() (any, error) {
+	switch {
+	case !t.HasOverrides() && !t.Direct:
+		return t.Enabled, nil
+	case !t.HasOverrides() && t.Enabled:
+		return direct, nil
+	}
+	m := toolMapping{Direct: t.Direct, HTTP: t.HTTP, HTTPS: t.HTTPS, NoProxy: t.NoProxy, CACert: t.CACert}
+	if !t.Enabled {
+		m.Enabled = &t.Enabled
+	}
+	return m, nil
+}
+
+// SetToolEnabled enables or disables a tool, keeping its other settings.
+func (c *Config) SetToolEnabled(name string, enabled bool) {
+	if c.Tools == nil {
+		c.Tools = make(map[string]ToolConfig)
+	}
+	t := c.Tools[name]
+	t.Enabled = enabled
+	c.Tools[name] = t
+}
+
+// ForTool returns the config the named tool's configurator should see: c
+// with the tool's own proxy and CA settings in place of the top-level
+// ones. A tool without overrides gets c itself. The overrides also apply
+// when Proxy points at the relay, so such a tool bypasses it.
+func (c *Config) ForTool(name string) *Config {
+	t := c.Tools[name]
+	if !t.HasOverrides() {
+		return c
+	}
+	out := *c
+	if t.HTTP != "" {
+		out.Proxy.HTTP = t.HTTP
+		out.Proxy.HTTPS = t.HTTP
+	}
+	if t.HTTPS != "" {
+		out.Proxy.HTTPS = t.HTTPS
+	}
+	if t.NoProxy != "" {
+		out.Proxy.NoProxy = t.NoProxy
+	}
+	if t.CACert != "" {
+		// The generated bundle and CA file hold the top-level CAs.
+		out.CACert, out.CACerts = t.CACert, nil
+		out.CABundle, out.CAFile = "", ""
+	}
+	return &out
+}
+
+// ToolsEnabled returns a tools map with only the enabled flags set, as
+// config.yaml had before per-tool settings.
+func ToolsEnabled(enabled map[string]bool) map[string]ToolConfig {
+	out := make(map[string]ToolConfig, len(enabled))
+	for name, on := range enabled {
+		out[name] = ToolConfig{Enabled: on}
+	}
+	return out
+}
+
+// cloneTools copies a tools map.
+func cloneTools(tools map[string]ToolConfig) map[string]ToolConfig {
+	out := make(map[string]ToolConfig, len(tools))
+	for k, v := range tools {
+		out[k] = v
+	}
+	return out
+}
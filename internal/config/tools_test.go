@@ -0,0 +1,121 @@
+package config
+
+import (
+	"strings"
+	"testing"
+
+	"gopkg.in/yaml.v3"
+)
+
+const toolsYAML = `proxy:
+  http: http://proxy.corp.com:8080
+  https: http://proxy.corp.com:8080
+  no_proxy: localhost,.corp.com
+ca_cert: /etc/pki/corp.pem
+tools:
+  git: true
+  pip: false
+  maven: direct
+  docker:
+    http: http://egress.corp.com:3128
+  apt:
+    enabled: false
+    http: http://apt-cache:3142
+    no_proxy: localhost
+    ca_cert: /etc/pki/apt.pem
+`
+
+func TestToolConfig_Forms(t *testing.T) {
+	var cfg Config
+	if err := yaml.Unmarshal([]byte(toolsYAML), &cfg); err != nil {
+		t.Fatalf("Unmarshal: %v", err)
+	}
+	for name, want := range map[string]ToolConfig{
+		"git":    {Enabled: true},
+		"pip":    {},
+		"maven":  {Enabled: true, Direct: true},
+		"docker": {Enabled: true, HTTP: "http://egress.corp.com:3128"},
+		"apt":    {HTTP: "http://apt-cache:3142", NoProxy: "localhost", CACert: "/etc/pki/apt.pem"},
+	} {
+		if got := cfg.Tools[name]; got != want {
+			t.Errorf("%s = %+v, want %+v", name, got, want)
+		}
+	}
+
+	// Written back in the same forms.
+	data, err := yaml.Marshal(&cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"git: true", "pip: false", "maven: direct", "docker:\n        http: http://egress.corp.com:3128", "enabled: false"} {
+		if !strings.Contains(string(data), want) {
+			t.Errorf("marshalled config lacks %q:\n%s", want, data)
+		}
+	}
+	var again Config
+	if err := yaml.Unmarshal(data, &again); err != nil {
+		t.Fatal(err)
+	}
+	for name, tc := range cfg.Tools {
+		if again.Tools[name] != tc {
+			t.Errorf("round trip %s = %+v, want %+v", name, again.Tools[name], tc)
+		}
+	}
+}
+
+func TestToolConfig_Invalid(t *testing.T) {
+	for _, tools := range []string{
+		"git: maybe",
+		"git: [true]",
+		"docker:\n    htpp: http://egress:3128",
+		"docker:\n    http: egress",
+	} {
+		var cfg Config
+		if err := yaml.Unmarshal([]byte("tools:\n  "+tools+"\n"), &cfg); err == nil {
+			t.Errorf("accepted %q", tools)
+		}
+	}
+}
+
+func TestForTool(t *testing.T) {
+	var cfg Config
+	if err := yaml.Unmarshal([]byte(toolsYAML), &cfg); err != nil {
+		t.Fatal(err)
+	}
+	cfg.CABundle, cfg.CAFile = "/home/me/.ezproxy/ca-bundle.pem", "/home/me/.ezproxy/corp-cas.pem"
+
+	if got := cfg.ForTool("git"); got != &cfg {
+		t.Error("tool without overrides should get the config itself")
+	}
+	docker := cfg.ForTool("docker")
+	if docker.Proxy.HTTP != "http://egress.corp.com:3128" || docker.Proxy.HTTPS != "http://egress.corp.com:3128" || docker.Proxy.NoProxy != "localhost,.corp.com" {
+		t.Errorf("docker proxy = %+v", docker.Proxy)
+	}
+	if docker.TrustBundlePath() != cfg.CABundle {
+		t.Errorf("docker trust bundle = %q", docker.TrustBundlePath())
+	}
+	apt := cfg.ForTool("apt")
+	if apt.Proxy.NoProxy != "localhost" || apt.TrustBundlePath() != "/etc/pki/apt.pem" || apt.CorporateCAPath() != "/etc/pki/apt.pem" {
+		t.Errorf("apt = %+v, trust %q", apt.Proxy, apt.TrustBundlePath())
+	}
+	if cfg.Proxy.HTTP != "http://proxy.corp.com:8080" || cfg.CABundle == "" {
+		t.Error("ForTool changed the config it was called on")
+	}
+
+	cfg.UseRelay()
+	if got := cfg.ForTool("docker").Proxy.HTTP; got != "http://egress.corp.com:3128" {
+		t.Errorf("docker with relay = %q, want its own proxy", got)
+	}
+}
+
+func TestSetToolEnabled_KeepsSettings(t *testing.T) {
+	cfg := &Config{Tools: map[string]ToolConfig{"maven": {Enabled: true, Direct: true}}}
+	cfg.SetToolEnabled("maven", false)
+	cfg.SetToolEnabled("git", true)
+	if got := cfg.Tools["maven"]; got.Enabled || !got.Direct {
+		t.Errorf("maven = %+v", got)
+	}
+	if !cfg.Tools["git"].Enabled {
+		t.Error("git not enabled")
+	}
+}
@@ -3,38 +3,71 @@ package configurator
 import (
 	"fmt"
 	"os"
+	"strings"
 
 	"github.com/andrew/ezproxy/internal/config"
 	"github.com/andrew/ezproxy/internal/detect"
+	"github.com/andrew/ezproxy/internal/escape"
+	"github.com/andrew/ezproxy/internal/noproxy"
+	"github.com/andrew/ezproxy/internal/privileged"
 )
 
+const aptDropIn = "/etc/apt/apt.conf.d/99ezproxy"
+
 type Apt struct{}
 
 func (a *Apt) Name() string { return "apt" }
 
+func (a *Apt) NoProxyDialect() noproxy.Dialect { return noproxy.Apt }
+
+// AuthMethod is empty: the settings are system-wide, so they never get a
+// user's password.
+func (a *Apt) AuthMethod() string { return "" }
+
 func (a *Apt) IsAvailable(osInfo detect.OSInfo) bool {
 	return detect.IsCommandAvailable("apt") || detect.IsCommandAvailable("apt-get")
 }
 
-func (a *Apt) Apply(cfg *config.Config) error {
-	content := fmt.Sprintf("Acquire::http::Proxy \"%s\";\nAcquire::https::Proxy \"%s\";\n", cfg.Proxy.HTTP, cfg.Proxy.HTTPS)
-	return runSudoCommands(a.Name(), []string{
-		fmt.Sprintf("printf '%s' > /etc/apt/apt.conf.d/99ezproxy", content),
-	})
+func (a *Apt) Plan(cfg *config.Config) ([]Change, error) {
+	return []Change{Privileged{Actions: []privileged.Action{
+		privileged.WriteFile{Path: aptDropIn, Content: a.content(cfg), Mode: 0644},
+	}}}, nil
+}
+
+func (a *Apt) PlanRemove() ([]Change, error) {
+	if _, err := os.Stat(aptDropIn); os.IsNotExist(err) {
+		return nil, nil
+	}
+	return []Change{Privileged{Actions: []privileged.Action{privileged.RemoveFile{Path: aptDropIn}}}}, nil
 }
 
-func (a *Apt) Remove() error {
-	if _, err := os.Stat("/etc/apt/apt.conf.d/99ezproxy"); os.IsNotExist(err) {
-		return nil
+// content returns the drop-in: the proxies, and a DIRECT line for each
+// host on NO_PROXY, the only kind of entry apt has a setting for.
+func (a *Apt) content(cfg *config.Config) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "Acquire::http::Proxy %s;\nAcquire::https::Proxy %s;\n", escape.AptConf(cfg.Proxy.HTTP), escape.AptConf(cfg.Proxy.HTTPS))
+	hosts, _ := noproxy.Apt.Render(noproxy.Parse(cfg.Proxy.NoProxy))
+	for _, host := range hosts {
+		fmt.Fprintf(&b, "Acquire::http::Proxy::%s \"DIRECT\";\nAcquire::https::Proxy::%s \"DIRECT\";\n", host, host)
 	}
-	return runSudoRemoveCommands(a.Name(), []string{
-		"rm -f /etc/apt/apt.conf.d/99ezproxy",
-	})
+	return b.String()
 }
 
+// Status checks that every line Apply writes is still in the drop-in.
 func (a *Apt) Status(cfg *config.Config) (string, error) {
-	if _, err := os.Stat("/etc/apt/apt.conf.d/99ezproxy"); err == nil {
-		return "configured", nil
+	data, err := os.ReadFile(aptDropIn)
+	if err != nil {
+		return StatusNotConfigured, nil
+	}
+	var stale []string
+	for _, line := range strings.Split(strings.TrimSpace(a.content(cfg)), "\n") {
+		if !strings.Contains(string(data), line) {
+			key, _, _ := strings.Cut(line, " ")
+			stale = append(stale, key)
+		}
+	}
+	if len(stale) > 0 {
+		return staleStatus(stale), nil
 	}
-	return "not configured", nil
+	return StatusConfigured, nil
 }
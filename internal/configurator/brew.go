@@ -4,30 +4,33 @@ import (
 	"github.com/andrew/ezproxy/internal/config"
 	"github.com/andrew/ezproxy/internal/detect"
 	"github.com/andrew/ezproxy/internal/fileutil"
+	"github.com/andrew/ezproxy/internal/noproxy"
 )
 
 type Brew struct{}
 
 func (b *Brew) Name() string { return "brew" }
 
+func (b *Brew) NoProxyDialect() noproxy.Dialect { return noproxy.Curl }
+
 func (b *Brew) IsAvailable(_ detect.OSInfo) bool {
 	return detect.IsCommandAvailable("brew")
 }
 
-func (b *Brew) Apply(cfg *config.Config) error {
+func (b *Brew) Plan(cfg *config.Config) ([]Change, error) {
 	// Covered by env_vars configurator (HTTP_PROXY + HOMEBREW_CURLRC=1)
-	return nil
+	return nil, nil
 }
 
-func (b *Brew) Remove() error {
+func (b *Brew) PlanRemove() ([]Change, error) {
 	// Covered by env_vars configurator
-	return nil
+	return nil, nil
 }
 
 func (b *Brew) Status(cfg *config.Config) (string, error) {
-	// Check if any shell profile has the HOMEBREW_CURLRC marker
+	// Check if any shell profile has the env_vars block (HOMEBREW_CURLRC)
 	for _, profile := range detect.ShellProfiles() {
-		if fileutil.HasMarkerBlock(profile, "#") {
+		if fileutil.HasMarkerBlock(profile, "env_vars", "#") {
 			return "configured (via env_vars)", nil
 		}
 	}
@@ -1,14 +1,16 @@
 package configurator
 
 import (
-	"fmt"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 
 	"github.com/andrew/ezproxy/internal/config"
 	"github.com/andrew/ezproxy/internal/detect"
+	"github.com/andrew/ezproxy/internal/escape"
 	"github.com/andrew/ezproxy/internal/fileutil"
+	"github.com/andrew/ezproxy/internal/noproxy"
 )
 
 // Bundler configures Ruby Bundler's SSL CA cert path.
@@ -20,6 +22,8 @@ type Bundler struct {
 
 func (b *Bundler) Name() string { return "bundler" }
 
+func (b *Bundler) NoProxyDialect() noproxy.Dialect { return noproxy.Ruby }
+
 func (b *Bundler) IsAvailable(_ detect.OSInfo) bool {
 	return detect.IsCommandAvailable("bundle")
 }
@@ -32,92 +36,121 @@ func (b *Bundler) configPath() string {
 	return filepath.Join(home, ".bundle", "config")
 }
 
-func (b *Bundler) Apply(cfg *config.Config) error {
-	certPath := config.ExpandPath(cfg.CACert)
+func (b *Bundler) Plan(cfg *config.Config) ([]Change, error) {
+	certPath := cfg.TrustBundlePath()
 
 	if certPath == "" {
 		// Bundler uses HTTP_PROXY from env (handled by env_vars).
 		// Without a CA cert, there's nothing Bundler-specific to configure.
-		if fileutil.DryRun {
-			fmt.Printf("\n  [dry-run] No CA cert configured; Bundler uses HTTP_PROXY from env_vars.\n")
-		}
-		return nil
+		return []Change{Note{Text: "No CA cert configured; Bundler uses HTTP_PROXY from env_vars."}}, nil
 	}
 
 	path := b.configPath()
+	data, _ := fileutil.ReadFile(path)
+	content := string(data)
 
-	if fileutil.DryRun {
-		fmt.Printf("\n  [dry-run] Would set in %s:\n", path)
-		fmt.Printf("    BUNDLE_SSL_CA_CERT: \"%s\"\n", certPath)
-		return nil
-	}
+	record := recordSetting(path, bundleCAKey, bundleGet(content, bundleCAKey), certPath)
+	content = bundleSet(content, bundleCAKey, &certPath)
+	return []Change{FileEdit{Path: path, Content: []byte(content), Mode: 0644, Records: []Record{record}}}, nil
+}
 
-	// Read existing config
-	existing := make(map[string]string)
-	if data, err := os.ReadFile(path); err == nil {
-		for _, line := range strings.Split(string(data), "\n") {
-			line = strings.TrimSpace(line)
-			if line == "" || line == "---" {
-				continue
-			}
-			if idx := strings.Index(line, ": "); idx > 0 {
-				key := line[:idx]
-				val := strings.Trim(line[idx+2:], "\"")
-				existing[key] = val
-			}
-		}
-	}
+// PlanRemove restores BUNDLE_SSL_CA_CERT to its value before apply, or
+// deletes it if it was not set. A value the user changed since apply is
+// kept. Without a recorded state (applied by an older ezproxy) the key is
+// deleted.
+func (b *Bundler) PlanRemove() ([]Change, error) {
+	path := b.configPath()
 
-	existing["BUNDLE_SSL_CA_CERT"] = certPath
+	if edit, ok := removeIfUntouched(b.Name(), path); ok {
+		return []Change{edit}, nil
+	}
 
-	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
-		return err
+	data, err := fileutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
 	}
+	content := string(data)
 
-	var buf strings.Builder
-	buf.WriteString("---\n")
-	for k, v := range existing {
-		buf.WriteString(fmt.Sprintf("%s: \"%s\"\n", k, v))
+	var previous *string
+	if t, ok := State.Lookup(b.Name()); ok {
+		s, ok := t.Setting(path, bundleCAKey)
+		if !ok {
+			return nil, nil
+		}
+		if current := bundleGet(content, bundleCAKey); current == nil || *current != s.Value {
+			return nil, nil
+		}
+		previous = s.Previous
 	}
 
-	return os.WriteFile(path, []byte(buf.String()), 0644)
+	return []Change{FileEdit{Path: path, Content: []byte(bundleSet(content, bundleCAKey, previous)), Mode: 0644}}, nil
 }
 
-func (b *Bundler) Remove() error {
-	path := b.configPath()
-
-	if fileutil.DryRun {
-		fmt.Printf("\n  [dry-run] Would remove BUNDLE_SSL_CA_CERT from %s\n", path)
-		return nil
-	}
-
-	data, err := os.ReadFile(path)
-	if err != nil {
-		if os.IsNotExist(err) {
-			return nil
+const bundleCAKey = "BUNDLE_SSL_CA_CERT"
+
+// bundleGet returns the value of key in a ~/.bundle/config document, or nil
+// if the key is not present.
+func bundleGet(content, key string) *string {
+	for _, line := range strings.Split(content, "\n") {
+		k, v, ok := strings.Cut(strings.TrimSpace(line), ": ")
+		if ok && k == key {
+			if u, err := strconv.Unquote(v); err == nil {
+				v = u
+			} else {
+				v = strings.Trim(v, "\"")
+			}
+			return &v
 		}
-		return err
 	}
+	return nil
+}
 
-	var buf strings.Builder
-	for _, line := range strings.Split(string(data), "\n") {
-		if strings.HasPrefix(strings.TrimSpace(line), "BUNDLE_SSL_CA_CERT") {
+// bundleSet sets key to value in a ~/.bundle/config document, or deletes it
+// if value is nil. All other lines are kept as they are.
+func bundleSet(content, key string, value *string) string {
+	var lines []string
+	if content != "" {
+		lines = strings.Split(strings.TrimRight(content, "\n"), "\n")
+	}
+	var out []string
+	found := false
+	for _, line := range lines {
+		if k, _, ok := strings.Cut(strings.TrimSpace(line), ":"); ok && k == key {
+			if value != nil && !found {
+				out = append(out, key+": "+escape.JSON(*value))
+			}
+			found = true
 			continue
 		}
-		buf.WriteString(line + "\n")
+		out = append(out, line)
 	}
-
-	result := strings.TrimRight(buf.String(), "\n") + "\n"
-	return os.WriteFile(path, []byte(result), 0644)
+	if value != nil && !found {
+		if len(out) == 0 {
+			out = append(out, "---")
+		}
+		out = append(out, key+": "+escape.JSON(*value))
+	}
+	if len(out) == 0 {
+		return ""
+	}
+	return strings.Join(out, "\n") + "\n"
 }
 
 func (b *Bundler) Status(cfg *config.Config) (string, error) {
-	data, err := os.ReadFile(b.configPath())
-	if err != nil {
-		return "not configured", nil
-	}
-	if strings.Contains(string(data), "BUNDLE_SSL_CA_CERT") {
-		return "configured", nil
+	certPath := cfg.TrustBundlePath()
+	data, _ := os.ReadFile(b.configPath())
+	current := bundleGet(string(data), bundleCAKey)
+	if certPath == "" {
+		// Nothing to apply without a CA cert; a leftover key is stale.
+		if current != nil {
+			return staleStatus([]string{bundleCAKey}), nil
+		}
+		return StatusConfigured, nil
 	}
-	return "not configured", nil
+	return compareValues([]string{bundleCAKey},
+		map[string]string{bundleCAKey: certPath},
+		map[string]*string{bundleCAKey: current}), nil
 }
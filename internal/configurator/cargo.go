@@ -1,14 +1,14 @@
 package configurator
 
 import (
-	"fmt"
 	"os"
 	"path/filepath"
-	"strings"
 
 	"github.com/andrew/ezproxy/internal/config"
 	"github.com/andrew/ezproxy/internal/detect"
+	"github.com/andrew/ezproxy/internal/escape"
 	"github.com/andrew/ezproxy/internal/fileutil"
+	"github.com/andrew/ezproxy/internal/noproxy"
 )
 
 type Cargo struct {
@@ -17,6 +17,8 @@ type Cargo struct {
 
 func (c *Cargo) Name() string { return "cargo" }
 
+func (c *Cargo) NoProxyDialect() noproxy.Dialect { return noproxy.Curl }
+
 func (c *Cargo) IsAvailable(_ detect.OSInfo) bool {
 	return detect.IsCommandAvailable("cargo")
 }
@@ -29,24 +31,31 @@ func (c *Cargo) getPath() string {
 	return filepath.Join(home, ".cargo", "config.toml")
 }
 
-func (c *Cargo) Apply(cfg *config.Config) error {
-	certPath := config.ExpandPath(cfg.CACert)
-	var b strings.Builder
-	fmt.Fprintf(&b, "[http]\n")
-	fmt.Fprintf(&b, "proxy = \"%s\"\n", cfg.Proxy.HTTP)
-	if certPath != "" {
-		fmt.Fprintf(&b, "cainfo = \"%s\"\n", certPath)
+func (c *Cargo) Plan(cfg *config.Config) ([]Change, error) {
+	edit, err := mergeKeys(c.Name(), c.getPath(), fileutil.TOML, c.keys(cfg))
+	if err != nil {
+		return nil, err
+	}
+	edit.Private = hasAuth(cfg)
+	return []Change{edit}, nil
+}
+
+func (c *Cargo) AuthMethod() string { return "in the proxy URL in .cargo/config.toml (mode 0600)" }
+
+// keys returns the [http] settings. A user's own [http] table (or http.*
+// dotted keys) is extended rather than duplicated, which cargo rejects.
+func (c *Cargo) keys(cfg *config.Config) []fileutil.Key {
+	keys := []fileutil.Key{{Section: "http", Name: "proxy", Value: escape.TOML(cfg.WithAuth(cfg.Proxy.HTTP))}}
+	if certPath := cfg.TrustBundlePath(); certPath != "" {
+		keys = append(keys, fileutil.Key{Section: "http", Name: "cainfo", Value: escape.TOML(certPath)})
 	}
-	return fileutil.UpsertMarkerBlock(c.getPath(), b.String(), "#")
+	return keys
 }
 
-func (c *Cargo) Remove() error {
-	return fileutil.RemoveMarkerBlock(c.getPath(), "#")
+func (c *Cargo) PlanRemove() ([]Change, error) {
+	return unmergeKeys(c.Name(), c.getPath(), fileutil.TOML)
 }
 
 func (c *Cargo) Status(cfg *config.Config) (string, error) {
-	if fileutil.HasMarkerBlock(c.getPath(), "#") {
-		return "configured", nil
-	}
-	return "not configured", nil
+	return keysStatus(c.Name(), c.getPath(), fileutil.TOML, c.keys(cfg)), nil
 }
@@ -16,7 +16,7 @@ func TestCargoApply(t *testing.T) {
 		Proxy:  config.ProxyConfig{HTTP: "http://proxy:8080"},
 		CACert: "/tmp/ca.pem",
 	}
-	if err := c.Apply(cfg); err != nil {
+	if err := Apply(c, cfg); err != nil {
 		t.Fatalf("Apply: %v", err)
 	}
 	data, _ := os.ReadFile(c.path)
@@ -39,8 +39,8 @@ func TestCargoRemove(t *testing.T) {
 		Proxy:  config.ProxyConfig{HTTP: "http://proxy:8080"},
 		CACert: "/tmp/ca.pem",
 	}
-	c.Apply(cfg)
-	if err := c.Remove(); err != nil {
+	Apply(c, cfg)
+	if err := Remove(c); err != nil {
 		t.Fatalf("Remove: %v", err)
 	}
 	status, _ := c.Status(cfg)
@@ -55,3 +55,31 @@ func TestCargoName(t *testing.T) {
 		t.Errorf("expected 'cargo', got %q", c.Name())
 	}
 }
+
+func TestCargoMergesIntoUserTable(t *testing.T) {
+	dir := t.TempDir()
+	c := &Cargo{path: filepath.Join(dir, "config.toml")}
+	original := "[http]\ntimeout = 30 # seconds\n\n[net]\ngit-fetch-with-cli = true\n"
+	os.WriteFile(c.path, []byte(original), 0644)
+
+	cfg := &config.Config{
+		Proxy:  config.ProxyConfig{HTTP: "http://proxy:8080"},
+		CACert: "/tmp/ca.pem",
+	}
+	if err := Apply(c, cfg); err != nil {
+		t.Fatalf("Apply: %v", err)
+	}
+	data, _ := os.ReadFile(c.path)
+	want := "[http]\ntimeout = 30 # seconds\nproxy = \"http://proxy:8080\"\ncainfo = \"/tmp/ca.pem\"\n\n[net]\ngit-fetch-with-cli = true\n"
+	if string(data) != want {
+		t.Errorf("got:\n%s\nwant:\n%s", data, want)
+	}
+
+	if err := Remove(c); err != nil {
+		t.Fatalf("Remove: %v", err)
+	}
+	data, _ = os.ReadFile(c.path)
+	if string(data) != original {
+		t.Errorf("after Remove got:\n%s\nwant:\n%s", data, original)
+	}
+}
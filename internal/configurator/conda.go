@@ -1,14 +1,14 @@
 package configurator
 
 import (
-	"fmt"
 	"os"
 	"path/filepath"
-	"strings"
 
 	"github.com/andrew/ezproxy/internal/config"
 	"github.com/andrew/ezproxy/internal/detect"
+	"github.com/andrew/ezproxy/internal/escape"
 	"github.com/andrew/ezproxy/internal/fileutil"
+	"github.com/andrew/ezproxy/internal/noproxy"
 )
 
 type Conda struct {
@@ -17,6 +17,8 @@ type Conda struct {
 
 func (c *Conda) Name() string { return "conda" }
 
+func (c *Conda) NoProxyDialect() noproxy.Dialect { return noproxy.Python }
+
 func (c *Conda) IsAvailable(_ detect.OSInfo) bool {
 	return detect.IsCommandAvailable("conda")
 }
@@ -29,25 +31,34 @@ func (c *Conda) getPath() string {
 	return filepath.Join(home, ".condarc")
 }
 
-func (c *Conda) Apply(cfg *config.Config) error {
-	certPath := config.ExpandPath(cfg.CACert)
-	var b strings.Builder
-	fmt.Fprintf(&b, "proxy_servers:\n")
-	fmt.Fprintf(&b, "  http: %s\n", cfg.Proxy.HTTP)
-	fmt.Fprintf(&b, "  https: %s\n", cfg.Proxy.HTTPS)
-	if certPath != "" {
-		fmt.Fprintf(&b, "ssl_verify: %s\n", certPath)
+func (c *Conda) Plan(cfg *config.Config) ([]Change, error) {
+	edit, err := mergeKeys(c.Name(), c.getPath(), fileutil.YAML, c.keys(cfg))
+	if err != nil {
+		return nil, err
 	}
-	return fileutil.UpsertMarkerBlock(c.getPath(), b.String(), "#")
+	edit.Private = hasAuth(cfg)
+	return []Change{edit}, nil
 }
 
-func (c *Conda) Remove() error {
-	return fileutil.RemoveMarkerBlock(c.getPath(), "#")
+func (c *Conda) AuthMethod() string { return "in the proxy URLs in .condarc (mode 0600)" }
+
+// keys returns the .condarc settings. The proxies go into the user's
+// proxy_servers mapping if there is one.
+func (c *Conda) keys(cfg *config.Config) []fileutil.Key {
+	keys := []fileutil.Key{
+		{Section: "proxy_servers", Name: "http", Value: escape.YAML(cfg.WithAuth(cfg.Proxy.HTTP))},
+		{Section: "proxy_servers", Name: "https", Value: escape.YAML(cfg.WithAuth(cfg.Proxy.HTTPS))},
+	}
+	if certPath := cfg.TrustBundlePath(); certPath != "" {
+		keys = append(keys, fileutil.Key{Name: "ssl_verify", Value: escape.YAML(certPath)})
+	}
+	return keys
+}
+
+func (c *Conda) PlanRemove() ([]Change, error) {
+	return unmergeKeys(c.Name(), c.getPath(), fileutil.YAML)
 }
 
 func (c *Conda) Status(cfg *config.Config) (string, error) {
-	if fileutil.HasMarkerBlock(c.getPath(), "#") {
-		return "configured", nil
-	}
-	return "not configured", nil
+	return keysStatus(c.Name(), c.getPath(), fileutil.YAML, c.keys(cfg)), nil
 }
@@ -16,7 +16,7 @@ func TestCondaApply(t *testing.T) {
 		Proxy:  config.ProxyConfig{HTTP: "http://proxy:8080", HTTPS: "http://proxy:8080"},
 		CACert: "/tmp/ca.pem",
 	}
-	if err := c.Apply(cfg); err != nil {
+	if err := Apply(c, cfg); err != nil {
 		t.Fatalf("Apply: %v", err)
 	}
 	data, _ := os.ReadFile(c.path)
@@ -42,8 +42,8 @@ func TestCondaRemove(t *testing.T) {
 		Proxy:  config.ProxyConfig{HTTP: "http://proxy:8080", HTTPS: "http://proxy:8080"},
 		CACert: "/tmp/ca.pem",
 	}
-	c.Apply(cfg)
-	if err := c.Remove(); err != nil {
+	Apply(c, cfg)
+	if err := Remove(c); err != nil {
 		t.Fatalf("Remove: %v", err)
 	}
 	status, _ := c.Status(cfg)
@@ -58,3 +58,31 @@ func TestCondaName(t *testing.T) {
 		t.Errorf("expected 'conda', got %q", c.Name())
 	}
 }
+
+func TestCondaMergesIntoProxyServers(t *testing.T) {
+	dir := t.TempDir()
+	c := &Conda{path: filepath.Join(dir, ".condarc")}
+	original := "channels:\n  - conda-forge\nproxy_servers:\n  http: http://old:1234\nssl_verify: true\n"
+	os.WriteFile(c.path, []byte(original), 0644)
+
+	cfg := &config.Config{
+		Proxy:  config.ProxyConfig{HTTP: "http://proxy:8080", HTTPS: "http://proxy:8080"},
+		CACert: "/tmp/ca.pem",
+	}
+	if err := Apply(c, cfg); err != nil {
+		t.Fatalf("Apply: %v", err)
+	}
+	data, _ := os.ReadFile(c.path)
+	want := "channels:\n  - conda-forge\nproxy_servers:\n  http: http://proxy:8080\n  https: http://proxy:8080\nssl_verify: /tmp/ca.pem\n"
+	if string(data) != want {
+		t.Errorf("got:\n%s\nwant:\n%s", data, want)
+	}
+
+	if err := Remove(c); err != nil {
+		t.Fatalf("Remove: %v", err)
+	}
+	data, _ = os.ReadFile(c.path)
+	if string(data) != original {
+		t.Errorf("after Remove got:\n%s\nwant:\n%s", data, original)
+	}
+}
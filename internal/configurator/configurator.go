@@ -3,6 +3,7 @@ package configurator
 import (
 	"github.com/andrew/ezproxy/internal/config"
 	"github.com/andrew/ezproxy/internal/detect"
+	"github.com/andrew/ezproxy/internal/noproxy"
 )
 
 // Configurator is the interface all tool configurators implement.
@@ -11,14 +12,55 @@ type Configurator interface {
 	Name() string
 	// IsAvailable returns true if the tool is installed/relevant on this system.
 	IsAvailable(osInfo detect.OSInfo) bool
-	// Apply writes proxy configuration for this tool.
-	Apply(cfg *config.Config) error
-	// Remove undoes proxy configuration for this tool.
-	Remove() error
+	// Plan returns the changes that configure the tool for cfg, without
+	// making any of them (see Apply).
+	Plan(cfg *config.Config) ([]Change, error)
+	// PlanRemove returns the changes that undo the tool's proxy
+	// configuration (see Remove).
+	PlanRemove() ([]Change, error)
 	// Status returns "configured", "not configured", or "stale".
 	Status(cfg *config.Config) (string, error)
 }
 
+// Diagnoser is implemented by configurators whose setup depends on more
+// than the files they write, such as a helper program. "ezproxy doctor"
+// runs it in addition to Status.
+type Diagnoser interface {
+	// Diagnose returns an error describing what would stop the applied
+	// configuration from working, or nil if nothing is wrong.
+	Diagnose(cfg *config.Config) error
+}
+
+// NoProxyReader is implemented by configurators of tools that go through
+// the proxy. NoProxyDialect is how the tool reads the NO_PROXY list,
+// whether ezproxy writes it into the tool's config or the tool takes it
+// from the environment; "ezproxy status" warns about entries it can't
+// honour.
+type NoProxyReader interface {
+	NoProxyDialect() noproxy.Dialect
+}
+
+// noProxy returns cfg's NO_PROXY written in dialect d.
+func noProxy(d noproxy.Dialect, cfg *config.Config) string {
+	return d.Format(noproxy.Parse(cfg.Proxy.NoProxy))
+}
+
+// AuthWriter is implemented by configurators that write proxy settings of
+// their own. AuthMethod says how the tool is given the proxy credentials
+// (see config.Config.AuthFor), for "ezproxy status". It is empty for tools
+// whose settings are system-wide, where one user's password doesn't
+// belong: with an authenticating proxy they need the relay. Tools that
+// read the environment get the credentials through env_vars.
+type AuthWriter interface {
+	AuthMethod() string
+}
+
+// hasAuth reports whether cfg has credentials for either of the proxies a
+// tool is given.
+func hasAuth(cfg *config.Config) bool {
+	return cfg.AuthFor(cfg.Proxy.HTTP) != nil || cfg.AuthFor(cfg.Proxy.HTTPS) != nil
+}
+
 // All returns all registered configurators in apply order.
 func All() []Configurator {
 	return []Configurator{
@@ -8,7 +8,8 @@ import (
 
 	"github.com/andrew/ezproxy/internal/config"
 	"github.com/andrew/ezproxy/internal/detect"
-	"github.com/andrew/ezproxy/internal/fileutil"
+	"github.com/andrew/ezproxy/internal/escape"
+	"github.com/andrew/ezproxy/internal/noproxy"
 )
 
 type Curl struct {
@@ -17,6 +18,8 @@ type Curl struct {
 
 func (c *Curl) Name() string { return "curl" }
 
+func (c *Curl) NoProxyDialect() noproxy.Dialect { return noproxy.Curl }
+
 func (c *Curl) IsAvailable(_ detect.OSInfo) bool {
 	return detect.IsCommandAvailable("curl")
 }
@@ -29,23 +32,37 @@ func (c *Curl) getPath() string {
 	return filepath.Join(home, ".curlrc")
 }
 
-func (c *Curl) Apply(cfg *config.Config) error {
-	certPath := config.ExpandPath(cfg.CACert)
+func (c *Curl) Plan(cfg *config.Config) ([]Change, error) {
+	edit, err := upsertBlock(c.Name(), c.getPath(), c.content(cfg))
+	if err != nil {
+		return nil, err
+	}
+	edit.Private = hasAuth(cfg)
+	return []Change{edit}, nil
+}
+
+func (c *Curl) AuthMethod() string { return "proxy-user in .curlrc (mode 0600)" }
+
+func (c *Curl) content(cfg *config.Config) string {
+	certPath := cfg.TrustBundlePath()
 	var b strings.Builder
-	fmt.Fprintf(&b, "proxy = \"%s\"\n", cfg.Proxy.HTTP)
+	fmt.Fprintf(&b, "proxy = %s\n", escape.Curlrc(cfg.Proxy.HTTP))
+	if a := cfg.AuthFor(cfg.Proxy.HTTP); a != nil {
+		fmt.Fprintf(&b, "proxy-user = %s\n", escape.Curlrc(a.Username+":"+a.Password))
+	}
+	if np := noProxy(noproxy.Curl, cfg); np != "" {
+		fmt.Fprintf(&b, "noproxy = %s\n", escape.Curlrc(np))
+	}
 	if certPath != "" {
-		fmt.Fprintf(&b, "cacert = \"%s\"\n", certPath)
+		fmt.Fprintf(&b, "cacert = %s\n", escape.Curlrc(certPath))
 	}
-	return fileutil.UpsertMarkerBlock(c.getPath(), b.String(), "#")
+	return b.String()
 }
 
-func (c *Curl) Remove() error {
-	return fileutil.RemoveMarkerBlock(c.getPath(), "#")
+func (c *Curl) PlanRemove() ([]Change, error) {
+	return removeBlock(c.Name(), c.getPath())
 }
 
 func (c *Curl) Status(cfg *config.Config) (string, error) {
-	if fileutil.HasMarkerBlock(c.getPath(), "#") {
-		return "configured", nil
-	}
-	return "not configured", nil
+	return blockStatus(c.Name(), c.getPath(), c.content(cfg)), nil
 }
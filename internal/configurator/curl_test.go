@@ -13,10 +13,10 @@ func TestCurlApply(t *testing.T) {
 	dir := t.TempDir()
 	c := &Curl{path: filepath.Join(dir, ".curlrc")}
 	cfg := &config.Config{
-		Proxy:  config.ProxyConfig{HTTP: "http://proxy:8080"},
+		Proxy:  config.ProxyConfig{HTTP: "http://proxy:8080", NoProxy: "localhost,.corp.com,git:8443"},
 		CACert: "/tmp/ca.pem",
 	}
-	if err := c.Apply(cfg); err != nil {
+	if err := Apply(c, cfg); err != nil {
 		t.Fatalf("Apply: %v", err)
 	}
 	data, _ := os.ReadFile(c.path)
@@ -27,6 +27,9 @@ func TestCurlApply(t *testing.T) {
 	if !strings.Contains(got, `cacert = "/tmp/ca.pem"`) {
 		t.Error("missing cacert")
 	}
+	if !strings.Contains(got, `noproxy = "localhost,.corp.com,git"`) {
+		t.Errorf("missing noproxy:\n%s", got)
+	}
 }
 
 func TestCurlRemove(t *testing.T) {
@@ -36,10 +39,34 @@ func TestCurlRemove(t *testing.T) {
 		Proxy:  config.ProxyConfig{HTTP: "http://proxy:8080"},
 		CACert: "/tmp/ca.pem",
 	}
-	c.Apply(cfg)
-	c.Remove()
+	Apply(c, cfg)
+	Remove(c)
 	data, _ := os.ReadFile(c.path)
 	if strings.Contains(string(data), "ezproxy") {
 		t.Error("should be cleaned")
 	}
 }
+
+func TestCurlApplyCredentials(t *testing.T) {
+	c := &Curl{path: filepath.Join(t.TempDir(), ".curlrc")}
+	cfg := &config.Config{
+		Proxy: config.ProxyConfig{HTTP: "http://proxy:8080"},
+		Auth:  &config.ProxyAuth{Host: "proxy:8080", Username: "alice", Password: "s3cret"},
+	}
+	if err := Apply(c, cfg); err != nil {
+		t.Fatalf("Apply: %v", err)
+	}
+	data, _ := os.ReadFile(c.path)
+	if !strings.Contains(string(data), "proxy = \"http://proxy:8080\"\nproxy-user = \"alice:s3cret\"\n") {
+		t.Errorf("unexpected .curlrc:\n%s", data)
+	}
+	if info, _ := os.Stat(c.path); info.Mode().Perm() != 0600 {
+		t.Errorf("mode = %04o, want 0600", info.Mode().Perm())
+	}
+
+	// The relay adds the credentials itself.
+	cfg.UseRelay()
+	if strings.Contains(c.content(cfg), "proxy-user") {
+		t.Error("credentials given to a tool pointed at the relay")
+	}
+}
@@ -6,11 +6,13 @@ import (
 	"os"
 	"path/filepath"
 	"runtime"
-	"strings"
 
 	"github.com/andrew/ezproxy/internal/config"
 	"github.com/andrew/ezproxy/internal/detect"
+	"github.com/andrew/ezproxy/internal/escape"
 	"github.com/andrew/ezproxy/internal/fileutil"
+	"github.com/andrew/ezproxy/internal/noproxy"
+	"github.com/andrew/ezproxy/internal/privileged"
 )
 
 type Docker struct {
@@ -19,6 +21,8 @@ type Docker struct {
 
 func (d *Docker) Name() string { return "docker" }
 
+func (d *Docker) NoProxyDialect() noproxy.Dialect { return noproxy.Go }
+
 func (d *Docker) IsAvailable(_ detect.OSInfo) bool {
 	return detect.IsCommandAvailable("docker")
 }
@@ -31,126 +35,213 @@ func (d *Docker) getConfigPath() string {
 	return filepath.Join(home, ".docker", "config.json")
 }
 
-func (d *Docker) Apply(cfg *config.Config) error {
+func (d *Docker) Plan(cfg *config.Config) ([]Change, error) {
 	// Client proxy config
-	if err := d.applyClientConfig(cfg); err != nil {
-		return fmt.Errorf("docker client config: %w", err)
+	client, err := d.planClientConfig(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("docker client config: %w", err)
 	}
+	changes := []Change{client}
 
 	// Daemon config (Linux only)
 	if runtime.GOOS == "linux" {
-		if err := d.applyDaemonConfig(cfg); err != nil {
-			fmt.Printf("  docker daemon: %v\n", err)
-		}
+		changes = append(changes, d.planDaemonConfig(cfg))
 	} else if runtime.GOOS == "darwin" {
-		fmt.Println("\n[Docker Desktop - macOS]")
-		fmt.Println("Configure proxy via: Docker Desktop > Settings > Resources > Proxies")
-		fmt.Printf("  HTTP Proxy:  %s\n", cfg.Proxy.HTTP)
-		fmt.Printf("  HTTPS Proxy: %s\n", cfg.Proxy.HTTPS)
-		fmt.Printf("  No Proxy:    %s\n", cfg.Proxy.NoProxy)
-		fmt.Println("Docker Desktop reads macOS system CA certs automatically after restart.")
+		changes = append(changes, Manual{Text: fmt.Sprintf("[Docker Desktop - macOS]\n"+
+			"Configure proxy via: Docker Desktop > Settings > Resources > Proxies\n"+
+			"  HTTP Proxy:  %s\n"+
+			"  HTTPS Proxy: %s\n"+
+			"  No Proxy:    %s\n"+
+			"Docker Desktop reads macOS system CA certs automatically after restart.",
+			cfg.Proxy.HTTP, cfg.Proxy.HTTPS, noProxy(noproxy.Go, cfg))})
 	}
 
-	return nil
+	return changes, nil
 }
 
-func (d *Docker) applyClientConfig(cfg *config.Config) error {
+func (d *Docker) planClientConfig(cfg *config.Config) (FileEdit, error) {
 	path := d.getConfigPath()
 
 	proxies := map[string]interface{}{
-		"default": map[string]interface{}{
-			"httpProxy":  cfg.Proxy.HTTP,
-			"httpsProxy": cfg.Proxy.HTTPS,
-			"noProxy":    cfg.Proxy.NoProxy,
-		},
-	}
-
-	if fileutil.DryRun {
-		data, _ := json.MarshalIndent(map[string]interface{}{"proxies": proxies}, "", "  ")
-		fmt.Printf("\n  [dry-run] Would merge into %s:\n", path)
-		for _, line := range strings.Split(string(data), "\n") {
-			fmt.Printf("    %s\n", line)
-		}
-		return nil
+		"default": d.defaultProxies(cfg),
 	}
 
 	// Read existing config
-	var dockerConfig map[string]interface{}
-	if data, err := os.ReadFile(path); err == nil {
+	dockerConfig := make(map[string]interface{})
+	if data, err := fileutil.ReadFile(path); err == nil {
 		if err := json.Unmarshal(data, &dockerConfig); err != nil {
-			dockerConfig = make(map[string]interface{})
+			return FileEdit{}, fmt.Errorf("%s is not valid JSON, not overwriting it: %w", path, err)
 		}
-	} else {
-		dockerConfig = make(map[string]interface{})
 	}
 
+	record := recordSetting(path, "proxies", jsonValue(dockerConfig, "proxies"), mustJSON(proxies))
 	dockerConfig["proxies"] = proxies
 
 	// Write back
-	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
-		return err
-	}
 	data, err := json.MarshalIndent(dockerConfig, "", "  ")
 	if err != nil {
-		return err
+		return FileEdit{}, err
+	}
+	return FileEdit{Path: path, Content: append(data, '\n'), Mode: 0644, Private: hasAuth(cfg), Records: []Record{record}}, nil
+}
+
+// AuthMethod covers the client config only. The daemon's drop-in is
+// system-wide, so image pulls through an authenticating proxy need the
+// relay.
+func (d *Docker) AuthMethod() string {
+	return "in the proxy URLs in ~/.docker/config.json (mode 0600), passed to containers; image pulls need the relay"
+}
+
+func (d *Docker) defaultProxies(cfg *config.Config) map[string]interface{} {
+	return map[string]interface{}{
+		"httpProxy":  cfg.WithAuth(cfg.Proxy.HTTP),
+		"httpsProxy": cfg.WithAuth(cfg.Proxy.HTTPS),
+		"noProxy":    noProxy(noproxy.Go, cfg),
+	}
+}
+
+// planDaemonConfig writes the daemon's systemd drop-in as root and
+// restarts it. The drop-in is recorded as ours, so Remove deletes it.
+func (d *Docker) planDaemonConfig(cfg *config.Config) Change {
+	return Privileged{
+		Actions: []privileged.Action{
+			privileged.WriteFile{Path: dockerDaemonDropIn, Content: d.daemonContent(cfg), Mode: 0644},
+			privileged.RestartUnit{Unit: "docker"},
+		},
+		Records: []Record{recordFile(dockerDaemonDropIn, fileExists(dockerDaemonDropIn))},
 	}
-	return os.WriteFile(path, append(data, '\n'), 0644)
 }
 
-func (d *Docker) applyDaemonConfig(cfg *config.Config) error {
-	content := fmt.Sprintf("[Service]\nEnvironment=\"HTTP_PROXY=%s\"\nEnvironment=\"HTTPS_PROXY=%s\"\nEnvironment=\"NO_PROXY=%s\"\n",
-		cfg.Proxy.HTTP, cfg.Proxy.HTTPS, cfg.Proxy.NoProxy)
-	return runSudoCommands("docker daemon", []string{
-		"mkdir -p /etc/systemd/system/docker.service.d",
-		fmt.Sprintf("printf '%s' > /etc/systemd/system/docker.service.d/ezproxy.conf", content),
-		"systemctl daemon-reload && systemctl restart docker",
-	})
+// daemonContent returns the systemd drop-in that gives dockerd the proxy.
+func (d *Docker) daemonContent(cfg *config.Config) string {
+	return fmt.Sprintf("[Service]\nEnvironment=%s\nEnvironment=%s\nEnvironment=%s\n",
+		escape.Systemd("HTTP_PROXY="+cfg.Proxy.HTTP),
+		escape.Systemd("HTTPS_PROXY="+cfg.Proxy.HTTPS),
+		escape.Systemd("NO_PROXY="+noProxy(noproxy.Go, cfg)))
 }
 
-func (d *Docker) Remove() error {
+const dockerDaemonDropIn = "/etc/systemd/system/docker.service.d/ezproxy.conf"
+
+func (d *Docker) PlanRemove() ([]Change, error) {
+	changes, err := d.planRemoveClientConfig()
+	if err != nil {
+		return nil, fmt.Errorf("docker client config: %w", err)
+	}
+	return append(changes, d.planRemoveDaemonConfig()...), nil
+}
+
+// planRemoveClientConfig puts the "proxies" key back the way it was
+// before apply: the previous value is restored, or the key is deleted if
+// there was none. If the user has changed the key since apply it is left
+// alone. Without a recorded state (applied by an older ezproxy) the key is
+// deleted.
+func (d *Docker) planRemoveClientConfig() ([]Change, error) {
 	path := d.getConfigPath()
 
-	if fileutil.DryRun {
-		fmt.Printf("\n  [dry-run] Would remove \"proxies\" key from %s\n", path)
-		return nil
+	if edit, ok := removeIfUntouched(d.Name(), path); ok {
+		return []Change{edit}, nil
 	}
 
-	data, err := os.ReadFile(path)
+	data, err := fileutil.ReadFile(path)
 	if err != nil {
 		if os.IsNotExist(err) {
-			return nil
+			return nil, nil
 		}
-		return err
+		return nil, err
 	}
 
 	var dockerConfig map[string]interface{}
 	if err := json.Unmarshal(data, &dockerConfig); err != nil {
-		return nil
+		return nil, nil
 	}
 
-	delete(dockerConfig, "proxies")
+	var previous *string
+	if t, ok := State.Lookup(d.Name()); ok {
+		s, ok := t.Setting(path, "proxies")
+		if !ok {
+			return nil, nil
+		}
+		if current := jsonValue(dockerConfig, "proxies"); current == nil || *current != s.Value {
+			return nil, nil
+		}
+		previous = s.Previous
+	}
+
+	if previous != nil {
+		var v interface{}
+		if err := json.Unmarshal([]byte(*previous), &v); err != nil {
+			return nil, fmt.Errorf("restoring previous proxies: %w", err)
+		}
+		dockerConfig["proxies"] = v
+	} else {
+		delete(dockerConfig, "proxies")
+	}
 
 	out, err := json.MarshalIndent(dockerConfig, "", "  ")
 	if err != nil {
-		return err
+		return nil, err
 	}
-	return os.WriteFile(path, append(out, '\n'), 0644)
+	return []Change{FileEdit{Path: path, Content: append(out, '\n'), Mode: 0644}}, nil
+}
+
+// planRemoveDaemonConfig deletes the systemd drop-in if ezproxy wrote one.
+func (d *Docker) planRemoveDaemonConfig() []Change {
+	t, ok := State.Lookup(d.Name())
+	if !ok {
+		return nil
+	}
+	if _, ok := t.File(dockerDaemonDropIn); !ok || !fileExists(dockerDaemonDropIn) {
+		return nil
+	}
+	return []Change{Privileged{Actions: []privileged.Action{
+		privileged.RemoveFile{Path: dockerDaemonDropIn},
+		privileged.RestartUnit{Unit: "docker"},
+	}}}
+}
+
+// jsonValue returns the canonical JSON encoding of m[key], or nil if unset.
+func jsonValue(m map[string]interface{}, key string) *string {
+	v, ok := m[key]
+	if !ok {
+		return nil
+	}
+	s := mustJSON(v)
+	return &s
+}
+
+func mustJSON(v interface{}) string {
+	data, _ := json.Marshal(v)
+	return string(data)
 }
 
 func (d *Docker) Status(cfg *config.Config) (string, error) {
 	path := d.getConfigPath()
 	data, err := os.ReadFile(path)
 	if err != nil {
-		return "not configured", nil
+		return StatusNotConfigured, nil
 	}
 
 	var dockerConfig map[string]interface{}
 	if err := json.Unmarshal(data, &dockerConfig); err != nil {
-		return "not configured", nil
+		return StatusNotConfigured, nil
+	}
+
+	proxies, _ := dockerConfig["proxies"].(map[string]interface{})
+	current, _ := proxies["default"].(map[string]interface{})
+	if current == nil {
+		return StatusNotConfigured, nil
 	}
 
-	if _, ok := dockerConfig["proxies"]; ok {
-		return "configured", nil
+	keys := []string{"httpProxy", "httpsProxy", "noProxy"}
+	expected := make(map[string]string)
+	actual := make(map[string]*string)
+	for k, v := range d.defaultProxies(cfg) {
+		expected[k] = v.(string)
+	}
+	for _, k := range keys {
+		if v, ok := current[k].(string); ok {
+			actual[k] = &v
+		}
 	}
-	return "not configured", nil
+	return compareValues(keys, expected, actual), nil
 }
@@ -30,7 +30,7 @@ func TestDockerApplyClient(t *testing.T) {
 		},
 	}
 
-	if err := d.Apply(cfg); err != nil {
+	if err := Apply(d, cfg); err != nil {
 		t.Fatalf("Apply: %v", err)
 	}
 
@@ -66,8 +66,8 @@ func TestDockerRemove(t *testing.T) {
 	cfg := &config.Config{
 		Proxy: config.ProxyConfig{HTTP: "http://proxy:8080", HTTPS: "http://proxy:8080", NoProxy: "localhost"},
 	}
-	d.Apply(cfg)
-	d.Remove()
+	Apply(d, cfg)
+	Remove(d)
 
 	data, _ := os.ReadFile(configPath)
 	var result map[string]interface{}
@@ -76,3 +76,48 @@ func TestDockerRemove(t *testing.T) {
 		t.Error("proxies should be removed")
 	}
 }
+
+func TestDockerRemoveRestoresUserProxies(t *testing.T) {
+	dir := t.TempDir()
+	configPath := filepath.Join(dir, "config.json")
+	os.WriteFile(configPath, []byte(`{"proxies": {"default": {"httpProxy": "http://mine:3128"}}}`), 0644)
+
+	d := &Docker{configPath: configPath}
+	cfg := &config.Config{
+		Proxy: config.ProxyConfig{HTTP: "http://proxy:8080", HTTPS: "http://proxy:8080", NoProxy: "localhost"},
+	}
+	if err := Apply(d, cfg); err != nil {
+		t.Fatalf("Apply: %v", err)
+	}
+	if err := Remove(d); err != nil {
+		t.Fatalf("Remove: %v", err)
+	}
+
+	data, _ := os.ReadFile(configPath)
+	var result map[string]interface{}
+	json.Unmarshal(data, &result)
+	proxies, ok := result["proxies"].(map[string]interface{})
+	if !ok {
+		t.Fatal("user's proxies key should be restored")
+	}
+	def := proxies["default"].(map[string]interface{})
+	if def["httpProxy"] != "http://mine:3128" {
+		t.Errorf("httpProxy = %v, want the user's original value", def["httpProxy"])
+	}
+}
+
+func TestDockerApplyRefusesInvalidJSON(t *testing.T) {
+	dir := t.TempDir()
+	configPath := filepath.Join(dir, "config.json")
+	os.WriteFile(configPath, []byte(`{"auths": {`), 0644)
+
+	d := &Docker{configPath: configPath}
+	cfg := &config.Config{Proxy: config.ProxyConfig{HTTP: "http://proxy:8080"}}
+	if err := Apply(d, cfg); err == nil {
+		t.Error("expected an error for a config.json that is not valid JSON")
+	}
+	data, _ := os.ReadFile(configPath)
+	if string(data) != `{"auths": {` {
+		t.Error("invalid config.json must not be overwritten")
+	}
+}
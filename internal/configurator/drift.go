@@ -0,0 +1,190 @@
+package configurator
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/andrew/ezproxy/internal/fileutil"
+)
+
+// Status values shared by all configurators. Stale and conflicting results
+// carry the affected keys in parentheses, e.g. "stale (proxy, cafile)".
+const (
+	StatusConfigured    = "configured"
+	StatusNotConfigured = "not configured"
+	StatusStale         = "stale"
+	StatusConflicting   = "conflicting"
+
+	// StatusDirect is reported for a tool set to direct in config.yaml,
+	// which ezproxy leaves without a proxy.
+	StatusDirect = "direct"
+)
+
+// IsDrift reports whether a Status result means the tool's on-disk
+// configuration does not match what Apply would write for config.yaml.
+func IsDrift(status string) bool {
+	switch {
+	case status == StatusNotConfigured,
+		strings.HasPrefix(status, StatusStale),
+		strings.HasPrefix(status, StatusConflicting),
+		strings.HasPrefix(status, "not trusted by system"),
+		strings.HasPrefix(status, "not imported"):
+		return true
+	}
+	return false
+}
+
+func staleStatus(keys []string) string {
+	return fmt.Sprintf("%s (%s)", StatusStale, strings.Join(keys, ", "))
+}
+
+func conflictingStatus(keys []string) string {
+	return fmt.Sprintf("%s (%s)", StatusConflicting, strings.Join(keys, ", "))
+}
+
+// compareValues returns a Status for a set of expected key/value pairs
+// against the values currently in effect (nil = unset). It is used by
+// configurators that don't use marker blocks.
+func compareValues(keys []string, expected map[string]string, actual map[string]*string) string {
+	var stale []string
+	set := 0
+	for _, k := range keys {
+		v := actual[k]
+		if v != nil {
+			set++
+		}
+		if v == nil || *v != expected[k] {
+			stale = append(stale, k)
+		}
+	}
+	switch {
+	case set == 0:
+		return StatusNotConfigured
+	case len(stale) > 0:
+		return staleStatus(stale)
+	}
+	return StatusConfigured
+}
+
+// blockStatus compares tool's ezproxy marker block in path with the content
+// Apply would write now. A key that is also set outside the block (where it
+// may override or be overridden by ours) makes the result "conflicting".
+func blockStatus(tool, path, expected string) string {
+	if status := blockDiff(tool, path, expected); status != StatusConfigured {
+		return status
+	}
+	outside, err := fileutil.ContentOutsideMarkerBlock(path, tool, "#")
+	if err != nil {
+		return StatusConfigured
+	}
+	if keys := sharedKeys(parseSettings(expected), parseSettings(outside)); len(keys) > 0 {
+		return conflictingStatus(keys)
+	}
+	return StatusConfigured
+}
+
+// blockDiff is blockStatus without the conflict check, for files where the
+// same key legitimately appears many times (ssh_config "Host" stanzas).
+func blockDiff(tool, path, expected string) string {
+	actual, err := fileutil.GetMarkerBlockContent(path, tool, "#")
+	if err != nil {
+		return StatusNotConfigured
+	}
+	if keys := diffSettings(parseSettings(expected), parseSettings(actual)); len(keys) > 0 {
+		return staleStatus(keys)
+	}
+	return StatusConfigured
+}
+
+// setting is one key/value pair found in a config file. Keys inside an
+// INI/TOML section are prefixed with the section name ("global.proxy").
+type setting struct {
+	key   string
+	value string
+}
+
+// parseSettings extracts key/value pairs from the config syntaxes ezproxy
+// writes: "key = value", "key=value", "key: value", "key value",
+// "export KEY=value", "set -gx KEY value", quoted list items such as
+// "KEY=value", and "[section]" headers. Comments and blank lines are
+// skipped.
+func parseSettings(content string) []setting {
+	var out []setting
+	section := ""
+	for _, line := range strings.Split(content, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || line == "]" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, ";") {
+			continue
+		}
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			section = strings.Trim(line, "[]")
+			continue
+		}
+		line = strings.TrimPrefix(line, "export ")
+		if rest, ok := strings.CutPrefix(line, "set -gx "); ok {
+			line = strings.Replace(rest, " ", "=", 1)
+		}
+		line = strings.Trim(strings.TrimSuffix(line, ","), `"`)
+
+		idx := strings.IndexAny(line, "=: ")
+		if idx < 0 {
+			continue
+		}
+		key := line[:idx]
+		value := strings.TrimSpace(strings.TrimLeft(strings.TrimSpace(line[idx:]), "=:"))
+		if section != "" {
+			key = section + "." + key
+		}
+		out = append(out, setting{key: key, value: value})
+	}
+	return out
+}
+
+// diffSettings returns the sorted keys whose values differ between the two
+// sets, including keys present in only one of them.
+func diffSettings(expected, actual []setting) []string {
+	want := make(map[string]string, len(expected))
+	for _, s := range expected {
+		want[s.key] = s.value
+	}
+	got := make(map[string]string, len(actual))
+	for _, s := range actual {
+		got[s.key] = s.value
+	}
+	seen := make(map[string]bool)
+	var keys []string
+	for k, v := range want {
+		if g, ok := got[k]; !ok || g != v {
+			seen[k] = true
+		}
+	}
+	for k := range got {
+		if _, ok := want[k]; !ok {
+			seen[k] = true
+		}
+	}
+	for k := range seen {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// sharedKeys returns the sorted keys of ours that also appear in theirs.
+func sharedKeys(ours, theirs []setting) []string {
+	mine := make(map[string]bool, len(ours))
+	for _, s := range ours {
+		mine[s.key] = true
+	}
+	seen := make(map[string]bool)
+	var keys []string
+	for _, s := range theirs {
+		if mine[s.key] && !seen[s.key] {
+			seen[s.key] = true
+			keys = append(keys, s.key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,123 @@
+package configurator
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestStatusStaleAfterProxyChange(t *testing.T) {
+	dir := t.TempDir()
+	n := &Npm{path: filepath.Join(dir, ".npmrc")}
+	cfg := testConfig("/tmp/corp-ca.pem")
+	if err := Apply(n, cfg); err != nil {
+		t.Fatalf("Apply: %v", err)
+	}
+
+	cfg.Proxy.HTTPS = "http://other-proxy:3128"
+	status, _ := n.Status(cfg)
+	assertEqual(t, "stale (https-proxy)", status)
+	if !IsDrift(status) {
+		t.Errorf("IsDrift(%q) = false", status)
+	}
+}
+
+func TestStatusConflictingDuplicateSection(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "pip.conf")
+	// A block from an older ezproxy next to the user's own [global].
+	os.WriteFile(path, []byte("[global]\nproxy = http://old:1234\n\n"+
+		"# >>> ezproxy:pip >>>\n[global]\nproxy = http://proxy:8080\ncert = /tmp/corp-ca.pem\n# <<< ezproxy:pip <<<\n"), 0644)
+
+	p := &Pip{path: path}
+	cfg := testConfig("/tmp/corp-ca.pem")
+	status, _ := p.Status(cfg)
+	assertEqual(t, "conflicting (global.proxy)", status)
+
+	// Apply folds the block into the user's section.
+	if err := Apply(p, cfg); err != nil {
+		t.Fatalf("Apply: %v", err)
+	}
+	status, _ = p.Status(cfg)
+	assertEqual(t, "configured", status)
+}
+
+func TestDockerStatusStale(t *testing.T) {
+	dir := t.TempDir()
+	d := &Docker{configPath: filepath.Join(dir, "config.json")}
+	cfg := testConfig("")
+	edit, err := d.planClientConfig(cfg)
+	if err == nil {
+		err = execute(d.Name(), []Change{edit}, false)
+	}
+	if err != nil {
+		t.Fatalf("applying the client config: %v", err)
+	}
+
+	status, _ := d.Status(cfg)
+	assertEqual(t, "configured", status)
+
+	cfg.Proxy.NoProxy = "localhost"
+	status, _ = d.Status(cfg)
+	assertEqual(t, "stale (noProxy)", status)
+}
+
+func TestMavenStatusConflictingUserProxy(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "settings.xml")
+	os.WriteFile(path, []byte(`<settings>
+  <proxies>
+    <proxy>
+      <id>corp</id>
+      <active>true</active>
+      <protocol>http</protocol>
+      <host>old-proxy</host>
+      <port>3128</port>
+    </proxy>
+  </proxies>
+</settings>
+`), 0644)
+
+	m := &Maven{path: path}
+	cfg := testConfig("")
+	if err := Apply(m, cfg); err != nil {
+		t.Fatalf("Apply: %v", err)
+	}
+
+	status, _ := m.Status(cfg)
+	assertEqual(t, "conflicting (corp)", status)
+}
+
+func TestEnvVarsStatusMissingProfile(t *testing.T) {
+	dir := t.TempDir()
+	bashrc := filepath.Join(dir, ".bashrc")
+	zshrc := filepath.Join(dir, ".zshrc")
+	e := &EnvVars{profiles: []string{bashrc, zshrc}}
+	cfg := testConfig("")
+	if err := Apply(e, cfg); err != nil {
+		t.Fatalf("Apply: %v", err)
+	}
+
+	Remove(&EnvVars{profiles: []string{zshrc}})
+	status, _ := e.Status(cfg)
+	assertEqual(t, "stale (.zshrc)", status)
+}
+
+func TestIsDrift(t *testing.T) {
+	tests := []struct {
+		status string
+		want   bool
+	}{
+		{"configured", false},
+		{"trusted by system", false},
+		{"not configured", true},
+		{"stale (proxy)", true},
+		{"conflicting (global.proxy)", true},
+		{"not trusted by system", true},
+	}
+	for _, tt := range tests {
+		if got := IsDrift(tt.status); got != tt.want {
+			t.Errorf("IsDrift(%q) = %v, want %v", tt.status, got, tt.want)
+		}
+	}
+}
@@ -2,19 +2,26 @@ package configurator
 
 import (
 	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
 	"strings"
 
 	"github.com/andrew/ezproxy/internal/config"
 	"github.com/andrew/ezproxy/internal/detect"
-	"github.com/andrew/ezproxy/internal/fileutil"
+	"github.com/andrew/ezproxy/internal/escape"
+	"github.com/andrew/ezproxy/internal/noproxy"
 )
 
 type EnvVars struct {
 	profiles []string // override for testing; nil = auto-detect
+	authPath string   // override for testing
 }
 
 func (e *EnvVars) Name() string { return "env_vars" }
 
+func (e *EnvVars) NoProxyDialect() noproxy.Dialect { return noproxy.Env }
+
 func (e *EnvVars) IsAvailable(_ detect.OSInfo) bool { return true }
 
 func (e *EnvVars) getProfiles() []string {
@@ -24,75 +31,176 @@ func (e *EnvVars) getProfiles() []string {
 	return detect.ShellProfiles()
 }
 
-func (e *EnvVars) Apply(cfg *config.Config) error {
-	certPath := config.ExpandPath(cfg.CACert)
-	isFish := detect.IsFishShell()
+func (e *EnvVars) getAuthPath() string {
+	if e.authPath != "" {
+		return e.authPath
+	}
+	home, _ := os.UserHomeDir()
+	return filepath.Join(home, ".ezproxy", "proxy-auth")
+}
 
-	var b strings.Builder
-	if isFish {
-		e.writeFishExports(&b, cfg, certPath)
-	} else {
-		e.writePosixExports(&b, cfg, certPath)
+func (e *EnvVars) AuthMethod() string {
+	return "read from ~/.ezproxy/proxy-auth (mode 0600) by the shell profile"
+}
+
+// auth returns the credentials for the proxy-auth file, URL-encoded as
+// user:password, or "" if there are none.
+func (e *EnvVars) auth(cfg *config.Config) string {
+	a := cfg.AuthFor(cfg.Proxy.HTTP)
+	if a == nil {
+		a = cfg.AuthFor(cfg.Proxy.HTTPS)
 	}
+	if a == nil {
+		return ""
+	}
+	return url.UserPassword(a.Username, a.Password).String()
+}
 
+func (e *EnvVars) Plan(cfg *config.Config) ([]Change, error) {
+	changes := e.planAuth(cfg)
+	content := e.content(cfg)
 	for _, profile := range e.getProfiles() {
-		if err := fileutil.UpsertMarkerBlock(profile, b.String(), "#"); err != nil {
-			return fmt.Errorf("updating %s: %w", profile, err)
+		edit, err := upsertBlock(e.Name(), profile, content)
+		if err != nil {
+			return nil, fmt.Errorf("updating %s: %w", profile, err)
 		}
+		changes = append(changes, edit)
 	}
-	return nil
+	return changes, nil
 }
 
-func (e *EnvVars) writePosixExports(b *strings.Builder, cfg *config.Config, certPath string) {
-	fmt.Fprintf(b, "export HTTP_PROXY=%s\n", cfg.Proxy.HTTP)
-	fmt.Fprintf(b, "export HTTPS_PROXY=%s\n", cfg.Proxy.HTTPS)
-	fmt.Fprintf(b, "export http_proxy=%s\n", cfg.Proxy.HTTP)
-	fmt.Fprintf(b, "export https_proxy=%s\n", cfg.Proxy.HTTPS)
-	fmt.Fprintf(b, "export NO_PROXY=%s\n", cfg.Proxy.NoProxy)
-	fmt.Fprintf(b, "export no_proxy=%s\n", cfg.Proxy.NoProxy)
-	if certPath != "" {
-		fmt.Fprintf(b, "export SSL_CERT_FILE=%s\n", certPath)
-		fmt.Fprintf(b, "export REQUESTS_CA_BUNDLE=%s\n", certPath)
-		fmt.Fprintf(b, "export CURL_CA_BUNDLE=%s\n", certPath)
-		fmt.Fprintf(b, "export NODE_EXTRA_CA_CERTS=%s\n", certPath)
+// planAuth returns the edit that writes the credentials to the proxy-auth file, which only the
+// user can read, or deletes it once there are none. The profiles read it
+// at startup, so they hold no password themselves.
+func (e *EnvVars) planAuth(cfg *config.Config) []Change {
+	path, auth := e.getAuthPath(), e.auth(cfg)
+	switch {
+	case auth == "" && !fileExists(path):
+		return nil
+	case auth == "":
+		return []Change{FileEdit{Path: path, Delete: true}}
+	}
+	return []Change{FileEdit{Path: path, Content: []byte(auth + "\n"), Mode: 0600, Private: true}}
+}
+
+// proxyValue returns what the profile sets a proxy variable to, as one
+// word quoted by quote. With credentials, ref, which expands to
+// "user:password@" or nothing, goes after the scheme.
+func (e *EnvVars) proxyValue(cfg *config.Config, proxyURL, ref string, quote func(string) string) string {
+	if cfg.AuthFor(proxyURL) == nil {
+		return quote(proxyURL)
+	}
+	scheme, rest, _ := strings.Cut(proxyURL, "://")
+	return quote(scheme+"://") + ref + quote(rest)
+}
+
+func (e *EnvVars) content(cfg *config.Config) string {
+	var b strings.Builder
+	if detect.IsFishShell() {
+		e.writeFishExports(&b, cfg)
+	} else {
+		e.writePosixExports(&b, cfg)
+	}
+	return b.String()
+}
+
+func (e *EnvVars) writePosixExports(b *strings.Builder, cfg *config.Config) {
+	q := escape.Shell
+	auth := e.auth(cfg) != ""
+	if auth {
+		fmt.Fprintf(b, "ezproxy_auth=$(cat %s 2>/dev/null)\n", q(e.getAuthPath()))
+	}
+	const ref = `"${ezproxy_auth:+$ezproxy_auth@}"`
+	httpProxy, httpsProxy := e.proxyValue(cfg, cfg.Proxy.HTTP, ref, q), e.proxyValue(cfg, cfg.Proxy.HTTPS, ref, q)
+	fmt.Fprintf(b, "export HTTP_PROXY=%s\n", httpProxy)
+	fmt.Fprintf(b, "export HTTPS_PROXY=%s\n", httpsProxy)
+	fmt.Fprintf(b, "export http_proxy=%s\n", httpProxy)
+	fmt.Fprintf(b, "export https_proxy=%s\n", httpsProxy)
+	if auth {
+		fmt.Fprintf(b, "unset ezproxy_auth\n")
+	}
+	fmt.Fprintf(b, "export NO_PROXY=%s\n", q(noProxy(noproxy.Env, cfg)))
+	fmt.Fprintf(b, "export no_proxy=%s\n", q(noProxy(noproxy.Env, cfg)))
+	if bundle := cfg.TrustBundlePath(); bundle != "" {
+		fmt.Fprintf(b, "export SSL_CERT_FILE=%s\n", q(bundle))
+		fmt.Fprintf(b, "export REQUESTS_CA_BUNDLE=%s\n", q(bundle))
+		fmt.Fprintf(b, "export CURL_CA_BUNDLE=%s\n", q(bundle))
+		// Node adds these to its built-in roots, so the cert alone is enough.
+		fmt.Fprintf(b, "export NODE_EXTRA_CA_CERTS=%s\n", q(cfg.CorporateCAPath()))
 	}
 	fmt.Fprintf(b, "export HOMEBREW_CURLRC=1\n")
 }
 
-func (e *EnvVars) writeFishExports(b *strings.Builder, cfg *config.Config, certPath string) {
-	fmt.Fprintf(b, "set -gx HTTP_PROXY %s\n", cfg.Proxy.HTTP)
-	fmt.Fprintf(b, "set -gx HTTPS_PROXY %s\n", cfg.Proxy.HTTPS)
-	fmt.Fprintf(b, "set -gx http_proxy %s\n", cfg.Proxy.HTTP)
-	fmt.Fprintf(b, "set -gx https_proxy %s\n", cfg.Proxy.HTTPS)
-	fmt.Fprintf(b, "set -gx NO_PROXY %s\n", cfg.Proxy.NoProxy)
-	fmt.Fprintf(b, "set -gx no_proxy %s\n", cfg.Proxy.NoProxy)
-	if certPath != "" {
-		fmt.Fprintf(b, "set -gx SSL_CERT_FILE %s\n", certPath)
-		fmt.Fprintf(b, "set -gx REQUESTS_CA_BUNDLE %s\n", certPath)
-		fmt.Fprintf(b, "set -gx CURL_CA_BUNDLE %s\n", certPath)
-		fmt.Fprintf(b, "set -gx NODE_EXTRA_CA_CERTS %s\n", certPath)
+func (e *EnvVars) writeFishExports(b *strings.Builder, cfg *config.Config) {
+	q := escape.Fish
+	if e.auth(cfg) != "" {
+		// Appending @ to the file's contents gives an empty list, and so
+		// an empty string in the quotes below, if the file is missing.
+		fmt.Fprintf(b, "set -l ezproxy_auth (cat %s 2>/dev/null)@\n", q(e.getAuthPath()))
+	}
+	const ref = `"$ezproxy_auth"`
+	httpProxy, httpsProxy := e.proxyValue(cfg, cfg.Proxy.HTTP, ref, q), e.proxyValue(cfg, cfg.Proxy.HTTPS, ref, q)
+	fmt.Fprintf(b, "set -gx HTTP_PROXY %s\n", httpProxy)
+	fmt.Fprintf(b, "set -gx HTTPS_PROXY %s\n", httpsProxy)
+	fmt.Fprintf(b, "set -gx http_proxy %s\n", httpProxy)
+	fmt.Fprintf(b, "set -gx https_proxy %s\n", httpsProxy)
+	fmt.Fprintf(b, "set -gx NO_PROXY %s\n", q(noProxy(noproxy.Env, cfg)))
+	fmt.Fprintf(b, "set -gx no_proxy %s\n", q(noProxy(noproxy.Env, cfg)))
+	if bundle := cfg.TrustBundlePath(); bundle != "" {
+		fmt.Fprintf(b, "set -gx SSL_CERT_FILE %s\n", q(bundle))
+		fmt.Fprintf(b, "set -gx REQUESTS_CA_BUNDLE %s\n", q(bundle))
+		fmt.Fprintf(b, "set -gx CURL_CA_BUNDLE %s\n", q(bundle))
+		fmt.Fprintf(b, "set -gx NODE_EXTRA_CA_CERTS %s\n", q(cfg.CorporateCAPath()))
 	}
 	fmt.Fprintf(b, "set -gx HOMEBREW_CURLRC 1\n")
 }
 
-func (e *EnvVars) Remove() error {
+func (e *EnvVars) PlanRemove() ([]Change, error) {
+	var changes []Change
 	for _, profile := range e.getProfiles() {
-		if err := fileutil.RemoveMarkerBlock(profile, "#"); err != nil {
-			return fmt.Errorf("cleaning %s: %w", profile, err)
+		edits, err := removeBlock(e.Name(), profile)
+		if err != nil {
+			return nil, fmt.Errorf("cleaning %s: %w", profile, err)
 		}
+		changes = append(changes, edits...)
+	}
+	if path := e.getAuthPath(); fileExists(path) {
+		changes = append(changes, FileEdit{Path: path, Delete: true})
 	}
-	return nil
+	return changes, nil
 }
 
+// Status checks every shell profile. A profile that lost its block while
+// others still have one is reported as stale, named by its file.
 func (e *EnvVars) Status(cfg *config.Config) (string, error) {
-	profiles := e.getProfiles()
-	if len(profiles) == 0 {
-		return "not configured", nil
+	content := e.content(cfg)
+	var missing []string
+	drift := ""
+	configured := false
+	for _, profile := range e.getProfiles() {
+		status := blockStatus(e.Name(), profile, content)
+		switch {
+		case status == StatusNotConfigured:
+			missing = append(missing, filepath.Base(profile))
+		case status == StatusConfigured:
+			configured = true
+		case drift == "":
+			configured = true
+			drift = status
+		}
 	}
-	for _, profile := range profiles {
-		if fileutil.HasMarkerBlock(profile, "#") {
-			return "configured", nil
+	if auth := e.auth(cfg); auth != "" && configured {
+		if data, err := os.ReadFile(e.getAuthPath()); err != nil || strings.TrimSpace(string(data)) != auth {
+			missing = append(missing, filepath.Base(e.getAuthPath()))
 		}
 	}
-	return "not configured", nil
+	switch {
+	case drift != "":
+		return drift, nil
+	case !configured:
+		return StatusNotConfigured, nil
+	case len(missing) > 0:
+		return staleStatus(missing), nil
+	}
+	return StatusConfigured, nil
 }
@@ -1,72 +1,186 @@
 package configurator
 
 import (
+	"bytes"
 	"fmt"
+	"net/url"
+	"os"
 	"os/exec"
+	"path/filepath"
 	"strings"
 
 	"github.com/andrew/ezproxy/internal/config"
 	"github.com/andrew/ezproxy/internal/detect"
 	"github.com/andrew/ezproxy/internal/fileutil"
+	"github.com/andrew/ezproxy/internal/noproxy"
 )
 
 type Git struct{}
 
 func (g *Git) Name() string { return "git" }
 
+func (g *Git) NoProxyDialect() noproxy.Dialect { return noproxy.Curl }
+
 func (g *Git) IsAvailable(_ detect.OSInfo) bool {
 	return detect.IsCommandAvailable("git")
 }
 
-func (g *Git) Apply(cfg *config.Config) error {
-	certPath := config.ExpandPath(cfg.CACert)
+func (g *Git) Plan(cfg *config.Config) ([]Change, error) {
+	certPath := cfg.TrustBundlePath()
 
 	cmds := [][]string{
-		{"git", "config", "--global", "http.proxy", cfg.Proxy.HTTP},
+		{"http.proxy", g.proxy(cfg)},
 	}
 	if certPath != "" {
-		cmds = append(cmds, []string{"git", "config", "--global", "http.sslCAInfo", certPath})
+		cmds = append(cmds, []string{"http.sslCAInfo", certPath})
+	}
+
+	edit, _, err := planGitConfig(cmds, false)
+	if err != nil {
+		return nil, err
+	}
+	// The edit is kept even if the file already has the values, so they
+	// are still recorded.
+	for _, args := range cmds {
+		edit.Records = append(edit.Records, recordSetting("", args[0], gitConfigGet(args[0]), args[1]))
 	}
+	return []Change{edit}, nil
+}
+
+// proxy returns the http.proxy value. It carries the user name only:
+// given a proxy URL without a password, git asks its credential helper
+// for one, so the password can stay in the OS keychain instead of
+// .gitconfig.
+func (g *Git) proxy(cfg *config.Config) string {
+	a := cfg.AuthFor(cfg.Proxy.HTTP)
+	if a == nil {
+		return cfg.Proxy.HTTP
+	}
+	u, _ := url.Parse(cfg.Proxy.HTTP)
+	u.User = url.User(a.Username)
+	return u.String()
+}
 
-	if fileutil.DryRun {
-		fmt.Println("\n  [dry-run] Would run:")
-		for _, args := range cmds {
-			fmt.Printf("    %s\n", strings.Join(args, " "))
+func (g *Git) AuthMethod() string {
+	return "user name in http.proxy; git asks its credential helper for the password"
+}
+
+// PlanRemove restores each key ezproxy set to the value it had before
+// apply, or unsets it if it was not set. Keys the user has changed since
+// apply are left alone. Without a recorded state (applied by an older
+// ezproxy) both keys are unset. If ezproxy created the config file and
+// nothing is left in it, the file is deleted.
+func (g *Git) PlanRemove() ([]Change, error) {
+	keys := []string{"http.proxy", "http.sslCAInfo"}
+	t, recorded := State.Lookup(g.Name())
+
+	var cmds [][]string
+	for _, key := range keys {
+		if !recorded {
+			cmds = append(cmds, []string{"--unset", key})
+			continue
+		}
+		s, ok := t.Setting("", key)
+		if !ok {
+			continue
+		}
+		if current := gitConfigGet(key); current == nil || *current != s.Value {
+			continue
+		}
+		if s.Previous != nil {
+			cmds = append(cmds, []string{key, *s.Previous})
+		} else {
+			cmds = append(cmds, []string{"--unset", key})
 		}
-		return nil
 	}
+	edit, changed, err := planGitConfig(cmds, true)
+	if err != nil || !changed {
+		return nil, err
+	}
+	if strings.TrimSpace(string(edit.Content)) == "" && created(g.Name(), edit.Path) {
+		return []Change{FileEdit{Path: edit.Path, Delete: true}}, nil
+	}
+	return []Change{edit}, nil
+}
 
+// planGitConfig returns the edit to the global config that the "git
+// config" arguments in cmds make, and whether it changes the file. git
+// itself makes them, on a copy of the file, so the result is written the
+// way git would write it. A failed
+// command is an error unless ignoreErrors is set, as PlanRemove does since
+// --unset of a missing key fails.
+func planGitConfig(cmds [][]string, ignoreErrors bool) (FileEdit, bool, error) {
+	path := gitGlobalConfigPath()
+	data, err := fileutil.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return FileEdit{}, false, err
+	}
+	f, err := os.CreateTemp("", "ezproxy-gitconfig-*")
+	if err != nil {
+		return FileEdit{}, false, err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return FileEdit{}, false, err
+	}
+	if err := f.Close(); err != nil {
+		return FileEdit{}, false, err
+	}
 	for _, args := range cmds {
-		if err := exec.Command(args[0], args[1:]...).Run(); err != nil {
-			return err
+		out, err := exec.Command("git", append([]string{"config", "--file", f.Name()}, args...)...).CombinedOutput()
+		if err != nil && !ignoreErrors {
+			return FileEdit{}, false, fmt.Errorf("git config %s: %s", args[0], strings.TrimSpace(string(out)))
 		}
 	}
-	return nil
+	out, err := os.ReadFile(f.Name())
+	if err != nil {
+		return FileEdit{}, false, err
+	}
+	return FileEdit{Path: path, Content: out, Mode: 0644}, !bytes.Equal(out, data), nil
 }
 
-func (g *Git) Remove() error {
-	keys := []string{"http.proxy", "http.sslCAInfo"}
-	if fileutil.DryRun {
-		fmt.Println("\n  [dry-run] Would run:")
-		for _, key := range keys {
-			fmt.Printf("    git config --global --unset %s\n", key)
-		}
+// gitConfigGet returns the global value of key, or nil if it is not set.
+func gitConfigGet(key string) *string {
+	out, err := exec.Command("git", "config", "--global", "--get", key).Output()
+	if err != nil {
 		return nil
 	}
-	for _, key := range keys {
-		exec.Command("git", "config", "--global", "--unset", key).Run()
-	}
-	return nil
+	v := strings.TrimRight(string(out), "\n")
+	return &v
 }
 
 func (g *Git) Status(cfg *config.Config) (string, error) {
-	out, err := exec.Command("git", "config", "--global", "http.proxy").Output()
-	if err != nil || strings.TrimSpace(string(out)) == "" {
-		return "not configured", nil
+	keys := []string{"http.proxy"}
+	expected := map[string]string{"http.proxy": g.proxy(cfg)}
+	if certPath := cfg.TrustBundlePath(); certPath != "" {
+		keys = append(keys, "http.sslCAInfo")
+		expected["http.sslCAInfo"] = certPath
+	}
+	actual := make(map[string]*string)
+	for _, k := range keys {
+		actual[k] = gitConfigGet(k)
+	}
+	return compareValues(keys, expected, actual), nil
+}
+
+// gitGlobalConfigPath returns the file "git config --global" writes to:
+// ~/.gitconfig, unless only the XDG config file exists.
+func gitGlobalConfigPath() string {
+	if p := os.Getenv("GIT_CONFIG_GLOBAL"); p != "" {
+		return p
+	}
+	home, _ := os.UserHomeDir()
+	path := filepath.Join(home, ".gitconfig")
+	if fileExists(path) {
+		return path
+	}
+	xdg := os.Getenv("XDG_CONFIG_HOME")
+	if xdg == "" {
+		xdg = filepath.Join(home, ".config")
 	}
-	current := strings.TrimSpace(string(out))
-	if current == cfg.Proxy.HTTP {
-		return "configured", nil
+	if p := filepath.Join(xdg, "git", "config"); fileExists(p) {
+		return p
 	}
-	return "stale", nil
+	return path
 }
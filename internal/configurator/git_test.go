@@ -27,7 +27,7 @@ func TestGitApplyAndRemove(t *testing.T) {
 		CACert: "/tmp/ca.pem",
 	}
 
-	if err := g.Apply(cfg); err != nil {
+	if err := Apply(g, cfg); err != nil {
 		t.Fatalf("Apply failed: %v", err)
 	}
 
@@ -41,7 +41,7 @@ func TestGitApplyAndRemove(t *testing.T) {
 		t.Errorf("http.sslCAInfo = %q", strings.TrimSpace(string(out)))
 	}
 
-	if err := g.Remove(); err != nil {
+	if err := Remove(g); err != nil {
 		t.Fatalf("Remove failed: %v", err)
 	}
 
@@ -50,3 +50,78 @@ func TestGitApplyAndRemove(t *testing.T) {
 		t.Error("http.proxy should be unset after Remove")
 	}
 }
+
+func TestGitRemoveDeletesCreatedConfig(t *testing.T) {
+	if !detect.IsCommandAvailable("git") {
+		t.Skip("git not available")
+	}
+
+	gitconfig := filepath.Join(t.TempDir(), ".gitconfig")
+	t.Setenv("GIT_CONFIG_GLOBAL", gitconfig)
+	State.Forget("git")
+	defer State.Forget("git")
+
+	g := &Git{}
+	if err := Apply(g, &config.Config{Proxy: config.ProxyConfig{HTTP: "http://proxy:8080"}}); err != nil {
+		t.Fatalf("Apply failed: %v", err)
+	}
+	if err := Remove(g); err != nil {
+		t.Fatalf("Remove failed: %v", err)
+	}
+	if _, err := os.Stat(gitconfig); !os.IsNotExist(err) {
+		t.Errorf("%s left behind after Remove: %v", gitconfig, err)
+	}
+}
+
+func TestGitRemoveRestoresPreviousValue(t *testing.T) {
+	if !detect.IsCommandAvailable("git") {
+		t.Skip("git not available")
+	}
+
+	dir := t.TempDir()
+	gitconfig := filepath.Join(dir, ".gitconfig")
+	os.WriteFile(gitconfig, []byte("[http]\n\tproxy = http://mine:3128\n"), 0644)
+	t.Setenv("GIT_CONFIG_GLOBAL", gitconfig)
+
+	g := &Git{}
+	cfg := &config.Config{Proxy: config.ProxyConfig{HTTP: "http://proxy:8080"}}
+	if err := Apply(g, cfg); err != nil {
+		t.Fatalf("Apply failed: %v", err)
+	}
+	if err := Remove(g); err != nil {
+		t.Fatalf("Remove failed: %v", err)
+	}
+
+	out, _ := exec.Command("git", "config", "--global", "http.proxy").Output()
+	if got := strings.TrimSpace(string(out)); got != "http://mine:3128" {
+		t.Errorf("http.proxy = %q, want the value from before apply", got)
+	}
+}
+
+func TestGitWritesXDGConfig(t *testing.T) {
+	if !detect.IsCommandAvailable("git") {
+		t.Skip("git not available")
+	}
+
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	t.Setenv("GIT_CONFIG_GLOBAL", "")
+	t.Setenv("XDG_CONFIG_HOME", "")
+	xdg := filepath.Join(home, ".config", "git", "config")
+	os.MkdirAll(filepath.Dir(xdg), 0755)
+	os.WriteFile(xdg, []byte("[user]\n\tname = Me\n"), 0644)
+
+	cfg := &config.Config{Proxy: config.ProxyConfig{HTTP: "http://proxy:8080"}}
+	if err := Apply(&Git{}, cfg); err != nil {
+		t.Fatalf("Apply failed: %v", err)
+	}
+
+	// Without a ~/.gitconfig, git itself uses the XDG file; so does ezproxy.
+	if fileExists(filepath.Join(home, ".gitconfig")) {
+		t.Error("Apply created ~/.gitconfig next to the XDG config")
+	}
+	out, _ := exec.Command("git", "config", "--file", xdg, "http.proxy").Output()
+	if got := strings.TrimSpace(string(out)); got != "http://proxy:8080" {
+		t.Errorf("http.proxy in the XDG config = %q", got)
+	}
+}
@@ -8,6 +8,7 @@ import (
 	"github.com/andrew/ezproxy/internal/config"
 	"github.com/andrew/ezproxy/internal/detect"
 	"github.com/andrew/ezproxy/internal/fileutil"
+	"github.com/andrew/ezproxy/internal/noproxy"
 )
 
 // Golang configures Go module proxy settings (GOPRIVATE, GONOSUMDB).
@@ -17,11 +18,13 @@ type Golang struct{}
 
 func (g *Golang) Name() string { return "go" }
 
+func (g *Golang) NoProxyDialect() noproxy.Dialect { return noproxy.Go }
+
 func (g *Golang) IsAvailable(_ detect.OSInfo) bool {
 	return detect.IsCommandAvailable("go")
 }
 
-func (g *Golang) Apply(cfg *config.Config) error {
+func (g *Golang) Plan(cfg *config.Config) ([]Change, error) {
 	// Go uses the system cert store and respects HTTP_PROXY/HTTPS_PROXY
 	// from the environment (handled by env_vars configurator).
 	//
@@ -29,11 +32,10 @@ func (g *Golang) Apply(cfg *config.Config) error {
 	// and GONOSUMDB so private modules don't leak to the public sum DB.
 	// We write these to the shell profile alongside the other env vars.
 
-	shell := detect.DetectShell()
 	profiles := detect.ShellProfiles()
 
 	if len(profiles) == 0 {
-		return fmt.Errorf("no shell profile found")
+		return nil, fmt.Errorf("no shell profile found")
 	}
 
 	var content string
@@ -49,23 +51,41 @@ func (g *Golang) Apply(cfg *config.Config) error {
 			"# export GONOSUMDB=\"$GOPRIVATE\"\n"
 	}
 
-	if fileutil.DryRun {
-		fmt.Printf("\n  [dry-run] Would add Go module comments to shell profile\n")
-		fmt.Printf("  Note: Go uses system cert store and HTTP_PROXY from env_vars.\n")
-		fmt.Printf("  Set GOPRIVATE for any internal Go module hosts.\n")
-		return nil
+	// Only write to the first profile, in a block of its own next to the
+	// env_vars one. An unnamed block from an older version belongs to
+	// env_vars; label it so it isn't mistaken for ours.
+	data, err := fileutil.ReadFile(profiles[0])
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
 	}
-
-	// Only write to the first profile
-	return fileutil.UpsertMarkerBlock(profiles[0], content, goMarkerComment(shell))
+	existing := fileutil.NameMarkerBlock(string(data), "env_vars", "#")
+	return []Change{
+		Note{Text: "Note: Go uses system cert store and HTTP_PROXY from env_vars.\n" +
+			"Set GOPRIVATE for any internal Go module hosts."},
+		FileEdit{Path: profiles[0], Content: []byte(fileutil.SetMarkerBlock(existing, g.Name(), content, "#")), Mode: 0644},
+	}, nil
 }
 
-func (g *Golang) Remove() error {
-	shell := detect.DetectShell()
+func (g *Golang) PlanRemove() ([]Change, error) {
+	var changes []Change
 	for _, profile := range detect.ShellProfiles() {
-		fileutil.RemoveMarkerBlock(profile, goMarkerComment(shell))
+		data, err := fileutil.ReadFile(profile)
+		if err != nil {
+			continue
+		}
+		content := fileutil.NameMarkerBlock(string(data), "env_vars", "#")
+		content = fileutil.DeleteMarkerBlock(content, g.Name(), "#")
+		if content == string(data) {
+			continue
+		}
+		switch {
+		case strings.TrimSpace(content) == "" && created(g.Name(), profile):
+			changes = append(changes, FileEdit{Path: profile, Delete: true})
+		default:
+			changes = append(changes, FileEdit{Path: profile, Content: []byte(content), Mode: 0644})
+		}
 	}
-	return nil
+	return changes, nil
 }
 
 func (g *Golang) Status(cfg *config.Config) (string, error) {
@@ -75,19 +95,11 @@ func (g *Golang) Status(cfg *config.Config) (string, error) {
 	}
 
 	// Check shell profiles for our marker
-	shell := detect.DetectShell()
 	for _, profile := range detect.ShellProfiles() {
-		if fileutil.HasMarkerBlock(profile, goMarkerComment(shell)) {
+		if fileutil.HasMarkerBlock(profile, g.Name(), "#") {
 			return "configured (GOPRIVATE not yet set)", nil
 		}
 	}
 
 	return "not configured", nil
 }
-
-func goMarkerComment(shell string) string {
-	if strings.Contains(shell, "fish") {
-		return "#"
-	}
-	return "#"
-}
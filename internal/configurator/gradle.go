@@ -9,7 +9,8 @@ import (
 
 	"github.com/andrew/ezproxy/internal/config"
 	"github.com/andrew/ezproxy/internal/detect"
-	"github.com/andrew/ezproxy/internal/fileutil"
+	"github.com/andrew/ezproxy/internal/escape"
+	"github.com/andrew/ezproxy/internal/noproxy"
 )
 
 type Gradle struct {
@@ -18,6 +19,8 @@ type Gradle struct {
 
 func (g *Gradle) Name() string { return "gradle" }
 
+func (g *Gradle) NoProxyDialect() noproxy.Dialect { return noproxy.Java }
+
 func (g *Gradle) IsAvailable(_ detect.OSInfo) bool {
 	return detect.IsCommandAvailable("gradle")
 }
@@ -30,35 +33,53 @@ func (g *Gradle) getPath() string {
 	return filepath.Join(home, ".gradle", "gradle.properties")
 }
 
-func (g *Gradle) Apply(cfg *config.Config) error {
-	path := g.getPath()
+func (g *Gradle) Plan(cfg *config.Config) ([]Change, error) {
+	edit, err := upsertBlock(g.Name(), g.getPath(), g.content(cfg))
+	if err != nil {
+		return nil, err
+	}
+	edit.Private = hasAuth(cfg)
+	return []Change{edit}, nil
+}
+
+func (g *Gradle) AuthMethod() string {
+	return "proxyUser and proxyPassword in gradle.properties (mode 0600)"
+}
 
+func (g *Gradle) content(cfg *config.Config) string {
 	httpHost, httpPort := parseProxyURL(cfg.Proxy.HTTP)
 	httpsHost, httpsPort := parseProxyURL(cfg.Proxy.HTTPS)
-	nonProxy := toJavaNonProxyHosts(cfg.Proxy.NoProxy)
+	nonProxy := noProxy(noproxy.Java, cfg)
 
 	lines := []string{
-		fmt.Sprintf("systemProp.http.proxyHost=%s", httpHost),
-		fmt.Sprintf("systemProp.http.proxyPort=%s", httpPort),
-		fmt.Sprintf("systemProp.http.nonProxyHosts=%s", nonProxy),
-		fmt.Sprintf("systemProp.https.proxyHost=%s", httpsHost),
-		fmt.Sprintf("systemProp.https.proxyPort=%s", httpsPort),
-		fmt.Sprintf("systemProp.https.nonProxyHosts=%s", nonProxy),
+		fmt.Sprintf("systemProp.http.proxyHost=%s", escape.Properties(httpHost)),
+		fmt.Sprintf("systemProp.http.proxyPort=%s", escape.Properties(httpPort)),
+		fmt.Sprintf("systemProp.http.nonProxyHosts=%s", escape.Properties(nonProxy)),
+	}
+	if a := cfg.AuthFor(cfg.Proxy.HTTP); a != nil {
+		lines = append(lines,
+			fmt.Sprintf("systemProp.http.proxyUser=%s", escape.Properties(a.Username)),
+			fmt.Sprintf("systemProp.http.proxyPassword=%s", escape.Properties(a.Password)))
+	}
+	lines = append(lines,
+		fmt.Sprintf("systemProp.https.proxyHost=%s", escape.Properties(httpsHost)),
+		fmt.Sprintf("systemProp.https.proxyPort=%s", escape.Properties(httpsPort)),
+		fmt.Sprintf("systemProp.https.nonProxyHosts=%s", escape.Properties(nonProxy)))
+	if a := cfg.AuthFor(cfg.Proxy.HTTPS); a != nil {
+		lines = append(lines,
+			fmt.Sprintf("systemProp.https.proxyUser=%s", escape.Properties(a.Username)),
+			fmt.Sprintf("systemProp.https.proxyPassword=%s", escape.Properties(a.Password)))
 	}
 
-	content := strings.Join(lines, "\n") + "\n"
-	return fileutil.UpsertMarkerBlock(path, content, "#")
+	return strings.Join(lines, "\n") + "\n"
 }
 
-func (g *Gradle) Remove() error {
-	return fileutil.RemoveMarkerBlock(g.getPath(), "#")
+func (g *Gradle) PlanRemove() ([]Change, error) {
+	return removeBlock(g.Name(), g.getPath())
 }
 
 func (g *Gradle) Status(cfg *config.Config) (string, error) {
-	if fileutil.HasMarkerBlock(g.getPath(), "#") {
-		return "configured", nil
-	}
-	return "not configured", nil
+	return blockStatus(g.Name(), g.getPath(), g.content(cfg)), nil
 }
 
 // parseProxyURL extracts host and port from a proxy URL like http://proxy:8080
@@ -78,26 +99,3 @@ func parseProxyURL(proxyURL string) (host, port string) {
 	}
 	return host, port
 }
-
-// toJavaNonProxyHosts converts comma-separated NO_PROXY to pipe-separated Java format.
-// Also converts .domain.com to *.domain.com as Java expects.
-func toJavaNonProxyHosts(noProxy string) string {
-	parts := strings.Split(noProxy, ",")
-	var result []string
-	for _, p := range parts {
-		p = strings.TrimSpace(p)
-		if p == "" {
-			continue
-		}
-		// Java uses *.domain.com, NO_PROXY uses .domain.com
-		if strings.HasPrefix(p, ".") {
-			p = "*" + p
-		}
-		// Strip CIDR notation - Java nonProxyHosts doesn't support it
-		if strings.Contains(p, "/") {
-			continue
-		}
-		result = append(result, p)
-	}
-	return strings.Join(result, "|")
-}
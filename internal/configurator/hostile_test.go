@@ -0,0 +1,395 @@
+package configurator
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/andrew/ezproxy/internal/config"
+	"github.com/andrew/ezproxy/internal/fileutil"
+)
+
+// Values that end a quoted string, start a comment, run a command or
+// expand a variable in one of the syntaxes ezproxy writes.
+const (
+	hostileURL      = "http://proxy.corp.com:8080/$(touch pwned);a&b|c'd\"e\\f%25g`id` #x"
+	hostileUser     = "al'ice $(touch pwned)"
+	hostilePassword = "p$a;s&s|w\"o\\rd #%41${HOME}'"
+	hostileNoProxy  = "localhost,$(reboot),a;b,'q',.corp.com"
+)
+
+// hostileConfig returns a config whose proxy URL, credentials, NO_PROXY
+// and CA bundle path are all hostile. The credentials are for
+// hostileAuthURL, a proxy they can be added to.
+func hostileConfig(t *testing.T) *config.Config {
+	return &config.Config{
+		Proxy:    config.ProxyConfig{HTTP: hostileURL, HTTPS: hostileAuthURL, NoProxy: hostileNoProxy},
+		CACert:   "/etc/corp-ca.pem",
+		CABundle: filepath.Join(t.TempDir(), "ca dir", "it's $HOME; \"q\" `id`.pem"),
+		Auth:     &config.ProxyAuth{Host: "proxy.corp.com:8443", Username: hostileUser, Password: hostilePassword},
+	}
+}
+
+const hostileAuthURL = "http://proxy.corp.com:8443"
+
+// checkNoProxy fails if a NO_PROXY entry that isn't a host made it into
+// out. Such entries are dropped before any encoder sees them.
+func checkNoProxy(t *testing.T, tool, out string) {
+	t.Helper()
+	for _, bad := range []string{"reboot", "a;b", "'q'"} {
+		if strings.Contains(out, bad) {
+			t.Errorf("%s: invalid NO_PROXY entry %q written:\n%s", tool, bad, out)
+		}
+	}
+}
+
+// lineValues maps each "key<sep>value" line of content to its value.
+func lineValues(content, sep string) map[string]string {
+	values := make(map[string]string)
+	for _, line := range strings.Split(content, "\n") {
+		if k, v, ok := strings.Cut(line, sep); ok {
+			values[strings.TrimSpace(k)] = v
+		}
+	}
+	return values
+}
+
+func TestHostile_EnvVars(t *testing.T) {
+	dir := t.TempDir()
+	profile := filepath.Join(dir, ".profile")
+	os.WriteFile(profile, nil, 0644)
+	cfg := hostileConfig(t)
+	cfg.Proxy.HTTP = hostileAuthURL
+	cfg.Proxy.HTTPS = hostileURL
+	e := &EnvVars{profiles: []string{profile}, authPath: filepath.Join(dir, "proxy auth")}
+	if err := Apply(e, cfg); err != nil {
+		t.Fatalf("Apply: %v", err)
+	}
+
+	sh := exec.Command("sh", "-c", `. "$1" && printf '%s\n' "$HTTP_PROXY" "$HTTPS_PROXY" "$SSL_CERT_FILE" "$NO_PROXY"`, "sh", profile)
+	sh.Dir = dir
+	out, err := sh.Output()
+	if err != nil {
+		t.Fatalf("sourcing the profile: %v", err)
+	}
+	want := strings.Join([]string{cfg.WithAuth(hostileAuthURL), hostileURL, cfg.TrustBundlePath(), "localhost,.corp.com"}, "\n") + "\n"
+	if string(out) != want {
+		t.Errorf("the shell read\n%s\nwant\n%s", out, want)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "pwned")); err == nil {
+		t.Error("sourcing the profile ran a command from the proxy URL")
+	}
+}
+
+func TestHostile_Curl(t *testing.T) {
+	cfg := hostileConfig(t)
+	cfg.Proxy.HTTP = hostileAuthURL
+	content := (&Curl{}).content(cfg)
+	checkNoProxy(t, "curl", content)
+	values := lineValues(content, " = ")
+	for key, want := range map[string]string{
+		"proxy-user": hostileUser + ":" + hostilePassword,
+		"cacert":     cfg.TrustBundlePath(),
+	} {
+		if got, err := strconv.Unquote(values[key]); err != nil || got != want {
+			t.Errorf("%s = %s, read as %q (%v), want %q", key, values[key], got, err, want)
+		}
+	}
+	cfg.Proxy.HTTP = hostileURL
+	if got, _ := strconv.Unquote(lineValues((&Curl{}).content(cfg), " = ")["proxy"]); got != hostileURL {
+		t.Errorf("proxy read as %q", got)
+	}
+}
+
+func TestHostile_Wget(t *testing.T) {
+	cfg := hostileConfig(t)
+	cfg.Proxy.HTTP, cfg.Proxy.HTTPS = hostileAuthURL, hostileURL
+	content, err := (&Wget{}).content(cfg)
+	if err != nil {
+		t.Fatalf("content: %v", err)
+	}
+	checkNoProxy(t, "wget", content)
+	values := lineValues(content, " = ")
+	for key, want := range map[string]string{
+		"https_proxy":    hostileURL,
+		"proxy_user":     hostileUser,
+		"proxy_password": hostilePassword,
+		"ca_certificate": cfg.TrustBundlePath(),
+	} {
+		if values[key] != want {
+			t.Errorf("%s = %q, want %q", key, values[key], want)
+		}
+	}
+
+	cfg.Auth.Password = "s3cret\npass"
+	if _, err := (&Wget{}).content(cfg); err == nil || strings.Contains(err.Error(), "s3cret") {
+		t.Errorf("line break in the password: err = %v", err)
+	}
+}
+
+func TestHostile_Npm(t *testing.T) {
+	cfg := hostileConfig(t)
+	content := (&Npm{}).content(cfg)
+	checkNoProxy(t, "npm", content)
+	values := lineValues(content, "=")
+	for key, want := range map[string]string{
+		"proxy":       hostileURL,
+		"https-proxy": cfg.WithAuth(hostileAuthURL),
+		"cafile":      cfg.TrustBundlePath(),
+	} {
+		got := values[key]
+		if strings.HasPrefix(got, `"`) {
+			json.Unmarshal([]byte(got), &got)
+		}
+		if got != want {
+			t.Errorf("%s = %s, read as %q, want %q", key, values[key], got, want)
+		}
+	}
+}
+
+func TestHostile_Yarn(t *testing.T) {
+	cfg := hostileConfig(t)
+	y := &Yarn{}
+	want := map[string]string{"proxy": hostileURL, "https-proxy": cfg.WithAuth(hostileAuthURL), "cafile": cfg.TrustBundlePath()}
+	for key, v := range lineValues(y.v1Content(cfg), " ") {
+		var got string
+		if err := json.Unmarshal([]byte(v), &got); err != nil || got != want[key] {
+			t.Errorf(".yarnrc %s = %s, read as %q (%v), want %q", key, v, got, err, want[key])
+		}
+	}
+
+	var v2 map[string]string
+	if err := yaml.Unmarshal([]byte(y.v2Content(cfg)), &v2); err != nil {
+		t.Fatalf(".yarnrc.yml: %v", err)
+	}
+	if v2["httpProxy"] != hostileURL || v2["httpsProxy"] != want["https-proxy"] || v2["caFilePath"] != want["cafile"] {
+		t.Errorf(".yarnrc.yml read as %q", v2)
+	}
+}
+
+func TestHostile_Pip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "pip.conf")
+	cfg := hostileConfig(t)
+	if err := Apply(&Pip{path: path}, cfg); err != nil {
+		t.Fatalf("Apply: %v", err)
+	}
+	data, _ := os.ReadFile(path)
+	values := lineValues(string(data), " = ")
+	if values["proxy"] != hostileURL || values["cert"] != cfg.TrustBundlePath() {
+		t.Errorf("pip.conf:\n%s", data)
+	}
+
+	cfg.Proxy.HTTP = "http://proxy:8080/\n[global]"
+	if err := Apply(&Pip{path: path}, cfg); err == nil {
+		t.Error("line break in the proxy URL written to pip.conf")
+	}
+}
+
+func TestHostile_CargoAndPodman(t *testing.T) {
+	dir := t.TempDir()
+	cfg := hostileConfig(t)
+	cargo := filepath.Join(dir, "config.toml")
+	if err := Apply(&Cargo{path: cargo}, cfg); err != nil {
+		t.Fatalf("cargo Apply: %v", err)
+	}
+	data, _ := os.ReadFile(cargo)
+	for key, want := range map[string]string{"proxy": hostileURL, "cainfo": cfg.TrustBundlePath()} {
+		v := fileutil.GetKey(fileutil.TOML, string(data), "http", key)
+		if v == nil {
+			t.Fatalf("cargo: no http.%s in\n%s", key, data)
+		}
+		if got, err := strconv.Unquote(*v); err != nil || got != want {
+			t.Errorf("cargo http.%s = %s, read as %q (%v)", key, *v, got, err)
+		}
+	}
+
+	podman := filepath.Join(dir, "containers.conf")
+	if err := Apply(&Podman{path: podman}, cfg); err != nil {
+		t.Fatalf("podman Apply: %v", err)
+	}
+	data, _ = os.ReadFile(podman)
+	checkNoProxy(t, "podman", string(data))
+	env := fileutil.GetKey(fileutil.TOML, string(data), "containers", "env")
+	if env == nil {
+		t.Fatalf("podman: no env in\n%s", data)
+	}
+	var got []string
+	for _, s := range tomlStringRe.FindAllString(*env, -1) {
+		u, err := strconv.Unquote(s)
+		if err != nil {
+			t.Fatalf("podman env entry %s: %v", s, err)
+		}
+		got = append(got, u)
+	}
+	if len(got) != 6 || got[0] != "http_proxy="+hostileURL || got[1] != "https_proxy="+cfg.WithAuth(hostileAuthURL) {
+		t.Errorf("podman env read as %q", got)
+	}
+}
+
+func TestHostile_Conda(t *testing.T) {
+	path := filepath.Join(t.TempDir(), ".condarc")
+	cfg := hostileConfig(t)
+	if err := Apply(&Conda{path: path}, cfg); err != nil {
+		t.Fatalf("Apply: %v", err)
+	}
+	data, _ := os.ReadFile(path)
+	var condarc struct {
+		ProxyServers map[string]string `yaml:"proxy_servers"`
+		SSLVerify    string            `yaml:"ssl_verify"`
+	}
+	if err := yaml.Unmarshal(data, &condarc); err != nil {
+		t.Fatalf(".condarc: %v\n%s", err, data)
+	}
+	if condarc.ProxyServers["http"] != hostileURL || condarc.ProxyServers["https"] != cfg.WithAuth(hostileAuthURL) || condarc.SSLVerify != cfg.TrustBundlePath() {
+		t.Errorf(".condarc read as %+v", condarc)
+	}
+}
+
+func TestHostile_DockerDaemon(t *testing.T) {
+	cfg := hostileConfig(t)
+	content := (&Docker{}).daemonContent(cfg)
+	checkNoProxy(t, "docker daemon", content)
+	var env []string
+	for _, line := range strings.Split(content, "\n") {
+		if v, ok := strings.CutPrefix(line, "Environment="); ok {
+			u, err := strconv.Unquote(strings.ReplaceAll(v, "%%", "%"))
+			if err != nil {
+				t.Fatalf("%s: %v", line, err)
+			}
+			env = append(env, u)
+		}
+	}
+	if len(env) != 3 || env[0] != "HTTP_PROXY="+hostileURL || env[1] != "HTTPS_PROXY="+hostileAuthURL {
+		t.Errorf("systemd reads %q from\n%s", env, content)
+	}
+}
+
+func TestHostile_Gradle(t *testing.T) {
+	cfg := hostileConfig(t)
+	cfg.Proxy.HTTP = hostileAuthURL
+	content := (&Gradle{}).content(cfg)
+	values := lineValues(content, "=")
+	for key, want := range map[string]string{
+		"systemProp.http.proxyUser":     hostileUser,
+		"systemProp.http.proxyPassword": hostilePassword,
+	} {
+		if got := readProperty(values[key]); got != want {
+			t.Errorf("%s = %s, read as %q, want %q", key, values[key], got, want)
+		}
+	}
+}
+
+// readProperty undoes the escapes of a .properties value.
+func readProperty(v string) string {
+	var b strings.Builder
+	for i := 0; i < len(v); i++ {
+		if v[i] != '\\' || i+1 == len(v) {
+			b.WriteByte(v[i])
+			continue
+		}
+		i++
+		switch v[i] {
+		case 'n':
+			b.WriteByte('\n')
+		case 't':
+			b.WriteByte('\t')
+		case 'u':
+			r, _ := strconv.ParseUint(v[i+1:i+5], 16, 32)
+			b.WriteRune(rune(r))
+			i += 4
+		default:
+			b.WriteByte(v[i])
+		}
+	}
+	return b.String()
+}
+
+func TestHostile_Maven(t *testing.T) {
+	cfg := hostileConfig(t)
+	out := renderMavenProxies((&Maven{}).proxies(cfg), "", "  ", "\n")
+	dec := xml.NewDecoder(strings.NewReader(out))
+	var got []mavenProxy
+	for {
+		var p mavenProxy
+		if err := dec.Decode(&p); err != nil {
+			break
+		}
+		got = append(got, p)
+	}
+	if len(got) != 2 || got[1].Username != hostileUser || got[1].Password != hostilePassword {
+		t.Errorf("settings.xml read as %+v from\n%s", got, out)
+	}
+}
+
+func TestHostile_SSH(t *testing.T) {
+	cfg := hostileConfig(t)
+	cfg.Proxy.HTTP = hostileAuthURL
+	content, err := (&SSH{}).content(cfg)
+	if err != nil {
+		t.Fatalf("content: %v", err)
+	}
+	checkNoProxy(t, "ssh", content)
+	_, command, ok := strings.Cut(content, "ProxyCommand nc ")
+	if !ok {
+		t.Fatalf("no ProxyCommand in\n%s", content)
+	}
+	// ssh expands %h and %p, then runs the command with the shell.
+	command = strings.NewReplacer("%%", "%", "%h", "git.example.com", "%p", "22").Replace(strings.TrimSpace(command))
+	dir := t.TempDir()
+	sh := exec.Command("sh", "-c", `printf '%s\n' `+command)
+	sh.Dir = dir
+	out, err := sh.Output()
+	if err != nil {
+		t.Fatalf("sh: %v", err)
+	}
+	want := strings.Join([]string{"-X", "connect", "-P", hostileUser, "-x", "proxy.corp.com:8443", "git.example.com", "22"}, "\n") + "\n"
+	if string(out) != want {
+		t.Errorf("nc gets\n%s\nwant\n%s", out, want)
+	}
+}
+
+func TestHostile_Apt(t *testing.T) {
+	cfg := hostileConfig(t)
+	content := (&Apt{}).content(cfg)
+	checkNoProxy(t, "apt", content)
+	want := `"` + strings.NewReplacer(`"`, "%22", `\`, "%5C").Replace(hostileURL) + `";`
+	if got := lineValues(content, " ")["Acquire::http::Proxy"]; got != want {
+		t.Errorf("Acquire::http::Proxy %s, want %s", got, want)
+	}
+}
+
+func TestHostile_YumKeys(t *testing.T) {
+	cfg := hostileConfig(t)
+	keys, err := (&Yum{}).keys(cfg)
+	if err != nil {
+		t.Fatalf("keys: %v", err)
+	}
+	content := "[main]\ngpgcheck=1\nproxy=http://old:3128\n"
+	for _, k := range keys {
+		if content, err = yumSet(content, k.Name, &k.Value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := yumGet(content, "proxy"); got == nil || *got != hostileURL {
+		t.Errorf("proxy read back as %v from\n%s", got, content)
+	}
+
+	cfg.Proxy.HTTP = "http://proxy:8080\nexclude=*"
+	if _, err := (&Yum{}).keys(cfg); err == nil {
+		t.Error("line break in the proxy URL written to dnf.conf")
+	}
+}
+
+func TestHostile_Bundler(t *testing.T) {
+	path := hostileConfig(t).TrustBundlePath()
+	if got := bundleGet(bundleSet("---\n", bundleCAKey, &path), bundleCAKey); got == nil || *got != path {
+		t.Errorf("BUNDLE_SSL_CA_CERT read back as %v", got)
+	}
+}
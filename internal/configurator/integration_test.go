@@ -20,7 +20,7 @@ func testConfig(certPath string) *config.Config {
 			NoProxy: "localhost,127.0.0.1,.corp.com,10.0.0.0/8",
 		},
 		CACert: certPath,
-		Tools:  config.DefaultTools(),
+		Tools:  config.ToolsEnabled(config.DefaultTools()),
 	}
 }
 
@@ -32,7 +32,7 @@ func testConfigNoCert() *config.Config {
 			HTTPS:   "http://proxy.corp.com:8080",
 			NoProxy: "localhost,127.0.0.1,.corp.com,10.0.0.0/8",
 		},
-		Tools: config.DefaultTools(),
+		Tools: config.ToolsEnabled(config.DefaultTools()),
 	}
 }
 
@@ -64,7 +64,7 @@ func TestIntegration_EnvVars_ApplyAndRemove(t *testing.T) {
 	e := &EnvVars{profiles: []string{bashrc}}
 
 	// Apply
-	if err := e.Apply(cfg); err != nil {
+	if err := Apply(e, cfg); err != nil {
 		t.Fatalf("Apply: %v", err)
 	}
 
@@ -99,7 +99,7 @@ func TestIntegration_EnvVars_ApplyAndRemove(t *testing.T) {
 	}
 
 	// Remove
-	if err := e.Remove(); err != nil {
+	if err := Remove(e); err != nil {
 		t.Fatalf("Remove: %v", err)
 	}
 
@@ -128,7 +128,7 @@ func TestIntegration_Pip_ApplyAndRemove(t *testing.T) {
 
 	p := &Pip{path: path}
 
-	if err := p.Apply(cfg); err != nil {
+	if err := Apply(p, cfg); err != nil {
 		t.Fatalf("Apply: %v", err)
 	}
 
@@ -142,7 +142,7 @@ func TestIntegration_Pip_ApplyAndRemove(t *testing.T) {
 	assertEqual(t, "configured", status)
 
 	// Remove
-	p.Remove()
+	Remove(p)
 	status, _ = p.Status(cfg)
 	assertEqual(t, "not configured", status)
 }
@@ -157,7 +157,7 @@ func TestIntegration_Npm_ApplyAndRemove(t *testing.T) {
 
 	n := &Npm{path: path}
 
-	if err := n.Apply(cfg); err != nil {
+	if err := Apply(n, cfg); err != nil {
 		t.Fatalf("Apply: %v", err)
 	}
 
@@ -170,7 +170,7 @@ func TestIntegration_Npm_ApplyAndRemove(t *testing.T) {
 	status, _ := n.Status(cfg)
 	assertEqual(t, "configured", status)
 
-	n.Remove()
+	Remove(n)
 	status, _ = n.Status(cfg)
 	assertEqual(t, "not configured", status)
 }
@@ -185,7 +185,7 @@ func TestIntegration_Curl_ApplyAndRemove(t *testing.T) {
 
 	c := &Curl{path: path}
 
-	if err := c.Apply(cfg); err != nil {
+	if err := Apply(c, cfg); err != nil {
 		t.Fatalf("Apply: %v", err)
 	}
 
@@ -197,7 +197,7 @@ func TestIntegration_Curl_ApplyAndRemove(t *testing.T) {
 	status, _ := c.Status(cfg)
 	assertEqual(t, "configured", status)
 
-	c.Remove()
+	Remove(c)
 	status, _ = c.Status(cfg)
 	assertEqual(t, "not configured", status)
 }
@@ -212,7 +212,7 @@ func TestIntegration_Wget_ApplyAndRemove(t *testing.T) {
 
 	w := &Wget{path: path}
 
-	if err := w.Apply(cfg); err != nil {
+	if err := Apply(w, cfg); err != nil {
 		t.Fatalf("Apply: %v", err)
 	}
 
@@ -225,7 +225,7 @@ func TestIntegration_Wget_ApplyAndRemove(t *testing.T) {
 	status, _ := w.Status(cfg)
 	assertEqual(t, "configured", status)
 
-	w.Remove()
+	Remove(w)
 	status, _ = w.Status(cfg)
 	assertEqual(t, "not configured", status)
 }
@@ -240,7 +240,7 @@ func TestIntegration_Cargo_ApplyAndRemove(t *testing.T) {
 
 	c := &Cargo{path: path}
 
-	if err := c.Apply(cfg); err != nil {
+	if err := Apply(c, cfg); err != nil {
 		t.Fatalf("Apply: %v", err)
 	}
 
@@ -253,7 +253,7 @@ func TestIntegration_Cargo_ApplyAndRemove(t *testing.T) {
 	status, _ := c.Status(cfg)
 	assertEqual(t, "configured", status)
 
-	c.Remove()
+	Remove(c)
 	status, _ = c.Status(cfg)
 	assertEqual(t, "not configured", status)
 }
@@ -268,7 +268,7 @@ func TestIntegration_Conda_ApplyAndRemove(t *testing.T) {
 
 	c := &Conda{path: path}
 
-	if err := c.Apply(cfg); err != nil {
+	if err := Apply(c, cfg); err != nil {
 		t.Fatalf("Apply: %v", err)
 	}
 
@@ -282,7 +282,7 @@ func TestIntegration_Conda_ApplyAndRemove(t *testing.T) {
 	status, _ := c.Status(cfg)
 	assertEqual(t, "configured", status)
 
-	c.Remove()
+	Remove(c)
 	status, _ = c.Status(cfg)
 	assertEqual(t, "not configured", status)
 }
@@ -299,7 +299,7 @@ func TestIntegration_Yarn_V1_ApplyAndRemove(t *testing.T) {
 	// Use v1 paths — isV2OrLater will return false since yarn isn't installed
 	y := &Yarn{v1Path: v1Path, v2Path: v2Path}
 
-	if err := y.Apply(cfg); err != nil {
+	if err := Apply(y, cfg); err != nil {
 		t.Fatalf("Apply: %v", err)
 	}
 
@@ -312,7 +312,7 @@ func TestIntegration_Yarn_V1_ApplyAndRemove(t *testing.T) {
 	status, _ := y.Status(cfg)
 	assertEqual(t, "configured", status)
 
-	y.Remove()
+	Remove(y)
 	status, _ = y.Status(cfg)
 	assertEqual(t, "not configured", status)
 }
@@ -326,7 +326,7 @@ func TestIntegration_Docker_ApplyAndRemove(t *testing.T) {
 
 	d := &Docker{configPath: path}
 
-	if err := d.Apply(cfg); err != nil {
+	if err := Apply(d, cfg); err != nil {
 		t.Fatalf("Apply: %v", err)
 	}
 
@@ -350,7 +350,7 @@ func TestIntegration_Docker_ApplyAndRemove(t *testing.T) {
 	status, _ := d.Status(cfg)
 	assertEqual(t, "configured", status)
 
-	d.Remove()
+	Remove(d)
 	status, _ = d.Status(cfg)
 	assertEqual(t, "not configured", status)
 }
@@ -366,7 +366,7 @@ func TestIntegration_Docker_PreservesExistingConfig(t *testing.T) {
 	cfg := testConfigNoCert()
 	d := &Docker{configPath: path}
 
-	d.Apply(cfg)
+	Apply(d, cfg)
 
 	data, _ := os.ReadFile(path)
 	var dockerConfig map[string]interface{}
@@ -392,7 +392,7 @@ func TestIntegration_SSH_ApplyAndRemove(t *testing.T) {
 
 	s := &SSH{path: path}
 
-	if err := s.Apply(cfg); err != nil {
+	if err := Apply(s, cfg); err != nil {
 		t.Fatalf("Apply: %v", err)
 	}
 
@@ -404,7 +404,7 @@ func TestIntegration_SSH_ApplyAndRemove(t *testing.T) {
 	status, _ := s.Status(cfg)
 	assertEqual(t, "configured", status)
 
-	s.Remove()
+	Remove(s)
 	status, _ = s.Status(cfg)
 	assertEqual(t, "not configured", status)
 }
@@ -418,7 +418,7 @@ func TestIntegration_Gradle_ApplyAndRemove(t *testing.T) {
 
 	g := &Gradle{path: path}
 
-	if err := g.Apply(cfg); err != nil {
+	if err := Apply(g, cfg); err != nil {
 		t.Fatalf("Apply: %v", err)
 	}
 
@@ -433,7 +433,7 @@ func TestIntegration_Gradle_ApplyAndRemove(t *testing.T) {
 	status, _ := g.Status(cfg)
 	assertEqual(t, "configured", status)
 
-	g.Remove()
+	Remove(g)
 	status, _ = g.Status(cfg)
 	assertEqual(t, "not configured", status)
 }
@@ -447,7 +447,7 @@ func TestIntegration_Maven_ApplyAndRemove(t *testing.T) {
 
 	m := &Maven{path: path}
 
-	if err := m.Apply(cfg); err != nil {
+	if err := Apply(m, cfg); err != nil {
 		t.Fatalf("Apply: %v", err)
 	}
 
@@ -463,7 +463,7 @@ func TestIntegration_Maven_ApplyAndRemove(t *testing.T) {
 	status, _ := m.Status(cfg)
 	assertEqual(t, "configured", status)
 
-	m.Remove()
+	Remove(m)
 	status, _ = m.Status(cfg)
 	assertEqual(t, "not configured", status)
 }
@@ -491,7 +491,7 @@ func TestIntegration_Maven_PreservesUserProxies(t *testing.T) {
 	os.WriteFile(path, []byte(existing), 0644)
 
 	m := &Maven{path: path}
-	m.Apply(cfg)
+	Apply(m, cfg)
 
 	data, _ := os.ReadFile(path)
 	got := string(data)
@@ -508,7 +508,7 @@ func TestIntegration_Podman_ApplyAndRemove(t *testing.T) {
 
 	p := &Podman{path: path}
 
-	if err := p.Apply(cfg); err != nil {
+	if err := Apply(p, cfg); err != nil {
 		t.Fatalf("Apply: %v", err)
 	}
 
@@ -522,11 +522,39 @@ func TestIntegration_Podman_ApplyAndRemove(t *testing.T) {
 	status, _ := p.Status(cfg)
 	assertEqual(t, "configured", status)
 
-	p.Remove()
+	Remove(p)
 	status, _ = p.Status(cfg)
 	assertEqual(t, "not configured", status)
 }
 
+func TestIntegration_Podman_KeepsUserEnv(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "containers.conf")
+	original := "[containers]\nenv = [\"TZ=UTC\"]\nlog_size_max = -1\n"
+	os.WriteFile(path, []byte(original), 0644)
+	cfg := testConfigNoCert()
+
+	p := &Podman{path: path}
+	if err := Apply(p, cfg); err != nil {
+		t.Fatalf("Apply: %v", err)
+	}
+
+	data, _ := os.ReadFile(path)
+	got := string(data)
+	assertContains(t, got, `"TZ=UTC",`)
+	assertContains(t, got, `"https_proxy=http://proxy.corp.com:8080"`)
+	assertContains(t, got, "log_size_max = -1")
+	if n := strings.Count(got, "[containers]"); n != 1 {
+		t.Errorf("[containers] appears %d times", n)
+	}
+	status, _ := p.Status(cfg)
+	assertEqual(t, "configured", status)
+
+	Remove(p)
+	data, _ = os.ReadFile(path)
+	assertEqual(t, original, string(data))
+}
+
 // --- Bundler ---
 
 func TestIntegration_Bundler_ApplyAndRemove(t *testing.T) {
@@ -537,7 +565,7 @@ func TestIntegration_Bundler_ApplyAndRemove(t *testing.T) {
 
 	b := &Bundler{path: path}
 
-	if err := b.Apply(cfg); err != nil {
+	if err := Apply(b, cfg); err != nil {
 		t.Fatalf("Apply: %v", err)
 	}
 
@@ -549,7 +577,7 @@ func TestIntegration_Bundler_ApplyAndRemove(t *testing.T) {
 	status, _ := b.Status(cfg)
 	assertEqual(t, "configured", status)
 
-	b.Remove()
+	Remove(b)
 	status, _ = b.Status(cfg)
 	assertEqual(t, "not configured", status)
 }
@@ -565,7 +593,7 @@ func TestIntegration_Bundler_PreservesExistingKeys(t *testing.T) {
 	cfg := testConfig(certPath)
 	b := &Bundler{path: path}
 
-	b.Apply(cfg)
+	Apply(b, cfg)
 
 	data, _ := os.ReadFile(path)
 	got := string(data)
@@ -573,6 +601,46 @@ func TestIntegration_Bundler_PreservesExistingKeys(t *testing.T) {
 	assertContains(t, got, "BUNDLE_SSL_CA_CERT")
 }
 
+// --- Bundler restores the user's previous CA cert ---
+
+func TestIntegration_Bundler_RestoresPreviousValue(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "config")
+	original := "---\nBUNDLE_GEMFILE: \"Gemfile.custom\"\nBUNDLE_SSL_CA_CERT: \"/etc/ssl/mine.pem\"\n"
+	os.WriteFile(path, []byte(original), 0644)
+
+	b := &Bundler{path: path}
+	Apply(b, testConfig("/tmp/corp-ca.pem"))
+	Remove(b)
+
+	data, _ := os.ReadFile(path)
+	assertEqual(t, original, string(data))
+}
+
+// --- Remove deletes files that ezproxy created ---
+
+func TestIntegration_RemoveDeletesCreatedFiles(t *testing.T) {
+	dir := t.TempDir()
+	cfg := testConfig("/tmp/corp-ca.pem")
+
+	created := filepath.Join(dir, ".npmrc")
+	n := &Npm{path: created}
+	Apply(n, cfg)
+	Remove(n)
+	if _, err := os.Stat(created); !os.IsNotExist(err) {
+		t.Error(".npmrc created by apply should be deleted by remove")
+	}
+
+	existing := filepath.Join(dir, ".curlrc")
+	os.WriteFile(existing, []byte(""), 0644)
+	c := &Curl{path: existing}
+	Apply(c, cfg)
+	Remove(c)
+	if _, err := os.Stat(existing); err != nil {
+		t.Error(".curlrc that existed before apply should be kept")
+	}
+}
+
 // --- Bundler no-op without cert ---
 
 func TestIntegration_Bundler_NoCert(t *testing.T) {
@@ -581,7 +649,7 @@ func TestIntegration_Bundler_NoCert(t *testing.T) {
 	cfg := testConfigNoCert()
 
 	b := &Bundler{path: path}
-	b.Apply(cfg)
+	Apply(b, cfg)
 
 	// File should not be created
 	if _, err := os.Stat(path); err == nil {
@@ -596,10 +664,6 @@ func TestIntegration_Idempotency(t *testing.T) {
 		name string
 		fn   func(dir string) (Configurator, string)
 	}{
-		{"pip", func(dir string) (Configurator, string) {
-			p := filepath.Join(dir, "pip.conf")
-			return &Pip{path: p}, p
-		}},
 		{"npm", func(dir string) (Configurator, string) {
 			p := filepath.Join(dir, ".npmrc")
 			return &Npm{path: p}, p
@@ -612,14 +676,6 @@ func TestIntegration_Idempotency(t *testing.T) {
 			p := filepath.Join(dir, ".wgetrc")
 			return &Wget{path: p}, p
 		}},
-		{"cargo", func(dir string) (Configurator, string) {
-			p := filepath.Join(dir, "config.toml")
-			return &Cargo{path: p}, p
-		}},
-		{"conda", func(dir string) (Configurator, string) {
-			p := filepath.Join(dir, ".condarc")
-			return &Conda{path: p}, p
-		}},
 		{"gradle", func(dir string) (Configurator, string) {
 			p := filepath.Join(dir, "gradle.properties")
 			return &Gradle{path: p}, p
@@ -638,12 +694,12 @@ func TestIntegration_Idempotency(t *testing.T) {
 			c, path := tt.fn(dir)
 
 			// Apply twice
-			c.Apply(cfg)
-			c.Apply(cfg)
+			Apply(c, cfg)
+			Apply(c, cfg)
 
 			data, _ := os.ReadFile(path)
 			got := string(data)
-			count := strings.Count(got, ">>> ezproxy >>>")
+			count := strings.Count(got, ">>> ezproxy:")
 			if count != 1 {
 				t.Errorf("expected 1 marker block, got %d", count)
 			}
@@ -651,6 +707,54 @@ func TestIntegration_Idempotency(t *testing.T) {
 	}
 }
 
+// --- Idempotency: apply twice, keys merged once ---
+
+func TestIntegration_IdempotencyMergedKeys(t *testing.T) {
+	tests := []struct {
+		name    string
+		section string
+		fn      func(dir string) (Configurator, string)
+	}{
+		{"pip", "[global]", func(dir string) (Configurator, string) {
+			p := filepath.Join(dir, "pip.conf")
+			return &Pip{path: p}, p
+		}},
+		{"cargo", "[http]", func(dir string) (Configurator, string) {
+			p := filepath.Join(dir, "config.toml")
+			return &Cargo{path: p}, p
+		}},
+		{"conda", "proxy_servers:", func(dir string) (Configurator, string) {
+			p := filepath.Join(dir, ".condarc")
+			return &Conda{path: p}, p
+		}},
+		{"podman", "[containers]", func(dir string) (Configurator, string) {
+			p := filepath.Join(dir, "containers.conf")
+			return &Podman{path: p}, p
+		}},
+	}
+
+	cfg := testConfig("/tmp/corp-ca.pem")
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			c, path := tt.fn(dir)
+
+			Apply(c, cfg)
+			first, _ := os.ReadFile(path)
+			Apply(c, cfg)
+			second, _ := os.ReadFile(path)
+
+			if string(first) != string(second) {
+				t.Errorf("second apply changed the file:\n%s\nthen:\n%s", first, second)
+			}
+			if n := strings.Count(string(second), tt.section); n != 1 {
+				t.Errorf("%s appears %d times", tt.section, n)
+			}
+		})
+	}
+}
+
 // --- Config update: re-apply with different proxy URL ---
 
 func TestIntegration_ConfigUpdate(t *testing.T) {
@@ -672,16 +776,16 @@ func TestIntegration_ConfigUpdate(t *testing.T) {
 
 	n := &Npm{path: path}
 
-	n.Apply(cfg1)
+	Apply(n, cfg1)
 	data, _ := os.ReadFile(path)
 	assertContains(t, string(data), "old-proxy:3128")
 
-	n.Apply(cfg2)
+	Apply(n, cfg2)
 	data, _ = os.ReadFile(path)
 	got := string(data)
 	assertNotContains(t, got, "old-proxy:3128")
 	assertContains(t, got, "new-proxy:8080")
-	if strings.Count(got, ">>> ezproxy >>>") != 1 {
+	if strings.Count(got, ">>> ezproxy:npm >>>") != 1 {
 		t.Error("should still have exactly one marker block")
 	}
 }
@@ -698,7 +802,7 @@ func TestIntegration_DryRun(t *testing.T) {
 	defer func() { fileutil.DryRun = false }()
 
 	n := &Npm{path: path}
-	n.Apply(cfg)
+	Apply(n, cfg)
 
 	// File should not exist
 	if _, err := os.Stat(path); err == nil {
@@ -736,7 +840,7 @@ func TestIntegration_FullLifecycle(t *testing.T) {
 
 	// Phase 1: Apply all
 	for name, c := range configurators {
-		if err := c.Apply(cfg); err != nil {
+		if err := Apply(c, cfg); err != nil {
 			t.Errorf("Apply %s: %v", name, err)
 		}
 	}
@@ -751,7 +855,7 @@ func TestIntegration_FullLifecycle(t *testing.T) {
 
 	// Phase 3: Remove all
 	for name, c := range configurators {
-		if err := c.Remove(); err != nil {
+		if err := Remove(c); err != nil {
 			t.Errorf("Remove %s: %v", name, err)
 		}
 	}
@@ -793,3 +897,62 @@ func assertEqual(t *testing.T, want, got string) {
 		t.Errorf("expected %q, got %q", want, got)
 	}
 }
+
+// --- DryRun previews exactly what a real apply or remove writes ---
+
+func TestIntegration_DryRunPreviewsResult(t *testing.T) {
+	dir := t.TempDir()
+	cfg := testConfig("/tmp/corp-ca.pem")
+	bashrc := filepath.Join(dir, ".bashrc")
+	os.WriteFile(bashrc, []byte("# existing\n"), 0644)
+	settings := filepath.Join(dir, "settings.xml")
+	os.WriteFile(settings, []byte("<settings>\n  <offline>false</offline>\n</settings>\n"), 0644)
+
+	configurators := []struct {
+		c    Configurator
+		path string
+	}{
+		{&EnvVars{profiles: []string{bashrc}}, bashrc},
+		{&Pip{path: filepath.Join(dir, "pip.conf")}, filepath.Join(dir, "pip.conf")},
+		{&Npm{path: filepath.Join(dir, ".npmrc")}, filepath.Join(dir, ".npmrc")},
+		{&Docker{configPath: filepath.Join(dir, "docker-config.json")}, filepath.Join(dir, "docker-config.json")},
+		{&Maven{path: settings}, settings},
+		{&Bundler{path: filepath.Join(dir, "bundle-config")}, filepath.Join(dir, "bundle-config")},
+	}
+
+	for _, step := range []string{"apply", "remove"} {
+		fileutil.DryRun = true
+		previewed := map[string]string{}
+		for _, tc := range configurators {
+			var err error
+			if step == "apply" {
+				err = Apply(tc.c, cfg)
+			} else {
+				err = Remove(tc.c)
+			}
+			if err != nil {
+				t.Fatalf("dry-run %s %s: %v", step, tc.c.Name(), err)
+			}
+			data, _ := fileutil.ReadFile(tc.path)
+			previewed[tc.path] = string(data)
+		}
+		fileutil.DryRun = false
+		fileutil.ResetPreview()
+
+		for _, tc := range configurators {
+			var err error
+			if step == "apply" {
+				err = Apply(tc.c, cfg)
+			} else {
+				err = Remove(tc.c)
+			}
+			if err != nil {
+				t.Fatalf("%s %s: %v", step, tc.c.Name(), err)
+			}
+			data, _ := os.ReadFile(tc.path)
+			if string(data) != previewed[tc.path] {
+				t.Errorf("%s %s wrote\n%s\ndry run previewed\n%s", step, tc.c.Name(), data, previewed[tc.path])
+			}
+		}
+	}
+}
@@ -7,13 +7,12 @@ import (
 	"path/filepath"
 	"strings"
 
+	"github.com/andrew/ezproxy/internal/certs"
 	"github.com/andrew/ezproxy/internal/config"
 	"github.com/andrew/ezproxy/internal/detect"
-	"github.com/andrew/ezproxy/internal/fileutil"
+	"github.com/andrew/ezproxy/internal/privileged"
 )
 
-const javaCAAlias = "ezproxy-corp-ca"
-
 type JavaCA struct{}
 
 func (j *JavaCA) Name() string { return "java_ca" }
@@ -22,93 +21,111 @@ func (j *JavaCA) IsAvailable(_ detect.OSInfo) bool {
 	return detect.IsCommandAvailable("keytool")
 }
 
-func (j *JavaCA) Apply(cfg *config.Config) error {
-	certPath := config.ExpandPath(cfg.CACert)
-	if certPath == "" {
-		return nil
+func (j *JavaCA) Plan(cfg *config.Config) ([]Change, error) {
+	if !cfg.HasCACerts() {
+		return nil, nil
 	}
-
-	if _, err := os.Stat(certPath); err != nil {
-		return fmt.Errorf("cert file not found: %s", certPath)
+	cas, err := certs.Load(cfg.CACertPaths())
+	if err != nil {
+		return nil, err
 	}
 
 	cacertsPath := findJavaCacerts()
 	if cacertsPath == "" {
-		fmt.Println("  Could not locate JVM cacerts keystore. Set JAVA_HOME and retry.")
-		return nil
+		return []Change{Manual{Text: "Could not locate JVM cacerts keystore. Set JAVA_HOME and retry."}}, nil
 	}
 
-	// Check if already imported
-	if !fileutil.DryRun && isJavaCertInstalled(cacertsPath) {
-		fmt.Printf("  ✓ CA cert already in JVM trust store (%s)\n", cacertsPath)
-		return nil
+	var changes []Change
+	var actions []privileged.Action
+	var records []Record
+	for _, ca := range cas {
+		// Check if already imported
+		if isJavaCertInstalled(cacertsPath, ca.Alias) {
+			changes = append(changes, Note{Text: fmt.Sprintf("✓ %s already in JVM trust store (%s)", ca.Alias, cacertsPath)})
+			continue
+		}
+		// Without -file, keytool reads the certificate from stdin.
+		actions = append(actions, privileged.Run{
+			Argv:  []string{"keytool", "-importcert", "-alias", ca.Alias, "-keystore", cacertsPath, "-storepass", "changeit", "-noprompt"},
+			Stdin: string(ca.PEM()),
+		})
+		records = append(records, recordSetting("", ca.Alias, nil, ca.Fingerprint()))
 	}
-
-	cmd := fmt.Sprintf(
-		"keytool -importcert -alias %s -file %s -keystore %s -storepass changeit -noprompt",
-		javaCAAlias, shellQuote(certPath), shellQuote(cacertsPath),
-	)
-
-	if fileutil.DryRun {
-		fmt.Printf("\n  [dry-run] Would run (requires sudo):\n")
-		fmt.Printf("    sudo sh -c '%s'\n", cmd)
-		return nil
+	if len(actions) > 0 {
+		changes = append(changes, Privileged{Actions: actions, Records: records})
 	}
-
-	return runSudoCommands(j.Name(), []string{cmd})
+	return changes, nil
 }
 
-func (j *JavaCA) Remove() error {
+func (j *JavaCA) PlanRemove() ([]Change, error) {
 	cacertsPath := findJavaCacerts()
 	if cacertsPath == "" {
-		return nil
+		return nil, nil
 	}
 
-	if !isJavaCertInstalled(cacertsPath) {
-		return nil
+	var actions []privileged.Action
+	for _, alias := range installedCAAliases(j.Name()) {
+		if !isJavaCertInstalled(cacertsPath, alias) {
+			continue
+		}
+		actions = append(actions, privileged.Run{
+			Argv: []string{"keytool", "-delete", "-alias", alias, "-keystore", cacertsPath, "-storepass", "changeit", "-noprompt"},
+		})
 	}
-
-	cmd := fmt.Sprintf(
-		"keytool -delete -alias %s -keystore %s -storepass changeit -noprompt",
-		javaCAAlias, shellQuote(cacertsPath),
-	)
-
-	if fileutil.DryRun {
-		fmt.Printf("\n  [dry-run] Would run (requires sudo):\n")
-		fmt.Printf("    sudo sh -c '%s'\n", cmd)
-		return nil
+	if len(actions) == 0 {
+		return nil, nil
 	}
-
-	return runSudoRemoveCommands(j.Name(), []string{cmd})
+	return []Change{Privileged{Actions: actions}}, nil
 }
 
 func (j *JavaCA) Status(cfg *config.Config) (string, error) {
-	certPath := config.ExpandPath(cfg.CACert)
-	if certPath == "" {
+	if !cfg.HasCACerts() {
 		return "no cert configured", nil
 	}
+	cas, err := certs.Load(cfg.CACertPaths())
+	if err != nil {
+		return "", err
+	}
 
 	cacertsPath := findJavaCacerts()
 	if cacertsPath == "" {
 		return "JVM cacerts not found", nil
 	}
 
-	if isJavaCertInstalled(cacertsPath) {
+	var missing []string
+	for _, ca := range cas {
+		if !isJavaCertInstalled(cacertsPath, ca.Alias) {
+			missing = append(missing, ca.Alias)
+		}
+	}
+	switch {
+	case len(missing) == 0:
 		return "imported into JVM", nil
+	case len(missing) == len(cas):
+		return "not imported", nil
+	}
+	return fmt.Sprintf("not imported (%s)", strings.Join(missing, ", ")), nil
+}
+
+// Diagnose reports a JVM whose trust store can't be found, since the CA
+// import is then silently skipped.
+func (j *JavaCA) Diagnose(cfg *config.Config) error {
+	if cfg.HasCACerts() && findJavaCacerts() == "" {
+		return fmt.Errorf("JVM cacerts keystore not found; set JAVA_HOME")
 	}
-	return "not imported", nil
+	return nil
 }
 
-// isJavaCertInstalled checks if the ezproxy alias exists in the JVM keystore.
-func isJavaCertInstalled(cacertsPath string) bool {
+// isJavaCertInstalled checks if alias exists in the JVM keystore.
+func isJavaCertInstalled(cacertsPath, alias string) bool {
 	out, err := exec.Command("keytool", "-list",
-		"-alias", javaCAAlias,
+		"-alias", alias,
 		"-keystore", cacertsPath,
 		"-storepass", "changeit").CombinedOutput()
 	if err != nil {
 		return false
 	}
-	return strings.Contains(string(out), javaCAAlias)
+	return strings.Contains(string(out), alias)
 }
 
 // findJavaCacerts locates the JVM cacerts file.
@@ -0,0 +1,158 @@
+package configurator
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/andrew/ezproxy/internal/fileutil"
+	"github.com/andrew/ezproxy/internal/state"
+)
+
+// mergeKeys returns the edit that sets keys in the INI, TOML or YAML file
+// at path, inside the sections the user may already have, and leaves every
+// other line alone. The value each key had before is recorded so Remove
+// can put it back. Keys ezproxy set on an earlier apply but no longer
+// wants are restored, and a marker block written by an older ezproxy is
+// removed.
+func mergeKeys(tool, path string, format fileutil.Format, keys []fileutil.Key) (FileEdit, error) {
+	data, err := fileutil.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return FileEdit{}, err
+	}
+	content := fileutil.DeleteMarkerBlock(string(data), tool, "#")
+
+	wanted := make(map[string]bool, len(keys))
+	for _, k := range keys {
+		wanted[k.ID()] = true
+	}
+	if t, ok := State.Lookup(tool); ok {
+		for _, s := range t.Settings {
+			if s.File == path && !wanted[s.Key] {
+				if content, err = restoreKey(format, content, s); err != nil {
+					return FileEdit{}, fmt.Errorf("%s: %w", path, err)
+				}
+			}
+		}
+	}
+	records := []Record{forgetUnwanted(path, wanted)}
+
+	for _, k := range keys {
+		records = append(records, recordSetting(path, k.ID(), fileutil.GetKey(format, content, k.Section, k.Name), k.Value))
+		if content, err = fileutil.SetKey(format, content, k.Section, k.Name, &k.Value); err != nil {
+			return FileEdit{}, fmt.Errorf("%s: %w", path, err)
+		}
+	}
+	return FileEdit{Path: path, Content: []byte(content), Mode: 0644, Records: records}, nil
+}
+
+// forgetUnwanted is the Record that drops the settings recorded for path
+// whose keys are not in wanted, once mergeKeys has restored them.
+func forgetUnwanted(path string, wanted map[string]bool) Record {
+	return func(t *state.ToolState) {
+		settings := t.Settings[:0]
+		for _, s := range t.Settings {
+			if s.File != path || wanted[s.Key] {
+				settings = append(settings, s)
+			}
+		}
+		t.Settings = settings
+	}
+}
+
+// unmergeKeys returns the edit that undoes mergeKeys: each key ezproxy set
+// in path gets its previous value back, or is deleted if it had none. Keys
+// the user changed since apply are kept. If ezproxy created the file and
+// nothing is left in it, the file is deleted.
+func unmergeKeys(tool, path string, format fileutil.Format) ([]Change, error) {
+	data, err := fileutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	content := fileutil.DeleteMarkerBlock(string(data), tool, "#")
+	if t, ok := State.Lookup(tool); ok {
+		for _, s := range t.Settings {
+			if s.File != path {
+				continue
+			}
+			if content, err = restoreKey(format, content, s); err != nil {
+				return nil, fmt.Errorf("%s: %w", path, err)
+			}
+		}
+	}
+	if content == string(data) {
+		return nil, nil
+	}
+
+	if strings.TrimSpace(content) == "" && created(tool, path) {
+		return []Change{FileEdit{Path: path, Delete: true}}, nil
+	}
+	return []Change{FileEdit{Path: path, Content: []byte(content), Mode: 0644}}, nil
+}
+
+// restoreKey puts back the value a key had before ezproxy set it, unless
+// the user has changed it since.
+func restoreKey(format fileutil.Format, content string, s state.Setting) (string, error) {
+	section, name := fileutil.ParseKeyID(s.Key)
+	if current := fileutil.GetKey(format, content, section, name); current == nil || *current != s.Value {
+		return content, nil
+	}
+	return fileutil.SetKey(format, content, section, name, s.Previous)
+}
+
+// keysStatus compares the keys in path with the values Apply would set. A
+// key that is set more than once (a duplicated section, or a leftover
+// marker block next to the user's own section) is "conflicting", since
+// tools either reject the file or pick one of the values. A key ezproxy
+// set on an earlier apply but no longer wants is stale.
+func keysStatus(tool, path string, format fileutil.Format, keys []fileutil.Key) string {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return StatusNotConfigured
+	}
+	content := string(data)
+
+	var ids, conflicts []string
+	expected := make(map[string]string, len(keys))
+	actual := make(map[string]*string, len(keys))
+	for _, k := range keys {
+		id := k.ID()
+		ids = append(ids, id)
+		expected[id] = k.Value
+		values := fileutil.KeyValues(format, content, k.Section, k.Name)
+		if len(values) > 0 {
+			actual[id] = &values[0]
+		}
+		if len(values) > 1 {
+			conflicts = append(conflicts, id)
+		}
+	}
+
+	status := compareValues(ids, expected, actual)
+	if status != StatusNotConfigured && len(conflicts) > 0 {
+		return conflictingStatus(conflicts)
+	}
+	if status != StatusConfigured {
+		return status
+	}
+	if t, ok := State.Lookup(tool); ok {
+		var stale []string
+		for _, s := range t.Settings {
+			if _, ok := expected[s.Key]; ok || s.File != path {
+				continue
+			}
+			section, name := fileutil.ParseKeyID(s.Key)
+			if current := fileutil.GetKey(format, content, section, name); current != nil && *current == s.Value {
+				stale = append(stale, s.Key)
+			}
+		}
+		if len(stale) > 0 {
+			return staleStatus(stale)
+		}
+	}
+	return StatusConfigured
+}
@@ -1,6 +1,7 @@
 package configurator
 
 import (
+	"bytes"
 	"encoding/xml"
 	"fmt"
 	"os"
@@ -10,6 +11,7 @@ import (
 	"github.com/andrew/ezproxy/internal/config"
 	"github.com/andrew/ezproxy/internal/detect"
 	"github.com/andrew/ezproxy/internal/fileutil"
+	"github.com/andrew/ezproxy/internal/noproxy"
 )
 
 type Maven struct {
@@ -18,6 +20,8 @@ type Maven struct {
 
 func (m *Maven) Name() string { return "maven" }
 
+func (m *Maven) NoProxyDialect() noproxy.Dialect { return noproxy.Java }
+
 func (m *Maven) IsAvailable(_ detect.OSInfo) bool {
 	return detect.IsCommandAvailable("mvn")
 }
@@ -30,151 +34,301 @@ func (m *Maven) settingsPath() string {
 	return filepath.Join(home, ".m2", "settings.xml")
 }
 
-// Maven settings.xml types
-type mavenSettings struct {
-	XMLName xml.Name     `xml:"settings"`
-	Proxies *mavenProxies `xml:"proxies,omitempty"`
-	Other   []xmlNode    `xml:",any"`
+// mavenProxy is a <proxy> entry in settings.xml.
+type mavenProxy struct {
+	XMLName       xml.Name `xml:"proxy"`
+	ID            string   `xml:"id"`
+	Active        bool     `xml:"active"`
+	Protocol      string   `xml:"protocol"`
+	Username      string   `xml:"username,omitempty"`
+	Password      string   `xml:"password,omitempty"`
+	Host          string   `xml:"host"`
+	Port          string   `xml:"port"`
+	NonProxyHosts string   `xml:"nonProxyHosts,omitempty"`
 }
 
-type mavenProxies struct {
-	Proxy []mavenProxy `xml:"proxy"`
-}
+// mavenEmptySettings is the document Plan starts from when there is no
+// settings.xml yet.
+const mavenEmptySettings = xml.Header + "<settings>\n</settings>\n"
 
-type mavenProxy struct {
-	ID            string `xml:"id"`
-	Active        bool   `xml:"active"`
-	Protocol      string `xml:"protocol"`
-	Host          string `xml:"host"`
-	Port          string `xml:"port"`
-	NonProxyHosts string `xml:"nonProxyHosts,omitempty"`
-}
+// Plan adds the ezproxy-* <proxy> entries to settings.xml, replacing the
+// ones from an earlier apply. Only those elements are touched: the user's
+// proxies, mirrors, servers, comments and formatting stay byte for byte
+// as they were. A file that isn't well-formed XML is left alone.
+func (m *Maven) Plan(cfg *config.Config) ([]Change, error) {
+	path := m.settingsPath()
+	proxies := m.proxies(cfg)
 
-type xmlNode struct {
-	XMLName xml.Name
-	Content []byte `xml:",innerxml"`
+	data, err := fileutil.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if len(bytes.TrimSpace(data)) == 0 {
+		data = []byte(mavenEmptySettings)
+	}
+	out, err := mavenRemoveProxies(data)
+	if err != nil {
+		return nil, mavenMalformed(path, err)
+	}
+	if out, err = mavenInsertProxies(out, proxies); err != nil {
+		return nil, mavenMalformed(path, err)
+	}
+	return []Change{FileEdit{Path: path, Content: out, Mode: 0644, Private: hasAuth(cfg)}}, nil
 }
 
-func (m *Maven) Apply(cfg *config.Config) error {
-	path := m.settingsPath()
+func (m *Maven) AuthMethod() string { return "<username> and <password> in settings.xml (mode 0600)" }
+
+func mavenMalformed(path string, err error) error {
+	return fmt.Errorf("%s is not a valid Maven settings file, leaving it untouched: %w", path, err)
+}
 
+// proxies returns the ezproxy-owned <proxy> entries for cfg.
+func (m *Maven) proxies(cfg *config.Config) []mavenProxy {
 	httpHost, httpPort := parseProxyURL(cfg.Proxy.HTTP)
 	httpsHost, httpsPort := parseProxyURL(cfg.Proxy.HTTPS)
-	nonProxy := toJavaNonProxyHosts(cfg.Proxy.NoProxy)
-
-	newProxies := &mavenProxies{
-		Proxy: []mavenProxy{
-			{
-				ID:            "ezproxy-http",
-				Active:        true,
-				Protocol:      "http",
-				Host:          httpHost,
-				Port:          httpPort,
-				NonProxyHosts: nonProxy,
-			},
-			{
-				ID:            "ezproxy-https",
-				Active:        true,
-				Protocol:      "https",
-				Host:          httpsHost,
-				Port:          httpsPort,
-				NonProxyHosts: nonProxy,
-			},
+	nonProxy := noProxy(noproxy.Java, cfg)
+
+	proxies := []mavenProxy{
+		{
+			ID:            "ezproxy-http",
+			Active:        true,
+			Protocol:      "http",
+			Host:          httpHost,
+			Port:          httpPort,
+			NonProxyHosts: nonProxy,
+		},
+		{
+			ID:            "ezproxy-https",
+			Active:        true,
+			Protocol:      "https",
+			Host:          httpsHost,
+			Port:          httpsPort,
+			NonProxyHosts: nonProxy,
 		},
 	}
-
-	if fileutil.DryRun {
-		data, _ := xml.MarshalIndent(newProxies, "  ", "  ")
-		fmt.Printf("\n  [dry-run] Would merge into %s:\n", path)
-		for _, line := range strings.Split(string(data), "\n") {
-			fmt.Printf("    %s\n", line)
+	for i, u := range []string{cfg.Proxy.HTTP, cfg.Proxy.HTTPS} {
+		if a := cfg.AuthFor(u); a != nil {
+			proxies[i].Username, proxies[i].Password = a.Username, a.Password
 		}
-		return nil
 	}
+	return proxies
+}
 
-	// Read or create settings.xml
-	var settings mavenSettings
-	if data, err := os.ReadFile(path); err == nil {
-		xml.Unmarshal(data, &settings)
+// parseMavenSettings parses settings.xml and returns its root.
+func parseMavenSettings(data []byte) (*fileutil.XMLNode, error) {
+	root, err := fileutil.ParseXML(data)
+	if err != nil {
+		return nil, err
+	}
+	if root.Name != "settings" {
+		return nil, fmt.Errorf("root element is <%s>, not <settings>", root.Name)
 	}
+	return root, nil
+}
 
-	// Remove any existing ezproxy proxies, keep user's other proxies
-	if settings.Proxies != nil {
-		var kept []mavenProxy
-		for _, p := range settings.Proxies.Proxy {
-			if !strings.HasPrefix(p.ID, "ezproxy-") {
-				kept = append(kept, p)
-			}
+// mavenProxyFrom reads a <proxy> element.
+func mavenProxyFrom(n *fileutil.XMLNode) mavenProxy {
+	text := func(name string) string {
+		if c := n.Child(name); c != nil {
+			return c.Text()
 		}
-		newProxies.Proxy = append(kept, newProxies.Proxy...)
+		return ""
 	}
-	settings.Proxies = newProxies
-
-	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
-		return err
+	return mavenProxy{
+		ID:            text("id"),
+		Active:        text("active") == "true",
+		Protocol:      text("protocol"),
+		Username:      text("username"),
+		Password:      text("password"),
+		Host:          text("host"),
+		Port:          text("port"),
+		NonProxyHosts: text("nonProxyHosts"),
 	}
+}
+
+func isEzproxyProxy(n *fileutil.XMLNode) bool {
+	return n.Name == "proxy" && strings.HasPrefix(mavenProxyFrom(n).ID, "ezproxy-")
+}
 
-	out, err := xml.MarshalIndent(settings, "", "  ")
+// mavenRemoveProxies cuts the ezproxy-* <proxy> elements, each with its
+// own line, out of data.
+func mavenRemoveProxies(data []byte) ([]byte, error) {
+	root, err := parseMavenSettings(data)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	content := xml.Header + string(out) + "\n"
-	return os.WriteFile(path, []byte(content), 0644)
+	proxies := root.Child("proxies")
+	if proxies == nil {
+		return data, nil
+	}
+	var edits []fileutil.XMLEdit
+	for _, c := range proxies.Children {
+		if isEzproxyProxy(c) {
+			edits = append(edits, fileutil.XMLEdit{Start: fileutil.LineStart(data, c.Start), End: c.End})
+		}
+	}
+	return fileutil.ApplyXMLEdits(data, edits), nil
 }
 
-func (m *Maven) Remove() error {
-	path := m.settingsPath()
-
-	if fileutil.DryRun {
-		fmt.Printf("\n  [dry-run] Would remove ezproxy proxy entries from %s\n", path)
-		return nil
+// mavenInsertProxies adds proxies at the end of <proxies>, creating that
+// element at the end of <settings> if needed. Indentation and line endings
+// follow the rest of the file.
+func mavenInsertProxies(data []byte, proxies []mavenProxy) ([]byte, error) {
+	root, err := parseMavenSettings(data)
+	if err != nil {
+		return nil, err
+	}
+	nl := fileutil.Newline(data)
+	rootIndent := fileutil.LineIndent(data, root.Start)
+	childIndent := rootIndent + "  "
+	if len(root.Children) > 0 {
+		if indent := fileutil.LineIndent(data, root.Children[0].Start); len(indent) > len(rootIndent) {
+			childIndent = indent
+		}
 	}
+	unit := strings.TrimPrefix(childIndent, rootIndent)
 
-	data, err := os.ReadFile(path)
-	if err != nil {
-		if os.IsNotExist(err) {
-			return nil
+	parent := root.Child("proxies")
+	if parent == nil {
+		text := nl + childIndent + "<proxies>" +
+			renderMavenProxies(proxies, childIndent+unit, unit, nl) +
+			nl + childIndent + "</proxies>"
+		return fileutil.ApplyXMLEdits(data, []fileutil.XMLEdit{appendChild(data, root, text, rootIndent, nl)}), nil
+	}
+	indent := fileutil.LineIndent(data, parent.Start)
+	if indent == "" {
+		indent = childIndent
+	}
+	itemIndent := indent + unit
+	if len(parent.Children) > 0 {
+		if i := fileutil.LineIndent(data, parent.Children[0].Start); i != "" {
+			itemIndent = i
 		}
-		return err
 	}
+	text := renderMavenProxies(proxies, itemIndent, unit, nl)
+	return fileutil.ApplyXMLEdits(data, []fileutil.XMLEdit{appendChild(data, parent, text, indent, nl)}), nil
+}
 
-	var settings mavenSettings
-	if err := xml.Unmarshal(data, &settings); err != nil {
-		return nil
+// appendChild returns the edit that adds text (starting with a line break)
+// as the last content of parent, whose closing tag goes on its own line at
+// closeIndent.
+func appendChild(data []byte, parent *fileutil.XMLNode, text, closeIndent, nl string) fileutil.XMLEdit {
+	switch {
+	case parent.SelfClosing():
+		tag := strings.TrimRight(string(data[parent.Start:parent.End-2]), " \t\r\n")
+		name := strings.Fields(tag[1:])[0]
+		return fileutil.XMLEdit{Start: parent.Start, End: parent.End,
+			Text: tag + ">" + text + nl + closeIndent + "</" + name + ">"}
+	case len(parent.Children) > 0:
+		last := parent.Children[len(parent.Children)-1]
+		return fileutil.XMLEdit{Start: last.End, End: last.End, Text: text}
+	default:
+		cut := fileutil.LineStart(data, parent.InnerEnd)
+		return fileutil.XMLEdit{Start: cut, End: parent.InnerEnd, Text: text + nl + closeIndent}
 	}
+}
 
-	if settings.Proxies == nil {
-		return nil
+// renderMavenProxies formats proxies as indented <proxy> elements, each
+// preceded by a line break.
+func renderMavenProxies(proxies []mavenProxy, indent, unit, nl string) string {
+	var b strings.Builder
+	for _, p := range proxies {
+		out, _ := xml.MarshalIndent(p, indent, unit)
+		b.WriteString(nl + strings.ReplaceAll(string(out), "\n", nl))
 	}
+	return b.String()
+}
 
-	var kept []mavenProxy
-	for _, p := range settings.Proxies.Proxy {
-		if !strings.HasPrefix(p.ID, "ezproxy-") {
-			kept = append(kept, p)
-		}
+func (m *Maven) PlanRemove() ([]Change, error) {
+	path := m.settingsPath()
+
+	if edit, ok := removeIfUntouched(m.Name(), path); ok {
+		return []Change{edit}, nil
 	}
 
-	if len(kept) == 0 {
-		settings.Proxies = nil
-	} else {
-		settings.Proxies.Proxy = kept
+	data, err := fileutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	out, err := mavenRemoveProxies(data)
+	if err != nil {
+		return nil, mavenMalformed(path, err)
+	}
+	if bytes.Equal(out, data) {
+		return nil, nil
 	}
 
-	out, err := xml.MarshalIndent(settings, "", "  ")
+	// Drop <proxies> too if ours were all it held.
+	root, err := parseMavenSettings(out)
 	if err != nil {
-		return err
+		return nil, mavenMalformed(path, err)
+	}
+	if p := root.Child("proxies"); p != nil && len(p.Children) == 0 && len(bytes.TrimSpace(out[p.Inner:p.InnerEnd])) == 0 {
+		out = fileutil.ApplyXMLEdits(out, []fileutil.XMLEdit{{Start: fileutil.LineStart(out, p.Start), End: p.End}})
 	}
-	content := xml.Header + string(out) + "\n"
-	return os.WriteFile(path, []byte(content), 0644)
+
+	return []Change{FileEdit{Path: path, Content: out, Mode: 0644}}, nil
 }
 
 func (m *Maven) Status(cfg *config.Config) (string, error) {
-	data, err := os.ReadFile(m.settingsPath())
+	path := m.settingsPath()
+	data, err := os.ReadFile(path)
 	if err != nil {
-		return "not configured", nil
+		return StatusNotConfigured, nil
 	}
-	if strings.Contains(string(data), "ezproxy-http") {
-		return "configured", nil
+	root, err := parseMavenSettings(data)
+	if err != nil {
+		return "", mavenMalformed(path, err)
+	}
+	proxies := root.Child("proxies")
+	if proxies == nil {
+		return StatusNotConfigured, nil
+	}
+
+	// Maven uses the first active proxy per protocol, so an active entry
+	// of the user's listed before ours wins over it.
+	var keys []string
+	var conflicts []string
+	expected := make(map[string]string)
+	actual := make(map[string]*string)
+	seen := make(map[string]bool)
+	for _, p := range m.proxies(cfg) {
+		for _, field := range []string{"host", "port", "nonProxyHosts", "username", "password"} {
+			keys = append(keys, p.ID+"."+field)
+		}
+		expected[p.ID+".host"] = p.Host
+		expected[p.ID+".port"] = p.Port
+		expected[p.ID+".nonProxyHosts"] = p.NonProxyHosts
+		expected[p.ID+".username"] = p.Username
+		expected[p.ID+".password"] = p.Password
+	}
+	for _, n := range proxies.Children {
+		if n.Name != "proxy" {
+			continue
+		}
+		p := mavenProxyFrom(n)
+		if !strings.HasPrefix(p.ID, "ezproxy-") {
+			if p.Active && !seen[p.Protocol] {
+				conflicts = append(conflicts, p.ID)
+			}
+			seen[p.Protocol] = true
+			continue
+		}
+		seen[p.Protocol] = true
+		host, port, nonProxy, username, password := p.Host, p.Port, p.NonProxyHosts, p.Username, p.Password
+		actual[p.ID+".host"] = &host
+		actual[p.ID+".port"] = &port
+		actual[p.ID+".nonProxyHosts"] = &nonProxy
+		actual[p.ID+".username"] = &username
+		actual[p.ID+".password"] = &password
+	}
+
+	status := compareValues(keys, expected, actual)
+	if status == StatusConfigured && len(conflicts) > 0 {
+		return conflictingStatus(conflicts), nil
 	}
-	return "not configured", nil
+	return status, nil
 }
@@ -0,0 +1,165 @@
+package configurator
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/andrew/ezproxy/internal/config"
+)
+
+const userMavenSettings = `<?xml version="1.0" encoding="UTF-8"?>
+<!-- Managed by the platform team; ask in #build before editing. -->
+<settings xmlns="http://maven.apache.org/SETTINGS/1.0.0"
+          xmlns:xsi="http://www.w3.org/2001/XMLSchema-instance"
+          xsi:schemaLocation="http://maven.apache.org/SETTINGS/1.0.0 https://maven.apache.org/xsd/settings-1.0.0.xsd">
+    <servers>
+        <server>
+            <id>corp-releases</id>
+            <username>deploy</username>
+            <password>{COQLCE6DU6GtcS5P=}</password>
+        </server>
+    </servers>
+    <mirrors>
+        <mirror><id>corp</id><url>https://nexus.corp/repository/maven-public/</url><mirrorOf>*</mirrorOf></mirror>
+    </mirrors>
+    <proxies>
+        <!-- legacy office proxy -->
+        <proxy>
+            <id>office</id>
+            <active>false</active>
+            <protocol>http</protocol>
+            <host>office-proxy</host>
+            <port>3128</port>
+        </proxy>
+    </proxies>
+</settings>
+`
+
+func TestMavenApplyKeepsFileIntact(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "settings.xml")
+	os.WriteFile(path, []byte(userMavenSettings), 0644)
+
+	m := &Maven{path: path}
+	cfg := testConfigNoCert()
+	if err := Apply(m, cfg); err != nil {
+		t.Fatalf("Apply: %v", err)
+	}
+
+	data, _ := os.ReadFile(path)
+	got := string(data)
+	// Everything up to the end of the user's proxy is untouched, and ours
+	// follow with the same indentation.
+	head := userMavenSettings[:strings.Index(userMavenSettings, "        </proxy>")+len("        </proxy>")]
+	if !strings.HasPrefix(got, head) {
+		t.Errorf("user content changed:\n%s", got)
+	}
+	assertContains(t, got, "\n        <proxy>\n            <id>ezproxy-http</id>\n")
+	assertContains(t, got, "        </proxy>\n    </proxies>\n</settings>\n")
+
+	status, _ := m.Status(cfg)
+	assertEqual(t, "configured", status)
+
+	// Re-applying is a no-op.
+	Apply(m, cfg)
+	again, _ := os.ReadFile(path)
+	assertEqual(t, got, string(again))
+
+	if err := Remove(m); err != nil {
+		t.Fatalf("Remove: %v", err)
+	}
+	data, _ = os.ReadFile(path)
+	assertEqual(t, userMavenSettings, string(data))
+}
+
+func TestMavenApplyAddsProxiesElement(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "settings.xml")
+	original := "<settings>\r\n\t<localRepository>/data/m2</localRepository>\r\n</settings>\r\n"
+	os.WriteFile(path, []byte(original), 0644)
+
+	m := &Maven{path: path}
+	if err := Apply(m, testConfigNoCert()); err != nil {
+		t.Fatalf("Apply: %v", err)
+	}
+	data, _ := os.ReadFile(path)
+	got := string(data)
+	assertContains(t, got, "</localRepository>\r\n\t<proxies>\r\n\t\t<proxy>\r\n\t\t\t<id>ezproxy-http</id>\r\n")
+	if strings.Contains(strings.ReplaceAll(got, "\r\n", ""), "\n") {
+		t.Errorf("mixed line endings:\n%q", got)
+	}
+
+	Remove(m)
+	data, _ = os.ReadFile(path)
+	assertEqual(t, original, string(data))
+}
+
+func TestMavenApplySelfClosingSettings(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "settings.xml")
+	os.WriteFile(path, []byte(`<settings xmlns="http://maven.apache.org/SETTINGS/1.0.0"/>`+"\n"), 0644)
+
+	m := &Maven{path: path}
+	cfg := testConfigNoCert()
+	if err := Apply(m, cfg); err != nil {
+		t.Fatalf("Apply: %v", err)
+	}
+	data, _ := os.ReadFile(path)
+	assertContains(t, string(data), `<settings xmlns="http://maven.apache.org/SETTINGS/1.0.0">`)
+	status, _ := m.Status(cfg)
+	assertEqual(t, "configured", status)
+}
+
+func TestMavenRefusesMalformedFile(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "settings.xml")
+	broken := "<settings>\n  <servers>\n    <server><id>x</id>\n  </servers>\n</settings>\n"
+	os.WriteFile(path, []byte(broken), 0644)
+
+	m := &Maven{path: path}
+	cfg := testConfigNoCert()
+	err := Apply(m, cfg)
+	if err == nil || !strings.Contains(err.Error(), "leaving it untouched") {
+		t.Fatalf("Apply error = %v", err)
+	}
+	data, _ := os.ReadFile(path)
+	assertEqual(t, broken, string(data))
+
+	if err := Remove(m); err == nil {
+		t.Error("Remove should fail on a malformed file")
+	}
+	if _, err := m.Status(cfg); err == nil {
+		t.Error("Status should report the malformed file")
+	}
+}
+
+func TestMavenApplyCredentials(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "settings.xml")
+	m := &Maven{path: path}
+	cfg := testConfigNoCert()
+	cfg.Auth = &config.ProxyAuth{Host: "proxy.corp.com:8080", Username: "alice", Password: "s3cret"}
+	if err := Apply(m, cfg); err != nil {
+		t.Fatalf("Apply: %v", err)
+	}
+	data, _ := os.ReadFile(path)
+	for _, want := range []string{"<username>alice</username>", "<password>s3cret</password>"} {
+		if strings.Count(string(data), want) != 2 {
+			t.Errorf("settings.xml should have %s in both proxies:\n%s", want, data)
+		}
+	}
+	if strings.Contains(string(data), "alice:s3cret") {
+		t.Error("credentials written into a URL")
+	}
+	if info, _ := os.Stat(path); info.Mode().Perm() != 0600 {
+		t.Errorf("mode = %04o, want 0600", info.Mode().Perm())
+	}
+	status, _ := m.Status(cfg)
+	assertEqual(t, "configured", status)
+
+	cfg.Auth.Password = "changed"
+	if status, _ := m.Status(cfg); !strings.Contains(status, "ezproxy-http.password") {
+		t.Errorf("Status after password change = %q", status)
+	}
+}
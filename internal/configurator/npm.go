@@ -8,7 +8,8 @@ import (
 
 	"github.com/andrew/ezproxy/internal/config"
 	"github.com/andrew/ezproxy/internal/detect"
-	"github.com/andrew/ezproxy/internal/fileutil"
+	"github.com/andrew/ezproxy/internal/escape"
+	"github.com/andrew/ezproxy/internal/noproxy"
 )
 
 type Npm struct {
@@ -17,6 +18,8 @@ type Npm struct {
 
 func (n *Npm) Name() string { return "npm" }
 
+func (n *Npm) NoProxyDialect() noproxy.Dialect { return noproxy.Npm }
+
 func (n *Npm) IsAvailable(_ detect.OSInfo) bool {
 	return detect.IsCommandAvailable("npm")
 }
@@ -29,24 +32,37 @@ func (n *Npm) getPath() string {
 	return filepath.Join(home, ".npmrc")
 }
 
-func (n *Npm) Apply(cfg *config.Config) error {
-	certPath := config.ExpandPath(cfg.CACert)
+func (n *Npm) Plan(cfg *config.Config) ([]Change, error) {
+	edit, err := upsertBlock(n.Name(), n.getPath(), n.content(cfg))
+	if err != nil {
+		return nil, err
+	}
+	edit.Private = hasAuth(cfg)
+	return []Change{edit}, nil
+}
+
+// AuthMethod: npm keeps registry tokens in .npmrc too, and has no other
+// place for proxy credentials.
+func (n *Npm) AuthMethod() string { return "in the proxy URLs in .npmrc (mode 0600)" }
+
+func (n *Npm) content(cfg *config.Config) string {
+	certPath := cfg.TrustBundlePath()
 	var b strings.Builder
-	fmt.Fprintf(&b, "proxy=%s\n", cfg.Proxy.HTTP)
-	fmt.Fprintf(&b, "https-proxy=%s\n", cfg.Proxy.HTTPS)
+	fmt.Fprintf(&b, "proxy=%s\n", escape.Npmrc(cfg.WithAuth(cfg.Proxy.HTTP)))
+	fmt.Fprintf(&b, "https-proxy=%s\n", escape.Npmrc(cfg.WithAuth(cfg.Proxy.HTTPS)))
+	if np := noProxy(noproxy.Npm, cfg); np != "" {
+		fmt.Fprintf(&b, "noproxy=%s\n", escape.Npmrc(np))
+	}
 	if certPath != "" {
-		fmt.Fprintf(&b, "cafile=%s\n", certPath)
+		fmt.Fprintf(&b, "cafile=%s\n", escape.Npmrc(certPath))
 	}
-	return fileutil.UpsertMarkerBlock(n.getPath(), b.String(), "#")
+	return b.String()
 }
 
-func (n *Npm) Remove() error {
-	return fileutil.RemoveMarkerBlock(n.getPath(), "#")
+func (n *Npm) PlanRemove() ([]Change, error) {
+	return removeBlock(n.Name(), n.getPath())
 }
 
 func (n *Npm) Status(cfg *config.Config) (string, error) {
-	if fileutil.HasMarkerBlock(n.getPath(), "#") {
-		return "configured", nil
-	}
-	return "not configured", nil
+	return blockStatus(n.Name(), n.getPath(), n.content(cfg)), nil
 }
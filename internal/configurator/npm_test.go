@@ -16,7 +16,7 @@ func TestNpmApply(t *testing.T) {
 		Proxy:  config.ProxyConfig{HTTP: "http://proxy:8080", HTTPS: "http://proxy:8080"},
 		CACert: "/tmp/ca.pem",
 	}
-	if err := n.Apply(cfg); err != nil {
+	if err := Apply(n, cfg); err != nil {
 		t.Fatalf("Apply: %v", err)
 	}
 	data, _ := os.ReadFile(n.path)
@@ -39,8 +39,8 @@ func TestNpmRemove(t *testing.T) {
 		Proxy:  config.ProxyConfig{HTTP: "http://proxy:8080", HTTPS: "http://proxy:8080"},
 		CACert: "/tmp/ca.pem",
 	}
-	n.Apply(cfg)
-	if err := n.Remove(); err != nil {
+	Apply(n, cfg)
+	if err := Remove(n); err != nil {
 		t.Fatalf("Remove: %v", err)
 	}
 	status, _ := n.Status(cfg)
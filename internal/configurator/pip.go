@@ -5,11 +5,12 @@ import (
 	"os"
 	"path/filepath"
 	"runtime"
-	"strings"
 
 	"github.com/andrew/ezproxy/internal/config"
 	"github.com/andrew/ezproxy/internal/detect"
+	"github.com/andrew/ezproxy/internal/escape"
 	"github.com/andrew/ezproxy/internal/fileutil"
+	"github.com/andrew/ezproxy/internal/noproxy"
 )
 
 type Pip struct {
@@ -18,6 +19,8 @@ type Pip struct {
 
 func (p *Pip) Name() string { return "pip" }
 
+func (p *Pip) NoProxyDialect() noproxy.Dialect { return noproxy.Python }
+
 func (p *Pip) IsAvailable(_ detect.OSInfo) bool {
 	return detect.IsCommandAvailable("pip") || detect.IsCommandAvailable("pip3")
 }
@@ -33,24 +36,46 @@ func (p *Pip) getPath() string {
 	return filepath.Join(home, ".config", "pip", "pip.conf")
 }
 
-func (p *Pip) Apply(cfg *config.Config) error {
-	certPath := config.ExpandPath(cfg.CACert)
-	var b strings.Builder
-	fmt.Fprintf(&b, "[global]\n")
-	fmt.Fprintf(&b, "proxy = %s\n", cfg.Proxy.HTTP)
-	if certPath != "" {
-		fmt.Fprintf(&b, "cert = %s\n", certPath)
+func (p *Pip) Plan(cfg *config.Config) ([]Change, error) {
+	keys, err := p.keys(cfg)
+	if err != nil {
+		return nil, err
+	}
+	edit, err := mergeKeys(p.Name(), p.getPath(), fileutil.INI, keys)
+	if err != nil {
+		return nil, err
+	}
+	edit.Private = hasAuth(cfg)
+	return []Change{edit}, nil
+}
+
+func (p *Pip) AuthMethod() string { return "in the proxy URL in pip.conf (mode 0600)" }
+
+// keys returns the [global] settings; pip reads the rest of pip.conf as
+// the user left it.
+func (p *Pip) keys(cfg *config.Config) ([]fileutil.Key, error) {
+	keys := []fileutil.Key{{Section: "global", Name: "proxy", Value: cfg.WithAuth(cfg.Proxy.HTTP)}}
+	if certPath := cfg.TrustBundlePath(); certPath != "" {
+		keys = append(keys, fileutil.Key{Section: "global", Name: "cert", Value: certPath})
+	}
+	for i, k := range keys {
+		v, err := escape.INI(k.Value)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", k.ID(), err)
+		}
+		keys[i].Value = v
 	}
-	return fileutil.UpsertMarkerBlock(p.getPath(), b.String(), "#")
+	return keys, nil
 }
 
-func (p *Pip) Remove() error {
-	return fileutil.RemoveMarkerBlock(p.getPath(), "#")
+func (p *Pip) PlanRemove() ([]Change, error) {
+	return unmergeKeys(p.Name(), p.getPath(), fileutil.INI)
 }
 
 func (p *Pip) Status(cfg *config.Config) (string, error) {
-	if fileutil.HasMarkerBlock(p.getPath(), "#") {
-		return "configured", nil
+	keys, err := p.keys(cfg)
+	if err != nil {
+		return "", err
 	}
-	return "not configured", nil
+	return keysStatus(p.Name(), p.getPath(), fileutil.INI, keys), nil
 }
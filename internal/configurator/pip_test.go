@@ -16,7 +16,7 @@ func TestPipApply(t *testing.T) {
 		Proxy:  config.ProxyConfig{HTTP: "http://proxy:8080"},
 		CACert: "/tmp/ca.pem",
 	}
-	if err := p.Apply(cfg); err != nil {
+	if err := Apply(p, cfg); err != nil {
 		t.Fatalf("Apply: %v", err)
 	}
 	data, _ := os.ReadFile(p.path)
@@ -39,8 +39,8 @@ func TestPipRemove(t *testing.T) {
 		Proxy:  config.ProxyConfig{HTTP: "http://proxy:8080"},
 		CACert: "/tmp/ca.pem",
 	}
-	p.Apply(cfg)
-	if err := p.Remove(); err != nil {
+	Apply(p, cfg)
+	if err := Remove(p); err != nil {
 		t.Fatalf("Remove: %v", err)
 	}
 	status, _ := p.Status(cfg)
@@ -55,3 +55,49 @@ func TestPipName(t *testing.T) {
 		t.Errorf("expected 'pip', got %q", p.Name())
 	}
 }
+
+func TestPipMergesIntoUserSection(t *testing.T) {
+	dir := t.TempDir()
+	p := &Pip{path: filepath.Join(dir, "pip.conf")}
+	original := "# company mirror\n[global]\nindex-url = https://pypi.corp/simple\nproxy = http://old:1234\n\n[install]\nuser = true\n"
+	os.WriteFile(p.path, []byte(original), 0644)
+
+	cfg := &config.Config{
+		Proxy:  config.ProxyConfig{HTTP: "http://proxy:8080"},
+		CACert: "/tmp/ca.pem",
+	}
+	if err := Apply(p, cfg); err != nil {
+		t.Fatalf("Apply: %v", err)
+	}
+	data, _ := os.ReadFile(p.path)
+	want := "# company mirror\n[global]\nindex-url = https://pypi.corp/simple\nproxy = http://proxy:8080\ncert = /tmp/ca.pem\n\n[install]\nuser = true\n"
+	if string(data) != want {
+		t.Errorf("got:\n%s\nwant:\n%s", data, want)
+	}
+	if status, _ := p.Status(cfg); status != "configured" {
+		t.Errorf("expected 'configured', got %q", status)
+	}
+
+	if err := Remove(p); err != nil {
+		t.Fatalf("Remove: %v", err)
+	}
+	data, _ = os.ReadFile(p.path)
+	if string(data) != original {
+		t.Errorf("after Remove got:\n%s\nwant:\n%s", data, original)
+	}
+}
+
+func TestPipMigratesMarkerBlock(t *testing.T) {
+	dir := t.TempDir()
+	p := &Pip{path: filepath.Join(dir, "pip.conf")}
+	os.WriteFile(p.path, []byte("[global]\ntimeout = 60\n\n# >>> ezproxy >>>\n[global]\nproxy = http://old:1234\n# <<< ezproxy <<<\n"), 0644)
+
+	cfg := &config.Config{Proxy: config.ProxyConfig{HTTP: "http://proxy:8080"}}
+	if err := Apply(p, cfg); err != nil {
+		t.Fatalf("Apply: %v", err)
+	}
+	data, _ := os.ReadFile(p.path)
+	if want := "[global]\ntimeout = 60\nproxy = http://proxy:8080\n"; string(data) != want {
+		t.Errorf("got:\n%s\nwant:\n%s", data, want)
+	}
+}
@@ -0,0 +1,168 @@
+package configurator
+
+import (
+	"os"
+	"strings"
+
+	"github.com/andrew/ezproxy/internal/config"
+	"github.com/andrew/ezproxy/internal/fileutil"
+	"github.com/andrew/ezproxy/internal/privileged"
+	"github.com/andrew/ezproxy/internal/report"
+	"github.com/andrew/ezproxy/internal/state"
+)
+
+// A Change is one step of a plan, as returned by a configurator's Plan or
+// PlanRemove. Configurators only work out what should change; Apply and
+// Remove carry the plan out, and are the only place a dry run differs
+// from a real one. Each file in a plan appears in at most one FileEdit,
+// since every edit is worked out from the file as it is before the plan
+// runs. Planning leaves State alone too: what a change should note there
+// travels with it as Records, kept once the change has been made.
+type Change interface {
+	change()
+}
+
+// FileEdit gives a file the user owns its new content, or deletes it. It
+// is written through fileutil, so the file is backed up first, and in a
+// dry run the edit is shown as a diff instead.
+type FileEdit struct {
+	Path    string
+	Content []byte
+	Mode    os.FileMode // for a new file; an existing one keeps its mode
+	Delete  bool
+	// Private makes the file readable by its owner only, whatever its
+	// mode was, because Content holds proxy credentials.
+	Private bool
+	Records []Record
+}
+
+// Privileged is a change that needs root. Its actions are queued and run
+// at the end of the command, behind a single confirmation (see package
+// privileged); the files they write are backed up when they are queued. When applying, a failed action skips the tool's remaining
+// ones; when removing, the rest still run.
+type Privileged struct {
+	Actions []privileged.Action
+	Records []Record
+}
+
+// Manual is a step the user has to take themselves, such as a setting in
+// an application ezproxy can't edit.
+type Manual struct {
+	Text string
+}
+
+// Note is information about a plan that needs no action, such as a
+// certificate that is already trusted.
+type Note struct {
+	Text string
+}
+
+// A Record notes in a tool's State what one of its changes did, such as
+// the value a setting had before. Records are kept only once the change
+// has been made: never in a dry run, and not for root changes that were
+// declined or failed.
+type Record func(t *state.ToolState)
+
+// recordSetting is the Record of ToolState.RecordSetting.
+func recordSetting(file, key string, current *string, value string) Record {
+	return func(t *state.ToolState) { t.RecordSetting(file, key, current, value) }
+}
+
+// recordFile is the Record of ToolState.RecordFile.
+func recordFile(path string, existedBefore bool) Record {
+	return func(t *state.ToolState) { t.RecordFile(path, existedBefore) }
+}
+
+func (FileEdit) change()   {}
+func (Privileged) change() {}
+func (Manual) change()     {}
+func (Note) change()       {}
+
+// Apply plans c for cfg and carries out the plan. The files it writes are
+// recorded in State, so that PlanRemove can tell the ones ezproxy created.
+func Apply(c Configurator, cfg *config.Config) error {
+	changes, err := c.Plan(cfg)
+	if err != nil {
+		return err
+	}
+	return execute(c.Name(), changes, false)
+}
+
+// Remove plans undoing c's configuration and carries out the plan. Its
+// privileged changes are best effort: a failure is reported but doesn't
+// fail the tool.
+func Remove(c Configurator) error {
+	changes, err := c.PlanRemove()
+	if err != nil {
+		return err
+	}
+	return execute(c.Name(), changes, true)
+}
+
+// execute carries out tool's changes in order, stopping at the first file
+// that can't be written.
+func execute(tool string, changes []Change, removal bool) error {
+	for _, c := range changes {
+		switch c := c.(type) {
+		case FileEdit:
+			if err := editFile(tool, c, removal); err != nil {
+				return err
+			}
+			if !fileutil.DryRun && len(c.Records) > 0 {
+				keep(tool, c.Records)
+			}
+		case Privileged:
+			if err := privileged.Backup(c.Actions...); err != nil {
+				return err
+			}
+			if removal {
+				privileged.AddRemoval(tool, c.Actions...)
+			} else {
+				privileged.Add(tool, c.Actions...)
+			}
+			if len(c.Records) > 0 {
+				records := c.Records
+				privileged.Then(tool, func() { keep(tool, records) })
+			}
+		case Manual:
+			report.Warnf("\n%s\n", indent(c.Text))
+		case Note:
+			report.Printf("%s\n", indent(c.Text))
+		}
+	}
+	return nil
+}
+
+// keep adds records to tool's State.
+func keep(tool string, records []Record) {
+	t := State.Tool(tool)
+	for _, r := range records {
+		r(t)
+	}
+}
+
+func editFile(tool string, e FileEdit, removal bool) error {
+	if e.Delete {
+		return fileutil.RemoveFile(e.Path)
+	}
+	existed := fileExists(e.Path)
+	var err error
+	if e.Private {
+		err = fileutil.WritePrivateFile(e.Path, e.Content)
+	} else {
+		err = fileutil.WriteFile(e.Path, e.Content, e.Mode)
+	}
+	if err != nil {
+		return err
+	}
+	if !fileutil.DryRun && !removal {
+		State.Tool(tool).RecordFile(e.Path, existed)
+	}
+	return nil
+}
+
+// indent puts two spaces before each line of text, the indent of a tool's
+// messages.
+func indent(text string) string {
+	return "  " + strings.ReplaceAll(text, "\n", "\n  ")
+}
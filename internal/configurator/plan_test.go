@@ -0,0 +1,175 @@
+package configurator
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/andrew/ezproxy/internal/config"
+	"github.com/andrew/ezproxy/internal/fileutil"
+	"github.com/andrew/ezproxy/internal/privileged"
+	"github.com/andrew/ezproxy/internal/report"
+)
+
+func TestPlanLeavesFilesAlone(t *testing.T) {
+	dir := t.TempDir()
+	bashrc := filepath.Join(dir, ".bashrc")
+	os.WriteFile(bashrc, []byte("# mine\n"), 0644)
+	pip := filepath.Join(dir, "pip.conf")
+	authPath := filepath.Join(dir, "proxy-auth")
+
+	cfg := testConfigNoCert()
+	cfg.Auth = &config.ProxyAuth{Host: "proxy.corp.com:8080", Username: "alice", Password: "secret"}
+	configurators := []Configurator{
+		&EnvVars{profiles: []string{bashrc}, authPath: authPath},
+		&Pip{path: pip},
+	}
+
+	for _, c := range configurators {
+		State.Forget(c.Name())
+		changes, err := c.Plan(cfg)
+		if err != nil {
+			t.Fatalf("%s: %v", c.Name(), err)
+		}
+		if len(changes) == 0 {
+			t.Errorf("%s planned nothing", c.Name())
+		}
+		if _, ok := State.Lookup(c.Name()); ok {
+			t.Errorf("planning %s recorded state", c.Name())
+		}
+	}
+	if data, _ := os.ReadFile(bashrc); string(data) != "# mine\n" {
+		t.Errorf("planning wrote .bashrc:\n%s", data)
+	}
+	for _, path := range []string{pip, authPath} {
+		if fileExists(path) {
+			t.Errorf("planning created %s", path)
+		}
+	}
+
+	// Once applied, planning the removal changes nothing either.
+	for _, c := range configurators {
+		if err := Apply(c, cfg); err != nil {
+			t.Fatalf("Apply %s: %v", c.Name(), err)
+		}
+	}
+	applied, _ := os.ReadFile(bashrc)
+	for _, c := range configurators {
+		if _, err := c.PlanRemove(); err != nil {
+			t.Fatalf("PlanRemove %s: %v", c.Name(), err)
+		}
+	}
+	if data, _ := os.ReadFile(bashrc); string(data) != string(applied) {
+		t.Errorf("planning the removal wrote .bashrc:\n%s", data)
+	}
+	if !fileExists(pip) || !fileExists(authPath) {
+		t.Error("planning the removal deleted a file")
+	}
+}
+
+func TestExecuteFileEdits(t *testing.T) {
+	dir := t.TempDir()
+	created, removed := filepath.Join(dir, "created"), filepath.Join(dir, "removed")
+	os.WriteFile(removed, []byte("old\n"), 0644)
+
+	err := execute("plan_test", []Change{
+		FileEdit{Path: created, Content: []byte("proxy=p\n"), Mode: 0644, Private: true},
+		FileEdit{Path: removed, Delete: true},
+	}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if info, err := os.Stat(created); err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("private file: %v, %v", info, err)
+	}
+	if fileExists(removed) {
+		t.Error("deleted file still exists")
+	}
+	tool, ok := State.Lookup("plan_test")
+	if !ok {
+		t.Fatal("nothing recorded")
+	}
+	if f, ok := tool.File(created); !ok || !f.Created {
+		t.Errorf("written file recorded as %+v, %v", f, ok)
+	}
+	State.Forget("plan_test")
+
+	// A removal records nothing, since the tool's state is forgotten.
+	if err := execute("plan_test", []Change{FileEdit{Path: created, Content: []byte("\n"), Mode: 0644}}, true); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := State.Lookup("plan_test"); ok {
+		t.Error("removal recorded a file")
+	}
+}
+
+func TestExecuteKeepsRecordsOnceDone(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "99ezproxy")
+	changes := []Change{Privileged{
+		Actions: []privileged.Action{privileged.WriteFile{Path: path, Content: "x\n", Mode: 0644}},
+		Records: []Record{recordFile(path, false), recordSetting(path, "proxy", nil, "http://proxy:8080")},
+	}}
+	saved := privileged.Escalation
+	privileged.Escalation = func() ([]string, error) { return nil, nil }
+	fileutil.AutoYes = true
+	report.JSON = true
+	defer func() {
+		privileged.Escalation = saved
+		fileutil.AutoYes = false
+		report.JSON = false
+		State.Forget("plan_test")
+	}()
+	report.Start("apply")
+
+	// Nothing is recorded until the queued write has run, nor in a dry run.
+	fileutil.DryRun = true
+	if err := execute("plan_test", changes, false); err != nil {
+		t.Fatal(err)
+	}
+	privileged.Flush()
+	fileutil.DryRun = false
+	if _, ok := State.Lookup("plan_test"); ok {
+		t.Fatal("a dry run recorded state")
+	}
+	if err := execute("plan_test", changes, false); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := State.Lookup("plan_test"); ok {
+		t.Fatal("recorded state before the write ran")
+	}
+	privileged.Flush()
+	tool, ok := State.Lookup("plan_test")
+	if !ok {
+		t.Fatal("nothing recorded")
+	}
+	if f, ok := tool.File(path); !ok || !f.Created {
+		t.Errorf("file recorded as %+v, %v", f, ok)
+	}
+	if _, ok := tool.Setting(path, "proxy"); !ok {
+		t.Error("setting not recorded")
+	}
+}
+
+func TestExecuteReportsManualStepsAndNotes(t *testing.T) {
+	report.JSON = true
+	defer func() { report.JSON = false }()
+	report.Start("apply")
+	tool := report.BeginTool("plan_test")
+	defer report.EndTool()
+
+	err := execute("plan_test", []Change{
+		Manual{Text: "Open the settings\nand set the proxy"},
+		Note{Text: "✓ already trusted"},
+	}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(tool.Warnings) != 1 || tool.Warnings[0] != "Open the settings\n  and set the proxy" {
+		t.Errorf("warnings = %q", tool.Warnings)
+	}
+	if len(tool.Messages) != 1 || tool.Messages[0] != "✓ already trusted" {
+		t.Errorf("messages = %q", tool.Messages)
+	}
+}
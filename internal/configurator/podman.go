@@ -4,11 +4,15 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"regexp"
+	"slices"
 	"strings"
 
 	"github.com/andrew/ezproxy/internal/config"
 	"github.com/andrew/ezproxy/internal/detect"
+	"github.com/andrew/ezproxy/internal/escape"
 	"github.com/andrew/ezproxy/internal/fileutil"
+	"github.com/andrew/ezproxy/internal/noproxy"
 )
 
 type Podman struct {
@@ -17,6 +21,8 @@ type Podman struct {
 
 func (p *Podman) Name() string { return "podman" }
 
+func (p *Podman) NoProxyDialect() noproxy.Dialect { return noproxy.Go }
+
 func (p *Podman) IsAvailable(_ detect.OSInfo) bool {
 	return detect.IsCommandAvailable("podman")
 }
@@ -29,39 +35,63 @@ func (p *Podman) configPath() string {
 	return filepath.Join(home, ".config", "containers", "containers.conf")
 }
 
-func (p *Podman) Apply(cfg *config.Config) error {
-	path := p.configPath()
+func (p *Podman) Plan(cfg *config.Config) ([]Change, error) {
+	edit, err := mergeKeys(p.Name(), p.configPath(), fileutil.TOML, p.keys(cfg))
+	if err != nil {
+		return nil, err
+	}
+	edit.Private = hasAuth(cfg)
+	return []Change{edit}, nil
+}
 
-	// Podman containers.conf uses TOML. We use marker blocks to manage
-	// our env entries in the [containers] section.
-	content := fmt.Sprintf(`[containers]
-env = [
-  "http_proxy=%s",
-  "https_proxy=%s",
-  "no_proxy=%s",
-  "HTTP_PROXY=%s",
-  "HTTPS_PROXY=%s",
-  "NO_PROXY=%s",
-]
-`, cfg.Proxy.HTTP, cfg.Proxy.HTTPS, cfg.Proxy.NoProxy,
-		cfg.Proxy.HTTP, cfg.Proxy.HTTPS, cfg.Proxy.NoProxy)
+func (p *Podman) AuthMethod() string { return "in the proxy URLs in containers.conf (mode 0600)" }
 
-	return fileutil.UpsertMarkerBlock(path, content, "#")
-}
+// podmanProxyVars are the env entries ezproxy owns in containers.conf.
+var podmanProxyVars = []string{"http_proxy", "https_proxy", "no_proxy", "HTTP_PROXY", "HTTPS_PROXY", "NO_PROXY"}
 
-func (p *Podman) Remove() error {
-	path := p.configPath()
-	return fileutil.RemoveMarkerBlock(path, "#")
+// keys returns the [containers] env array: the user's own entries, if the
+// file has any, followed by the proxy variables.
+func (p *Podman) keys(cfg *config.Config) []fileutil.Key {
+	values := []string{cfg.WithAuth(cfg.Proxy.HTTP), cfg.WithAuth(cfg.Proxy.HTTPS), noProxy(noproxy.Go, cfg)}
+	var b strings.Builder
+	b.WriteString("[\n")
+	for _, entry := range p.userEnv() {
+		fmt.Fprintf(&b, "  %s,\n", entry)
+	}
+	for i, name := range podmanProxyVars {
+		fmt.Fprintf(&b, "  %s,\n", escape.TOML(name+"="+values[i%3]))
+	}
+	b.WriteString("]")
+	return []fileutil.Key{{Section: "containers", Name: "env", Value: b.String()}}
 }
 
-func (p *Podman) Status(cfg *config.Config) (string, error) {
-	path := p.configPath()
-	data, err := os.ReadFile(path)
+var tomlStringRe = regexp.MustCompile(`"(?:[^"\\]|\\.)*"|'[^']*'`)
+
+// userEnv returns the entries of the existing env array that are not proxy
+// variables, as written. A block from an older ezproxy is ignored.
+func (p *Podman) userEnv() []string {
+	content, err := fileutil.ContentOutsideMarkerBlock(p.configPath(), p.Name(), "#")
 	if err != nil {
-		return "not configured", nil
+		return nil
+	}
+	env := fileutil.GetKey(fileutil.TOML, content, "containers", "env")
+	if env == nil {
+		return nil
 	}
-	if strings.Contains(string(data), cfg.Proxy.HTTP) {
-		return "configured", nil
+	var out []string
+	for _, entry := range tomlStringRe.FindAllString(*env, -1) {
+		name, _, _ := strings.Cut(entry[1:len(entry)-1], "=")
+		if !slices.Contains(podmanProxyVars, name) {
+			out = append(out, entry)
+		}
 	}
-	return "not configured", nil
+	return out
+}
+
+func (p *Podman) PlanRemove() ([]Change, error) {
+	return unmergeKeys(p.Name(), p.configPath(), fileutil.TOML)
+}
+
+func (p *Podman) Status(cfg *config.Config) (string, error) {
+	return keysStatus(p.Name(), p.configPath(), fileutil.TOML, p.keys(cfg)), nil
 }
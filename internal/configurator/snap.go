@@ -1,42 +1,117 @@
 package configurator
 
 import (
-	"fmt"
+	"os/exec"
+	"strings"
 
+	"github.com/andrew/ezproxy/internal/certs"
 	"github.com/andrew/ezproxy/internal/config"
 	"github.com/andrew/ezproxy/internal/detect"
+	"github.com/andrew/ezproxy/internal/noproxy"
+	"github.com/andrew/ezproxy/internal/privileged"
 )
 
 type Snap struct{}
 
 func (s *Snap) Name() string { return "snap" }
 
+func (s *Snap) NoProxyDialect() noproxy.Dialect { return noproxy.None }
+
+// AuthMethod is empty: the settings are system-wide, so they never get a
+// user's password.
+func (s *Snap) AuthMethod() string { return "" }
+
 func (s *Snap) IsAvailable(_ detect.OSInfo) bool {
 	return detect.IsCommandAvailable("snap")
 }
 
-func (s *Snap) Apply(cfg *config.Config) error {
-	certPath := config.ExpandPath(cfg.CACert)
-	cmds := []string{
-		fmt.Sprintf("snap set system proxy.http=%s", shellQuote(cfg.Proxy.HTTP)),
-		fmt.Sprintf("snap set system proxy.https=%s", shellQuote(cfg.Proxy.HTTPS)),
+func (s *Snap) Plan(cfg *config.Config) ([]Change, error) {
+	cas, err := certs.Load(cfg.CACertPaths())
+	if err != nil {
+		return nil, err
+	}
+	actions := []privileged.Action{
+		snapSet("proxy.http", cfg.Proxy.HTTP),
+		snapSet("proxy.https", cfg.Proxy.HTTPS),
+	}
+	// One store cert per CA, named by alias.
+	for _, ca := range cas {
+		actions = append(actions, snapSet("store-certs."+ca.Alias, string(ca.PEM())))
+	}
+	records := []Record{
+		recordSetting("", "proxy.http", snapGet("proxy.http"), cfg.Proxy.HTTP),
+		recordSetting("", "proxy.https", snapGet("proxy.https"), cfg.Proxy.HTTPS),
+	}
+	for _, ca := range cas {
+		records = append(records, recordSetting("", ca.Alias, nil, ca.Fingerprint()))
+	}
+	return []Change{Privileged{Actions: actions, Records: records}}, nil
+}
+
+// PlanRemove restores the system proxy settings to their values before
+// apply, or unsets them if they were not set. The ezproxy store certs are
+// always removed since they are ours.
+func (s *Snap) PlanRemove() ([]Change, error) {
+	var actions []privileged.Action
+	t, recorded := State.Lookup(s.Name())
+	for _, key := range []string{"proxy.http", "proxy.https"} {
+		if !recorded {
+			actions = append(actions, snapUnset(key))
+			continue
+		}
+		setting, ok := t.Setting("", key)
+		if !ok {
+			continue
+		}
+		if current := snapGet(key); current == nil || *current != setting.Value {
+			continue
+		}
+		if setting.Previous != nil {
+			actions = append(actions, snapSet(key, *setting.Previous))
+		} else {
+			actions = append(actions, snapUnset(key))
+		}
 	}
-	if certPath != "" {
-		cmds = append(cmds,
-			fmt.Sprintf("snap set system store-certs.ezproxy=\"$(cat %s)\"", shellQuote(certPath)),
-		)
+	// "store-certs.ezproxy" is the name used before per-CA aliases.
+	actions = append(actions, snapUnset("store-certs.ezproxy"))
+	for _, alias := range installedCAAliases(s.Name()) {
+		if alias != legacyCAAlias {
+			actions = append(actions, snapUnset("store-certs."+alias))
+		}
 	}
-	return runSudoCommands(s.Name(), cmds)
+	return []Change{Privileged{Actions: actions}}, nil
+}
+
+// snapSet returns the action that sets a system snap setting. key=value
+// is passed to snap as a single argument, so the value needs no quoting.
+func snapSet(key, value string) privileged.Action {
+	return privileged.Run{Argv: []string{"snap", "set", "system", key + "=" + value}}
+}
+
+// snapUnset returns the action that unsets a system snap setting.
+func snapUnset(key string) privileged.Action {
+	return privileged.Run{Argv: []string{"snap", "unset", "system", key}}
 }
 
-func (s *Snap) Remove() error {
-	return runSudoRemoveCommands(s.Name(), []string{
-		"snap unset system proxy.http",
-		"snap unset system proxy.https",
-		"snap unset system store-certs.ezproxy",
-	})
+// snapGet returns a system snap setting, or nil if it is not set.
+func snapGet(key string) *string {
+	out, err := exec.Command("snap", "get", "system", key).Output()
+	if err != nil {
+		return nil
+	}
+	v := strings.TrimSpace(string(out))
+	if v == "" {
+		return nil
+	}
+	return &v
 }
 
 func (s *Snap) Status(cfg *config.Config) (string, error) {
-	return "unknown (check manually)", nil
+	keys := []string{"proxy.http", "proxy.https"}
+	expected := map[string]string{"proxy.http": cfg.Proxy.HTTP, "proxy.https": cfg.Proxy.HTTPS}
+	actual := make(map[string]*string)
+	for _, k := range keys {
+		actual[k] = snapGet(k)
+	}
+	return compareValues(keys, expected, actual), nil
 }
@@ -4,12 +4,14 @@ import (
 	"fmt"
 	"net/url"
 	"os"
+	"os/exec"
 	"path/filepath"
 	"strings"
 
 	"github.com/andrew/ezproxy/internal/config"
 	"github.com/andrew/ezproxy/internal/detect"
-	"github.com/andrew/ezproxy/internal/fileutil"
+	"github.com/andrew/ezproxy/internal/escape"
+	"github.com/andrew/ezproxy/internal/noproxy"
 )
 
 type SSH struct {
@@ -18,6 +20,8 @@ type SSH struct {
 
 func (s *SSH) Name() string { return "ssh" }
 
+func (s *SSH) NoProxyDialect() noproxy.Dialect { return noproxy.SSH }
+
 func (s *SSH) IsAvailable(_ detect.OSInfo) bool {
 	return detect.IsCommandAvailable("ssh")
 }
@@ -30,40 +34,70 @@ func (s *SSH) getPath() string {
 	return filepath.Join(home, ".ssh", "config")
 }
 
-func (s *SSH) Apply(cfg *config.Config) error {
-	// Extract host:port from proxy URL
-	proxyURL, err := url.Parse(cfg.Proxy.HTTP)
+func (s *SSH) Plan(cfg *config.Config) ([]Change, error) {
+	content, err := s.content(cfg)
 	if err != nil {
-		return fmt.Errorf("parsing proxy URL: %w", err)
+		return nil, err
 	}
-	proxyHost := proxyURL.Host
-
-	var b strings.Builder
-	fmt.Fprintf(&b, "Host *\n")
-	fmt.Fprintf(&b, "    ProxyCommand nc -X connect -x %s %%h %%p\n", proxyHost)
-
-	if err := fileutil.UpsertMarkerBlock(s.getPath(), b.String(), "#"); err != nil {
-		return err
+	edit, err := upsertBlock(s.Name(), s.getPath(), content)
+	if err != nil {
+		return nil, err
 	}
+	changes := []Change{edit}
 
 	// Warn about GNU netcat on Linux
 	osInfo := detect.DetectOS()
 	if osInfo.OS == "linux" {
-		fmt.Println("\nNote: SSH proxy requires OpenBSD netcat (netcat-openbsd).")
-		fmt.Println("GNU netcat does NOT support -X/-x proxy flags.")
-		fmt.Println("Install: sudo apt install netcat-openbsd (Debian/Ubuntu)")
+		changes = append(changes, Manual{Text: "Note: SSH proxy requires OpenBSD netcat (netcat-openbsd).\n" +
+			"GNU netcat does NOT support -X/-x proxy flags.\n" +
+			"Install: sudo apt install netcat-openbsd (Debian/Ubuntu)"})
 	}
 
-	return nil
+	return changes, nil
+}
+
+func (s *SSH) content(cfg *config.Config) (string, error) {
+	// Extract host:port from proxy URL
+	proxyURL, err := url.Parse(cfg.Proxy.HTTP)
+	if err != nil {
+		return "", fmt.Errorf("parsing proxy URL: %w", err)
+	}
+
+	var b strings.Builder
+	// Hosts on NO_PROXY are excluded with negated patterns.
+	fmt.Fprintf(&b, "%s\n", strings.TrimSpace("Host * "+noProxy(noproxy.SSH, cfg)))
+	// nc can take a user name but asks for the password itself.
+	user := ""
+	if a := cfg.AuthFor(cfg.Proxy.HTTP); a != nil {
+		user = "-P " + escape.SSHCommand(a.Username) + " "
+	}
+	fmt.Fprintf(&b, "    ProxyCommand nc -X connect %s-x %s %%h %%p\n", user, escape.SSHCommand(proxyURL.Host))
+	return b.String(), nil
 }
 
-func (s *SSH) Remove() error {
-	return fileutil.RemoveMarkerBlock(s.getPath(), "#")
+func (s *SSH) AuthMethod() string { return "user name for nc -P; nc asks for the password" }
+
+func (s *SSH) PlanRemove() ([]Change, error) {
+	return removeBlock(s.Name(), s.getPath())
 }
 
 func (s *SSH) Status(cfg *config.Config) (string, error) {
-	if fileutil.HasMarkerBlock(s.getPath(), "#") {
-		return "configured", nil
+	content, err := s.content(cfg)
+	if err != nil {
+		return "", err
+	}
+	return blockDiff(s.Name(), s.getPath(), content), nil
+}
+
+// Diagnose checks that nc supports the -X/-x proxy flags the ProxyCommand
+// relies on; GNU netcat does not.
+func (s *SSH) Diagnose(_ *config.Config) error {
+	if !detect.IsCommandAvailable("nc") {
+		return fmt.Errorf("nc not found; install OpenBSD netcat (netcat-openbsd)")
+	}
+	out, _ := exec.Command("nc", "-h").CombinedOutput()
+	if !strings.Contains(string(out), "-X") {
+		return fmt.Errorf("nc does not support -X (GNU netcat?); install OpenBSD netcat (netcat-openbsd)")
 	}
-	return "not configured", nil
+	return nil
 }
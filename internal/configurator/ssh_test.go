@@ -15,7 +15,7 @@ func TestSSHApply(t *testing.T) {
 	cfg := &config.Config{
 		Proxy: config.ProxyConfig{HTTP: "http://proxy.corp.com:8080"},
 	}
-	if err := s.Apply(cfg); err != nil {
+	if err := Apply(s, cfg); err != nil {
 		t.Fatalf("Apply: %v", err)
 	}
 	data, _ := os.ReadFile(s.path)
@@ -28,14 +28,29 @@ func TestSSHApply(t *testing.T) {
 	}
 }
 
+func TestSSHApply_NoProxy(t *testing.T) {
+	dir := t.TempDir()
+	s := &SSH{path: filepath.Join(dir, "config")}
+	cfg := &config.Config{
+		Proxy: config.ProxyConfig{HTTP: "http://proxy.corp.com:8080", NoProxy: "localhost,.corp.com,10.0.0.0/8"},
+	}
+	if err := Apply(s, cfg); err != nil {
+		t.Fatalf("Apply: %v", err)
+	}
+	data, _ := os.ReadFile(s.path)
+	if want := "Host * !localhost !*.corp.com !10.*\n"; !strings.Contains(string(data), want) {
+		t.Errorf("config lacks %q:\n%s", want, data)
+	}
+}
+
 func TestSSHRemove(t *testing.T) {
 	dir := t.TempDir()
 	s := &SSH{path: filepath.Join(dir, "config")}
 	cfg := &config.Config{
 		Proxy: config.ProxyConfig{HTTP: "http://proxy.corp.com:8080"},
 	}
-	s.Apply(cfg)
-	s.Remove()
+	Apply(s, cfg)
+	Remove(s)
 	data, _ := os.ReadFile(s.path)
 	if strings.Contains(string(data), "ezproxy") {
 		t.Error("should be cleaned")
@@ -0,0 +1,80 @@
+package configurator
+
+import (
+	"os"
+	"strings"
+
+	"github.com/andrew/ezproxy/internal/fileutil"
+	"github.com/andrew/ezproxy/internal/state"
+)
+
+// State is the manifest of what ezproxy has applied. cmd/ezproxy loads it
+// from ~/.ezproxy/state.json before running configurators and saves it
+// afterwards; on its own it is an empty in-memory manifest.
+var State = state.New()
+
+// fileExists reports whether path exists, counting the changes previewed
+// so far in a dry run.
+func fileExists(path string) bool {
+	return fileutil.Exists(path)
+}
+
+// upsertBlock returns the edit that writes tool's ezproxy marker block in
+// path.
+func upsertBlock(tool, path, content string) (FileEdit, error) {
+	data, err := fileutil.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return FileEdit{}, err
+	}
+	return FileEdit{Path: path, Content: []byte(fileutil.SetMarkerBlock(string(data), tool, content, "#")), Mode: 0644}, nil
+}
+
+// removeBlock returns the edit that strips tool's ezproxy marker block from
+// path, if it has one. If ezproxy created the file and nothing else is
+// left in it, the file is deleted so the system ends up exactly as it was
+// before apply.
+func removeBlock(tool, path string) ([]Change, error) {
+	data, err := fileutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	content := fileutil.DeleteMarkerBlock(string(data), tool, "#")
+	if content == string(data) {
+		return nil, nil
+	}
+	if strings.TrimSpace(content) == "" && created(tool, path) {
+		return []Change{FileEdit{Path: path, Delete: true}}, nil
+	}
+	return []Change{FileEdit{Path: path, Content: []byte(content), Mode: 0644}}, nil
+}
+
+// created reports whether path was recorded as created by ezproxy for tool.
+func created(tool, path string) bool {
+	t, ok := State.Lookup(tool)
+	if !ok {
+		return false
+	}
+	f, ok := t.File(path)
+	return ok && f.Created
+}
+
+// removeIfUntouched returns the edit that deletes path if ezproxy created
+// it and it has not been modified since, and whether it did.
+func removeIfUntouched(tool, path string) (FileEdit, bool) {
+	t, ok := State.Lookup(tool)
+	if !ok {
+		return FileEdit{}, false
+	}
+	f, ok := t.File(path)
+	if !ok || !f.Created {
+		return FileEdit{}, false
+	}
+	data, err := fileutil.ReadFile(path)
+	if err != nil || state.Hash(data) != f.Hash {
+		return FileEdit{}, false
+	}
+	return FileEdit{Path: path, Delete: true}, true
+}
@@ -2,16 +2,17 @@ package configurator
 
 import (
 	"crypto/x509"
-	"encoding/pem"
 	"fmt"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"runtime"
 	"strings"
 
+	"github.com/andrew/ezproxy/internal/certs"
 	"github.com/andrew/ezproxy/internal/config"
 	"github.com/andrew/ezproxy/internal/detect"
-	"github.com/andrew/ezproxy/internal/fileutil"
+	"github.com/andrew/ezproxy/internal/privileged"
 )
 
 type SystemCA struct{}
@@ -20,92 +21,122 @@ func (s *SystemCA) Name() string { return "system_ca" }
 
 func (s *SystemCA) IsAvailable(_ detect.OSInfo) bool { return true }
 
-func (s *SystemCA) Apply(cfg *config.Config) error {
-	certPath := config.ExpandPath(cfg.CACert)
-	if certPath == "" {
-		return fmt.Errorf("no CA cert configured")
+func (s *SystemCA) Plan(cfg *config.Config) ([]Change, error) {
+	if !cfg.HasCACerts() {
+		return nil, fmt.Errorf("no CA cert configured")
 	}
-
-	if _, err := os.Stat(certPath); err != nil {
-		return fmt.Errorf("cert file not found: %s", certPath)
+	cas, err := certs.Load(cfg.CACertPaths())
+	if err != nil {
+		return nil, err
 	}
 
-	if !fileutil.DryRun && isCertSystemTrusted(certPath) {
-		fmt.Printf("  ✓ CA cert is already trusted by the system (likely managed by IT)\n")
-		return nil
+	var changes []Change
+	var missing []*certs.CA
+	for _, ca := range cas {
+		if isCertSystemTrusted(ca) {
+			changes = append(changes, Note{Text: fmt.Sprintf("✓ %s is already trusted by the system (likely managed by IT)", ca.Cert.Subject.CommonName)})
+			continue
+		}
+		missing = append(missing, ca)
 	}
-
-	osInfo := detect.DetectOS()
-
-	if runtime.GOOS == "darwin" {
-		return s.applyDarwin(certPath)
+	if len(missing) == 0 {
+		return changes, nil
 	}
 
-	if fileutil.DryRun {
-		fmt.Printf("\n  [dry-run] Would check if CA cert is already in system trust store\n")
-		fmt.Printf("  [dry-run] If not found, would install via sudo\n")
-		return nil
+	actions, ok := systemCAInstallActions(missing)
+	if !ok {
+		return append(changes, Manual{Text: "Unknown Linux distro. Copy cert to your system's CA trust directory and update the trust store manually."}), nil
 	}
-
-	if osInfo.IsDebian() {
-		return runSudoCommands(s.Name(), []string{
-			fmt.Sprintf("cp %s /usr/local/share/ca-certificates/ezproxy-corp-ca.crt", shellQuote(certPath)),
-			"update-ca-certificates",
-		})
+	var records []Record
+	for _, ca := range missing {
+		records = append(records, recordSetting("", ca.Alias, nil, ca.Fingerprint()))
 	}
+	return append(changes, Privileged{Actions: actions, Records: records}), nil
+}
 
-	if osInfo.IsRHEL() {
-		return runSudoCommands(s.Name(), []string{
-			fmt.Sprintf("cp %s /etc/pki/ca-trust/source/anchors/ezproxy-corp-ca.pem", shellQuote(certPath)),
-			"update-ca-trust extract",
-		})
+// systemCAInstallActions returns the actions that add each CA to the OS
+// trust store under its alias. ok is false on an unsupported system.
+func systemCAInstallActions(cas []*certs.CA) (actions []privileged.Action, ok bool) {
+	if runtime.GOOS == "darwin" {
+		for _, ca := range cas {
+			actions = append(actions, privileged.Run{
+				Argv:  []string{"security", "add-trusted-cert", "-d", "-r", "trustRoot", "-k", "/Library/Keychains/System.keychain", "/dev/stdin"},
+				Stdin: string(ca.PEM()),
+			})
+		}
+		return actions, true
 	}
 
-	if osInfo.IsArch() {
-		return runSudoCommands(s.Name(), []string{
-			fmt.Sprintf("trust anchor --store %s", shellQuote(certPath)),
-		})
+	dir, update := systemCAStore(detect.DetectOS())
+	if dir == "" {
+		return nil, false
+	}
+	for _, ca := range cas {
+		actions = append(actions, privileged.WriteFile{Path: systemCAPath(dir, ca.Alias), Content: string(ca.PEM()), Mode: 0644})
 	}
+	return append(actions, privileged.Run{Argv: update}), true
+}
 
-	fmt.Println("\n  Unknown Linux distro. Copy cert to your system's CA trust directory and update the trust store manually.")
-	return nil
+// systemCAStore returns the directory of extra trusted CAs on a Linux
+// distro and the command that rebuilds the trust store from it, or "" if
+// the distro isn't supported.
+func systemCAStore(osInfo detect.OSInfo) (dir string, update []string) {
+	switch {
+	case osInfo.IsDebian():
+		return "/usr/local/share/ca-certificates", []string{"update-ca-certificates", "--fresh"}
+	case osInfo.IsRHEL():
+		return "/etc/pki/ca-trust/source/anchors", []string{"update-ca-trust", "extract"}
+	case osInfo.IsArch():
+		return "/etc/ca-certificates/trust-source/anchors", []string{"update-ca-trust", "extract"}
+	}
+	return "", nil
 }
 
-func (s *SystemCA) applyDarwin(certPath string) error {
-	if fileutil.DryRun {
-		fmt.Printf("\n  [dry-run] Would check if CA cert is already in macOS System Keychain\n")
-		fmt.Printf("  [dry-run] If not found, would run: sudo security add-trusted-cert ...\n")
-		return nil
+// systemCAPath is where the CA with alias is written in dir.
+// update-ca-certificates only reads files ending in .crt.
+func systemCAPath(dir, alias string) string {
+	if dir == "/usr/local/share/ca-certificates" {
+		return filepath.Join(dir, alias+".crt")
 	}
-
-	return runSudoCommands(s.Name(), []string{
-		fmt.Sprintf("security add-trusted-cert -d -r trustRoot -k /Library/Keychains/System.keychain %s", shellQuote(certPath)),
-	})
+	return filepath.Join(dir, alias+".pem")
 }
 
-// isCertSystemTrusted checks whether the given PEM cert is already trusted
-// by the operating system. On macOS it checks the Keychain, on Linux it uses
-// Go's SystemCertPool which reads the distro's CA bundle.
-func isCertSystemTrusted(certPath string) bool {
-	certData, err := os.ReadFile(certPath)
+// stageCert writes ca as PEM to a new temporary file of our own, so no
+// other user can have put a file of theirs in its place. The caller
+// removes it.
+func stageCert(ca *certs.CA) (string, error) {
+	f, err := os.CreateTemp("", "ezproxy-"+ca.Alias+"-*.pem")
 	if err != nil {
-		return false
+		return "", fmt.Errorf("staging %s: %w", ca.Alias, err)
 	}
-	block, _ := pem.Decode(certData)
-	if block == nil {
-		return false
+	if _, err := f.Write(ca.PEM()); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return "", fmt.Errorf("staging %s: %w", ca.Alias, err)
 	}
-	cert, err := x509.ParseCertificate(block.Bytes)
-	if err != nil {
-		return false
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return "", fmt.Errorf("staging %s: %w", ca.Alias, err)
 	}
+	return f.Name(), nil
+}
 
+// isCertSystemTrusted checks whether the given CA cert is already trusted
+// by the operating system. On macOS it checks the Keychain, on Linux it reads
+// the distro's CA bundle.
+func isCertSystemTrusted(ca *certs.CA) bool {
+	cert := ca.Cert
 	if runtime.GOOS == "darwin" {
-		return isDarwinCertTrusted(certPath, cert)
+		path, err := stageCert(ca)
+		if err != nil {
+			return false
+		}
+		defer os.Remove(path)
+		return isDarwinCertTrusted(path, cert)
 	}
 
 	// Linux: check against the system cert pool
-	pool, err := x509.SystemCertPool()
+	pool, err := certs.SystemPool()
 	if err != nil {
 		return false
 	}
@@ -145,44 +176,62 @@ func isDarwinCertTrusted(certPath string, cert *x509.Certificate) bool {
 	return strings.Contains(string(out), cert.Subject.CommonName)
 }
 
-func (s *SystemCA) Remove() error {
+// legacyCAAlias is the single name used before ezproxy supported several
+// CAs. It is always cleaned up on remove.
+const legacyCAAlias = "ezproxy-corp-ca"
+
+// installedCAAliases returns the aliases recorded by apply, plus the legacy
+// alias.
+func installedCAAliases(tool string) []string {
+	aliases := []string{legacyCAAlias}
+	if t, ok := State.Lookup(tool); ok {
+		for _, setting := range t.Settings {
+			if setting.File == "" && strings.HasPrefix(setting.Key, "ezproxy-") {
+				aliases = append(aliases, setting.Key)
+			}
+		}
+	}
+	return aliases
+}
+
+func (s *SystemCA) PlanRemove() ([]Change, error) {
 	osInfo := detect.DetectOS()
+	aliases := installedCAAliases(s.Name())
 
 	if runtime.GOOS == "darwin" {
-		fmt.Println("\n  To remove CA cert from macOS: open Keychain Access > System > Certificates, find the cert and delete it.")
-		return nil
+		return []Change{Manual{Text: "To remove CA cert from macOS: open Keychain Access > System > Certificates, find the cert and delete it."}}, nil
 	}
 
-	if osInfo.IsDebian() {
-		return runSudoRemoveCommands(s.Name(), []string{
-			"rm -f /usr/local/share/ca-certificates/ezproxy-corp-ca.crt",
-			"update-ca-certificates --fresh",
-		})
+	dir, update := systemCAStore(osInfo)
+	if dir == "" {
+		return nil, nil
 	}
-
-	if osInfo.IsRHEL() {
-		return runSudoRemoveCommands(s.Name(), []string{
-			"rm -f /etc/pki/ca-trust/source/anchors/ezproxy-corp-ca.pem",
-			"update-ca-trust extract",
-		})
-	}
-
-	if osInfo.IsArch() {
-		return runSudoRemoveCommands(s.Name(), []string{
-			"trust anchor --remove ezproxy-corp-ca.pem",
-		})
+	var actions []privileged.Action
+	for _, alias := range aliases {
+		actions = append(actions, privileged.RemoveFile{Path: systemCAPath(dir, alias)})
 	}
-
-	return nil
+	return []Change{Privileged{Actions: append(actions, privileged.Run{Argv: update})}}, nil
 }
 
 func (s *SystemCA) Status(cfg *config.Config) (string, error) {
-	certPath := config.ExpandPath(cfg.CACert)
-	if certPath == "" {
+	if !cfg.HasCACerts() {
 		return "no cert configured", nil
 	}
-	if isCertSystemTrusted(certPath) {
+	cas, err := certs.Load(cfg.CACertPaths())
+	if err != nil {
+		return "", err
+	}
+	var untrusted []string
+	for _, ca := range cas {
+		if !isCertSystemTrusted(ca) {
+			untrusted = append(untrusted, ca.Alias)
+		}
+	}
+	switch {
+	case len(untrusted) == 0:
 		return "trusted by system", nil
+	case len(untrusted) == len(cas):
+		return "not trusted by system", nil
 	}
-	return "not trusted by system", nil
+	return fmt.Sprintf("not trusted by system (%s)", strings.Join(untrusted, ", ")), nil
 }
@@ -8,7 +8,9 @@ import (
 
 	"github.com/andrew/ezproxy/internal/config"
 	"github.com/andrew/ezproxy/internal/detect"
+	"github.com/andrew/ezproxy/internal/escape"
 	"github.com/andrew/ezproxy/internal/fileutil"
+	"github.com/andrew/ezproxy/internal/noproxy"
 )
 
 type Wget struct {
@@ -17,6 +19,8 @@ type Wget struct {
 
 func (w *Wget) Name() string { return "wget" }
 
+func (w *Wget) NoProxyDialect() noproxy.Dialect { return noproxy.Wget }
+
 func (w *Wget) IsAvailable(_ detect.OSInfo) bool {
 	return detect.IsCommandAvailable("wget")
 }
@@ -29,24 +33,58 @@ func (w *Wget) getPath() string {
 	return filepath.Join(home, ".wgetrc")
 }
 
-func (w *Wget) Apply(cfg *config.Config) error {
-	certPath := config.ExpandPath(cfg.CACert)
+func (w *Wget) Plan(cfg *config.Config) ([]Change, error) {
+	content, err := w.content(cfg)
+	if err != nil {
+		return nil, err
+	}
+	edit, err := upsertBlock(w.Name(), w.getPath(), content)
+	if err != nil {
+		return nil, err
+	}
+	edit.Private = hasAuth(cfg)
+	return []Change{edit}, nil
+}
+
+func (w *Wget) AuthMethod() string { return "proxy_user and proxy_password in .wgetrc (mode 0600)" }
+
+func (w *Wget) content(cfg *config.Config) (string, error) {
+	settings := []fileutil.Key{
+		{Name: "http_proxy", Value: cfg.Proxy.HTTP},
+		{Name: "https_proxy", Value: cfg.Proxy.HTTPS},
+	}
+	// wget has one user and password for both proxies.
+	if a := cfg.AuthFor(cfg.Proxy.HTTP); a != nil {
+		settings = append(settings,
+			fileutil.Key{Name: "proxy_user", Value: a.Username},
+			fileutil.Key{Name: "proxy_password", Value: a.Password})
+	}
+	if np := noProxy(noproxy.Wget, cfg); np != "" {
+		settings = append(settings, fileutil.Key{Name: "no_proxy", Value: np})
+	}
+	if certPath := cfg.TrustBundlePath(); certPath != "" {
+		settings = append(settings, fileutil.Key{Name: "ca_certificate", Value: certPath})
+	}
+
 	var b strings.Builder
-	fmt.Fprintf(&b, "http_proxy = %s\n", cfg.Proxy.HTTP)
-	fmt.Fprintf(&b, "https_proxy = %s\n", cfg.Proxy.HTTPS)
-	if certPath != "" {
-		fmt.Fprintf(&b, "ca_certificate = %s\n", certPath)
+	for _, s := range settings {
+		v, err := escape.Wgetrc(s.Value)
+		if err != nil {
+			return "", fmt.Errorf("%s: %w", s.Name, err)
+		}
+		fmt.Fprintf(&b, "%s = %s\n", s.Name, v)
 	}
-	return fileutil.UpsertMarkerBlock(w.getPath(), b.String(), "#")
+	return b.String(), nil
 }
 
-func (w *Wget) Remove() error {
-	return fileutil.RemoveMarkerBlock(w.getPath(), "#")
+func (w *Wget) PlanRemove() ([]Change, error) {
+	return removeBlock(w.Name(), w.getPath())
 }
 
 func (w *Wget) Status(cfg *config.Config) (string, error) {
-	if fileutil.HasMarkerBlock(w.getPath(), "#") {
-		return "configured", nil
+	content, err := w.content(cfg)
+	if err != nil {
+		return "", err
 	}
-	return "not configured", nil
+	return blockStatus(w.Name(), w.getPath(), content), nil
 }
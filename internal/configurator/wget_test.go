@@ -16,7 +16,7 @@ func TestWgetApply(t *testing.T) {
 		Proxy:  config.ProxyConfig{HTTP: "http://proxy:8080", HTTPS: "http://proxy:8080"},
 		CACert: "/tmp/ca.pem",
 	}
-	if err := w.Apply(cfg); err != nil {
+	if err := Apply(w, cfg); err != nil {
 		t.Fatalf("Apply: %v", err)
 	}
 	data, _ := os.ReadFile(w.path)
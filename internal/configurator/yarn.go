@@ -9,7 +9,9 @@ import (
 
 	"github.com/andrew/ezproxy/internal/config"
 	"github.com/andrew/ezproxy/internal/detect"
+	"github.com/andrew/ezproxy/internal/escape"
 	"github.com/andrew/ezproxy/internal/fileutil"
+	"github.com/andrew/ezproxy/internal/noproxy"
 )
 
 type Yarn struct {
@@ -19,6 +21,8 @@ type Yarn struct {
 
 func (y *Yarn) Name() string { return "yarn" }
 
+func (y *Yarn) NoProxyDialect() noproxy.Dialect { return noproxy.Npm }
+
 func (y *Yarn) IsAvailable(_ detect.OSInfo) bool {
 	return detect.IsCommandAvailable("yarn")
 }
@@ -48,37 +52,60 @@ func (y *Yarn) getV2Path() string {
 	return filepath.Join(home, ".yarnrc.yml")
 }
 
-func (y *Yarn) Apply(cfg *config.Config) error {
-	certPath := config.ExpandPath(cfg.CACert)
-
+func (y *Yarn) Plan(cfg *config.Config) ([]Change, error) {
+	path, content := y.getV1Path(), y.v1Content(cfg)
 	if y.isV2OrLater() {
-		var b strings.Builder
-		fmt.Fprintf(&b, "httpProxy: \"%s\"\n", cfg.Proxy.HTTP)
-		fmt.Fprintf(&b, "httpsProxy: \"%s\"\n", cfg.Proxy.HTTPS)
-		if certPath != "" {
-			fmt.Fprintf(&b, "caFilePath: \"%s\"\n", certPath)
-		}
-		return fileutil.UpsertMarkerBlock(y.getV2Path(), b.String(), "#")
+		path, content = y.getV2Path(), y.v2Content(cfg)
+	}
+	edit, err := upsertBlock(y.Name(), path, content)
+	if err != nil {
+		return nil, err
+	}
+	edit.Private = hasAuth(cfg)
+	return []Change{edit}, nil
+}
+
+func (y *Yarn) AuthMethod() string { return "in the proxy URLs in .yarnrc or .yarnrc.yml (mode 0600)" }
+
+// v2Content returns the .yarnrc.yml block for Yarn 2+ (berry).
+func (y *Yarn) v2Content(cfg *config.Config) string {
+	certPath := cfg.TrustBundlePath()
+	var b strings.Builder
+	fmt.Fprintf(&b, "httpProxy: %s\n", escape.JSON(cfg.WithAuth(cfg.Proxy.HTTP)))
+	fmt.Fprintf(&b, "httpsProxy: %s\n", escape.JSON(cfg.WithAuth(cfg.Proxy.HTTPS)))
+	if certPath != "" {
+		fmt.Fprintf(&b, "caFilePath: %s\n", escape.JSON(certPath))
 	}
+	return b.String()
+}
 
+// v1Content returns the .yarnrc block for Yarn 1 (classic).
+func (y *Yarn) v1Content(cfg *config.Config) string {
+	certPath := cfg.TrustBundlePath()
 	var b strings.Builder
-	fmt.Fprintf(&b, "proxy \"%s\"\n", cfg.Proxy.HTTP)
-	fmt.Fprintf(&b, "https-proxy \"%s\"\n", cfg.Proxy.HTTPS)
+	fmt.Fprintf(&b, "proxy %s\n", escape.JSON(cfg.WithAuth(cfg.Proxy.HTTP)))
+	fmt.Fprintf(&b, "https-proxy %s\n", escape.JSON(cfg.WithAuth(cfg.Proxy.HTTPS)))
 	if certPath != "" {
-		fmt.Fprintf(&b, "cafile \"%s\"\n", certPath)
+		fmt.Fprintf(&b, "cafile %s\n", escape.JSON(certPath))
 	}
-	return fileutil.UpsertMarkerBlock(y.getV1Path(), b.String(), "#")
+	return b.String()
 }
 
-func (y *Yarn) Remove() error {
-	fileutil.RemoveMarkerBlock(y.getV1Path(), "#")
-	fileutil.RemoveMarkerBlock(y.getV2Path(), "#")
-	return nil
+func (y *Yarn) PlanRemove() ([]Change, error) {
+	var changes []Change
+	for _, path := range []string{y.getV1Path(), y.getV2Path()} {
+		edits, err := removeBlock(y.Name(), path)
+		if err != nil {
+			return nil, err
+		}
+		changes = append(changes, edits...)
+	}
+	return changes, nil
 }
 
 func (y *Yarn) Status(cfg *config.Config) (string, error) {
-	if fileutil.HasMarkerBlock(y.getV1Path(), "#") || fileutil.HasMarkerBlock(y.getV2Path(), "#") {
-		return "configured", nil
+	if fileutil.HasMarkerBlock(y.getV2Path(), y.Name(), "#") {
+		return blockStatus(y.Name(), y.getV2Path(), y.v2Content(cfg)), nil
 	}
-	return "not configured", nil
+	return blockStatus(y.Name(), y.getV1Path(), y.v1Content(cfg)), nil
 }
@@ -20,7 +20,7 @@ func TestYarnV1Apply(t *testing.T) {
 
 	// Simulate v1 content by writing marker block directly (avoids needing yarn installed)
 	content := "proxy \"http://proxy:8080\"\nhttps-proxy \"http://proxy:8080\"\ncafile \"/tmp/ca.pem\"\n"
-	if err := fileutil.UpsertMarkerBlock(v1Path, content, "#"); err != nil {
+	if err := fileutil.UpsertMarkerBlock(v1Path, "yarn", content, "#"); err != nil {
 		t.Fatalf("UpsertMarkerBlock: %v", err)
 	}
 
@@ -57,7 +57,7 @@ func TestYarnV2Format(t *testing.T) {
 
 	// Simulate v2 content by writing marker block directly
 	content := "httpProxy: \"http://proxy:8080\"\nhttpsProxy: \"http://proxy:8080\"\ncaFilePath: \"/tmp/ca.pem\"\n"
-	if err := fileutil.UpsertMarkerBlock(v2Path, content, "#"); err != nil {
+	if err := fileutil.UpsertMarkerBlock(v2Path, "yarn", content, "#"); err != nil {
 		t.Fatalf("UpsertMarkerBlock: %v", err)
 	}
 
@@ -96,9 +96,9 @@ func TestYarnRemove(t *testing.T) {
 	}
 
 	// Write a v1 marker block so we can remove it
-	fileutil.UpsertMarkerBlock(v1Path, "proxy \"http://proxy:8080\"\n", "#")
+	fileutil.UpsertMarkerBlock(v1Path, "yarn", "proxy \"http://proxy:8080\"\n", "#")
 
-	if err := y.Remove(); err != nil {
+	if err := Remove(y); err != nil {
 		t.Fatalf("Remove: %v", err)
 	}
 	status, _ := y.Status(cfg)
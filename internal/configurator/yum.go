@@ -3,16 +3,25 @@ package configurator
 import (
 	"fmt"
 	"os"
-	"strings"
 
 	"github.com/andrew/ezproxy/internal/config"
 	"github.com/andrew/ezproxy/internal/detect"
+	"github.com/andrew/ezproxy/internal/escape"
+	"github.com/andrew/ezproxy/internal/fileutil"
+	"github.com/andrew/ezproxy/internal/noproxy"
+	"github.com/andrew/ezproxy/internal/privileged"
 )
 
 type Yum struct{}
 
 func (y *Yum) Name() string { return "yum" }
 
+func (y *Yum) NoProxyDialect() noproxy.Dialect { return noproxy.None }
+
+// AuthMethod is empty: the settings are system-wide, so they never get a
+// user's password.
+func (y *Yum) AuthMethod() string { return "" }
+
 func (y *Yum) IsAvailable(_ detect.OSInfo) bool {
 	return detect.IsCommandAvailable("yum") || detect.IsCommandAvailable("dnf")
 }
@@ -24,39 +33,111 @@ func (y *Yum) confFile() string {
 	return "/etc/yum.conf"
 }
 
-func (y *Yum) Apply(cfg *config.Config) error {
-	certPath := config.ExpandPath(cfg.CACert)
+func (y *Yum) Plan(cfg *config.Config) ([]Change, error) {
 	confFile := y.confFile()
-
-	// Build sed commands to add/update proxy lines in the [main] section
-	cmds := []string{
-		fmt.Sprintf("grep -q '^proxy=' %s && sed -i 's|^proxy=.*|proxy=%s|' %s || echo 'proxy=%s' >> %s",
-			confFile, cfg.Proxy.HTTP, confFile, cfg.Proxy.HTTP, confFile),
+	keys, err := y.keys(cfg)
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(confFile)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
 	}
-	if certPath != "" {
-		cmds = append(cmds,
-			fmt.Sprintf("grep -q '^sslcacert=' %s && sed -i 's|^sslcacert=.*|sslcacert=%s|' %s || echo 'sslcacert=%s' >> %s",
-				confFile, certPath, confFile, certPath, confFile),
-		)
+
+	// The file is edited here and written back whole, so no value passes
+	// through a sed expression.
+	content := string(data)
+	var records []Record
+	for _, k := range keys {
+		records = append(records, recordSetting(confFile, k.Name, yumGet(content, k.Name), k.Value))
+		if content, err = yumSet(content, k.Name, &k.Value); err != nil {
+			return nil, fmt.Errorf("%s: %w", confFile, err)
+		}
 	}
+	return []Change{Privileged{
+		Actions: []privileged.Action{privileged.WriteFile{Path: confFile, Content: content, Mode: 0644}},
+		Records: records,
+	}}, nil
+}
 
-	return runSudoCommands(y.Name(), cmds)
+// keys returns the [main] settings Apply writes.
+func (y *Yum) keys(cfg *config.Config) ([]fileutil.Key, error) {
+	keys := []fileutil.Key{{Section: "main", Name: "proxy", Value: cfg.Proxy.HTTP}}
+	if certPath := cfg.TrustBundlePath(); certPath != "" {
+		keys = append(keys, fileutil.Key{Section: "main", Name: "sslcacert", Value: certPath})
+	}
+	for i, k := range keys {
+		v, err := escape.INI(k.Value)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", k.Name, err)
+		}
+		keys[i].Value = v
+	}
+	return keys, nil
 }
 
-func (y *Yum) Remove() error {
+// PlanRemove restores the proxy and sslcacert lines to their values before
+// apply, or deletes them if they were not set. Lines the user changed
+// since apply are kept. Without a recorded state (applied by an older
+// ezproxy) both lines are deleted.
+func (y *Yum) PlanRemove() ([]Change, error) {
 	confFile := y.confFile()
-	return runSudoRemoveCommands(y.Name(), []string{
-		fmt.Sprintf("sed -i '/^proxy=/d; /^sslcacert=/d' %s", confFile),
-	})
+	data, err := os.ReadFile(confFile)
+	if err != nil {
+		return nil, nil
+	}
+	content := string(data)
+	t, recorded := State.Lookup(y.Name())
+	for _, key := range []string{"proxy", "sslcacert"} {
+		var previous *string
+		if recorded {
+			s, ok := t.Setting(confFile, key)
+			if !ok {
+				continue
+			}
+			if current := yumGet(content, key); current == nil || *current != s.Value {
+				continue
+			}
+			previous = s.Previous
+		}
+		if content, err = yumSet(content, key, previous); err != nil {
+			return nil, fmt.Errorf("%s: %w", confFile, err)
+		}
+	}
+	if content == string(data) {
+		return nil, nil
+	}
+	return []Change{Privileged{Actions: []privileged.Action{
+		privileged.WriteFile{Path: confFile, Content: content, Mode: 0644},
+	}}}, nil
+}
+
+// yumGet returns the value of key in the [main] section, or nil if absent.
+func yumGet(content, key string) *string {
+	return fileutil.GetKey(fileutil.INI, content, "main", key)
+}
+
+// yumSet sets key in the [main] section, or deletes it if value is nil.
+func yumSet(content, key string, value *string) (string, error) {
+	return fileutil.SetKey(fileutil.INI, content, "main", key, value)
 }
 
 func (y *Yum) Status(cfg *config.Config) (string, error) {
 	data, err := os.ReadFile(y.confFile())
 	if err != nil {
-		return "not configured", nil
+		return StatusNotConfigured, nil
+	}
+	keys, err := y.keys(cfg)
+	if err != nil {
+		return "", err
 	}
-	if strings.Contains(string(data), "proxy=") {
-		return "configured", nil
+	var names []string
+	expected := make(map[string]string)
+	actual := make(map[string]*string)
+	for _, k := range keys {
+		names = append(names, k.Name)
+		expected[k.Name] = k.Value
+		actual[k.Name] = yumGet(string(data), k.Name)
 	}
-	return "not configured", nil
+	return compareValues(names, expected, actual), nil
 }
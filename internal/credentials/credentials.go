@@ -0,0 +1,99 @@
+// Package credentials stores the upstream proxy credentials, either in
+// ~/.ezproxy/credentials.yaml or in the desktop keyring (see Store). The
+// file is kept at mode 0600 and refused if anyone else can read it, so the
+// password never has to sit in config.yaml. The local relay ("ezproxy
+// serve") reads them, and apply hands them to each tool in the safest form
+// it supports.
+package credentials
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/andrew/ezproxy/internal/fileutil"
+	"github.com/andrew/ezproxy/internal/redact"
+)
+
+// Schemes supported by the relay.
+const (
+	SchemeBasic = "basic"
+	SchemeNTLM  = "ntlm"
+)
+
+// Credentials authenticate ezproxy to the upstream proxy.
+type Credentials struct {
+	Scheme   string `yaml:"scheme"` // basic or ntlm
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+	Domain   string `yaml:"domain,omitempty"` // NTLM only
+
+	// Proxy is the host:port of the proxy the credentials are for. They
+	// are only given to tools for that proxy; empty means the upstream
+	// proxy, whichever it is (files written before it was recorded).
+	Proxy string `yaml:"proxy,omitempty"`
+}
+
+// Redacted returns the user name with the password masked, as
+// user:**** or DOMAIN\user:****.
+func (c *Credentials) Redacted() string {
+	user := c.Username
+	if c.Domain != "" {
+		user = c.Domain + `\` + user
+	}
+	return user + ":" + redact.Mask
+}
+
+// Validate checks that the scheme is known and a user name is set.
+func (c *Credentials) Validate() error {
+	switch c.Scheme {
+	case SchemeBasic, SchemeNTLM:
+	default:
+		return fmt.Errorf("unknown auth scheme %q (use basic or ntlm)", c.Scheme)
+	}
+	if c.Username == "" {
+		return fmt.Errorf("username is empty")
+	}
+	return nil
+}
+
+// Load reads the credentials file at path. It fails if the file is
+// readable by group or others.
+func Load(path string) (*Credentials, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if info.Mode().Perm()&0077 != 0 {
+		return nil, fmt.Errorf("%s is accessible by other users (mode %04o); run 'chmod 600 %s'", path, info.Mode().Perm(), path)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var c Credentials
+	if err := yaml.Unmarshal(data, &c); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if err := c.Validate(); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return &c, nil
+}
+
+// Save writes c to path with mode 0600.
+func Save(path string, c *Credentials) error {
+	if err := c.Validate(); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	data, err := yaml.Marshal(c)
+	if err != nil {
+		return err
+	}
+	return fileutil.AtomicWritePrivate(path, data)
+}
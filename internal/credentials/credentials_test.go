@@ -0,0 +1,51 @@
+package credentials
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSaveLoad(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "credentials.yaml")
+	in := &Credentials{Scheme: SchemeNTLM, Username: "alice", Password: "p&ss;word", Domain: "CORP"}
+	if err := Save(path, in); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+	info, _ := os.Stat(path)
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("mode = %04o, want 0600", info.Mode().Perm())
+	}
+	out, err := Load(path)
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if *out != *in {
+		t.Errorf("Load = %+v, want %+v", out, in)
+	}
+}
+
+func TestLoad_RejectsReadableFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "credentials.yaml")
+	os.WriteFile(path, []byte("scheme: basic\nusername: alice\npassword: x\n"), 0644)
+	if _, err := Load(path); err == nil || !strings.Contains(err.Error(), "chmod 600") {
+		t.Errorf("Load = %v, want permissions error", err)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	if err := (&Credentials{Scheme: "kerberos", Username: "a"}).Validate(); err == nil {
+		t.Error("unknown scheme accepted")
+	}
+	if err := (&Credentials{Scheme: SchemeBasic}).Validate(); err == nil {
+		t.Error("empty username accepted")
+	}
+}
+
+func TestRedacted(t *testing.T) {
+	c := &Credentials{Scheme: SchemeNTLM, Username: "alice", Password: "secret", Domain: "CORP"}
+	if got := c.Redacted(); got != `CORP\alice:****` {
+		t.Errorf("Redacted = %q", got)
+	}
+}
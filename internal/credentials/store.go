@@ -0,0 +1,137 @@
+package credentials
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/exec"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Stores config.yaml can name under credentials.
+const (
+	StoreFile    = "file"
+	StoreKeyring = "keyring"
+)
+
+// Store is where the proxy credentials are kept.
+type Store interface {
+	// Load returns the stored credentials. If there are none, the error
+	// satisfies errors.Is(err, fs.ErrNotExist).
+	Load() (*Credentials, error)
+	Save(c *Credentials) error
+	// Delete removes the credentials. Deleting none is not an error.
+	Delete() error
+	// String describes the store for messages, e.g. the file's path.
+	String() string
+}
+
+// Open returns the store named kind: "file" (or "") for the file at path,
+// "keyring" for the desktop keyring.
+func Open(kind, path string) (Store, error) {
+	switch kind {
+	case "", StoreFile:
+		return File(path), nil
+	case StoreKeyring:
+		return Keyring{}, nil
+	}
+	return nil, fmt.Errorf("unknown credentials store %q (use %s or %s)", kind, StoreFile, StoreKeyring)
+}
+
+// File is a YAML file of mode 0600.
+type File string
+
+func (f File) Load() (*Credentials, error) { return Load(string(f)) }
+func (f File) Save(c *Credentials) error   { return Save(string(f), c) }
+func (f File) String() string              { return string(f) }
+
+func (f File) Delete() error {
+	if err := os.Remove(string(f)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// secretTool is the Secret Service client the keyring store runs;
+// overridden in tests.
+var secretTool = "secret-tool"
+
+// keyringAttrs identify ezproxy's item in the keyring.
+var keyringAttrs = []string{"service", "ezproxy", "type", "proxy-credentials"}
+
+// Keyring keeps the credentials in the desktop Secret Service keyring
+// (GNOME Keyring, KWallet), through secret-tool. The item's secret is the
+// same YAML the file store holds.
+type Keyring struct{}
+
+// KeyringAvailable reports whether secret-tool is installed and there is a
+// session bus to reach the keyring on.
+func KeyringAvailable() bool {
+	if _, err := exec.LookPath(secretTool); err != nil {
+		return false
+	}
+	return os.Getenv("DBUS_SESSION_BUS_ADDRESS") != ""
+}
+
+func (Keyring) String() string { return "the Secret Service keyring" }
+
+func (k Keyring) Load() (*Credentials, error) {
+	out, err := k.run(nil, "lookup")
+	if err != nil {
+		return nil, err
+	}
+	if len(bytes.TrimSpace(out)) == 0 {
+		// secret-tool lookup prints nothing when there is no such item.
+		return nil, fmt.Errorf("no ezproxy credentials in %s: %w", k, fs.ErrNotExist)
+	}
+	var c Credentials
+	if err := yaml.Unmarshal(out, &c); err != nil {
+		return nil, fmt.Errorf("%s: %w", k, err)
+	}
+	if err := c.Validate(); err != nil {
+		return nil, fmt.Errorf("%s: %w", k, err)
+	}
+	return &c, nil
+}
+
+func (k Keyring) Save(c *Credentials) error {
+	if err := c.Validate(); err != nil {
+		return err
+	}
+	data, err := yaml.Marshal(c)
+	if err != nil {
+		return err
+	}
+	_, err = k.run(data, "store", "--label=ezproxy proxy credentials")
+	return err
+}
+
+func (k Keyring) Delete() error {
+	_, err := k.run(nil, "clear")
+	return err
+}
+
+// run runs secret-tool with the ezproxy attributes, passing the secret
+// on stdin so it never appears in a process listing.
+func (k Keyring) run(stdin []byte, args ...string) ([]byte, error) {
+	cmd := exec.Command(secretTool, append(args, keyringAttrs...)...)
+	cmd.Stdin = bytes.NewReader(stdin)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	var exit *exec.ExitError
+	switch {
+	case err == nil:
+		return out, nil
+	case errors.As(err, &exit) && args[0] == "lookup" && stderr.Len() == 0:
+		// Older secret-tool versions exit 1 quietly for a missing item.
+		return nil, nil
+	case errors.As(err, &exit):
+		return nil, fmt.Errorf("%s %s: %s", secretTool, args[0], strings.TrimSpace(stderr.String()))
+	}
+	return nil, fmt.Errorf("%s is needed for the keyring: %w", secretTool, err)
+}
@@ -0,0 +1,81 @@
+package credentials
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// fakeSecretTool points the keyring store at a script that keeps the
+// secret in a file, like secret-tool does in the real keyring.
+func fakeSecretTool(t *testing.T) {
+	dir := t.TempDir()
+	script := filepath.Join(dir, "secret-tool")
+	os.WriteFile(script, []byte(`#!/bin/sh
+secret="`+dir+`/secret"
+case "$1" in
+store) cat > "$secret" ;;
+lookup) [ -f "$secret" ] || exit 1; cat "$secret" ;;
+clear) rm -f "$secret" ;;
+esac
+`), 0755)
+	old := secretTool
+	secretTool = script
+	t.Cleanup(func() { secretTool = old })
+}
+
+func TestKeyring(t *testing.T) {
+	fakeSecretTool(t)
+	store, err := Open(StoreKeyring, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Load(); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("Load from empty keyring = %v, want ErrNotExist", err)
+	}
+	in := &Credentials{Scheme: SchemeBasic, Username: "alice", Password: `p@ss"word`, Proxy: "proxy.corp.com:8080"}
+	if err := store.Save(in); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+	out, err := store.Load()
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if *out != *in {
+		t.Errorf("Load = %+v, want %+v", out, in)
+	}
+	if err := store.Delete(); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if _, err := store.Load(); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Load after Delete = %v, want ErrNotExist", err)
+	}
+}
+
+func TestFileStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "credentials.yaml")
+	store, err := Open("", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Load(); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("Load of missing file = %v, want ErrNotExist", err)
+	}
+	if err := store.Save(&Credentials{Scheme: SchemeBasic, Username: "alice"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Delete(); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Delete(); err != nil {
+		t.Errorf("second Delete: %v", err)
+	}
+}
+
+func TestOpen_Unknown(t *testing.T) {
+	if _, err := Open("vault", ""); err == nil {
+		t.Error("unknown store accepted")
+	}
+}
@@ -0,0 +1,193 @@
+// Package diff renders the change between two versions of a file as a
+// unified diff, the format of "diff -u" and "git diff", for dry-run
+// previews.
+package diff
+
+import (
+	"fmt"
+	"strings"
+)
+
+// context is the number of unchanged lines shown around each change.
+const context = 3
+
+// op is one line of an edit script: kept (' '), deleted ('-') or added
+// ('+'). a and b are the positions in the old and new lines before it.
+type op struct {
+	kind byte
+	a, b int
+}
+
+// Unified returns the unified diff that turns from into to, with the file
+// names fromName and toName in its header, or "" if they are equal. Use
+// "/dev/null" as the name of a file that doesn't exist.
+func Unified(fromName, toName, from, to string) string {
+	if from == to {
+		return ""
+	}
+	a, b := splitLines(from), splitLines(to)
+	ops := edits(a, b)
+
+	var out strings.Builder
+	fmt.Fprintf(&out, "--- %s\n+++ %s\n", fromName, toName)
+	for _, h := range hunks(ops) {
+		writeHunk(&out, ops[h[0]:h[1]], a, b)
+	}
+	return out.String()
+}
+
+// splitLines splits s after each line break, so the last line can be told
+// apart when it has none.
+func splitLines(s string) []string {
+	lines := strings.SplitAfter(s, "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
+
+// edits returns the shortest edit script from a to b, from the longest
+// common subsequence of their lines. The common prefix and suffix are
+// taken off first, which leaves little to compare for a typical edit.
+func edits(a, b []string) []op {
+	pre := 0
+	for pre < len(a) && pre < len(b) && a[pre] == b[pre] {
+		pre++
+	}
+	suf := 0
+	for suf < len(a)-pre && suf < len(b)-pre && a[len(a)-1-suf] == b[len(b)-1-suf] {
+		suf++
+	}
+	ma, mb := a[pre:len(a)-suf], b[pre:len(b)-suf]
+
+	// lcs[i][j] is the length of the LCS of ma[i:] and mb[j:].
+	lcs := make([][]int, len(ma)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(mb)+1)
+	}
+	for i := len(ma) - 1; i >= 0; i-- {
+		for j := len(mb) - 1; j >= 0; j-- {
+			if ma[i] == mb[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else {
+				lcs[i][j] = max(lcs[i+1][j], lcs[i][j+1])
+			}
+		}
+	}
+
+	ops := make([]op, 0, len(a)+len(b))
+	for i := 0; i < pre; i++ {
+		ops = append(ops, op{' ', i, i})
+	}
+	i, j := 0, 0
+	for i < len(ma) || j < len(mb) {
+		switch {
+		case i < len(ma) && j < len(mb) && ma[i] == mb[j]:
+			ops = append(ops, op{' ', pre + i, pre + j})
+			i++
+			j++
+		case j == len(mb) || (i < len(ma) && lcs[i+1][j] >= lcs[i][j+1]):
+			ops = append(ops, op{'-', pre + i, pre + j})
+			i++
+		default:
+			ops = append(ops, op{'+', pre + i, pre + j})
+			j++
+		}
+	}
+	for k := 0; k < suf; k++ {
+		ops = append(ops, op{' ', len(a) - suf + k, len(b) - suf + k})
+	}
+	return ops
+}
+
+// hunks returns the [start, end) ranges of ops to print: each change with
+// up to context kept lines either side, merging changes that are close.
+func hunks(ops []op) [][2]int {
+	var out [][2]int
+	for i := 0; i < len(ops); i++ {
+		if ops[i].kind == ' ' {
+			continue
+		}
+		start := max(i-context, 0)
+		end := min(i+1+context, len(ops))
+		if n := len(out); n > 0 && start <= out[n-1][1] {
+			out[n-1][1] = end
+		} else {
+			out = append(out, [2]int{start, end})
+		}
+	}
+	return out
+}
+
+func writeHunk(out *strings.Builder, ops []op, a, b []string) {
+	var na, nb int
+	for _, o := range ops {
+		if o.kind != '+' {
+			na++
+		}
+		if o.kind != '-' {
+			nb++
+		}
+	}
+	fmt.Fprintf(out, "@@ -%s +%s @@\n", hunkRange(ops[0].a, na), hunkRange(ops[0].b, nb))
+	for _, o := range ops {
+		var line string
+		if o.kind == '+' {
+			line = b[o.b]
+		} else {
+			line = a[o.a]
+		}
+		out.WriteByte(o.kind)
+		out.WriteString(line)
+		if !strings.HasSuffix(line, "\n") {
+			out.WriteString("\n\\ No newline at end of file\n")
+		}
+	}
+}
+
+// hunkRange formats the start line and length of a hunk's side. An empty
+// side is numbered after the line it follows.
+func hunkRange(start, n int) string {
+	if n == 0 {
+		return fmt.Sprintf("%d,0", start)
+	}
+	if n == 1 {
+		return fmt.Sprintf("%d", start+1)
+	}
+	return fmt.Sprintf("%d,%d", start+1, n)
+}
+
+// ANSI colours for Color.
+const (
+	bold  = "\x1b[1m"
+	red   = "\x1b[31m"
+	green = "\x1b[32m"
+	cyan  = "\x1b[36m"
+	reset = "\x1b[0m"
+)
+
+// Color adds terminal colours to a unified diff the way git does: headers
+// in bold, hunk ranges in cyan, deleted lines in red and added ones in
+// green.
+func Color(d string) string {
+	var out strings.Builder
+	header := true
+	for _, line := range splitLines(d) {
+		text := strings.TrimSuffix(line, "\n")
+		switch {
+		case header && !strings.HasPrefix(text, "@@"):
+			out.WriteString(bold + text + reset)
+		case strings.HasPrefix(text, "@@"):
+			header = false
+			out.WriteString(cyan + text + reset)
+		case strings.HasPrefix(text, "-"):
+			out.WriteString(red + text + reset)
+		case strings.HasPrefix(text, "+"):
+			out.WriteString(green + text + reset)
+		default:
+			out.WriteString(text)
+		}
+		out.WriteString(line[len(text):])
+	}
+	return out.String()
+}
@@ -0,0 +1,82 @@
+package diff
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestUnified(t *testing.T) {
+	tests := []struct {
+		name, from, to, want string
+	}{
+		{
+			name: "equal",
+			from: "a\n",
+			to:   "a\n",
+			want: "",
+		},
+		{
+			name: "create",
+			from: "",
+			to:   "a\nb\n",
+			want: "--- old\n+++ new\n@@ -0,0 +1,2 @@\n+a\n+b\n",
+		},
+		{
+			name: "delete",
+			from: "a\n",
+			to:   "",
+			want: "--- old\n+++ new\n@@ -1 +0,0 @@\n-a\n",
+		},
+		{
+			name: "change in the middle",
+			from: "1\n2\n3\n4\nold\n6\n7\n8\n9\n",
+			to:   "1\n2\n3\n4\nnew\n6\n7\n8\n9\n",
+			want: "--- old\n+++ new\n@@ -2,7 +2,7 @@\n 2\n 3\n 4\n-old\n+new\n 6\n 7\n 8\n",
+		},
+		{
+			name: "append",
+			from: "x=1\n",
+			to:   "x=1\n\n# >>> ezproxy >>>\nproxy=p\n# <<< ezproxy <<<\n",
+			want: "--- old\n+++ new\n@@ -1 +1,5 @@\n x=1\n+\n+# >>> ezproxy >>>\n+proxy=p\n+# <<< ezproxy <<<\n",
+		},
+		{
+			name: "no newline at end",
+			from: "a\nb",
+			to:   "a\nc\n",
+			want: "--- old\n+++ new\n@@ -1,2 +1,2 @@\n a\n-b\n\\ No newline at end of file\n+c\n",
+		},
+	}
+	for _, tt := range tests {
+		if got := Unified("old", "new", tt.from, tt.to); got != tt.want {
+			t.Errorf("%s:\ngot\n%s\nwant\n%s", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestUnifiedSeparateHunks(t *testing.T) {
+	var from, to strings.Builder
+	for i := 0; i < 20; i++ {
+		line := string(rune('a'+i)) + "\n"
+		from.WriteString(line)
+		if i == 2 || i == 17 {
+			line = "changed\n"
+		}
+		to.WriteString(line)
+	}
+	got := Unified("old", "new", from.String(), to.String())
+	if n := strings.Count(got, "@@ -"); n != 2 {
+		t.Errorf("%d hunks, want 2:\n%s", n, got)
+	}
+	if !strings.Contains(got, "@@ -1,6 +1,6 @@\n a\n b\n-c\n+changed\n") || !strings.Contains(got, "@@ -15,6 +15,6 @@\n") {
+		t.Errorf("unexpected hunks:\n%s", got)
+	}
+}
+
+func TestColor(t *testing.T) {
+	got := Color("--- old\n+++ new\n@@ -1 +1 @@\n--- a\n+++ b\n same\n")
+	want := bold + "--- old" + reset + "\n" + bold + "+++ new" + reset + "\n" + cyan + "@@ -1 +1 @@" + reset + "\n" +
+		red + "--- a" + reset + "\n" + green + "+++ b" + reset + "\n same\n"
+	if got != want {
+		t.Errorf("Color = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,347 @@
+// Package doctor runs end-to-end connectivity checks for "ezproxy doctor".
+// Each check exercises one link of the chain a tool depends on: reaching
+// the proxy, tunnelling through it with CONNECT, trusting the certificate
+// it presents, and reaching NO_PROXY hosts without it. A failing check
+// says which link is broken and what to do about it.
+package doctor
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Result status values.
+const (
+	Pass = "pass"
+	Fail = "fail"
+	Warn = "warn"
+	Skip = "skip"
+)
+
+// DefaultProbeHost is the host tunnelled to when no probe host is set.
+const DefaultProbeHost = "www.google.com:443"
+
+// Result is the outcome of one check.
+type Result struct {
+	Step   string `json:"step"`
+	Status string `json:"status"`
+	Detail string `json:"detail,omitempty"`
+	Hint   string `json:"hint,omitempty"` // what to do about a failure
+}
+
+// Failed reports whether any result is a failure.
+func Failed(results []Result) bool {
+	for _, r := range results {
+		if r.Status == Fail {
+			return true
+		}
+	}
+	return false
+}
+
+// Checker holds what the network checks need. Proxy is the proxy URL from
+// config.yaml; Roots holds only the configured corporate CAs, so a TLS
+// handshake that passes proves those CAs are the ones the proxy uses.
+type Checker struct {
+	Proxy     string
+	ProbeHost string // host:port to CONNECT to; DefaultProbeHost if empty
+	Roots     *x509.CertPool
+	Timeout   time.Duration // per check; 5s if zero
+}
+
+func (c *Checker) timeout() time.Duration {
+	if c.Timeout > 0 {
+		return c.Timeout
+	}
+	return 5 * time.Second
+}
+
+func (c *Checker) probeHost() string {
+	if c.ProbeHost == "" {
+		return DefaultProbeHost
+	}
+	if _, _, err := net.SplitHostPort(c.ProbeHost); err != nil {
+		return net.JoinHostPort(c.ProbeHost, "443")
+	}
+	return c.ProbeHost
+}
+
+// Run performs the proxy, CONNECT and TLS checks in order. Later checks
+// are skipped once one fails, since they would fail for the same reason.
+func (c *Checker) Run(ctx context.Context) []Result {
+	results := []Result{c.CheckProxy(ctx)}
+	if results[0].Status == Fail {
+		return append(results,
+			Result{Step: "connect", Status: Skip, Detail: "proxy unreachable"},
+			Result{Step: "tls", Status: Skip, Detail: "proxy unreachable"})
+	}
+	connect := c.CheckConnect(ctx)
+	results = append(results, connect)
+	if connect.Status == Fail {
+		return append(results, Result{Step: "tls", Status: Skip, Detail: "CONNECT failed"})
+	}
+	return append(results, c.CheckTLS(ctx))
+}
+
+// proxyAddr returns the host:port of the proxy URL.
+func (c *Checker) proxyAddr() (*url.URL, string, error) {
+	u, err := url.Parse(c.Proxy)
+	if err != nil || u.Host == "" {
+		return nil, "", fmt.Errorf("invalid proxy URL %q", c.Proxy)
+	}
+	port := u.Port()
+	if port == "" {
+		port = "80"
+		if u.Scheme == "https" {
+			port = "443"
+		}
+	}
+	return u, net.JoinHostPort(u.Hostname(), port), nil
+}
+
+// CheckProxy resolves the proxy's host name and opens a TCP connection.
+func (c *Checker) CheckProxy(ctx context.Context) Result {
+	r := Result{Step: "proxy"}
+	u, addr, err := c.proxyAddr()
+	if err != nil {
+		r.Status, r.Detail = Fail, err.Error()
+		r.Hint = "Fix proxy.http in ~/.ezproxy/config.yaml (e.g. http://proxy.corp.com:8080)."
+		return r
+	}
+	ctx, cancel := context.WithTimeout(ctx, c.timeout())
+	defer cancel()
+
+	ips, err := net.DefaultResolver.LookupHost(ctx, u.Hostname())
+	if err != nil {
+		r.Status, r.Detail = Fail, fmt.Sprintf("cannot resolve %s: %v", u.Hostname(), err)
+		r.Hint = "Check DNS and that you are on the corporate network or VPN."
+		return r
+	}
+	start := time.Now()
+	conn, err := (&net.Dialer{}).DialContext(ctx, "tcp", addr)
+	if err != nil {
+		r.Status, r.Detail = Fail, fmt.Sprintf("cannot connect to %s: %v", addr, err)
+		r.Hint = "Check the proxy port and that a firewall is not blocking it."
+		return r
+	}
+	conn.Close()
+	r.Status = Pass
+	r.Detail = fmt.Sprintf("%s resolved to %s, connected in %s", u.Hostname(), strings.Join(ips, ", "), time.Since(start).Round(time.Millisecond))
+	return r
+}
+
+// tunnel opens a connection to the proxy and sends CONNECT for the probe
+// host. The returned connection carries the tunnel on success.
+func (c *Checker) tunnel(ctx context.Context) (net.Conn, error) {
+	u, addr, err := c.proxyAddr()
+	if err != nil {
+		return nil, err
+	}
+	conn, err := (&net.Dialer{}).DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	if u.Scheme == "https" {
+		tlsConn := tls.Client(conn, &tls.Config{ServerName: u.Hostname(), RootCAs: c.Roots})
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("TLS to proxy: %w", err)
+		}
+		conn = tlsConn
+	}
+
+	target := c.probeHost()
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: target},
+		Host:   target,
+		Header: make(http.Header),
+	}
+	if u.User != nil {
+		password, _ := u.User.Password()
+		creds := base64.StdEncoding.EncodeToString([]byte(u.User.Username() + ":" + password))
+		req.Header.Set("Proxy-Authorization", "Basic "+creds)
+	}
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("reading CONNECT response: %w", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, &connectError{status: resp.Status, code: resp.StatusCode}
+	}
+	if br.Buffered() > 0 {
+		conn.Close()
+		return nil, fmt.Errorf("proxy sent data before the tunnel was established")
+	}
+	conn.SetDeadline(time.Time{})
+	return conn, nil
+}
+
+type connectError struct {
+	status string
+	code   int
+}
+
+func (e *connectError) Error() string {
+	return "proxy answered CONNECT with " + e.status
+}
+
+// CheckConnect asks the proxy to open a tunnel to the probe host.
+func (c *Checker) CheckConnect(ctx context.Context) Result {
+	r := Result{Step: "connect"}
+	ctx, cancel := context.WithTimeout(ctx, c.timeout())
+	defer cancel()
+	conn, err := c.tunnel(ctx)
+	if err != nil {
+		r.Status, r.Detail = Fail, err.Error()
+		var ce *connectError
+		switch {
+		case errors.As(err, &ce) && ce.code == http.StatusProxyAuthRequired:
+			r.Hint = "The proxy requires authentication; add credentials to the proxy URL."
+		case errors.As(err, &ce) && ce.code == http.StatusForbidden:
+			r.Hint = fmt.Sprintf("The proxy refuses %s; try another probe host with --probe.", c.probeHost())
+		default:
+			r.Hint = "Check that proxy.http points at an HTTP proxy that supports CONNECT."
+		}
+		return r
+	}
+	conn.Close()
+	r.Status = Pass
+	r.Detail = "tunnel to " + c.probeHost() + " established"
+	return r
+}
+
+// CheckTLS completes a TLS handshake with the probe host through the
+// tunnel and verifies the presented chain against Roots only. On failure
+// it names the issuer the proxy actually presented, which is usually the
+// CA that should be configured instead.
+func (c *Checker) CheckTLS(ctx context.Context) Result {
+	r := Result{Step: "tls"}
+	ctx, cancel := context.WithTimeout(ctx, c.timeout())
+	defer cancel()
+	conn, err := c.tunnel(ctx)
+	if err != nil {
+		r.Status, r.Detail = Fail, err.Error()
+		return r
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	host, _, _ := net.SplitHostPort(c.probeHost())
+	// Verification is done below so the presented chain can be reported
+	// when it doesn't match.
+	tlsConn := tls.Client(conn, &tls.Config{ServerName: host, InsecureSkipVerify: true})
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		r.Status, r.Detail = Fail, fmt.Sprintf("TLS handshake with %s: %v", host, err)
+		r.Hint = "The proxy closed the tunnel during the handshake; it may block this host."
+		return r
+	}
+	chain := tlsConn.ConnectionState().PeerCertificates
+	if len(chain) == 0 {
+		r.Status, r.Detail = Fail, "no certificate presented"
+		return r
+	}
+
+	if err := Verify(chain, host, c.Roots); err != nil {
+		issuer := chain[len(chain)-1].Issuer.String()
+		r.Status = Fail
+		r.Detail = fmt.Sprintf("certificate for %s issued by %q is not trusted by the configured CA(s): %v", host, issuer, err)
+		r.Hint = fmt.Sprintf("Export the CA %q from your browser or IT and add it to ca_cert/ca_certs.", issuer)
+		return r
+	}
+	r.Status = Pass
+	r.Detail = fmt.Sprintf("%s verified, issued by %q", host, chain[0].Issuer.String())
+	return r
+}
+
+// Verify checks a presented chain for host against roots.
+func Verify(chain []*x509.Certificate, host string, roots *x509.CertPool) error {
+	if roots == nil {
+		return fmt.Errorf("no CA configured")
+	}
+	inter := x509.NewCertPool()
+	for _, cert := range chain[1:] {
+		inter.AddCert(cert)
+	}
+	_, err := chain[0].Verify(x509.VerifyOptions{
+		DNSName:       host,
+		Roots:         roots,
+		Intermediates: inter,
+	})
+	return err
+}
+
+// CheckNoProxy connects straight to every NO_PROXY entry that names a
+// single host, without the proxy. Domain suffixes and CIDR ranges can't
+// be probed and are skipped; loopback entries are always direct.
+func CheckNoProxy(ctx context.Context, noProxy string, timeout time.Duration) []Result {
+	if timeout <= 0 {
+		timeout = 5 * time.Second
+	}
+	var results []Result
+	for _, entry := range strings.Split(noProxy, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		r := Result{Step: "no_proxy " + entry}
+		addr, skip := probeAddr(entry)
+		if skip != "" {
+			r.Status, r.Detail = Skip, skip
+			results = append(results, r)
+			continue
+		}
+		dctx, cancel := context.WithTimeout(ctx, timeout)
+		conn, err := (&net.Dialer{}).DialContext(dctx, "tcp", addr)
+		cancel()
+		if err != nil {
+			r.Status, r.Detail = Fail, fmt.Sprintf("cannot reach %s directly: %v", addr, err)
+			r.Hint = "Remove it from NO_PROXY if it is only reachable through the proxy, or check the VPN."
+		} else {
+			conn.Close()
+			r.Status, r.Detail = Pass, "reached "+addr+" directly"
+		}
+		results = append(results, r)
+	}
+	return results
+}
+
+// probeAddr returns the host:port to dial for a NO_PROXY entry, or the
+// reason it is not probed.
+func probeAddr(entry string) (addr, skip string) {
+	if strings.HasPrefix(entry, ".") || strings.HasPrefix(entry, "*") || strings.Contains(entry, "/") {
+		return "", "domain suffix or range; nothing to probe"
+	}
+	if host, port, err := net.SplitHostPort(entry); err == nil {
+		return net.JoinHostPort(host, port), ""
+	}
+	host := strings.Trim(entry, "[]")
+	switch host {
+	case "localhost", "127.0.0.1", "::1":
+		return "", "loopback is always direct"
+	}
+	return net.JoinHostPort(host, "443"), ""
+}
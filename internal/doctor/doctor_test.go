@@ -0,0 +1,175 @@
+package doctor
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// connectProxy returns a test proxy that tunnels CONNECT requests. If
+// allow is non-nil, only targets it accepts are tunnelled; others get 403.
+func connectProxy(t *testing.T, allow func(target string) bool) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodConnect {
+			http.Error(w, "CONNECT only", http.StatusMethodNotAllowed)
+			return
+		}
+		if allow != nil && !allow(r.Host) {
+			http.Error(w, "blocked", http.StatusForbidden)
+			return
+		}
+		upstream, err := net.Dial("tcp", r.Host)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		conn, _, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			upstream.Close()
+			return
+		}
+		io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n")
+		go func() {
+			io.Copy(upstream, conn)
+			upstream.Close()
+		}()
+		io.Copy(conn, upstream)
+		conn.Close()
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// target returns a TLS server and a pool holding the CA that issued its
+// certificate (httptest's certificate is its own CA).
+func target(t *testing.T) (*httptest.Server, *x509.CertPool) {
+	t.Helper()
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	t.Cleanup(srv.Close)
+	pool := x509.NewCertPool()
+	pool.AddCert(srv.Certificate())
+	return srv, pool
+}
+
+func otherCA(t *testing.T) *x509.CertPool {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Some Other CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return pool
+}
+
+func hostPort(srv *httptest.Server) string {
+	return strings.TrimPrefix(strings.TrimPrefix(srv.URL, "https://"), "http://")
+}
+
+func TestRun_AllPass(t *testing.T) {
+	proxy := connectProxy(t, nil)
+	tlsSrv, pool := target(t)
+
+	c := &Checker{Proxy: proxy.URL, ProbeHost: hostPort(tlsSrv), Roots: pool, Timeout: 2 * time.Second}
+	results := c.Run(context.Background())
+	if len(results) != 3 {
+		t.Fatalf("got %d results, want 3", len(results))
+	}
+	for _, r := range results {
+		if r.Status != Pass {
+			t.Errorf("%s: %s (%s)", r.Step, r.Status, r.Detail)
+		}
+	}
+}
+
+func TestRun_ProxyUnreachable(t *testing.T) {
+	ln, _ := net.Listen("tcp", "127.0.0.1:0")
+	addr := ln.Addr().String()
+	ln.Close()
+
+	c := &Checker{Proxy: "http://" + addr, Timeout: time.Second}
+	results := c.Run(context.Background())
+	if results[0].Status != Fail || results[0].Hint == "" {
+		t.Errorf("proxy check = %+v, want fail with hint", results[0])
+	}
+	for _, r := range results[1:] {
+		if r.Status != Skip {
+			t.Errorf("%s = %s, want skip after proxy failure", r.Step, r.Status)
+		}
+	}
+	if !Failed(results) {
+		t.Error("Failed = false")
+	}
+}
+
+func TestCheckConnect_Refused(t *testing.T) {
+	proxy := connectProxy(t, func(string) bool { return false })
+	c := &Checker{Proxy: proxy.URL, ProbeHost: "blocked.example:443", Timeout: time.Second}
+	r := c.CheckConnect(context.Background())
+	if r.Status != Fail || !strings.Contains(r.Detail, "403") {
+		t.Errorf("CheckConnect = %+v, want 403 failure", r)
+	}
+	if !strings.Contains(r.Hint, "--probe") {
+		t.Errorf("hint %q should suggest another probe host", r.Hint)
+	}
+}
+
+func TestCheckTLS_IssuerMismatch(t *testing.T) {
+	proxy := connectProxy(t, nil)
+	tlsSrv, _ := target(t)
+
+	c := &Checker{Proxy: proxy.URL, ProbeHost: hostPort(tlsSrv), Roots: otherCA(t), Timeout: 2 * time.Second}
+	r := c.CheckTLS(context.Background())
+	if r.Status != Fail {
+		t.Fatalf("CheckTLS = %+v, want fail", r)
+	}
+	issuer := tlsSrv.Certificate().Issuer.String()
+	if !strings.Contains(r.Detail, issuer) {
+		t.Errorf("detail %q should name the presented issuer %q", r.Detail, issuer)
+	}
+}
+
+func TestCheckNoProxy(t *testing.T) {
+	direct := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer direct.Close()
+	ln, _ := net.Listen("tcp", "127.0.0.1:0")
+	closed := ln.Addr().String()
+	ln.Close()
+
+	results := CheckNoProxy(context.Background(), "localhost, .corp.com,10.0.0.0/8,"+hostPort(direct)+","+closed, time.Second)
+	want := []string{Skip, Skip, Skip, Pass, Fail}
+	if len(results) != len(want) {
+		t.Fatalf("got %d results, want %d: %+v", len(results), len(want), results)
+	}
+	for i, r := range results {
+		if r.Status != want[i] {
+			t.Errorf("%s = %s (%s), want %s", r.Step, r.Status, r.Detail, want[i])
+		}
+	}
+}
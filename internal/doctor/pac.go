@@ -0,0 +1,81 @@
+package doctor
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/andrew/ezproxy/internal/pac"
+	"github.com/andrew/ezproxy/internal/redact"
+	"github.com/andrew/ezproxy/internal/relay"
+)
+
+// CheckPAC compares the network's PAC file with the static settings the
+// tools use: the route it picks for the probe host against proxy, and the
+// hosts it sends direct against noProxy. Disagreements are warnings, since
+// the static settings may be deliberate.
+func CheckPAC(s *pac.Script, proxy, noProxy, probeHost string) []Result {
+	if probeHost == "" {
+		probeHost = DefaultProbeHost
+	}
+	host := probeHost
+	if h, _, err := net.SplitHostPort(probeHost); err == nil {
+		host = h
+	}
+	hint := "Run 'ezproxy init' to derive the settings from the PAC file again."
+
+	route := Result{Step: "pac route"}
+	r, err := s.Route(host, true)
+	switch {
+	case err != nil:
+		route.Status, route.Detail = Fail, err.Error()
+		route.Hint = "Check pac_url in ~/.ezproxy/config.yaml; the PAC file must define a working FindProxyForURL."
+		return []Result{route}
+	case r.Direct():
+		route.Status = Warn
+		route.Detail = fmt.Sprintf("PAC sends %s DIRECT, but tools use %s", r.URL, redact.URL(proxy))
+		route.Hint = hint
+	case !sameProxy(proxy, r.Via()):
+		route.Status = Warn
+		route.Detail = fmt.Sprintf("PAC sends %s via %s, but tools use %s", r.URL, r.Via().Host, redact.URL(proxy))
+		route.Hint = hint
+	default:
+		route.Status, route.Detail = Pass, fmt.Sprintf("%s → %s, as configured", r.URL, r.Via())
+	}
+	results := []Result{route}
+
+	var mismatches []Result
+	for _, entry := range strings.Split(noProxy, ",") {
+		entry = strings.TrimSpace(entry)
+		probe := pac.ProbeHost(entry)
+		if probe == "" || probe == "localhost" || probe == "127.0.0.1" || probe == "::1" {
+			continue
+		}
+		if r, err := s.Route(probe, true); err == nil && !r.Direct() {
+			mismatches = append(mismatches, Result{Step: "pac " + entry, Status: Warn,
+				Detail: fmt.Sprintf("NO_PROXY sends %s direct, but the PAC file routes it via %s", probe, r.Via().Host),
+				Hint:   "Remove it from NO_PROXY if it is only reachable through the proxy."})
+		}
+	}
+	for _, entry := range s.Candidates() {
+		probe := pac.ProbeHost(entry)
+		if probe == "" || relay.Bypass(noProxy, probe) {
+			continue
+		}
+		if r, err := s.Route(probe, true); err == nil && r.Direct() {
+			mismatches = append(mismatches, Result{Step: "pac " + entry, Status: Warn,
+				Detail: fmt.Sprintf("PAC sends %s DIRECT, but it is not in NO_PROXY", entry),
+				Hint:   "Add it to NO_PROXY (or re-run 'ezproxy init') so tools skip the proxy for it."})
+		}
+	}
+	if len(mismatches) == 0 {
+		return append(results, Result{Step: "pac no_proxy", Status: Pass, Detail: "NO_PROXY agrees with the PAC file"})
+	}
+	return append(results, mismatches...)
+}
+
+// sameProxy reports whether proxyURL points at the PAC entry's host:port.
+func sameProxy(proxyURL string, p pac.Proxy) bool {
+	_, addr, err := (&Checker{Proxy: proxyURL}).proxyAddr()
+	return err == nil && strings.EqualFold(addr, p.Host)
+}
@@ -0,0 +1,251 @@
+// Package escape writes values into the syntaxes of the files and command
+// lines ezproxy generates. Proxy URLs, CA paths and above all passwords can
+// hold any character, and each target has its own idea of which ones are
+// special: a "$" means nothing in TOML but expands in a shell profile, and
+// a "%" is fine in a shell but a specifier in a systemd unit. Configurators
+// pass every value through the encoder for the file they write instead of
+// pasting it into a format string.
+//
+// Encoders return the value ready to write, quotes included. Where a
+// syntax has no way to write a character at all (a line break in an INI
+// value), the encoder returns an error rather than a file the tool would
+// misread; the error never quotes the value, which may be a password.
+package escape
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"unicode"
+	"unicode/utf16"
+)
+
+// ErrLineBreak is returned for a value with a line break, or with
+// whitespace at either end, written to a format that can't hold it.
+var ErrLineBreak = errors.New("the value has a line break or surrounding whitespace, which the file can't hold")
+
+var (
+	shellSafeRe = regexp.MustCompile(`^[A-Za-z0-9_@%+=:,./-]+$`)
+	fishSafeRe  = regexp.MustCompile(`^[A-Za-z0-9_@+=:,./-]+$`)
+	yamlPlainRe = regexp.MustCompile(`^[A-Za-z/][A-Za-z0-9_./:@%+=~-]*$`)
+	npmEnvRe    = regexp.MustCompile(`(\\*)(\$\{[^${}?]+\})`)
+)
+
+// Shell returns s as a single word for a POSIX shell: as is if it is made
+// of characters the shell gives no meaning to, otherwise in single quotes.
+func Shell(s string) string {
+	if shellSafeRe.MatchString(s) {
+		return s
+	}
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// Fish returns s as a single word for fish. Inside fish's single quotes
+// only backslash and the quote itself are special.
+func Fish(s string) string {
+	if fishSafeRe.MatchString(s) {
+		return s
+	}
+	r := strings.NewReplacer(`\`, `\\`, `'`, `\'`)
+	return "'" + r.Replace(s) + "'"
+}
+
+// JSON returns s as a JSON string. It is also a valid double-quoted YAML
+// scalar and a string in yarn 1's .yarnrc, which parses it as JSON.
+func JSON(s string) string {
+	return quote(s, func(b *strings.Builder, r rune) bool { return false })
+}
+
+// TOML returns s as a TOML basic string.
+func TOML(s string) string {
+	// TOML's escapes are a subset of JSON's that covers everything quote
+	// writes.
+	return JSON(s)
+}
+
+// YAML returns s as a YAML scalar: plain if it can't be mistaken for
+// anything but a string, otherwise double-quoted.
+func YAML(s string) string {
+	switch strings.ToLower(s) {
+	case "true", "false", "yes", "no", "on", "off", "y", "n", "null":
+		return JSON(s)
+	}
+	if yamlPlainRe.MatchString(s) && !strings.HasSuffix(s, ":") {
+		return s
+	}
+	return JSON(s)
+}
+
+// Curlrc returns s as a double-quoted .curlrc parameter, with the escapes
+// curl's config parser knows.
+func Curlrc(s string) string {
+	var b strings.Builder
+	b.WriteByte('"')
+	for _, r := range s {
+		switch r {
+		case '\\', '"':
+			b.WriteByte('\\')
+			b.WriteRune(r)
+		case '\t':
+			b.WriteString(`\t`)
+		case '\n':
+			b.WriteString(`\n`)
+		case '\r':
+			b.WriteString(`\r`)
+		case '\v':
+			b.WriteString(`\v`)
+		default:
+			b.WriteRune(r)
+		}
+	}
+	b.WriteByte('"')
+	return b.String()
+}
+
+// INI returns s as a value in a Python configparser file (pip.conf,
+// yum.conf and dnf.conf). configparser has no quoting or escapes: the value
+// is the rest of the line, trimmed, and an indented next line continues
+// it.
+func INI(s string) (string, error) {
+	return restOfLine(s)
+}
+
+// Wgetrc returns s as a .wgetrc value, which like INI is the rest of the
+// line with no escapes.
+func Wgetrc(s string) (string, error) {
+	return restOfLine(s)
+}
+
+func restOfLine(s string) (string, error) {
+	if strings.ContainsAny(s, "\r\n") || strings.TrimSpace(s) != s {
+		return "", ErrLineBreak
+	}
+	return s, nil
+}
+
+// Npmrc returns s as a value in .npmrc. npm cuts a bare value at ";" or
+// "#" and reads one in double quotes as JSON, so values with those, quotes,
+// backslashes or surrounding whitespace are written as JSON. npm also
+// replaces ${VAR} with the environment variable anywhere in a value unless
+// the "$" is escaped with a backslash.
+func Npmrc(s string) string {
+	s = npmEnvRe.ReplaceAllStringFunc(s, func(m string) string {
+		ref := m[strings.Index(m, "${"):]
+		n := len(m) - len(ref)
+		// npm keeps (n-1)/2 of an odd run of n backslashes and the
+		// reference unexpanded.
+		return strings.Repeat(`\`, 2*n+1) + ref
+	})
+	if strings.ContainsAny(s, ";#\"'\\\r\n") || strings.TrimSpace(s) != s || s == "" {
+		return JSON(s)
+	}
+	return s
+}
+
+// Properties returns s as the value of a Java .properties entry
+// (gradle.properties). Properties files are read as ISO 8859-1, so
+// anything outside ASCII is written as a \u escape.
+func Properties(s string) string {
+	var b strings.Builder
+	for i, r := range s {
+		switch {
+		case r == '\\':
+			b.WriteString(`\\`)
+		case r == '\n':
+			b.WriteString(`\n`)
+		case r == '\r':
+			b.WriteString(`\r`)
+		case r == '\t':
+			b.WriteString(`\t`)
+		case r == '\f':
+			b.WriteString(`\f`)
+		case r == ' ' && i == 0:
+			// Leading whitespace is skipped before the value starts.
+			b.WriteString(`\ `)
+		case r < 0x20 || r >= 0x7f:
+			if r1, r2 := utf16.EncodeRune(r); r1 != unicode.ReplacementChar {
+				fmt.Fprintf(&b, `\u%04X\u%04X`, r1, r2)
+			} else {
+				fmt.Fprintf(&b, `\u%04X`, r)
+			}
+		default:
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+// AptConf returns a URL as a double-quoted apt.conf value. apt.conf has no
+// escapes and its values can't hold a double quote or a backslash, so
+// those and control characters are percent-encoded, which leaves the URL
+// meaning the same thing.
+func AptConf(s string) string {
+	var b strings.Builder
+	b.WriteByte('"')
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c == '"' || c == '\\' || c < 0x20 || c == 0x7f {
+			fmt.Fprintf(&b, "%%%02X", c)
+			continue
+		}
+		b.WriteByte(c)
+	}
+	b.WriteByte('"')
+	return b.String()
+}
+
+// Systemd returns s as a double-quoted word in a systemd unit file, such
+// as the argument of Environment=. systemd expands "%" specifiers even
+// inside quotes, so a literal "%" is written as "%%".
+func Systemd(s string) string {
+	return quote(s, func(b *strings.Builder, r rune) bool {
+		if r == '%' {
+			b.WriteString("%%")
+			return true
+		}
+		return false
+	})
+}
+
+// SSHCommand returns s as a single word in an ssh_config ProxyCommand,
+// which ssh expands "%" tokens in and then hands to the shell.
+func SSHCommand(s string) string {
+	return strings.ReplaceAll(Shell(s), "%", "%%")
+}
+
+// quote writes s in double quotes with C-style escapes for backslash, the
+// quote and control characters, which JSON, TOML, YAML and systemd all
+// read the same way. special may write a rune itself and return true.
+func quote(s string, special func(b *strings.Builder, r rune) bool) string {
+	var b strings.Builder
+	b.WriteByte('"')
+	for _, r := range s {
+		if special(&b, r) {
+			continue
+		}
+		switch r {
+		case '\\', '"':
+			b.WriteByte('\\')
+			b.WriteRune(r)
+		case '\n':
+			b.WriteString(`\n`)
+		case '\r':
+			b.WriteString(`\r`)
+		case '\t':
+			b.WriteString(`\t`)
+		case '\b':
+			b.WriteString(`\b`)
+		case '\f':
+			b.WriteString(`\f`)
+		default:
+			if r < 0x20 || r == 0x7f {
+				fmt.Fprintf(&b, `\u%04X`, r)
+			} else {
+				b.WriteRune(r)
+			}
+		}
+	}
+	b.WriteByte('"')
+	return b.String()
+}
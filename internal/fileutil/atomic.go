@@ -0,0 +1,191 @@
+package fileutil
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// AtomicWrite replaces the contents of path with data so that readers see
+// either the old file or the new one, never a partial write: the data goes
+// to a temporary file next to the target, which is then renamed over it.
+//
+// An existing file keeps its mode and owner; perm only applies to new
+// files (subject to the umask, like os.WriteFile). If path is a symlink,
+// as with dotfiles managed by stow or chezmoi, the file it points to is
+// written and the link stays in place. Files with more than one hard link,
+// or whose owner can't be kept, are rewritten in place instead, since a
+// rename would detach or re-own them.
+func AtomicWrite(path string, data []byte, perm os.FileMode) error {
+	return atomicWrite(path, data, perm, false)
+}
+
+// AtomicWritePrivate is AtomicWrite for data only the owner may read, such
+// as credentials. The file ends up with mode 0600 whatever its mode was,
+// and the data is never in a file others can read, not even briefly.
+func AtomicWritePrivate(path string, data []byte) error {
+	return atomicWrite(path, data, 0600, true)
+}
+
+func atomicWrite(path string, data []byte, perm os.FileMode, private bool) error {
+	target, err := resolveSymlinks(path)
+	if err != nil {
+		return err
+	}
+	info, err := os.Stat(target)
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			return err
+		}
+		return writeTemp(target, data, perm, nil, private)
+	case err != nil:
+		return err
+	case !info.Mode().IsRegular():
+		return fmt.Errorf("%s is not a regular file", target)
+	}
+
+	st, _ := info.Sys().(*syscall.Stat_t)
+	if st != nil && st.Nlink > 1 {
+		return writeInPlace(target, data, private)
+	}
+	err = writeTemp(target, data, 0600, info, private)
+	if errors.Is(err, errKeepOwner) {
+		return writeInPlace(target, data, private)
+	}
+	return err
+}
+
+// errKeepOwner means the temporary file could not be given the original
+// file's owner (we are not root and the file isn't ours).
+var errKeepOwner = errors.New("cannot keep file owner")
+
+// writeTemp writes data to a new temporary file in target's directory and
+// renames it to target. With orig set, the temporary file first gets the
+// mode and owner of the file it replaces; with private, its mode stays
+// 0600.
+func writeTemp(target string, data []byte, perm os.FileMode, orig os.FileInfo, private bool) error {
+	f, err := createTemp(target, perm)
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+	ok := false
+	defer func() {
+		if !ok {
+			f.Close()
+			os.Remove(tmp)
+		}
+	}()
+
+	if orig != nil {
+		if st, isStat := orig.Sys().(*syscall.Stat_t); isStat && (int(st.Uid) != os.Getuid() || int(st.Gid) != os.Getgid()) {
+			if err := f.Chown(int(st.Uid), int(st.Gid)); err != nil {
+				return errKeepOwner
+			}
+		}
+		// Chmod after Chown: changing the owner clears setuid/setgid bits.
+		mode := orig.Mode().Perm() | orig.Mode()&(os.ModeSetuid|os.ModeSetgid|os.ModeSticky)
+		if private {
+			mode = 0600
+		}
+		if err := f.Chmod(mode); err != nil {
+			return err
+		}
+	}
+	if _, err := f.Write(data); err != nil {
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, target); err != nil {
+		return err
+	}
+	ok = true
+	syncDir(filepath.Dir(target))
+	return nil
+}
+
+// createTemp creates a uniquely named file next to target. Unlike
+// os.CreateTemp it takes a mode, so new files honour the umask.
+func createTemp(target string, perm os.FileMode) (*os.File, error) {
+	dir, base := filepath.Split(target)
+	for range 100 {
+		var b [6]byte
+		if _, err := rand.Read(b[:]); err != nil {
+			return nil, err
+		}
+		name := filepath.Join(dir, "."+base+".ezproxy-"+hex.EncodeToString(b[:]))
+		f, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_EXCL, perm)
+		if !errors.Is(err, fs.ErrExist) {
+			return f, err
+		}
+	}
+	return nil, fmt.Errorf("creating temporary file for %s: too many attempts", target)
+}
+
+// writeInPlace truncates and rewrites target, keeping its inode. With
+// private, the file is made 0600 before data is written to it.
+func writeInPlace(target string, data []byte, private bool) error {
+	f, err := os.OpenFile(target, os.O_WRONLY|os.O_TRUNC, 0)
+	if err != nil {
+		return err
+	}
+	if private {
+		if err := f.Chmod(0600); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// syncDir flushes a directory so a rename in it survives a crash. Errors
+// are ignored: some filesystems don't support syncing directories.
+func syncDir(dir string) {
+	if d, err := os.Open(dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+}
+
+// resolveSymlinks follows path through any chain of symlinks to the file
+// it names, which need not exist yet (a dangling link is written through,
+// creating its target). Links in parent directories are left as they are;
+// the rename happens in the final directory either way.
+func resolveSymlinks(path string) (string, error) {
+	for range 40 {
+		info, err := os.Lstat(path)
+		if errors.Is(err, fs.ErrNotExist) {
+			return path, nil
+		}
+		if err != nil {
+			return "", err
+		}
+		if info.Mode()&os.ModeSymlink == 0 {
+			return path, nil
+		}
+		link, err := os.Readlink(path)
+		if err != nil {
+			return "", err
+		}
+		if !filepath.IsAbs(link) {
+			link = filepath.Join(filepath.Dir(path), link)
+		}
+		path = link
+	}
+	return "", fmt.Errorf("%s: too many levels of symbolic links", path)
+}
@@ -0,0 +1,136 @@
+package fileutil
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestAtomicWrite_KeepsMode(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, ".npmrc")
+	os.WriteFile(path, []byte("//registry/:_authToken=secret\n"), 0600)
+
+	if err := AtomicWrite(path, []byte("proxy=http://proxy:8080\n"), 0644); err != nil {
+		t.Fatalf("AtomicWrite: %v", err)
+	}
+	info, _ := os.Stat(path)
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("mode = %v, want 0600", info.Mode().Perm())
+	}
+	data, _ := os.ReadFile(path)
+	if string(data) != "proxy=http://proxy:8080\n" {
+		t.Errorf("content = %q", data)
+	}
+}
+
+func TestAtomicWrite_NewFile(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "sub", "config")
+
+	if err := AtomicWrite(path, []byte("x"), 0640); err != nil {
+		t.Fatalf("AtomicWrite: %v", err)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("stat: %v", err)
+	}
+	if info.Mode().Perm()&^0640 != 0 {
+		t.Errorf("mode = %v, want at most 0640", info.Mode().Perm())
+	}
+	entries, _ := os.ReadDir(filepath.Dir(path))
+	if len(entries) != 1 {
+		t.Errorf("temporary files left behind: %v", entries)
+	}
+}
+
+func TestAtomicWrite_ThroughSymlink(t *testing.T) {
+	dir := t.TempDir()
+	dotfiles := filepath.Join(dir, "dotfiles")
+	os.Mkdir(dotfiles, 0755)
+	target := filepath.Join(dotfiles, "bashrc")
+	os.WriteFile(target, []byte("# mine\n"), 0640)
+	link := filepath.Join(dir, ".bashrc")
+	os.Symlink("dotfiles/bashrc", link)
+
+	if err := AtomicWrite(link, []byte("# mine\nexport A=1\n"), 0644); err != nil {
+		t.Fatalf("AtomicWrite: %v", err)
+	}
+	info, _ := os.Lstat(link)
+	if info.Mode()&os.ModeSymlink == 0 {
+		t.Fatal("symlink was replaced by a regular file")
+	}
+	data, _ := os.ReadFile(target)
+	if !strings.Contains(string(data), "export A=1") {
+		t.Errorf("target not updated: %q", data)
+	}
+	if info, _ := os.Stat(target); info.Mode().Perm() != 0640 {
+		t.Errorf("target mode = %v, want 0640", info.Mode().Perm())
+	}
+}
+
+func TestAtomicWrite_DanglingSymlink(t *testing.T) {
+	dir := t.TempDir()
+	link := filepath.Join(dir, ".curlrc")
+	os.Symlink(filepath.Join(dir, "managed", "curlrc"), link)
+
+	if err := AtomicWrite(link, []byte("proxy = x\n"), 0644); err != nil {
+		t.Fatalf("AtomicWrite: %v", err)
+	}
+	if info, _ := os.Lstat(link); info.Mode()&os.ModeSymlink == 0 {
+		t.Fatal("symlink was replaced")
+	}
+	if data, _ := os.ReadFile(filepath.Join(dir, "managed", "curlrc")); string(data) != "proxy = x\n" {
+		t.Errorf("target content = %q", data)
+	}
+}
+
+func TestAtomicWrite_HardLink(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "a")
+	other := filepath.Join(dir, "b")
+	os.WriteFile(path, []byte("old"), 0644)
+	os.Link(path, other)
+
+	if err := AtomicWrite(path, []byte("new"), 0644); err != nil {
+		t.Fatalf("AtomicWrite: %v", err)
+	}
+	if data, _ := os.ReadFile(other); string(data) != "new" {
+		t.Errorf("hard link lost the update: %q", data)
+	}
+}
+
+func TestAtomicWritePrivate(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "proxy-auth")
+	os.WriteFile(path, []byte("old\n"), 0644)
+	linked := filepath.Join(dir, "linked")
+	os.WriteFile(linked, []byte("old\n"), 0644)
+	os.Link(linked, filepath.Join(dir, "other"))
+
+	for _, p := range []string{path, linked} {
+		if err := AtomicWritePrivate(p, []byte("secret\n")); err != nil {
+			t.Fatalf("AtomicWritePrivate: %v", err)
+		}
+		if info, _ := os.Stat(p); info.Mode().Perm() != 0600 {
+			t.Errorf("%s: mode = %v, want 0600", p, info.Mode().Perm())
+		}
+		if data, _ := os.ReadFile(p); string(data) != "secret\n" {
+			t.Errorf("%s: content = %q", p, data)
+		}
+	}
+}
+
+func TestWriteFile_KeepsModeOnUpsert(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, ".npmrc")
+	os.WriteFile(path, []byte("//registry/:_authToken=secret\n"), 0600)
+
+	if err := UpsertMarkerBlock(path, "npm", "proxy=http://proxy:8080\n", "#"); err != nil {
+		t.Fatalf("UpsertMarkerBlock: %v", err)
+	}
+	if info, _ := os.Stat(path); info.Mode().Perm() != 0600 {
+		t.Errorf("mode = %v, want 0600", info.Mode().Perm())
+	}
+}
@@ -0,0 +1,274 @@
+package fileutil
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/andrew/ezproxy/internal/report"
+)
+
+const snapshotManifest = "manifest.json"
+
+// Snapshot holds the original contents of every file touched during one
+// ezproxy run, stored under <root>/<id>/. While a snapshot is active (see
+// BeginSnapshot), WriteFile and RemoveFile record each file before its
+// first modification so the whole run can be restored later.
+type Snapshot struct {
+	ID      string          `json:"id"`
+	Created time.Time       `json:"created"`
+	Command string          `json:"command,omitempty"`
+	Entries []SnapshotEntry `json:"entries"`
+
+	dir string
+}
+
+// SnapshotEntry describes a single file as it was before ezproxy touched it.
+type SnapshotEntry struct {
+	Path    string      `json:"path"`
+	Existed bool        `json:"existed"`
+	Mode    os.FileMode `json:"mode,omitempty"`
+	Backup  string      `json:"backup,omitempty"` // file name inside the snapshot dir
+	// Root marks a file that only root can write, recorded by
+	// BackupRootFile. Restore leaves it to package privileged.
+	Root bool `json:"root,omitempty"`
+}
+
+var activeSnapshot *Snapshot
+
+// BeginSnapshot starts recording file modifications into a new snapshot
+// under root. The snapshot directory is only created once the first file
+// is recorded. Call EndSnapshot when the run is finished.
+func BeginSnapshot(root, command string) *Snapshot {
+	now := time.Now()
+	id := now.Format("20060102-150405")
+	for i := 2; ; i++ {
+		if _, err := os.Stat(filepath.Join(root, id)); os.IsNotExist(err) {
+			break
+		}
+		id = now.Format("20060102-150405") + "-" + strconv.Itoa(i)
+	}
+	activeSnapshot = &Snapshot{
+		ID:      id,
+		Created: now,
+		Command: command,
+		dir:     filepath.Join(root, id),
+	}
+	return activeSnapshot
+}
+
+// EndSnapshot stops recording into the active snapshot.
+func EndSnapshot() {
+	activeSnapshot = nil
+}
+
+// Len returns the number of files recorded in the snapshot.
+func (s *Snapshot) Len() int {
+	return len(s.Entries)
+}
+
+// BackupFile records path in the active snapshot before it is modified.
+// It is a no-op when no snapshot is active, in dry-run mode, or when the
+// file has already been recorded during this run.
+func BackupFile(path string) error {
+	return backup(path, false)
+}
+
+// BackupRootFile is BackupFile for a file that root writes or deletes on
+// ezproxy's behalf, such as a system-wide config file (see package
+// privileged).
+func BackupRootFile(path string) error {
+	return backup(path, true)
+}
+
+func backup(path string, root bool) error {
+	s := activeSnapshot
+	if s == nil || DryRun {
+		return nil
+	}
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return err
+	}
+	for _, e := range s.Entries {
+		if e.Path == abs {
+			return nil
+		}
+	}
+
+	entry := SnapshotEntry{Path: abs, Root: root}
+	data, err := os.ReadFile(abs)
+	switch {
+	case err == nil:
+		info, err := os.Stat(abs)
+		if err != nil {
+			return err
+		}
+		entry.Existed = true
+		entry.Mode = info.Mode().Perm()
+		entry.Backup = strconv.Itoa(len(s.Entries)) + "-" + filepath.Base(abs)
+		if err := os.MkdirAll(s.dir, 0700); err != nil {
+			return fmt.Errorf("creating backup dir: %w", err)
+		}
+		if err := os.WriteFile(filepath.Join(s.dir, entry.Backup), data, 0600); err != nil {
+			return fmt.Errorf("backing up %s: %w", abs, err)
+		}
+	case os.IsNotExist(err):
+		if err := os.MkdirAll(s.dir, 0700); err != nil {
+			return fmt.Errorf("creating backup dir: %w", err)
+		}
+	default:
+		return fmt.Errorf("backing up %s: %w", abs, err)
+	}
+
+	s.Entries = append(s.Entries, entry)
+	return s.save()
+}
+
+func (s *Snapshot) save() error {
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(s.dir, snapshotManifest), append(data, '\n'), 0600)
+}
+
+// Restore puts every recorded file back the way it was: files that existed
+// get their original content and mode back, files created during the run
+// are deleted. Files only root can write are skipped; privileged.AddRestore
+// queues those. Restoring is itself recorded if another snapshot is
+// active, so a rollback can be rolled back.
+func (s *Snapshot) Restore() error {
+	if activeSnapshot == s {
+		EndSnapshot()
+	}
+	var failed []string
+	for i := len(s.Entries) - 1; i >= 0; i-- {
+		e := s.Entries[i]
+		if e.Root {
+			continue
+		}
+		var err error
+		if e.Existed {
+			var data []byte
+			data, err = s.ReadBackup(e)
+			if err == nil {
+				err = WriteFile(e.Path, data, e.Mode)
+			}
+			if err == nil {
+				err = os.Chmod(e.Path, e.Mode)
+			}
+		} else {
+			err = RemoveFile(e.Path)
+		}
+		if err != nil {
+			failed = append(failed, fmt.Sprintf("%s: %v", e.Path, err))
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("could not restore %d file(s): %v", len(failed), failed)
+	}
+	return nil
+}
+
+// ReadBackup returns the content e had before the run. e must have
+// existed.
+func (s *Snapshot) ReadBackup(e SnapshotEntry) ([]byte, error) {
+	return os.ReadFile(filepath.Join(s.dir, e.Backup))
+}
+
+// LoadSnapshot reads the snapshot with the given ID from root.
+func LoadSnapshot(root, id string) (*Snapshot, error) {
+	dir := filepath.Join(root, id)
+	data, err := os.ReadFile(filepath.Join(dir, snapshotManifest))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, fmt.Errorf("no backup %q in %s", id, root)
+		}
+		return nil, err
+	}
+	var s Snapshot
+	if err := json.Unmarshal(data, &s); err != nil {
+		return nil, fmt.Errorf("reading backup %s: %w", id, err)
+	}
+	s.dir = dir
+	return &s, nil
+}
+
+// ListSnapshots returns all snapshots under root, newest first.
+func ListSnapshots(root string) ([]*Snapshot, error) {
+	entries, err := os.ReadDir(root)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var snaps []*Snapshot
+	for _, e := range entries {
+		if !e.IsDir() {
+			continue
+		}
+		s, err := LoadSnapshot(root, e.Name())
+		if err != nil {
+			continue
+		}
+		snaps = append(snaps, s)
+	}
+	sort.Slice(snaps, func(i, j int) bool {
+		return snaps[i].Created.After(snaps[j].Created)
+	})
+	return snaps, nil
+}
+
+// WriteFile atomically writes data to path (see AtomicWrite), creating
+// parent directories as needed. The previous contents are recorded in the
+// active snapshot first. In dry-run mode it prints a diff of the change
+// instead.
+func WriteFile(path string, data []byte, perm os.FileMode) error {
+	if DryRun {
+		return preview(path, data, false)
+	}
+	if err := BackupFile(path); err != nil {
+		return err
+	}
+	report.File(path)
+	return AtomicWrite(path, data, perm)
+}
+
+// WritePrivateFile is WriteFile for data only the owner may read, such as
+// proxy credentials: the file is written with AtomicWritePrivate.
+func WritePrivateFile(path string, data []byte) error {
+	if DryRun {
+		return preview(path, data, false)
+	}
+	if err := BackupFile(path); err != nil {
+		return err
+	}
+	report.File(path)
+	return AtomicWritePrivate(path, data)
+}
+
+// RemoveFile deletes path after recording it in the active snapshot.
+// A missing file is not an error. In dry-run mode it prints a diff of the
+// deletion instead.
+func RemoveFile(path string) error {
+	if DryRun {
+		return preview(path, nil, true)
+	}
+	if err := BackupFile(path); err != nil {
+		return err
+	}
+	if err := os.Remove(path); err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	report.File(path)
+	return nil
+}
@@ -0,0 +1,96 @@
+package fileutil
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSnapshotRestore(t *testing.T) {
+	dir := t.TempDir()
+	root := filepath.Join(dir, "backups")
+	existing := filepath.Join(dir, "settings.xml")
+	created := filepath.Join(dir, "new", ".npmrc")
+
+	os.WriteFile(existing, []byte("<settings>hand tuned</settings>\n"), 0600)
+
+	snap := BeginSnapshot(root, "apply")
+	if err := WriteFile(existing, []byte("<settings/>\n"), 0644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	if err := UpsertMarkerBlock(created, "test", "proxy=http://proxy:8080\n", "#"); err != nil {
+		t.Fatalf("UpsertMarkerBlock: %v", err)
+	}
+	// A second write to the same file must not overwrite the original backup.
+	if err := WriteFile(existing, []byte("<settings>again</settings>\n"), 0644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	EndSnapshot()
+
+	if snap.Len() != 2 {
+		t.Fatalf("expected 2 entries, got %d", snap.Len())
+	}
+
+	loaded, err := LoadSnapshot(root, snap.ID)
+	if err != nil {
+		t.Fatalf("LoadSnapshot: %v", err)
+	}
+	if err := loaded.Restore(); err != nil {
+		t.Fatalf("Restore: %v", err)
+	}
+
+	data, _ := os.ReadFile(existing)
+	if string(data) != "<settings>hand tuned</settings>\n" {
+		t.Errorf("existing file not restored, got %q", data)
+	}
+	if info, _ := os.Stat(existing); info.Mode().Perm() != 0600 {
+		t.Errorf("mode not restored, got %v", info.Mode().Perm())
+	}
+	if _, err := os.Stat(created); !os.IsNotExist(err) {
+		t.Error("file created during the run should be deleted on restore")
+	}
+}
+
+func TestSnapshotNotRecordedWhenInactive(t *testing.T) {
+	dir := t.TempDir()
+	root := filepath.Join(dir, "backups")
+
+	snap := BeginSnapshot(root, "apply")
+	EndSnapshot()
+	WriteFile(filepath.Join(dir, "file"), []byte("x\n"), 0644)
+
+	if snap.Len() != 0 {
+		t.Errorf("expected no entries after EndSnapshot, got %d", snap.Len())
+	}
+	if _, err := os.Stat(root); !os.IsNotExist(err) {
+		t.Error("backup dir should not be created for an empty snapshot")
+	}
+}
+
+func TestListSnapshots(t *testing.T) {
+	dir := t.TempDir()
+	root := filepath.Join(dir, "backups")
+	path := filepath.Join(dir, "file")
+
+	first := BeginSnapshot(root, "apply")
+	WriteFile(path, []byte("1\n"), 0644)
+	EndSnapshot()
+	second := BeginSnapshot(root, "remove")
+	WriteFile(path, []byte("2\n"), 0644)
+	EndSnapshot()
+
+	if first.ID == second.ID {
+		t.Fatalf("snapshot IDs should be unique, both %q", first.ID)
+	}
+
+	snaps, err := ListSnapshots(root)
+	if err != nil {
+		t.Fatalf("ListSnapshots: %v", err)
+	}
+	if len(snaps) != 2 {
+		t.Fatalf("expected 2 snapshots, got %d", len(snaps))
+	}
+	if snaps[0].Command != "remove" {
+		t.Errorf("expected newest first, got %q", snaps[0].Command)
+	}
+}
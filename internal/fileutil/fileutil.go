@@ -3,155 +3,217 @@ package fileutil
 import (
 	"fmt"
 	"os"
-	"path/filepath"
 	"strings"
 )
 
 // DryRun controls whether file operations are performed or just previewed.
-// When true, UpsertMarkerBlock and RemoveMarkerBlock print what they would
-// do instead of modifying files.
+// When true, WriteFile and RemoveFile, and so everything built on them,
+// print a diff of the change instead of modifying files (see ReadFile).
 var DryRun bool
 
 // AutoYes skips interactive confirmations (e.g. sudo prompts).
 // Set via --yes flag for scripted/automated use.
 var AutoYes bool
 
-const (
-	markerStart = ">>> ezproxy >>>"
-	markerEnd   = "<<< ezproxy <<<"
-)
+// Marker blocks are delimited by "<comment> >>> ezproxy:<id> >>>" and
+// "<comment> <<< ezproxy:<id> <<<" lines. The ID (usually the tool name)
+// lets several tools keep their own block in one file, such as a shell
+// profile. Blocks written before IDs existed ("# >>> ezproxy >>>") are
+// taken to belong to whichever ID asks for them first; the next upsert
+// renames them in place.
+
+// markerName returns "ezproxy:<id>", or "ezproxy" for an unnamed block.
+func markerName(id string) string {
+	if id == "" {
+		return "ezproxy"
+	}
+	return "ezproxy:" + id
+}
 
-func startMarker(comment string) string {
-	return fmt.Sprintf("%s %s", comment, markerStart)
+func startMarker(comment, id string) string {
+	return fmt.Sprintf("%s >>> %s >>>", comment, markerName(id))
 }
 
-func endMarker(comment string) string {
-	return fmt.Sprintf("%s %s", comment, markerEnd)
+func endMarker(comment, id string) string {
+	return fmt.Sprintf("%s <<< %s <<<", comment, markerName(id))
 }
 
-func UpsertMarkerBlock(path string, content string, comment string) error {
-	block := fmt.Sprintf("%s\n%s%s\n", startMarker(comment), content, endMarker(comment))
+// blockRange locates a marker block within a file's content: start and
+// end span the whole block including its markers, body and bodyEnd its
+// content.
+type blockRange struct {
+	start, body, bodyEnd, end int
+}
 
-	if DryRun {
-		exists := "create"
-		if _, err := os.Stat(path); err == nil {
-			if HasMarkerBlock(path, comment) {
-				exists = "update"
-			} else {
-				exists = "append to"
-			}
-		}
-		fmt.Printf("\n  [dry-run] Would %s %s:\n", exists, path)
-		for _, line := range strings.Split(strings.TrimRight(block, "\n"), "\n") {
-			fmt.Printf("    %s\n", line)
-		}
-		return nil
+// findBlock returns the block with the given ID, falling back to an
+// unnamed block from an older version.
+func findBlock(content, id, comment string) (blockRange, bool) {
+	if r, ok := findMarkers(content, startMarker(comment, id), endMarker(comment, id)); ok || id == "" {
+		return r, ok
 	}
+	return findMarkers(content, startMarker(comment, ""), endMarker(comment, ""))
+}
 
-	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
-		return err
+func findMarkers(content, start, end string) (blockRange, bool) {
+	startIdx := strings.Index(content, start)
+	if startIdx < 0 {
+		return blockRange{}, false
 	}
-
-	existing := ""
-	if data, err := os.ReadFile(path); err == nil {
-		existing = string(data)
+	body := startIdx + len(start)
+	endIdx := strings.Index(content[body:], end)
+	if endIdx < 0 {
+		return blockRange{}, false
+	}
+	r := blockRange{start: startIdx, body: body, bodyEnd: body + endIdx, end: body + endIdx + len(end)}
+	if r.body < r.bodyEnd && content[r.body] == '\n' {
+		r.body++
 	}
+	return r, true
+}
 
-	start := startMarker(comment)
-	end := endMarker(comment)
+func readContent(path string) (string, error) {
+	data, err := ReadFile(path)
+	return string(data), err
+}
+
+// UpsertMarkerBlock writes content as the marker block with the given ID,
+// replacing the existing block (or an unnamed one) or appending a new one.
+func UpsertMarkerBlock(path, id, content, comment string) error {
+	existing, _ := readContent(path)
+	return WriteFile(path, []byte(SetMarkerBlock(existing, id, content, comment)), 0644)
+}
 
-	startIdx := strings.Index(existing, start)
-	endIdx := strings.Index(existing, end)
+// SetMarkerBlock returns existing with content as the marker block with
+// the given ID, replacing the existing block (or an unnamed one) or
+// appending a new one.
+func SetMarkerBlock(existing, id, content, comment string) string {
+	block := fmt.Sprintf("%s\n%s%s\n", startMarker(comment, id), content, endMarker(comment, id))
 
-	var result string
-	if startIdx >= 0 && endIdx >= 0 {
-		result = existing[:startIdx] + block + existing[endIdx+len(end):]
+	if r, ok := findBlock(existing, id, comment); ok {
+		// block ends with a newline; don't add a second one.
+		result := existing[:r.start] + block + strings.TrimPrefix(existing[r.end:], "\n")
 		if strings.HasSuffix(result, "\n\n\n") {
 			result = strings.TrimRight(result, "\n") + "\n"
 		}
-	} else {
-		if existing != "" && !strings.HasSuffix(existing, "\n") {
-			existing += "\n"
-		}
-		if existing != "" {
-			existing += "\n"
-		}
-		result = existing + block
+		return result
 	}
-
-	return os.WriteFile(path, []byte(result), 0644)
-}
-
-func RemoveMarkerBlock(path string, comment string) error {
-	if DryRun {
-		if HasMarkerBlock(path, comment) {
-			fmt.Printf("\n  [dry-run] Would remove ezproxy block from %s\n", path)
-		}
-		return nil
+	if existing != "" && !strings.HasSuffix(existing, "\n") {
+		existing += "\n"
 	}
+	if existing != "" {
+		existing += "\n"
+	}
+	return existing + block
+}
 
-	data, err := os.ReadFile(path)
+// RemoveMarkerBlock deletes the marker block with the given ID (or an
+// unnamed one) from path, leaving everything else in place.
+func RemoveMarkerBlock(path, id, comment string) error {
+	content, err := readContent(path)
 	if err != nil {
 		if os.IsNotExist(err) {
 			return nil
 		}
 		return err
 	}
-
-	content := string(data)
-	start := startMarker(comment)
-	end := endMarker(comment)
-
-	startIdx := strings.Index(content, start)
-	endIdx := strings.Index(content, end)
-
-	if startIdx < 0 || endIdx < 0 {
+	result := DeleteMarkerBlock(content, id, comment)
+	if result == content {
 		return nil
 	}
+	return WriteFile(path, []byte(result), 0644)
+}
 
-	before := content[:startIdx]
-	after := content[endIdx+len(end):]
+// DeleteMarkerBlock returns content without the marker block with the
+// given ID (or an unnamed one). Content without the block is returned as
+// is.
+func DeleteMarkerBlock(content, id, comment string) string {
+	r, ok := findBlock(content, id, comment)
+	if !ok {
+		return content
+	}
 
-	before = strings.TrimRight(before, "\n")
-	after = strings.TrimLeft(after, "\n")
+	before := strings.TrimRight(content[:r.start], "\n")
+	after := strings.TrimLeft(content[r.end:], "\n")
 
-	result := ""
-	if before != "" && after != "" {
-		result = before + "\n" + after + "\n"
-	} else if before != "" {
-		result = before + "\n"
-	} else if after != "" {
-		result = after + "\n"
+	switch {
+	case before != "" && after != "":
+		return before + "\n" + after + "\n"
+	case before != "":
+		return before + "\n"
+	case after != "":
+		return after + "\n"
 	}
-
-	return os.WriteFile(path, []byte(result), 0644)
+	return ""
 }
 
-func HasMarkerBlock(path string, comment string) bool {
-	data, err := os.ReadFile(path)
+// HasMarkerBlock reports whether path has the marker block with the given
+// ID (or an unnamed one).
+func HasMarkerBlock(path, id, comment string) bool {
+	content, err := readContent(path)
 	if err != nil {
 		return false
 	}
-	return strings.Contains(string(data), startMarker(comment))
+	_, ok := findBlock(content, id, comment)
+	return ok
 }
 
-func GetMarkerBlockContent(path string, comment string) (string, error) {
-	data, err := os.ReadFile(path)
+// GetMarkerBlockContent returns the content of the marker block with the
+// given ID (or an unnamed one), without its markers.
+func GetMarkerBlockContent(path, id, comment string) (string, error) {
+	content, err := readContent(path)
 	if err != nil {
 		return "", err
 	}
+	r, ok := findBlock(content, id, comment)
+	if !ok {
+		return "", fmt.Errorf("no %s block found in %s", markerName(id), path)
+	}
+	return content[r.body:r.bodyEnd], nil
+}
 
-	content := string(data)
-	start := startMarker(comment)
-	end := endMarker(comment)
-
-	startIdx := strings.Index(content, start)
-	endIdx := strings.Index(content, end)
+// ContentOutsideMarkerBlock returns the file content with the given ezproxy
+// block removed, i.e. everything the user (or another tool) wrote.
+func ContentOutsideMarkerBlock(path, id, comment string) (string, error) {
+	content, err := readContent(path)
+	if err != nil {
+		return "", err
+	}
+	r, ok := findBlock(content, id, comment)
+	if !ok {
+		return content, nil
+	}
+	return content[:r.start] + content[r.end:], nil
+}
 
-	if startIdx < 0 || endIdx < 0 {
-		return "", fmt.Errorf("no marker block found in %s", path)
+// MigrateMarkerBlock renames an unnamed block in path to the given ID, so
+// that a tool sharing the file with the block's real owner doesn't claim
+// it. It does nothing if the file already has a block with that ID or no
+// unnamed block.
+func MigrateMarkerBlock(path, id, comment string) error {
+	content, err := readContent(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	result := NameMarkerBlock(content, id, comment)
+	if result == content {
+		return nil
 	}
+	return WriteFile(path, []byte(result), 0644)
+}
 
-	blockContent := content[startIdx+len(start)+1 : endIdx]
-	return blockContent, nil
+// NameMarkerBlock returns content with an unnamed block renamed to the
+// given ID, as MigrateMarkerBlock does to a file.
+func NameMarkerBlock(content, id, comment string) string {
+	if _, ok := findMarkers(content, startMarker(comment, id), endMarker(comment, id)); ok {
+		return content
+	}
+	r, ok := findMarkers(content, startMarker(comment, ""), endMarker(comment, ""))
+	if !ok {
+		return content
+	}
+	return content[:r.start] + startMarker(comment, id) + "\n" + content[r.body:r.bodyEnd] +
+		endMarker(comment, id) + content[r.end:]
 }
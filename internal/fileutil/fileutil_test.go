@@ -12,17 +12,17 @@ func TestUpsertMarkerBlock_NewFile(t *testing.T) {
 	path := filepath.Join(dir, "testfile")
 
 	content := "export FOO=bar\nexport BAZ=qux\n"
-	err := UpsertMarkerBlock(path, content, "#")
+	err := UpsertMarkerBlock(path, "test", content, "#")
 	if err != nil {
 		t.Fatalf("UpsertMarkerBlock failed: %v", err)
 	}
 
 	data, _ := os.ReadFile(path)
 	got := string(data)
-	if !strings.Contains(got, "# >>> ezproxy >>>") {
+	if !strings.Contains(got, "# >>> ezproxy:test >>>") {
 		t.Error("missing start marker")
 	}
-	if !strings.Contains(got, "# <<< ezproxy <<<") {
+	if !strings.Contains(got, "# <<< ezproxy:test <<<") {
 		t.Error("missing end marker")
 	}
 	if !strings.Contains(got, "export FOO=bar") {
@@ -38,7 +38,7 @@ func TestUpsertMarkerBlock_ExistingFile(t *testing.T) {
 	os.WriteFile(path, []byte(existing), 0644)
 
 	content := "export PROXY=http://proxy:8080\n"
-	err := UpsertMarkerBlock(path, content, "#")
+	err := UpsertMarkerBlock(path, "test", content, "#")
 	if err != nil {
 		t.Fatalf("UpsertMarkerBlock failed: %v", err)
 	}
@@ -57,8 +57,8 @@ func TestUpsertMarkerBlock_Replace(t *testing.T) {
 	dir := t.TempDir()
 	path := filepath.Join(dir, "testfile")
 
-	UpsertMarkerBlock(path, "OLD CONTENT\n", "#")
-	UpsertMarkerBlock(path, "NEW CONTENT\n", "#")
+	UpsertMarkerBlock(path, "test", "OLD CONTENT\n", "#")
+	UpsertMarkerBlock(path, "test", "NEW CONTENT\n", "#")
 
 	data, _ := os.ReadFile(path)
 	got := string(data)
@@ -68,7 +68,7 @@ func TestUpsertMarkerBlock_Replace(t *testing.T) {
 	if !strings.Contains(got, "NEW CONTENT") {
 		t.Error("new content missing")
 	}
-	if strings.Count(got, ">>> ezproxy >>>") != 1 {
+	if strings.Count(got, ">>> ezproxy:test >>>") != 1 {
 		t.Error("should have exactly one start marker")
 	}
 }
@@ -81,13 +81,13 @@ func TestRemoveMarkerBlock(t *testing.T) {
 	after := "line2\n"
 	os.WriteFile(path, []byte(before), 0644)
 
-	UpsertMarkerBlock(path, "PROXY STUFF\n", "#")
+	UpsertMarkerBlock(path, "test", "PROXY STUFF\n", "#")
 
 	f, _ := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0644)
 	f.WriteString(after)
 	f.Close()
 
-	err := RemoveMarkerBlock(path, "#")
+	err := RemoveMarkerBlock(path, "test", "#")
 	if err != nil {
 		t.Fatalf("RemoveMarkerBlock failed: %v", err)
 	}
@@ -110,12 +110,12 @@ func TestHasMarkerBlock(t *testing.T) {
 	path := filepath.Join(dir, "testfile")
 
 	os.WriteFile(path, []byte("nothing here\n"), 0644)
-	if HasMarkerBlock(path, "#") {
+	if HasMarkerBlock(path, "test", "#") {
 		t.Error("should not have marker block")
 	}
 
-	UpsertMarkerBlock(path, "stuff\n", "#")
-	if !HasMarkerBlock(path, "#") {
+	UpsertMarkerBlock(path, "test", "stuff\n", "#")
+	if !HasMarkerBlock(path, "test", "#") {
 		t.Error("should have marker block")
 	}
 }
@@ -124,8 +124,8 @@ func TestGetMarkerBlockContent(t *testing.T) {
 	dir := t.TempDir()
 	path := filepath.Join(dir, "testfile")
 
-	UpsertMarkerBlock(path, "FOO=bar\nBAZ=qux\n", "#")
-	content, err := GetMarkerBlockContent(path, "#")
+	UpsertMarkerBlock(path, "test", "FOO=bar\nBAZ=qux\n", "#")
+	content, err := GetMarkerBlockContent(path, "test", "#")
 	if err != nil {
 		t.Fatalf("GetMarkerBlockContent failed: %v", err)
 	}
@@ -133,3 +133,80 @@ func TestGetMarkerBlockContent(t *testing.T) {
 		t.Error("missing content")
 	}
 }
+
+func TestMarkerBlocks_SeveralIDsShareAFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), ".bashrc")
+	os.WriteFile(path, []byte("alias ll='ls -l'\n"), 0644)
+
+	UpsertMarkerBlock(path, "env_vars", "export HTTP_PROXY=http://proxy:8080\n", "#")
+	UpsertMarkerBlock(path, "go", "# GOPRIVATE hint\n", "#")
+	UpsertMarkerBlock(path, "env_vars", "export HTTP_PROXY=http://new:3128\n", "#")
+
+	env, _ := GetMarkerBlockContent(path, "env_vars", "#")
+	if env != "export HTTP_PROXY=http://new:3128\n" {
+		t.Errorf("env_vars block = %q", env)
+	}
+	if got, _ := GetMarkerBlockContent(path, "go", "#"); got != "# GOPRIVATE hint\n" {
+		t.Errorf("go block = %q", got)
+	}
+	if HasMarkerBlock(path, "golang", "#") {
+		t.Error("an ID must not match a longer ID")
+	}
+
+	RemoveMarkerBlock(path, "go", "#")
+	data, _ := os.ReadFile(path)
+	want := "alias ll='ls -l'\n\n# >>> ezproxy:env_vars >>>\nexport HTTP_PROXY=http://new:3128\n# <<< ezproxy:env_vars <<<\n"
+	if string(data) != want {
+		t.Errorf("after removing go:\n%s\nwant:\n%s", data, want)
+	}
+	outside, _ := ContentOutsideMarkerBlock(path, "env_vars", "#")
+	if strings.TrimSpace(outside) != "alias ll='ls -l'" {
+		t.Errorf("outside = %q", outside)
+	}
+}
+
+func TestMarkerBlocks_UnnamedBlockMigrates(t *testing.T) {
+	path := filepath.Join(t.TempDir(), ".npmrc")
+	legacy := "color=true\n\n# >>> ezproxy >>>\nproxy=http://old:8080\n# <<< ezproxy <<<\n"
+	os.WriteFile(path, []byte(legacy), 0644)
+
+	if !HasMarkerBlock(path, "npm", "#") {
+		t.Fatal("unnamed block not found by ID")
+	}
+	if got, _ := GetMarkerBlockContent(path, "npm", "#"); got != "proxy=http://old:8080\n" {
+		t.Errorf("content = %q", got)
+	}
+
+	UpsertMarkerBlock(path, "npm", "proxy=http://new:8080\n", "#")
+	data, _ := os.ReadFile(path)
+	want := "color=true\n\n# >>> ezproxy:npm >>>\nproxy=http://new:8080\n# <<< ezproxy:npm <<<\n"
+	if string(data) != want {
+		t.Errorf("after upsert:\n%s\nwant:\n%s", data, want)
+	}
+
+	os.WriteFile(path, []byte(legacy), 0644)
+	RemoveMarkerBlock(path, "npm", "#")
+	if data, _ := os.ReadFile(path); string(data) != "color=true\n" {
+		t.Errorf("after remove = %q", data)
+	}
+}
+
+func TestMigrateMarkerBlock(t *testing.T) {
+	path := filepath.Join(t.TempDir(), ".zshrc")
+	os.WriteFile(path, []byte("# >>> ezproxy >>>\nexport HTTP_PROXY=http://proxy:8080\n# <<< ezproxy <<<\n"), 0644)
+
+	if err := MigrateMarkerBlock(path, "env_vars", "#"); err != nil {
+		t.Fatalf("MigrateMarkerBlock: %v", err)
+	}
+	// The go block must now be separate rather than replacing env_vars.
+	UpsertMarkerBlock(path, "go", "# GOPRIVATE hint\n", "#")
+	if got, _ := GetMarkerBlockContent(path, "env_vars", "#"); got != "export HTTP_PROXY=http://proxy:8080\n" {
+		t.Errorf("env_vars block = %q", got)
+	}
+	if got, _ := GetMarkerBlockContent(path, "go", "#"); got != "# GOPRIVATE hint\n" {
+		t.Errorf("go block = %q", got)
+	}
+	if err := MigrateMarkerBlock(filepath.Join(t.TempDir(), "missing"), "env_vars", "#"); err != nil {
+		t.Errorf("missing file: %v", err)
+	}
+}
@@ -0,0 +1,105 @@
+package fileutil
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+
+	"github.com/andrew/ezproxy/internal/diff"
+	"github.com/andrew/ezproxy/internal/report"
+)
+
+// In dry-run mode WriteFile and RemoveFile leave the disk alone and print
+// a unified diff of the change instead. The content each file would have
+// is kept for the rest of the run and returned by ReadFile, so a file that
+// several tools edit (a shell profile) previews as the combined result,
+// and each tool's diff is against what the ones before it would have left.
+
+// previews maps the absolute path of each file changed in this dry run to
+// its new content, or nil if it would be deleted.
+var previews = map[string]*[]byte{}
+
+// ReadFile is os.ReadFile, except that in dry-run mode it returns what
+// the writes previewed so far would have left in path.
+func ReadFile(path string) ([]byte, error) {
+	if data, ok := previewed(path); ok {
+		if data == nil {
+			return nil, &fs.PathError{Op: "open", Path: path, Err: fs.ErrNotExist}
+		}
+		return *data, nil
+	}
+	return os.ReadFile(path)
+}
+
+// Exists reports whether path exists, or in dry-run mode whether it
+// would after the writes previewed so far.
+func Exists(path string) bool {
+	if data, ok := previewed(path); ok {
+		return data != nil
+	}
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+// previewed returns the content previewed for path in this dry run, and
+// whether there is any.
+func previewed(path string) (*[]byte, bool) {
+	if !DryRun {
+		return nil, false
+	}
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return nil, false
+	}
+	data, ok := previews[abs]
+	return data, ok
+}
+
+// preview prints the diff from path's current content to data, or with
+// remove to deleting the file, and keeps the result for the rest of the
+// run.
+func preview(path string, data []byte, remove bool) error {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return err
+	}
+	old, err := ReadFile(abs)
+	exists := err == nil
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if remove && !exists {
+		return nil
+	}
+
+	from, to := abs, abs
+	switch {
+	case remove:
+		to = "/dev/null"
+		previews[abs] = nil
+	case !exists:
+		from = "/dev/null"
+		previews[abs] = &data
+	default:
+		previews[abs] = &data
+	}
+	d := diff.Unified(from, to, string(old), string(data))
+	if d == "" {
+		if !exists {
+			// A new empty file still gets a line of its own.
+			report.Printf("\n  [dry-run] Would create %s (empty)\n", abs)
+		}
+		return nil
+	}
+	if report.Color() {
+		d = diff.Color(d)
+	}
+	report.Printf("\n%s", d)
+	return nil
+}
+
+// ResetPreview forgets the writes previewed so far, as at the start of a
+// new run.
+func ResetPreview() {
+	previews = map[string]*[]byte{}
+}
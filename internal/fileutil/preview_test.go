@@ -0,0 +1,98 @@
+package fileutil
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/andrew/ezproxy/internal/report"
+)
+
+// dryRun turns on DryRun with the report collected as JSON, and returns
+// the messages printed.
+func dryRun(t *testing.T) func() string {
+	t.Helper()
+	DryRun, report.JSON = true, true
+	r := report.Start("apply")
+	t.Cleanup(func() {
+		DryRun, report.JSON = false, false
+		ResetPreview()
+	})
+	return func() string { return strings.Join(r.Messages, "\n") }
+}
+
+func TestDryRunPreviewsMarkerEdits(t *testing.T) {
+	path := filepath.Join(t.TempDir(), ".bashrc")
+	os.WriteFile(path, []byte("# mine\n"), 0644)
+	messages := dryRun(t)
+
+	if err := UpsertMarkerBlock(path, "env_vars", "export A=1\n", "#"); err != nil {
+		t.Fatal(err)
+	}
+	// The second tool's diff is against what the first would have left.
+	if err := UpsertMarkerBlock(path, "go", "# go\n", "#"); err != nil {
+		t.Fatal(err)
+	}
+
+	if data, _ := os.ReadFile(path); string(data) != "# mine\n" {
+		t.Errorf("dry run wrote the file: %q", data)
+	}
+	want := "# mine\n\n# >>> ezproxy:env_vars >>>\nexport A=1\n# <<< ezproxy:env_vars <<<\n\n# >>> ezproxy:go >>>\n# go\n# <<< ezproxy:go <<<\n"
+	if data, err := ReadFile(path); err != nil || string(data) != want {
+		t.Errorf("previewed content = %q, %v\nwant %q", data, err, want)
+	}
+
+	got := messages()
+	for _, s := range []string{
+		"--- " + path + "\n+++ " + path + "\n@@ -1 +1,5 @@\n # mine\n+\n+# >>> ezproxy:env_vars >>>\n+export A=1\n",
+		"@@ -3,3 +3,7 @@\n # >>> ezproxy:env_vars >>>\n export A=1\n # <<< ezproxy:env_vars <<<\n+\n+# >>> ezproxy:go >>>\n",
+	} {
+		if !strings.Contains(got, s) {
+			t.Errorf("output lacks\n%s\nin\n%s", s, got)
+		}
+	}
+}
+
+func TestDryRunPreviewsCreateAndDelete(t *testing.T) {
+	dir := t.TempDir()
+	created, deleted := filepath.Join(dir, "new.conf"), filepath.Join(dir, "old.conf")
+	os.WriteFile(deleted, []byte("proxy=p\n"), 0644)
+	messages := dryRun(t)
+
+	if err := WriteFile(created, []byte("a=1\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := RemoveFile(deleted); err != nil {
+		t.Fatal(err)
+	}
+	if err := RemoveFile(filepath.Join(dir, "missing")); err != nil {
+		t.Fatal(err)
+	}
+
+	if Exists(deleted) || !Exists(created) {
+		t.Errorf("Exists after preview: deleted %v, created %v", Exists(deleted), Exists(created))
+	}
+	if _, err := ReadFile(deleted); !os.IsNotExist(err) {
+		t.Errorf("ReadFile of a previewed deletion: %v", err)
+	}
+	if _, err := os.Stat(created); err == nil {
+		t.Error("dry run created the file")
+	}
+	if _, err := os.Stat(deleted); err != nil {
+		t.Error("dry run deleted the file")
+	}
+
+	got := messages()
+	for _, s := range []string{
+		"--- /dev/null\n+++ " + created + "\n@@ -0,0 +1 @@\n+a=1",
+		"--- " + deleted + "\n+++ /dev/null\n@@ -1 +0,0 @@\n-proxy=p",
+	} {
+		if !strings.Contains(got, s) {
+			t.Errorf("output lacks\n%s\nin\n%s", s, got)
+		}
+	}
+	if strings.Contains(got, "missing") {
+		t.Errorf("deleting a missing file previewed:\n%s", got)
+	}
+}
@@ -0,0 +1,498 @@
+package fileutil
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Format is the syntax of a structured config file edited key by key.
+type Format int
+
+const (
+	// INI files have "[section]" headers and "key = value" or
+	// "key: value" lines; indented lines continue a value (pip.conf).
+	INI Format = iota
+	// TOML files have "[table]" headers and "key = value" lines whose
+	// arrays may span lines (Cargo's config.toml, containers.conf).
+	TOML
+	// YAML files are edited at the top level and one mapping below it
+	// (.condarc's proxy_servers).
+	YAML
+)
+
+// Key is one setting in a structured file. Section is the INI section,
+// TOML table or top-level YAML mapping it belongs to ("" for the top
+// level); Value is written as is, so it must already be in the file's
+// syntax (quoted for TOML strings).
+type Key struct {
+	Section string
+	Name    string
+	Value   string
+}
+
+// ID names the key for state and status output, e.g. "global.proxy".
+func (k Key) ID() string {
+	if k.Section == "" {
+		return k.Name
+	}
+	return k.Section + "." + k.Name
+}
+
+// ParseKeyID splits an ID made by Key.ID. Key names never contain dots,
+// so the section is everything before the last one.
+func ParseKeyID(id string) (section, name string) {
+	if i := strings.LastIndex(id, "."); i >= 0 {
+		return id[:i], id[i+1:]
+	}
+	return "", id
+}
+
+// GetKey returns the value of the first occurrence of the key in content,
+// or nil if it is not set.
+func GetKey(format Format, content, section, name string) *string {
+	values := KeyValues(format, content, section, name)
+	if len(values) == 0 {
+		return nil
+	}
+	return &values[0]
+}
+
+// KeyValues returns every value the key has in content. More than one
+// means the section or key is duplicated, which most parsers reject or
+// resolve differently from what ezproxy wrote.
+func KeyValues(format Format, content, section, name string) []string {
+	doc := parseDocument(format, content)
+	var out []string
+	for _, e := range doc.entries {
+		if doc.matches(e, section, name) {
+			out = append(out, e.value)
+		}
+	}
+	return out
+}
+
+// SetKey returns content with the key set to value, or removed when value
+// is nil. An existing key is replaced in place; a new one goes after the
+// last key of its section, and a missing section is added at the end.
+// Every other line, comments included, is kept as it is. Removing the last
+// key of a section also removes the then empty section header.
+func SetKey(format Format, content, section, name string, value *string) (string, error) {
+	doc := parseDocument(format, content)
+	lines := doc.lines
+
+	for _, e := range doc.entries {
+		if !doc.matches(e, section, name) {
+			continue
+		}
+		var repl []string
+		if value != nil {
+			repl = splitLines(e.indent + e.key + doc.separator() + *value)
+		}
+		lines = splice(lines, e.start, e.end, repl)
+		if value == nil {
+			lines = dropEmptySection(doc, lines, e)
+		}
+		return joinLines(lines), nil
+	}
+	if value == nil {
+		return content, nil
+	}
+
+	sec, ok := doc.section(section)
+	switch {
+	case !ok && section != "" && format == TOML && doc.hasDottedRoot(section):
+		// Keys written as "section.key = ..." at the top level; a
+		// [section] table would redefine them.
+		root, _ := doc.section("")
+		lines = splice(lines, root.insertAt, root.insertAt, splitLines(section+"."+name+" = "+*value))
+	case !ok:
+		if e, ok := doc.rootEntry(section); ok && section != "" {
+			// A YAML flow mapping or TOML inline table; a second
+			// definition would make the file invalid.
+			return "", fmt.Errorf("%s is set inline; can't add %s to it", e.key, name)
+		}
+		for len(lines) > 0 && strings.TrimSpace(lines[len(lines)-1]) == "" {
+			lines = lines[:len(lines)-1]
+		}
+		if len(lines) > 0 {
+			lines = append(lines, "")
+		}
+		if section != "" {
+			lines = append(lines, doc.header(section))
+		}
+		lines = append(lines, splitLines(doc.childIndent(section)+name+doc.separator()+*value)...)
+	default:
+		lines = splice(lines, sec.insertAt, sec.insertAt, splitLines(sec.childIndent+name+doc.separator()+*value))
+	}
+	return joinLines(lines), nil
+}
+
+// entry is one key found in a document, spanning lines [start, end).
+type entry struct {
+	section string
+	key     string // as written, e.g. "proxy" or "http.proxy" for a dotted TOML key
+	name    string // key within section
+	indent  string
+	value   string
+	start   int
+	end     int
+}
+
+// docSection is a section header and the lines it spans. insertAt is the
+// line after its last key, where a new key goes.
+type docSection struct {
+	name        string
+	header      int // -1 for the top level
+	end         int
+	insertAt    int
+	childIndent string
+}
+
+type document struct {
+	format   Format
+	lines    []string
+	entries  []entry
+	sections []docSection
+}
+
+func splitLines(s string) []string {
+	if s == "" {
+		return nil
+	}
+	return strings.Split(strings.TrimSuffix(s, "\n"), "\n")
+}
+
+func joinLines(lines []string) string {
+	if len(lines) == 0 {
+		return ""
+	}
+	return strings.Join(lines, "\n") + "\n"
+}
+
+func splice(lines []string, start, end int, repl []string) []string {
+	out := make([]string, 0, len(lines)-(end-start)+len(repl))
+	out = append(out, lines[:start]...)
+	out = append(out, repl...)
+	return append(out, lines[end:]...)
+}
+
+func isComment(trimmed string) bool {
+	return strings.HasPrefix(trimmed, "#") || strings.HasPrefix(trimmed, ";")
+}
+
+func indentOf(line string) int {
+	return len(line) - len(strings.TrimLeft(line, " \t"))
+}
+
+func parseDocument(format Format, content string) *document {
+	doc := &document{format: format, lines: splitLines(content)}
+	if format == YAML {
+		doc.parseYAML()
+	} else {
+		doc.parseSections()
+	}
+	return doc
+}
+
+func (d *document) separator() string {
+	if d.format == YAML {
+		return ": "
+	}
+	return " = "
+}
+
+func (d *document) header(section string) string {
+	if d.format == YAML {
+		return section + ":"
+	}
+	return "[" + section + "]"
+}
+
+func (d *document) childIndent(section string) string {
+	if d.format == YAML && section != "" {
+		return "  "
+	}
+	return ""
+}
+
+func (d *document) matches(e entry, section, name string) bool {
+	if e.section != section {
+		return false
+	}
+	if d.format == INI {
+		// configparser lower-cases option names.
+		return strings.EqualFold(e.name, name)
+	}
+	return e.name == name
+}
+
+func (d *document) section(name string) (docSection, bool) {
+	for _, s := range d.sections {
+		if s.name == name {
+			return s, true
+		}
+	}
+	return docSection{}, false
+}
+
+// rootEntry returns a top-level key named name.
+func (d *document) rootEntry(name string) (entry, bool) {
+	for _, e := range d.entries {
+		if e.section == "" && e.name == name {
+			return e, true
+		}
+	}
+	return entry{}, false
+}
+
+func (d *document) hasDottedRoot(section string) bool {
+	for _, e := range d.entries {
+		if e.section == section && e.key != e.name {
+			return true
+		}
+	}
+	return false
+}
+
+// parseSections reads INI and TOML documents.
+func (d *document) parseSections() {
+	cur := docSection{header: -1}
+	lines := d.lines
+	for i := 0; i < len(lines); {
+		trimmed := strings.TrimSpace(lines[i])
+		switch {
+		case trimmed == "" || isComment(trimmed):
+			i++
+		case strings.HasPrefix(trimmed, "["):
+			cur.end = i
+			d.sections = append(d.sections, cur)
+			name := trimmed
+			if end := strings.Index(name, "]"); end > 0 {
+				name = name[:end+1]
+			}
+			if strings.HasPrefix(name, "[[") {
+				// Arrays of tables are never merged into.
+				name = "[" + name
+			}
+			cur = docSection{name: strings.TrimSpace(strings.Trim(name, "[]")), header: i, insertAt: i + 1}
+			i++
+		default:
+			seps := "="
+			if d.format == INI {
+				seps = "=:"
+			}
+			idx := strings.IndexAny(trimmed, seps)
+			if idx <= 0 {
+				i++
+				continue
+			}
+			e := entry{
+				section: cur.name,
+				key:     strings.TrimSpace(trimmed[:idx]),
+				indent:  lines[i][:indentOf(lines[i])],
+				value:   strings.TrimSpace(trimmed[idx+1:]),
+				start:   i,
+			}
+			e.name = e.key
+			if d.format == TOML && cur.header < 0 {
+				if sec, name, ok := cutDotted(e.key); ok {
+					e.section, e.name = sec, name
+				}
+			}
+			end := i + 1
+			if d.format == TOML {
+				for ; tomlOpen(e.value) && end < len(lines); end++ {
+					e.value += "\n" + lines[end]
+				}
+			} else {
+				for ; end < len(lines) && indentOf(lines[end]) > 0 && strings.TrimSpace(lines[end]) != ""; end++ {
+					e.value += "\n" + lines[end]
+				}
+			}
+			e.end = end
+			d.entries = append(d.entries, e)
+			cur.insertAt = end
+			i = end
+		}
+	}
+	cur.end = len(lines)
+	d.sections = append(d.sections, cur)
+}
+
+// cutDotted splits an unquoted dotted TOML key such as http.proxy.
+func cutDotted(key string) (section, name string, ok bool) {
+	if strings.ContainsAny(key, `"'`) {
+		return "", "", false
+	}
+	i := strings.LastIndex(key, ".")
+	if i <= 0 {
+		return "", "", false
+	}
+	return strings.TrimSpace(key[:i]), strings.TrimSpace(key[i+1:]), true
+}
+
+// tomlOpen reports whether a TOML value continues on the next line: an
+// unclosed array, inline table or multi-line string.
+func tomlOpen(v string) bool {
+	if strings.Count(v, `"""`)%2 == 1 || strings.Count(v, `'''`)%2 == 1 {
+		return true
+	}
+	depth := 0
+	var quote byte
+	for i := 0; i < len(v); i++ {
+		c := v[i]
+		switch {
+		case quote != 0:
+			if c == '\\' && quote == '"' {
+				i++
+			} else if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '#':
+			for i < len(v) && v[i] != '\n' {
+				i++
+			}
+		case c == '[' || c == '{':
+			depth++
+		case c == ']' || c == '}':
+			depth--
+		}
+	}
+	return depth > 0
+}
+
+// parseYAML reads top-level keys, and the keys one level down in
+// top-level block mappings. A key's value runs until the next line that is
+// indented no deeper than the key.
+func (d *document) parseYAML() {
+	lines := d.lines
+	root := docSection{header: -1}
+	for i := 0; i < len(lines); {
+		trimmed := strings.TrimSpace(lines[i])
+		if trimmed == "" || isComment(trimmed) || trimmed == "---" || trimmed == "..." || indentOf(lines[i]) > 0 {
+			i++
+			continue
+		}
+		key, value, ok := cutYAMLKey(trimmed)
+		if !ok {
+			i++
+			continue
+		}
+		end := yamlEnd(lines, i, 0)
+		e := entry{key: key, name: key, value: value, start: i, end: end}
+		for j := i + 1; j < end; j++ {
+			e.value += "\n" + lines[j]
+		}
+		d.entries = append(d.entries, e)
+		root.insertAt = end
+
+		if value == "" || isComment(value) {
+			d.parseYAMLMapping(key, i, end)
+		}
+		i = end
+	}
+	root.end = len(lines)
+	d.sections = append([]docSection{root}, d.sections...)
+}
+
+func (d *document) parseYAMLMapping(name string, header, end int) {
+	lines := d.lines
+	sec := docSection{name: name, header: header, end: end, insertAt: header + 1, childIndent: "  "}
+	childIndent := -1
+	for i := header + 1; i < end; {
+		trimmed := strings.TrimSpace(lines[i])
+		if trimmed == "" || isComment(trimmed) {
+			i++
+			continue
+		}
+		indent := indentOf(lines[i])
+		if childIndent < 0 {
+			childIndent = indent
+			sec.childIndent = lines[i][:indent]
+		}
+		key, value, ok := cutYAMLKey(trimmed)
+		if indent != childIndent || !ok {
+			i++
+			continue
+		}
+		childEnd := yamlEnd(lines[:end], i, indent)
+		e := entry{section: name, key: key, name: key, indent: sec.childIndent, value: value, start: i, end: childEnd}
+		for j := i + 1; j < childEnd; j++ {
+			e.value += "\n" + lines[j]
+		}
+		d.entries = append(d.entries, e)
+		sec.insertAt = childEnd
+		i = childEnd
+	}
+	d.sections = append(d.sections, sec)
+}
+
+// yamlEnd returns the line after the value of the key on line start,
+// whose indentation is indent. Trailing blank lines and comments are left
+// to whatever follows.
+func yamlEnd(lines []string, start, indent int) int {
+	end := start + 1
+	last := end
+	for ; end < len(lines); end++ {
+		trimmed := strings.TrimSpace(lines[end])
+		if trimmed == "" || isComment(trimmed) {
+			continue
+		}
+		deeper := indentOf(lines[end]) > indent
+		// A list may sit at the same indentation as its key.
+		if !deeper && !strings.HasPrefix(trimmed, "- ") && trimmed != "-" {
+			break
+		}
+		last = end + 1
+	}
+	return last
+}
+
+// cutYAMLKey splits "key: value" (or "key:").
+func cutYAMLKey(trimmed string) (key, value string, ok bool) {
+	if strings.HasPrefix(trimmed, "- ") {
+		return "", "", false
+	}
+	i := strings.Index(trimmed, ":")
+	if i <= 0 || (i+1 < len(trimmed) && trimmed[i+1] != ' ') {
+		return "", "", false
+	}
+	return strings.TrimSpace(trimmed[:i]), strings.TrimSpace(trimmed[i+1:]), true
+}
+
+// dropEmptySection removes the header of e's section from lines (after e
+// was removed) if no key is left in it. Comments keep a section alive.
+func dropEmptySection(doc *document, lines []string, e entry) []string {
+	if e.section == "" {
+		return lines
+	}
+	sec, ok := doc.section(e.section)
+	if !ok || sec.header < 0 {
+		return lines
+	}
+	for _, other := range doc.entries {
+		if other.section == e.section && other.start != e.start && other.start > sec.header && other.start < sec.end {
+			return lines
+		}
+	}
+	removed := e.end - e.start
+	end := sec.end - removed
+	for i := sec.header + 1; i < end; i++ {
+		if strings.TrimSpace(lines[i]) != "" {
+			return lines
+		}
+	}
+	// Drop the header, the blank lines in the section, and the blank line
+	// that separated it from what came before.
+	start := sec.header
+	if start > 0 && strings.TrimSpace(lines[start-1]) == "" {
+		start--
+	}
+	lines = splice(lines, start, end, nil)
+	for len(lines) > 0 && strings.TrimSpace(lines[len(lines)-1]) == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
@@ -0,0 +1,218 @@
+package fileutil
+
+import (
+	"strings"
+	"testing"
+)
+
+func strPtr(s string) *string { return &s }
+
+func mustSetKey(t *testing.T, format Format, content, section, name string, value *string) string {
+	t.Helper()
+	got, err := SetKey(format, content, section, name, value)
+	if err != nil {
+		t.Fatalf("SetKey(%s.%s) failed: %v", section, name, err)
+	}
+	return got
+}
+
+func TestSetKey_INIExistingSection(t *testing.T) {
+	content := "# pip settings\n[global]\ntimeout = 60\nindex-url = https://pypi.corp/simple\n\n[install]\nuser = true\n"
+
+	got := mustSetKey(t, INI, content, "global", "proxy", strPtr("http://proxy:8080"))
+	want := "# pip settings\n[global]\ntimeout = 60\nindex-url = https://pypi.corp/simple\nproxy = http://proxy:8080\n\n[install]\nuser = true\n"
+	if got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+	if n := strings.Count(got, "[global]"); n != 1 {
+		t.Errorf("[global] appears %d times", n)
+	}
+}
+
+func TestSetKey_INIReplaceInPlace(t *testing.T) {
+	content := "[global]\n; corporate proxy\nproxy=http://old:1234\ntimeout = 60\n"
+
+	got := mustSetKey(t, INI, content, "global", "proxy", strPtr("http://proxy:8080"))
+	want := "[global]\n; corporate proxy\nproxy = http://proxy:8080\ntimeout = 60\n"
+	if got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+	if v := GetKey(INI, content, "global", "proxy"); v == nil || *v != "http://old:1234" {
+		t.Errorf("GetKey = %v, want http://old:1234", v)
+	}
+}
+
+func TestSetKey_INIContinuationLines(t *testing.T) {
+	content := "[global]\nextra-index-url =\n    https://a.example/simple\n    https://b.example/simple\ntimeout = 60\n"
+
+	v := GetKey(INI, content, "global", "extra-index-url")
+	if v == nil || !strings.Contains(*v, "https://b.example/simple") {
+		t.Fatalf("GetKey = %v, want the continuation lines", v)
+	}
+	got := mustSetKey(t, INI, content, "global", "extra-index-url", nil)
+	if got != "[global]\ntimeout = 60\n" {
+		t.Errorf("got:\n%s", got)
+	}
+}
+
+func TestSetKey_NewSection(t *testing.T) {
+	got := mustSetKey(t, INI, "[install]\nuser = true\n\n", "global", "proxy", strPtr("http://proxy:8080"))
+	want := "[install]\nuser = true\n\n[global]\nproxy = http://proxy:8080\n"
+	if got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+
+	got = mustSetKey(t, INI, "", "global", "proxy", strPtr("http://proxy:8080"))
+	if got != "[global]\nproxy = http://proxy:8080\n" {
+		t.Errorf("empty file: got:\n%s", got)
+	}
+}
+
+func TestSetKey_DeleteDropsEmptySection(t *testing.T) {
+	content := "[install]\nuser = true\n\n[global]\nproxy = http://proxy:8080\n"
+
+	got := mustSetKey(t, INI, content, "global", "proxy", nil)
+	if got != "[install]\nuser = true\n" {
+		t.Errorf("got:\n%s", got)
+	}
+
+	// A comment keeps the section.
+	content = "[global]\n# keep me\nproxy = http://proxy:8080\n"
+	got = mustSetKey(t, INI, content, "global", "proxy", nil)
+	if got != "[global]\n# keep me\n" {
+		t.Errorf("got:\n%s", got)
+	}
+
+	// Deleting a missing key is a no-op.
+	got = mustSetKey(t, INI, content, "global", "cert", nil)
+	if got != content {
+		t.Errorf("got:\n%s", got)
+	}
+}
+
+func TestKeyValues_Duplicates(t *testing.T) {
+	content := "[global]\nproxy = a\n\n[global]\nproxy = b\n"
+	values := KeyValues(INI, content, "global", "proxy")
+	if len(values) != 2 || values[0] != "a" || values[1] != "b" {
+		t.Errorf("KeyValues = %v", values)
+	}
+}
+
+func TestSetKey_TOMLMultiLineArray(t *testing.T) {
+	content := `[containers]
+# user settings
+env = [
+  "FOO=bar",
+  "BAZ=[qux]",
+]
+log_size_max = -1
+
+[engine]
+cgroup_manager = "systemd"
+`
+	v := GetKey(TOML, content, "containers", "env")
+	if v == nil || !strings.HasSuffix(*v, "]") || !strings.Contains(*v, `"BAZ=[qux]"`) {
+		t.Fatalf("GetKey = %v, want the whole array", v)
+	}
+
+	got := mustSetKey(t, TOML, content, "containers", "env", strPtr("[\n  \"http_proxy=http://proxy:8080\",\n]"))
+	want := `[containers]
+# user settings
+env = [
+  "http_proxy=http://proxy:8080",
+]
+log_size_max = -1
+
+[engine]
+cgroup_manager = "systemd"
+`
+	if got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestSetKey_TOMLExistingTable(t *testing.T) {
+	content := "[http]\ntimeout = 30 # seconds\n\n[net]\nretry = 3\n"
+
+	got := mustSetKey(t, TOML, content, "http", "proxy", strPtr(`"http://proxy:8080"`))
+	want := "[http]\ntimeout = 30 # seconds\nproxy = \"http://proxy:8080\"\n\n[net]\nretry = 3\n"
+	if got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestSetKey_TOMLDottedKeys(t *testing.T) {
+	content := "http.timeout = 30\n\n[net]\nretry = 3\n"
+
+	got := mustSetKey(t, TOML, content, "http", "proxy", strPtr(`"http://proxy:8080"`))
+	want := "http.timeout = 30\nhttp.proxy = \"http://proxy:8080\"\n\n[net]\nretry = 3\n"
+	if got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+	if v := GetKey(TOML, got, "http", "proxy"); v == nil || *v != `"http://proxy:8080"` {
+		t.Errorf("GetKey = %v", v)
+	}
+}
+
+func TestSetKey_InlineTableRefused(t *testing.T) {
+	if _, err := SetKey(TOML, "http = { timeout = 30 }\n", "http", "proxy", strPtr(`"x"`)); err == nil {
+		t.Error("expected an error for an inline table")
+	}
+	if _, err := SetKey(YAML, "proxy_servers: {http: x}\n", "proxy_servers", "https", strPtr("x")); err == nil {
+		t.Error("expected an error for a flow mapping")
+	}
+}
+
+func TestSetKey_YAMLNested(t *testing.T) {
+	content := `# conda settings
+channels:
+  - defaults
+proxy_servers:
+    http: http://old:1234   # office
+ssl_verify: true
+`
+	got := mustSetKey(t, YAML, content, "proxy_servers", "http", strPtr("http://proxy:8080"))
+	got = mustSetKey(t, YAML, got, "proxy_servers", "https", strPtr("http://proxy:8443"))
+	got = mustSetKey(t, YAML, got, "", "ssl_verify", strPtr("/tmp/ca.pem"))
+	want := `# conda settings
+channels:
+  - defaults
+proxy_servers:
+    http: http://proxy:8080
+    https: http://proxy:8443
+ssl_verify: /tmp/ca.pem
+`
+	if got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+	if n := strings.Count(got, "proxy_servers:"); n != 1 {
+		t.Errorf("proxy_servers appears %d times", n)
+	}
+	if v := GetKey(YAML, content, "", "channels"); v == nil || !strings.Contains(*v, "- defaults") {
+		t.Errorf("GetKey(channels) = %v", v)
+	}
+}
+
+func TestSetKey_YAMLNewMapping(t *testing.T) {
+	content := "channels:\n- defaults\n"
+
+	got := mustSetKey(t, YAML, content, "proxy_servers", "http", strPtr("http://proxy:8080"))
+	want := "channels:\n- defaults\n\nproxy_servers:\n  http: http://proxy:8080\n"
+	if got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+
+	got = mustSetKey(t, YAML, got, "proxy_servers", "http", nil)
+	if got != content {
+		t.Errorf("after delete got:\n%s\nwant:\n%s", got, content)
+	}
+}
+
+func TestParseKeyID(t *testing.T) {
+	for _, k := range []Key{{"global", "proxy", ""}, {"", "ssl_verify", ""}, {"a.b", "c", ""}} {
+		section, name := ParseKeyID(k.ID())
+		if section != k.Section || name != k.Name {
+			t.Errorf("ParseKeyID(%q) = %q, %q", k.ID(), section, name)
+		}
+	}
+}
@@ -0,0 +1,159 @@
+package fileutil
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// XMLNode is an element of a document read by ParseXML. It records where
+// the element sits in the original bytes, so callers can splice in changes
+// and leave everything else (comments, attributes, namespaces, layout)
+// exactly as it was.
+type XMLNode struct {
+	Name     string // local name, without namespace prefix
+	Start    int    // offset of "<name"
+	End      int    // offset just past the closing tag (or "/>")
+	Inner    int    // offset just past the start tag
+	InnerEnd int    // offset of the closing tag; equal to Inner for <name/>
+	Children []*XMLNode
+	text     strings.Builder
+}
+
+// SelfClosing reports whether the element is written as <name/>.
+func (n *XMLNode) SelfClosing() bool {
+	return n.InnerEnd == n.End
+}
+
+// Child returns the first child element with the given name, or nil.
+func (n *XMLNode) Child(name string) *XMLNode {
+	for _, c := range n.Children {
+		if c.Name == name {
+			return c
+		}
+	}
+	return nil
+}
+
+// Text returns the element's character data with entities decoded and
+// surrounding whitespace trimmed.
+func (n *XMLNode) Text() string {
+	return strings.TrimSpace(n.text.String())
+}
+
+// ParseXML reads a document and returns its root element. Unlike
+// xml.Unmarshal it rejects anything that isn't well-formed, including
+// trailing content after the root, so a caller never rewrites a file it
+// only partly understood.
+func ParseXML(data []byte) (*XMLNode, error) {
+	d := xml.NewDecoder(bytes.NewReader(data))
+	var root *XMLNode
+	var stack []*XMLNode
+	for {
+		start := int(d.InputOffset())
+		tok, err := d.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		end := int(d.InputOffset())
+		switch t := tok.(type) {
+		case xml.StartElement:
+			if len(stack) == 0 && root != nil {
+				line := bytes.Count(data[:start], []byte("\n")) + 1
+				return nil, fmt.Errorf("XML syntax error on line %d: content after the root element", line)
+			}
+			n := &XMLNode{Name: t.Name.Local, Start: start, Inner: end}
+			if len(stack) == 0 {
+				root = n
+			} else {
+				parent := stack[len(stack)-1]
+				parent.Children = append(parent.Children, n)
+			}
+			stack = append(stack, n)
+		case xml.EndElement:
+			n := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+			n.InnerEnd, n.End = start, end
+		case xml.CharData:
+			if len(stack) > 0 {
+				stack[len(stack)-1].text.Write(t)
+			} else if len(bytes.TrimSpace(t)) > 0 {
+				line := bytes.Count(data[:start], []byte("\n")) + 1
+				return nil, fmt.Errorf("XML syntax error on line %d: text outside the root element", line)
+			}
+		}
+	}
+	if root == nil {
+		return nil, errors.New("XML syntax error: no root element")
+	}
+	return root, nil
+}
+
+// XMLEdit replaces the bytes [Start, End) of a document with Text.
+type XMLEdit struct {
+	Start, End int
+	Text       string
+}
+
+// ApplyXMLEdits returns data with the edits applied. Edits must not
+// overlap; they may be given in any order.
+func ApplyXMLEdits(data []byte, edits []XMLEdit) []byte {
+	sorted := append([]XMLEdit(nil), edits...)
+	sort.SliceStable(sorted, func(i, j int) bool { return sorted[i].Start < sorted[j].Start })
+	var b bytes.Buffer
+	pos := 0
+	for _, e := range sorted {
+		b.Write(data[pos:e.Start])
+		b.WriteString(e.Text)
+		pos = e.End
+	}
+	b.Write(data[pos:])
+	return b.Bytes()
+}
+
+// LineIndent returns the whitespace between the start of the line holding
+// offset and offset itself, or "" if anything else precedes it on the line.
+func LineIndent(data []byte, offset int) string {
+	i := offset
+	for i > 0 && (data[i-1] == ' ' || data[i-1] == '\t') {
+		i--
+	}
+	if i > 0 && data[i-1] != '\n' {
+		return ""
+	}
+	return string(data[i:offset])
+}
+
+// LineStart returns the offset to cut from to remove the element at offset
+// along with its own line: it backs up over the indentation and the line
+// break before it, if the element starts its line.
+func LineStart(data []byte, offset int) int {
+	i := offset
+	for i > 0 && (data[i-1] == ' ' || data[i-1] == '\t') {
+		i--
+	}
+	if i == 0 || data[i-1] != '\n' {
+		return offset
+	}
+	i--
+	if i > 0 && data[i-1] == '\r' {
+		i--
+	}
+	return i
+}
+
+// Newline returns the line ending data uses: "\r\n" if it has any, "\n"
+// otherwise.
+func Newline(data []byte) string {
+	if bytes.Contains(data, []byte("\r\n")) {
+		return "\r\n"
+	}
+	return "\n"
+}
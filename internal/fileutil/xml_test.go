@@ -0,0 +1,76 @@
+package fileutil
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseXML_Offsets(t *testing.T) {
+	data := []byte("<?xml version=\"1.0\"?>\n<!-- top -->\n<settings xmlns=\"urn:x\">\n  <proxies/>\n  <id>a &amp; b</id>\n</settings>\n")
+	root, err := ParseXML(data)
+	if err != nil {
+		t.Fatalf("ParseXML: %v", err)
+	}
+	if root.Name != "settings" || len(root.Children) != 2 {
+		t.Fatalf("root = %s with %d children", root.Name, len(root.Children))
+	}
+	if got := string(data[root.Start:root.End]); !strings.HasPrefix(got, "<settings") || !strings.HasSuffix(got, "</settings>") {
+		t.Errorf("root span = %q", got)
+	}
+
+	proxies := root.Child("proxies")
+	if !proxies.SelfClosing() || string(data[proxies.Start:proxies.End]) != "<proxies/>" {
+		t.Errorf("proxies span = %q", data[proxies.Start:proxies.End])
+	}
+	id := root.Child("id")
+	if id.SelfClosing() || id.Text() != "a & b" {
+		t.Errorf("id text = %q", id.Text())
+	}
+	if got := string(data[id.Inner:id.InnerEnd]); got != "a &amp; b" {
+		t.Errorf("id inner = %q", got)
+	}
+}
+
+func TestParseXML_Malformed(t *testing.T) {
+	for _, doc := range []string{
+		"",
+		"<settings><proxies></settings>",
+		"<settings></settings><extra/>",
+		"<settings></settings>trailing",
+		"<settings>&nbsp;</settings>",
+		"<settings>\n  <id>x</id\n</settings>",
+	} {
+		if _, err := ParseXML([]byte(doc)); err == nil {
+			t.Errorf("ParseXML(%q) succeeded", doc)
+		}
+	}
+}
+
+func TestApplyXMLEdits(t *testing.T) {
+	data := []byte("<a>\n  <b/>\n  <c/>\n</a>\n")
+	root, _ := ParseXML(data)
+	b, c := root.Children[0], root.Children[1]
+
+	got := ApplyXMLEdits(data, []XMLEdit{
+		{Start: c.End, End: c.End, Text: "\n  <d/>"},
+		{Start: LineStart(data, b.Start), End: b.End},
+	})
+	if string(got) != "<a>\n  <c/>\n  <d/>\n</a>\n" {
+		t.Errorf("got %q", got)
+	}
+	if indent := LineIndent(data, c.Start); indent != "  " {
+		t.Errorf("LineIndent = %q", indent)
+	}
+}
+
+func TestLineStart_CRLF(t *testing.T) {
+	data := []byte("<a>\r\n\t<b/>\r\n</a>")
+	root, _ := ParseXML(data)
+	b := root.Children[0]
+	if got := LineStart(data, b.Start); got != 3 {
+		t.Errorf("LineStart = %d, want 3", got)
+	}
+	if Newline(data) != "\r\n" {
+		t.Error("Newline should detect CRLF")
+	}
+}
@@ -0,0 +1,213 @@
+package noproxy
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// Dialect is how one tool reads a bypass list: the separator it expects
+// and which kinds of entry it understands.
+type Dialect struct {
+	Name string // shown in warnings, e.g. "wget"
+	Sep  string
+
+	prefix  string // written before every entry ("!" for ssh)
+	domain  string // written before a domain: "." or "*."; "" if unsupported
+	all     bool   // understands "*"
+	ports   bool   // understands host:port
+	cidr    bool   // understands IPv4 ranges
+	cidr6   bool   // understands IPv6 ranges
+	octets  bool   // writes IPv4 ranges as 10.* wildcards
+	globs   bool   // understands * anywhere in a host name
+	edges   bool   // understands * at the start or end of a host name
+	nothing bool   // has no bypass list at all
+}
+
+// The dialects of the tools ezproxy configures.
+var (
+	// Env is the NO_PROXY environment variable. It is read by many tools
+	// at once, so it keeps every entry in the form Go and most others
+	// take; each reader's own limits are reported for that reader.
+	Env = Dialect{Name: "NO_PROXY", Sep: ",", domain: ".", all: true, ports: true, cidr: true, cidr6: true}
+
+	// Go is Go's net/http (docker, podman, go).
+	Go = Dialect{Name: "Go", Sep: ",", domain: ".", all: true, ports: true, cidr: true, cidr6: true}
+
+	// Curl is libcurl (curl, git, cargo, brew). Ranges need curl 7.86.
+	Curl = Dialect{Name: "curl", Sep: ",", domain: ".", all: true, cidr: true, cidr6: true}
+
+	// Wget matches domain suffixes only.
+	Wget = Dialect{Name: "wget", Sep: ",", domain: "."}
+
+	// Npm matches domain suffixes (npm, yarn).
+	Npm = Dialect{Name: "npm", Sep: ",", domain: ".", all: true}
+
+	// Python is requests and urllib (pip, conda).
+	Python = Dialect{Name: "Python", Sep: ",", domain: ".", all: true, ports: true, cidr: true}
+
+	// Ruby is Net::HTTP (bundler).
+	Ruby = Dialect{Name: "Ruby", Sep: ",", domain: ".", ports: true, cidr: true, cidr6: true}
+
+	// Java is the nonProxyHosts property (gradle, maven).
+	Java = Dialect{Name: "Java", Sep: "|", domain: "*.", all: true, octets: true, edges: true}
+
+	// SSH writes negated Host patterns after "Host *".
+	SSH = Dialect{Name: "ssh", Sep: " ", prefix: "!", domain: "*.", all: true, octets: true, globs: true}
+
+	// Apt can only send single hosts direct.
+	Apt = Dialect{Name: "apt", Sep: "\n"}
+
+	// None is a tool with no bypass list (yum, snap).
+	None = Dialect{Name: "none", nothing: true}
+)
+
+// Problem is an entry a dialect can't express as written.
+type Problem struct {
+	Entry string // "" for the list as a whole
+	Note  string
+}
+
+func (p Problem) String() string {
+	if p.Entry == "" {
+		return p.Note
+	}
+	return p.Entry + ": " + p.Note
+}
+
+// Format renders l and joins the entries with the dialect's separator.
+func (d Dialect) Format(l List) string {
+	entries, _ := d.Render(l)
+	return strings.Join(entries, d.Sep)
+}
+
+// Render returns l in the dialect, entry by entry, and what it had to
+// change or drop. Entries the tool can't express are approximated where
+// the result still bypasses the same hosts, possibly more, and dropped
+// otherwise, so those hosts keep going through the proxy.
+func (d Dialect) Render(l List) ([]string, []Problem) {
+	if d.nothing {
+		if len(l) == 0 {
+			return nil, nil
+		}
+		return nil, []Problem{{Note: "no NO_PROXY support; every host goes through the proxy"}}
+	}
+	var out []string
+	var problems []Problem
+	seen := make(map[string]bool)
+	add := func(s string) {
+		if s = d.prefix + s; !seen[s] {
+			seen[s] = true
+			out = append(out, s)
+		}
+	}
+	for _, e := range l {
+		entries, note := d.entry(e)
+		for _, s := range entries {
+			add(s)
+		}
+		if note != "" {
+			problems = append(problems, Problem{Entry: e.Raw, Note: note})
+		}
+	}
+	return out, problems
+}
+
+// entry renders one entry, with a note if it isn't exact.
+func (d Dialect) entry(e Entry) ([]string, string) {
+	var note string
+	if e.Port != "" && !d.ports {
+		note = "ports not supported; bypassed on every port"
+	}
+	switch e.Kind {
+	case Invalid:
+		return nil, "not a valid NO_PROXY entry; ignored"
+	case All:
+		if d.all {
+			return []string{"*"}, ""
+		}
+		return nil, "* not supported; ignored"
+	case Host, IP:
+		return []string{d.withPort(e.Host, e.Port)}, note
+	case Domain:
+		if d.domain == "" {
+			return nil, "domain suffixes not supported; ignored"
+		}
+		return []string{d.withPort(d.domain+e.Host, e.Port)}, note
+	case Pattern:
+		return d.pattern(e, note)
+	case CIDR:
+		return d.cidrs(e)
+	}
+	return nil, ""
+}
+
+func (d Dialect) withPort(host, port string) string {
+	if port == "" || !d.ports {
+		return host
+	}
+	return net.JoinHostPort(host, port)
+}
+
+// pattern renders a host with wildcards. Where the tool can't take it,
+// the part after the last * stands in if it is a domain, so
+// build-*.corp.com becomes .corp.com.
+func (d Dialect) pattern(e Entry, note string) ([]string, string) {
+	inner := strings.Trim(e.Host, "*")
+	if d.globs || d.edges && !strings.Contains(inner, "*") {
+		return []string{e.Host}, note
+	}
+	suffix := e.Host[strings.LastIndex(e.Host, "*")+1:]
+	if d.domain == "" || !strings.HasPrefix(suffix, ".") || !strings.Contains(suffix[1:], ".") {
+		return nil, "wildcards not supported; ignored"
+	}
+	s := d.domain + suffix[1:]
+	return []string{s}, "wildcards not supported; approximated as " + s
+}
+
+// cidrs renders an address range: as written, as 10.* style wildcards, or
+// not at all.
+func (d Dialect) cidrs(e Entry) ([]string, string) {
+	v4 := e.Net.IP.To4() != nil
+	switch {
+	case v4 && d.cidr, !v4 && d.cidr6:
+		return []string{e.Net.String()}, ""
+	case v4 && d.octets:
+		return octetPatterns(e.Net), ""
+	}
+	return nil, "address ranges not supported; ignored"
+}
+
+// octetPatterns writes an IPv4 range as wildcards on octet boundaries:
+// 10.0.0.0/8 is 10.*, and 172.16.0.0/12 is 172.16.* to 172.31.*.
+func octetPatterns(n *net.IPNet) []string {
+	ip := n.IP.To4()
+	ones, _ := n.Mask.Size()
+	full, rem := ones/8, ones%8
+	prefix := func(octets []byte) string {
+		parts := make([]string, len(octets))
+		for i, o := range octets {
+			parts[i] = fmt.Sprint(o)
+		}
+		return strings.Join(parts, ".")
+	}
+	if rem == 0 {
+		switch full {
+		case 0:
+			return []string{"*"}
+		case 4:
+			return []string{prefix(ip)}
+		}
+		return []string{prefix(ip[:full]) + ".*"}
+	}
+	var out []string
+	for i := 0; i < 1<<(8-rem); i++ {
+		octets := append(append([]byte(nil), ip[:full]...), ip[full]+byte(i))
+		if s := prefix(octets); full == 3 {
+			out = append(out, s)
+		} else {
+			out = append(out, s+".*")
+		}
+	}
+	return out
+}
@@ -0,0 +1,93 @@
+package noproxy
+
+import (
+	"strings"
+	"testing"
+)
+
+const corp = "localhost,127.0.0.1,.corp.com,git.corp.com,intranet:8443,10.0.0.0/8,172.16.0.0/12,fd00::/8,build-*.lab.corp.com"
+
+func TestRender(t *testing.T) {
+	tests := []struct {
+		d        Dialect
+		want     string
+		problems []string // entries reported
+	}{
+		{Env, "localhost,127.0.0.1,.corp.com,git.corp.com,intranet:8443,10.0.0.0/8,172.16.0.0/12,fd00::/8,.lab.corp.com",
+			[]string{"build-*.lab.corp.com"}},
+		{Curl, "localhost,127.0.0.1,.corp.com,git.corp.com,intranet,10.0.0.0/8,172.16.0.0/12,fd00::/8,.lab.corp.com",
+			[]string{"intranet:8443", "build-*.lab.corp.com"}},
+		{Wget, "localhost,127.0.0.1,.corp.com,git.corp.com,intranet,.lab.corp.com",
+			[]string{"intranet:8443", "10.0.0.0/8", "172.16.0.0/12", "fd00::/8", "build-*.lab.corp.com"}},
+		{Python, "localhost,127.0.0.1,.corp.com,git.corp.com,intranet:8443,10.0.0.0/8,172.16.0.0/12,.lab.corp.com",
+			[]string{"fd00::/8", "build-*.lab.corp.com"}},
+		{Java, "localhost|127.0.0.1|*.corp.com|git.corp.com|intranet|10.*|" +
+			"172.16.*|172.17.*|172.18.*|172.19.*|172.20.*|172.21.*|172.22.*|172.23.*|" +
+			"172.24.*|172.25.*|172.26.*|172.27.*|172.28.*|172.29.*|172.30.*|172.31.*|*.lab.corp.com",
+			[]string{"intranet:8443", "fd00::/8", "build-*.lab.corp.com"}},
+		{SSH, "!localhost !127.0.0.1 !*.corp.com !git.corp.com !intranet !10.* " +
+			"!172.16.* !172.17.* !172.18.* !172.19.* !172.20.* !172.21.* !172.22.* !172.23.* " +
+			"!172.24.* !172.25.* !172.26.* !172.27.* !172.28.* !172.29.* !172.30.* !172.31.* !build-*.lab.corp.com",
+			[]string{"intranet:8443", "fd00::/8"}},
+		{Apt, "localhost\n127.0.0.1\ngit.corp.com\nintranet",
+			[]string{".corp.com", "intranet:8443", "10.0.0.0/8", "172.16.0.0/12", "fd00::/8", "build-*.lab.corp.com"}},
+		{None, "", []string{""}},
+	}
+	for _, tt := range tests {
+		entries, problems := tt.d.Render(Parse(corp))
+		if got := strings.Join(entries, tt.d.Sep); got != tt.want {
+			t.Errorf("%s:\n got %s\nwant %s", tt.d.Name, got, tt.want)
+		}
+		var reported []string
+		for _, p := range problems {
+			reported = append(reported, p.Entry)
+		}
+		if strings.Join(reported, ",") != strings.Join(tt.problems, ",") {
+			t.Errorf("%s: problems for %q, want %q", tt.d.Name, reported, tt.problems)
+		}
+	}
+}
+
+func TestRender_Notes(t *testing.T) {
+	_, problems := Wget.Render(Parse("*,10.0.0.0/8,bad entry,build-*.lab.corp.com,ci-*"))
+	var notes []string
+	for _, p := range problems {
+		notes = append(notes, p.String())
+	}
+	want := []string{
+		"*: * not supported; ignored",
+		"10.0.0.0/8: address ranges not supported; ignored",
+		"bad entry: not a valid NO_PROXY entry; ignored",
+		"build-*.lab.corp.com: wildcards not supported; approximated as .lab.corp.com",
+		"ci-*: wildcards not supported; ignored",
+	}
+	if strings.Join(notes, "\n") != strings.Join(want, "\n") {
+		t.Errorf("notes:\n%s", strings.Join(notes, "\n"))
+	}
+	if entries, problems := None.Render(nil); entries != nil || problems != nil {
+		t.Errorf("None with an empty list = %v, %v", entries, problems)
+	}
+}
+
+func TestOctetPatterns(t *testing.T) {
+	tests := map[string]string{
+		"0.0.0.0/0":      "*",
+		"10.1.0.0/16":    "10.1.*",
+		"10.1.2.3/32":    "10.1.2.3",
+		"192.168.1.0/30": "192.168.1.0,192.168.1.1,192.168.1.2,192.168.1.3",
+		"100.64.0.0/10":  "", // checked by count below
+		"192.168.0.0/23": "192.168.0.*,192.168.1.*",
+	}
+	for cidr, want := range tests {
+		got := octetPatterns(ParseEntry(cidr).Net)
+		if cidr == "100.64.0.0/10" {
+			if len(got) != 64 || got[0] != "100.64.*" || got[63] != "100.127.*" {
+				t.Errorf("%s = %v", cidr, got)
+			}
+			continue
+		}
+		if strings.Join(got, ",") != want {
+			t.Errorf("%s = %v, want %s", cidr, got, want)
+		}
+	}
+}
@@ -0,0 +1,179 @@
+// Package noproxy parses the NO_PROXY list in config.yaml and writes it in
+// the form each tool understands. Tools disagree on nearly everything: Go
+// takes CIDR ranges and ports, wget only matches domain suffixes, Java
+// wants "*.corp.com" separated by "|", and apt can only send single hosts
+// direct. A Dialect describes one tool's rules; Render expands or
+// approximates entries it can't take as written and reports the ones it
+// can't honour at all.
+package noproxy
+
+import (
+	"net"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// Kind is what an entry matches.
+type Kind int
+
+const (
+	Invalid Kind = iota
+	All          // "*": every host
+	Host         // a host name, and by convention its subdomains
+	Domain       // ".corp.com" or "*.corp.com": hosts under corp.com
+	Pattern      // a host name with * elsewhere, e.g. build-*.corp.com
+	IP           // an IPv4 or IPv6 address
+	CIDR         // an address range: 10.0.0.0/8, or 10.* as Java writes it
+)
+
+// Entry is one parsed NO_PROXY entry.
+type Entry struct {
+	Raw  string
+	Kind Kind
+	Host string     // lower case: host, domain without the leading dot, pattern or IP
+	Port string     // "" for every port
+	Net  *net.IPNet // for CIDR
+}
+
+// List is a parsed NO_PROXY value.
+type List []Entry
+
+var (
+	hostRe  = regexp.MustCompile(`^[a-z0-9_*]([a-z0-9_.*-]*[a-z0-9_*])?$`)
+	octetRe = regexp.MustCompile(`^(\d{1,3}\.){1,3}\*(\.\*)*$`)
+	portRe  = regexp.MustCompile(`^\d{1,5}$`)
+)
+
+// Parse splits a comma-separated NO_PROXY value into entries, skipping
+// empty ones. Entries that aren't valid are kept as Invalid so they can be
+// reported.
+func Parse(s string) List {
+	var l List
+	for _, raw := range strings.Split(s, ",") {
+		if raw = strings.TrimSpace(raw); raw != "" {
+			l = append(l, ParseEntry(raw))
+		}
+	}
+	return l
+}
+
+// ParseEntry parses a single NO_PROXY entry.
+func ParseEntry(raw string) Entry {
+	e := Entry{Raw: raw}
+	s := strings.ToLower(strings.TrimSpace(raw))
+	switch {
+	case s == "*":
+		e.Kind = All
+		return e
+	case strings.Contains(s, "/"):
+		if _, n, err := net.ParseCIDR(strings.Trim(s, "[]")); err == nil {
+			e.Kind, e.Net, e.Host = CIDR, n, n.String()
+		}
+		return e
+	case octetRe.MatchString(s):
+		return octetEntry(e, s)
+	}
+
+	host := s
+	if h, port, err := net.SplitHostPort(s); err == nil {
+		if !portRe.MatchString(port) {
+			return e
+		}
+		host, e.Port = h, port
+	}
+	host = strings.Trim(host, "[]")
+	if ip := net.ParseIP(host); ip != nil {
+		e.Kind, e.Host = IP, ip.String()
+		return e
+	}
+	name := host
+	if strings.HasPrefix(host, "*.") || strings.HasPrefix(host, ".") {
+		name = host[strings.Index(host, ".")+1:]
+	}
+	switch {
+	case !hostRe.MatchString(strings.TrimPrefix(host, ".")) || name == "":
+	case host != name && !strings.Contains(name, "*"):
+		e.Kind, e.Host = Domain, name
+	case strings.Contains(host, "*"):
+		e.Kind, e.Host = Pattern, host
+	default:
+		e.Kind, e.Host = Host, host
+	}
+	return e
+}
+
+// octetEntry turns an IPv4 prefix written with wildcards, such as 10.* or
+// 192.168.*.*, into the CIDR range it stands for.
+func octetEntry(e Entry, s string) Entry {
+	fixed := strings.Split(strings.TrimRight(s, ".*"), ".")
+	full := append(fixed, make([]string, 4-len(fixed))...)
+	for i := len(fixed); i < 4; i++ {
+		full[i] = "0"
+	}
+	ip := net.ParseIP(strings.Join(full, ".")).To4()
+	if ip == nil {
+		return e
+	}
+	e.Kind = CIDR
+	e.Net = &net.IPNet{IP: ip, Mask: net.CIDRMask(8*len(fixed), 32)}
+	e.Host = e.Net.String()
+	return e
+}
+
+// Match reports whether addr (a host or host:port) bypasses the proxy. A
+// host name entry also matches its subdomains, as curl and Go do. An
+// entry's port only counts when addr has one.
+func (l List) Match(addr string) bool {
+	host, port := addr, ""
+	if h, p, err := net.SplitHostPort(addr); err == nil {
+		host, port = h, p
+	}
+	host = strings.ToLower(strings.Trim(host, "[]"))
+	ip := net.ParseIP(host)
+	for _, e := range l {
+		if e.match(host, port, ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func (e Entry) match(host, port string, ip net.IP) bool {
+	if e.Port != "" && port != "" && e.Port != port {
+		return false
+	}
+	switch e.Kind {
+	case All:
+		return true
+	case CIDR:
+		return ip != nil && e.Net.Contains(ip)
+	case IP:
+		return ip != nil && ip.Equal(net.ParseIP(e.Host))
+	case Host, Domain:
+		return ip == nil && (host == e.Host || strings.HasSuffix(host, "."+e.Host))
+	case Pattern:
+		ok, _ := path.Match(e.Host, host)
+		return ok
+	}
+	return false
+}
+
+// String returns the entry in its usual NO_PROXY form.
+func (e Entry) String() string {
+	var s string
+	switch e.Kind {
+	case Invalid:
+		return e.Raw
+	case All:
+		return "*"
+	case Domain:
+		s = "." + e.Host
+	default:
+		s = e.Host
+	}
+	if e.Port != "" {
+		return net.JoinHostPort(s, e.Port)
+	}
+	return s
+}
@@ -0,0 +1,69 @@
+package noproxy
+
+import "testing"
+
+func TestParseEntry(t *testing.T) {
+	tests := []struct {
+		raw        string
+		kind       Kind
+		host, port string
+	}{
+		{"*", All, "", ""},
+		{"localhost", Host, "localhost", ""},
+		{"Git.Corp.com", Host, "git.corp.com", ""},
+		{".corp.com", Domain, "corp.com", ""},
+		{"*.corp.com", Domain, "corp.com", ""},
+		{"build-*.corp.com", Pattern, "build-*.corp.com", ""},
+		{"*corp.com", Pattern, "*corp.com", ""},
+		{"intranet:8443", Host, "intranet", "8443"},
+		{".corp.com:8080", Domain, "corp.com", "8080"},
+		{"10.1.2.3", IP, "10.1.2.3", ""},
+		{"::1", IP, "::1", ""},
+		{"[fd00::1]:443", IP, "fd00::1", "443"},
+		{"10.0.0.0/8", CIDR, "10.0.0.0/8", ""},
+		{"fd00::/8", CIDR, "fd00::/8", ""},
+		{"192.168.*", CIDR, "192.168.0.0/16", ""},
+		{"172.16.*.*", CIDR, "172.16.0.0/16", ""},
+		{"10.0.0.0/33", Invalid, "", ""},
+		{"corp .com", Invalid, "", ""},
+		{"host:port", Invalid, "", ""},
+		{"a'b.com", Invalid, "", ""},
+		{".", Invalid, "", ""},
+	}
+	for _, tt := range tests {
+		e := ParseEntry(tt.raw)
+		if e.Kind != tt.kind || e.Host != tt.host || e.Port != tt.port {
+			t.Errorf("ParseEntry(%q) = %v %q %q, want %v %q %q", tt.raw, e.Kind, e.Host, e.Port, tt.kind, tt.host, tt.port)
+		}
+	}
+}
+
+func TestMatch(t *testing.T) {
+	l := Parse("localhost, .corp.com,example.org,10.0.0.0/8,::1,intranet:8443,build-*.lab.net,192.168.*")
+	tests := map[string]bool{
+		"localhost:80":        true,
+		"git.corp.com:443":    true,
+		"corp.com":            true,
+		"notcorp.com":         false,
+		"a.example.org":       true,
+		"10.1.2.3:22":         true,
+		"11.1.2.3":            false,
+		"[::1]:8080":          true,
+		"intranet":            true,
+		"intranet:8443":       true,
+		"intranet:443":        false,
+		"build-7.lab.net":     true,
+		"test-7.lab.net":      false,
+		"192.168.4.5":         true,
+		"LOCALHOST":           true,
+		"evil.com.corp.com.x": false,
+	}
+	for addr, want := range tests {
+		if got := l.Match(addr); got != want {
+			t.Errorf("Match(%q) = %v, want %v", addr, got, want)
+		}
+	}
+	if !Parse("*").Match("anything") {
+		t.Error(`"*" should match everything`)
+	}
+}
@@ -0,0 +1,232 @@
+package pac
+
+import (
+	"fmt"
+	"net"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/andrew/ezproxy/internal/config"
+)
+
+// DefaultSamples are public hosts whose routing decides which proxy the
+// tools get.
+var DefaultSamples = []string{"www.google.com", "github.com", "pypi.org", "registry.npmjs.org", "proxy.golang.org"}
+
+// Route is the PAC decision for one URL.
+type Route struct {
+	URL    string `json:"url"`
+	Result string `json:"result"` // raw FindProxyForURL result
+}
+
+// Via returns the entry a client tries first.
+func (r Route) Via() Proxy {
+	return First(r.Result)
+}
+
+// Direct reports whether the URL is reached without a proxy.
+func (r Route) Direct() bool {
+	return r.Via().Type == "DIRECT"
+}
+
+// Route evaluates the script for https://host/, or http://host/ when
+// secure is false.
+func (s *Script) Route(host string, secure bool) (Route, error) {
+	scheme := "http"
+	if secure {
+		scheme = "https"
+	}
+	u := scheme + "://" + host + "/"
+	if strings.Contains(host, ":") && net.ParseIP(host) != nil {
+		u = scheme + "://[" + host + "]/"
+	}
+	result, err := s.FindProxyForURL(u, host)
+	return Route{URL: u, Result: result}, err
+}
+
+// Derived holds the static settings derived from a PAC script and every
+// evaluation that went into them.
+type Derived struct {
+	Proxy  config.ProxyConfig
+	Routes []Route
+}
+
+// Derive evaluates the script for DefaultSamples to pick the HTTP and
+// HTTPS proxies (the one most samples use), then for the hosts and
+// networks the script itself names and the known NO_PROXY entries. Each
+// entry the script sends direct goes into NO_PROXY, after localhost.
+func (s *Script) Derive(known []string) (*Derived, error) {
+	d := &Derived{}
+	var httpVotes, httpsVotes votes
+	for _, host := range DefaultSamples {
+		for _, secure := range []bool{false, true} {
+			r, err := s.Route(host, secure)
+			if err != nil {
+				return nil, err
+			}
+			d.Routes = append(d.Routes, r)
+			if secure {
+				httpsVotes.add(r.Via().URL())
+			} else {
+				httpVotes.add(r.Via().URL())
+			}
+		}
+	}
+	d.Proxy.HTTP, d.Proxy.HTTPS = httpVotes.winner(), httpsVotes.winner()
+	switch {
+	case d.Proxy.HTTP == "" && d.Proxy.HTTPS == "":
+		return nil, fmt.Errorf("%s sends every sample host direct; there is no proxy to configure", s.Source)
+	case d.Proxy.HTTP == "":
+		d.Proxy.HTTP = d.Proxy.HTTPS
+	case d.Proxy.HTTPS == "":
+		d.Proxy.HTTPS = d.Proxy.HTTP
+	}
+
+	// Browsers never proxy loopback, whatever the script says.
+	noProxy := []string{"localhost", "127.0.0.1"}
+	seen := map[string]bool{"localhost": true, "127.0.0.1": true}
+	for _, entry := range append(s.Candidates(), known...) {
+		host := ProbeHost(entry)
+		if host == "" || seen[entry] {
+			continue
+		}
+		seen[entry] = true
+		r, err := s.Route(host, true)
+		if err != nil {
+			return nil, err
+		}
+		d.Routes = append(d.Routes, r)
+		if r.Direct() {
+			noProxy = append(noProxy, entry)
+		}
+	}
+	d.Proxy.NoProxy = strings.Join(noProxy, ",")
+	return d, nil
+}
+
+// votes counts proxy URLs; DIRECT ("") does not vote.
+type votes struct {
+	urls   []string
+	counts map[string]int
+}
+
+func (v *votes) add(u string) {
+	if u == "" {
+		return
+	}
+	if v.counts == nil {
+		v.counts = make(map[string]int)
+	}
+	if v.counts[u] == 0 {
+		v.urls = append(v.urls, u)
+	}
+	v.counts[u]++
+}
+
+// winner returns the most common URL; ties go to the first seen.
+func (v *votes) winner() string {
+	best := ""
+	for _, u := range v.urls {
+		if best == "" || v.counts[u] > v.counts[best] {
+			best = u
+		}
+	}
+	return best
+}
+
+var (
+	domainIsRe   = regexp.MustCompile(`dnsDomainIs\s*\(\s*\w+\s*,\s*["']([^"']+)["']`)
+	localHostRe  = regexp.MustCompile(`localHostOrDomainIs\s*\(\s*\w+\s*,\s*["']([^"']+)["']`)
+	shExpMatchRe = regexp.MustCompile(`shExpMatch\s*\(\s*host\s*,\s*["']([^"']+)["']`)
+	hostEqualRe  = regexp.MustCompile(`\bhost\s*===?\s*["']([^"']+)["']`)
+	isInNetRe    = regexp.MustCompile(`isInNet\s*\([^,()]*(?:\([^()]*\))?\s*,\s*["']([\d.]+)["']\s*,\s*["']([\d.]+)["']`)
+)
+
+// Candidates returns the NO_PROXY-style entries for the hosts, domains
+// and networks the script tests, in the order they appear. Whether each is
+// sent direct is up to FindProxyForURL.
+func (s *Script) Candidates() []string {
+	type found struct {
+		pos   int
+		entry string
+	}
+	var all []found
+	add := func(re *regexp.Regexp, convert func(m []string) string) {
+		for _, idx := range re.FindAllStringSubmatchIndex(s.src, -1) {
+			m := make([]string, len(idx)/2)
+			for i := range m {
+				m[i] = s.src[idx[2*i]:idx[2*i+1]]
+			}
+			if entry := convert(m); entry != "" {
+				all = append(all, found{idx[0], entry})
+			}
+		}
+	}
+	literal := func(m []string) string { return strings.ToLower(m[1]) }
+	add(domainIsRe, literal)
+	add(localHostRe, literal)
+	add(hostEqualRe, literal)
+	add(shExpMatchRe, func(m []string) string {
+		// "*.corp.com" becomes ".corp.com"; patterns with wildcards
+		// elsewhere have no NO_PROXY equivalent.
+		rest := strings.TrimPrefix(strings.ToLower(m[1]), "*")
+		if strings.ContainsAny(rest, "*?[") {
+			return ""
+		}
+		return rest
+	})
+	add(isInNetRe, func(m []string) string {
+		ip, mask := net.ParseIP(m[1]).To4(), net.ParseIP(m[2]).To4()
+		if ip == nil || mask == nil {
+			return ""
+		}
+		ones, bits := net.IPMask(mask).Size()
+		if bits == 0 {
+			return "" // not a contiguous mask
+		}
+		return (&net.IPNet{IP: ip.Mask(net.IPMask(mask)), Mask: net.CIDRMask(ones, bits)}).String()
+	})
+
+	sort.SliceStable(all, func(i, j int) bool { return all[i].pos < all[j].pos })
+	var out []string
+	seen := make(map[string]bool)
+	for _, f := range all {
+		if !seen[f.entry] {
+			seen[f.entry] = true
+			out = append(out, f.entry)
+		}
+	}
+	return out
+}
+
+// ProbeHost returns a host name or address that a NO_PROXY entry covers,
+// for asking the script how it is routed: the host itself, a made-up
+// subdomain for a domain suffix, or the first address of a CIDR range. It
+// returns "" for entries it can't probe ("*", IPv6 ranges).
+func ProbeHost(entry string) string {
+	entry = strings.ToLower(strings.TrimSpace(entry))
+	if entry == "" || entry == "*" {
+		return ""
+	}
+	if _, cidr, err := net.ParseCIDR(entry); err == nil {
+		ip := cidr.IP.To4()
+		if ip == nil {
+			return ""
+		}
+		first := make(net.IP, 4)
+		copy(first, ip)
+		if ones, _ := cidr.Mask.Size(); ones < 32 {
+			first[3]++
+		}
+		return first.String()
+	}
+	if h, _, err := net.SplitHostPort(entry); err == nil {
+		entry = h
+	}
+	entry = strings.Trim(entry, "[]")
+	if rest, ok := strings.CutPrefix(strings.TrimPrefix(entry, "*"), "."); ok {
+		return "ezproxy-probe." + rest
+	}
+	return entry
+}
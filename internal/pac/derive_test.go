@@ -0,0 +1,86 @@
+package pac
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestDerive(t *testing.T) {
+	s, err := Parse("test.pac", corpPAC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.LookupHost = noDNS(nil)
+	d, err := s.Derive([]string{"192.168.0.0/16", ".corp.example", "10.0.0.0/8"})
+	if err != nil {
+		t.Fatalf("Derive: %v", err)
+	}
+	if d.Proxy.HTTP != "http://proxy.corp.example:8080" {
+		t.Errorf("HTTP = %q", d.Proxy.HTTP)
+	}
+	if d.Proxy.HTTPS != "http://secure.corp.example:3128" {
+		t.Errorf("HTTPS = %q", d.Proxy.HTTPS)
+	}
+	// 192.168.0.0/16 is proxied by the script, so it is dropped.
+	if want := "localhost,127.0.0.1,.corp.example,.internal.example,10.0.0.0/8"; d.Proxy.NoProxy != want {
+		t.Errorf("NoProxy = %q, want %q", d.Proxy.NoProxy, want)
+	}
+	if len(d.Routes) == 0 {
+		t.Error("no routes recorded")
+	}
+}
+
+func TestDerive_AllDirect(t *testing.T) {
+	s, _ := Parse("direct.pac", `function FindProxyForURL(url, host) { return "DIRECT"; }`)
+	if _, err := s.Derive(nil); err == nil || !strings.Contains(err.Error(), "no proxy") {
+		t.Errorf("Derive = %v, want no-proxy error", err)
+	}
+}
+
+func TestDerive_MajorityWins(t *testing.T) {
+	s, _ := Parse("split.pac", `function FindProxyForURL(url, host) {
+		if (host == "pypi.org") return "PROXY other:9090";
+		return "PROXY main:8080";
+	}`)
+	d, err := s.Derive(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.Proxy.HTTP != "http://main:8080" || d.Proxy.HTTPS != "http://main:8080" {
+		t.Errorf("proxy = %+v", d.Proxy)
+	}
+}
+
+func TestCandidates(t *testing.T) {
+	s, _ := Parse("test.pac", `function FindProxyForURL(url, host) {
+		if (localHostOrDomainIs(host, "www.corp.example")) return "DIRECT";
+		if (isInNet(host, "172.16.0.0", "255.240.0.0")) return "DIRECT";
+		if (shExpMatch(host, "build-?.corp.example")) return "DIRECT";
+		if (shExpMatch(host, "*.Dev.Example")) return "DIRECT";
+		if (host === "printer") return "DIRECT";
+		return "PROXY p:1";
+	}`)
+	got := strings.Join(s.Candidates(), ",")
+	if want := "www.corp.example,172.16.0.0/12,.dev.example,printer"; got != want {
+		t.Errorf("Candidates = %q, want %q", got, want)
+	}
+}
+
+func TestProbeHost(t *testing.T) {
+	tests := map[string]string{
+		"localhost":      "localhost",
+		".corp.example":  "ezproxy-probe.corp.example",
+		"*.corp.example": "ezproxy-probe.corp.example",
+		"10.0.0.0/8":     "10.0.0.1",
+		"10.1.2.3/32":    "10.1.2.3",
+		"intranet:8443":  "intranet",
+		"[::1]":          "::1",
+		"fd00::/8":       "",
+		"*":              "",
+	}
+	for entry, want := range tests {
+		if got := ProbeHost(entry); got != want {
+			t.Errorf("ProbeHost(%q) = %q, want %q", entry, got, want)
+		}
+	}
+}
@@ -0,0 +1,201 @@
+package pac
+
+import (
+	"context"
+	"net"
+
+	"github.com/dop251/goja"
+)
+
+// installHelpers defines the PAC functions that need the network. The rest
+// are plain JavaScript (see helpers below).
+func (s *Script) installHelpers() {
+	s.vm.Set("dnsResolve", func(host string) goja.Value {
+		if ip := s.resolve(host); ip != "" {
+			return s.vm.ToValue(ip)
+		}
+		return goja.Null()
+	})
+	s.vm.Set("isResolvable", func(host string) bool {
+		return s.resolve(host) != ""
+	})
+	s.vm.Set("myIpAddress", func() string {
+		return myIPAddress()
+	})
+	s.vm.Set("alert", func(string) {})
+}
+
+// resolve returns the first IPv4 address of host, or "" if it does not
+// resolve.
+func (s *Script) resolve(host string) string {
+	if ip := net.ParseIP(host); ip != nil {
+		return ip.String()
+	}
+	lookup := s.LookupHost
+	if lookup == nil {
+		lookup = net.DefaultResolver.LookupHost
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout())
+	defer cancel()
+	addrs, err := lookup(ctx, host)
+	if err != nil {
+		return ""
+	}
+	for _, a := range addrs {
+		if ip := net.ParseIP(a); ip != nil && ip.To4() != nil {
+			return ip.String()
+		}
+	}
+	return ""
+}
+
+// myIPAddress returns the address of the interface used for outbound
+// traffic. Dialing UDP sends no packets; it only picks a route.
+func myIPAddress() string {
+	conn, err := net.Dial("udp", "192.0.2.1:53")
+	if err != nil {
+		return "127.0.0.1"
+	}
+	defer conn.Close()
+	return conn.LocalAddr().(*net.UDPAddr).IP.String()
+}
+
+// helpers are the standard PAC utility functions that need no network
+// access.
+const helpers = `
+function isPlainHostName(host) {
+	return host.indexOf('.') < 0;
+}
+
+function dnsDomainIs(host, domain) {
+	return host.length >= domain.length &&
+		host.substring(host.length - domain.length) == domain;
+}
+
+function localHostOrDomainIs(host, hostdom) {
+	return host == hostdom || hostdom.lastIndexOf(host + '.', 0) == 0;
+}
+
+function dnsDomainLevels(host) {
+	return host.split('.').length - 1;
+}
+
+function convert_addr(ipchars) {
+	var bytes = ipchars.split('.');
+	return (((bytes[0] & 0xff) << 24) | ((bytes[1] & 0xff) << 16) |
+		((bytes[2] & 0xff) << 8) | (bytes[3] & 0xff)) >>> 0;
+}
+
+function isInNet(ipaddr, pattern, maskstr) {
+	if (!/^\d{1,3}(\.\d{1,3}){3}$/.test(ipaddr)) {
+		ipaddr = dnsResolve(ipaddr);
+		if (ipaddr == null) {
+			return false;
+		}
+	}
+	var mask = convert_addr(maskstr);
+	return ((convert_addr(ipaddr) & mask) >>> 0) == ((convert_addr(pattern) & mask) >>> 0);
+}
+
+function shExpMatch(str, shexp) {
+	var re = shexp.replace(/[.+^${}()|[\]\\]/g, '\\$&')
+		.replace(/\*/g, '.*').replace(/\?/g, '.');
+	return new RegExp('^' + re + '$').test(str);
+}
+
+var __days = ['SUN', 'MON', 'TUE', 'WED', 'THU', 'FRI', 'SAT'];
+var __months = ['JAN', 'FEB', 'MAR', 'APR', 'MAY', 'JUN', 'JUL', 'AUG', 'SEP', 'OCT', 'NOV', 'DEC'];
+
+function __inRange(lo, value, hi) {
+	return lo <= hi ? (lo <= value && value <= hi) : (value >= lo || value <= hi);
+}
+
+function weekdayRange(wd1, wd2, gmt) {
+	if (wd2 == 'GMT') {
+		gmt = wd2;
+		wd2 = undefined;
+	}
+	var now = new Date();
+	var today = gmt == 'GMT' ? now.getUTCDay() : now.getDay();
+	var d1 = __days.indexOf(wd1);
+	var d2 = wd2 === undefined ? d1 : __days.indexOf(wd2);
+	if (d1 < 0 || d2 < 0) {
+		return false;
+	}
+	return __inRange(d1, today, d2);
+}
+
+// dateRange(day | month | year, ...[, 'GMT']): one value matches that day,
+// month or year; two or more are a range split in half.
+function dateRange() {
+	var args = Array.prototype.slice.call(arguments);
+	var gmt = args.length > 0 && args[args.length - 1] == 'GMT';
+	if (gmt) {
+		args.pop();
+	}
+	if (args.length == 0) {
+		return false;
+	}
+	var now = new Date();
+	var cur = {
+		day: gmt ? now.getUTCDate() : now.getDate(),
+		month: gmt ? now.getUTCMonth() : now.getMonth(),
+		year: gmt ? now.getUTCFullYear() : now.getFullYear()
+	};
+	function parse(list) {
+		var d = {};
+		for (var i = 0; i < list.length; i++) {
+			var m = __months.indexOf(list[i]);
+			if (m >= 0) {
+				d.month = m;
+			} else if (list[i] < 32) {
+				d.day = Number(list[i]);
+			} else {
+				d.year = Number(list[i]);
+			}
+		}
+		return d;
+	}
+	if (args.length == 1) {
+		var one = parse(args);
+		return (one.day === undefined || one.day == cur.day) &&
+			(one.month === undefined || one.month == cur.month) &&
+			(one.year === undefined || one.year == cur.year);
+	}
+	var from = parse(args.slice(0, args.length / 2));
+	var to = parse(args.slice(args.length / 2));
+	// Compare only the fields the range mentions.
+	function key(d) {
+		return (from.year !== undefined ? d.year * 10000 : 0) +
+			(from.month !== undefined ? d.month * 100 : 0) +
+			(from.day !== undefined ? d.day : 0);
+	}
+	return __inRange(key(from), key(cur), key(to));
+}
+
+// timeRange(hour), (h1, h2), (h1, m1, h2, m2) or (h1, m1, s1, h2, m2, s2),
+// each optionally followed by 'GMT'.
+function timeRange() {
+	var args = Array.prototype.slice.call(arguments);
+	var gmt = args.length > 0 && args[args.length - 1] == 'GMT';
+	if (gmt) {
+		args.pop();
+	}
+	var now = new Date();
+	var secs = gmt ?
+		now.getUTCHours() * 3600 + now.getUTCMinutes() * 60 + now.getUTCSeconds() :
+		now.getHours() * 3600 + now.getMinutes() * 60 + now.getSeconds();
+	var n = args.map(Number);
+	switch (n.length) {
+	case 1:
+		return Math.floor(secs / 3600) == n[0];
+	case 2:
+		return __inRange(n[0] * 3600, secs, n[1] * 3600 + 3599);
+	case 4:
+		return __inRange(n[0] * 3600 + n[1] * 60, secs, n[2] * 3600 + n[3] * 60 + 59);
+	case 6:
+		return __inRange(n[0] * 3600 + n[1] * 60 + n[2], secs, n[3] * 3600 + n[4] * 60 + n[5]);
+	}
+	return false;
+}
+`
@@ -0,0 +1,204 @@
+// Package pac evaluates proxy auto-config (PAC) files. A PAC file is a
+// JavaScript function, FindProxyForURL(url, host), that returns where a
+// request should go ("PROXY proxy.corp.com:8080; DIRECT"). ezproxy runs it
+// for a handful of hosts to derive the static proxy URLs and NO_PROXY list
+// that tools understand, and "ezproxy doctor" uses it to explain routing.
+package pac
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dop251/goja"
+)
+
+// maxSize caps how much of a PAC file is read.
+const maxSize = 1 << 20
+
+// Script is a loaded PAC file. It is safe for concurrent use.
+type Script struct {
+	// Source is where the script was loaded from (URL or path).
+	Source string
+
+	// LookupHost resolves names for dnsResolve, isResolvable and isInNet.
+	// nil uses the system resolver.
+	LookupHost func(ctx context.Context, host string) ([]string, error)
+
+	// Timeout bounds a single FindProxyForURL call, DNS lookups included.
+	// 5s if zero.
+	Timeout time.Duration
+
+	src  string
+	mu   sync.Mutex
+	vm   *goja.Runtime
+	find goja.Callable
+}
+
+// Parse compiles a PAC script and runs its top-level code, which like a
+// FindProxyForURL call is interrupted after the default timeout. source is
+// only used in messages.
+func Parse(source, src string) (*Script, error) {
+	s := &Script{Source: source, src: src, vm: goja.New()}
+	timer := time.AfterFunc(s.timeout(), func() { s.vm.Interrupt("timed out") })
+	defer func() {
+		timer.Stop()
+		s.vm.ClearInterrupt()
+	}()
+	s.installHelpers()
+	if _, err := s.vm.RunString(helpers); err != nil {
+		return nil, fmt.Errorf("PAC helpers: %w", err)
+	}
+	if _, err := s.vm.RunScript(source, src); err != nil {
+		return nil, fmt.Errorf("%s: %w", source, err)
+	}
+	find, ok := goja.AssertFunction(s.vm.Get("FindProxyForURL"))
+	if !ok {
+		return nil, fmt.Errorf("%s: no FindProxyForURL function", source)
+	}
+	s.find = find
+	return s, nil
+}
+
+// Load reads a PAC script from an http(s) or file URL, or a local path.
+// PAC files are fetched without a proxy, as browsers do.
+func Load(ctx context.Context, location string) (*Script, error) {
+	var (
+		data []byte
+		err  error
+	)
+	if u, perr := url.Parse(location); perr == nil && (u.Scheme == "http" || u.Scheme == "https") {
+		data, err = fetch(ctx, directClient, location)
+	} else {
+		data, err = os.ReadFile(strings.TrimPrefix(location, "file://"))
+	}
+	if err != nil {
+		return nil, err
+	}
+	return Parse(location, string(data))
+}
+
+// directClient fetches PAC files; the proxy they describe may not be
+// reachable (or configured) yet.
+var directClient = &http.Client{
+	Transport: &http.Transport{Proxy: nil, DialContext: (&net.Dialer{Timeout: 5 * time.Second}).DialContext},
+	Timeout:   10 * time.Second,
+}
+
+func fetch(ctx context.Context, client *http.Client, location string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, location, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetching %s: %s", location, resp.Status)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, maxSize))
+}
+
+// defaultTimeout is the Timeout of a Script that sets none. Tests may
+// lower it.
+var defaultTimeout = 5 * time.Second
+
+func (s *Script) timeout() time.Duration {
+	if s.Timeout > 0 {
+		return s.Timeout
+	}
+	return defaultTimeout
+}
+
+// FindProxyForURL runs the script for rawURL and returns its raw result.
+// host defaults to the URL's host name.
+func (s *Script) FindProxyForURL(rawURL, host string) (string, error) {
+	if host == "" {
+		u, err := url.Parse(rawURL)
+		if err != nil {
+			return "", err
+		}
+		host = u.Hostname()
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	timer := time.AfterFunc(s.timeout(), func() { s.vm.Interrupt("timed out") })
+	defer func() {
+		timer.Stop()
+		s.vm.ClearInterrupt()
+	}()
+	v, err := s.find(goja.Undefined(), s.vm.ToValue(rawURL), s.vm.ToValue(host))
+	if err != nil {
+		return "", fmt.Errorf("FindProxyForURL(%q): %w", rawURL, err)
+	}
+	if goja.IsUndefined(v) || goja.IsNull(v) {
+		return "", fmt.Errorf("FindProxyForURL(%q) returned nothing", rawURL)
+	}
+	return v.String(), nil
+}
+
+// Proxy is one entry of a FindProxyForURL result.
+type Proxy struct {
+	Type string // DIRECT, PROXY, HTTPS, SOCKS, SOCKS4 or SOCKS5
+	Host string // host:port; empty for DIRECT
+}
+
+// URL returns the entry as a proxy URL, or "" for DIRECT.
+func (p Proxy) URL() string {
+	switch p.Type {
+	case "PROXY", "HTTP":
+		return "http://" + p.Host
+	case "HTTPS":
+		return "https://" + p.Host
+	case "SOCKS", "SOCKS5":
+		return "socks5://" + p.Host
+	case "SOCKS4":
+		return "socks4://" + p.Host
+	}
+	return ""
+}
+
+func (p Proxy) String() string {
+	if p.Host == "" {
+		return p.Type
+	}
+	return p.Type + " " + p.Host
+}
+
+// ParseResult splits a FindProxyForURL result such as
+// "PROXY a:8080; PROXY b:8080; DIRECT" into its entries.
+func ParseResult(result string) []Proxy {
+	var out []Proxy
+	for _, part := range strings.Split(result, ";") {
+		fields := strings.Fields(part)
+		if len(fields) == 0 {
+			continue
+		}
+		p := Proxy{Type: strings.ToUpper(fields[0])}
+		if len(fields) > 1 {
+			p.Host = fields[1]
+		}
+		out = append(out, p)
+	}
+	return out
+}
+
+// First returns the entry a client tries first. An empty result means
+// DIRECT.
+func First(result string) Proxy {
+	entries := ParseResult(result)
+	if len(entries) == 0 {
+		return Proxy{Type: "DIRECT"}
+	}
+	return entries[0]
+}
@@ -0,0 +1,164 @@
+package pac
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// corpPAC is a typical corporate PAC file.
+const corpPAC = `
+function FindProxyForURL(url, host) {
+	if (isPlainHostName(host) || host == "localhost" ||
+		dnsDomainIs(host, ".corp.example") ||
+		shExpMatch(host, "*.internal.example") ||
+		isInNet(dnsResolve(host), "10.0.0.0", "255.0.0.0")) {
+		return "DIRECT";
+	}
+	if (url.substring(0, 6) == "https:") {
+		return "PROXY secure.corp.example:3128; DIRECT";
+	}
+	return "PROXY proxy.corp.example:8080; DIRECT";
+}
+`
+
+// pacServer serves body as a PAC file.
+func pacServer(t *testing.T, body string) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/x-ns-proxy-autoconfig")
+		w.Write([]byte(body))
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// noDNS makes every lookup fail except the names in hosts.
+func noDNS(hosts map[string]string) func(context.Context, string) ([]string, error) {
+	return func(_ context.Context, host string) ([]string, error) {
+		if ip, ok := hosts[host]; ok {
+			return []string{ip}, nil
+		}
+		return nil, errors.New("no such host")
+	}
+}
+
+func TestLoad_URLAndFile(t *testing.T) {
+	srv := pacServer(t, corpPAC)
+	s, err := Load(context.Background(), srv.URL+"/proxy.pac")
+	if err != nil {
+		t.Fatalf("Load URL: %v", err)
+	}
+	s.LookupHost = noDNS(nil)
+	if got, _ := s.FindProxyForURL("https://github.com/", ""); got != "PROXY secure.corp.example:3128; DIRECT" {
+		t.Errorf("github.com = %q", got)
+	}
+
+	path := filepath.Join(t.TempDir(), "proxy.pac")
+	os.WriteFile(path, []byte(corpPAC), 0644)
+	if _, err := Load(context.Background(), path); err != nil {
+		t.Errorf("Load file: %v", err)
+	}
+	if _, err := Load(context.Background(), "file://"+path); err != nil {
+		t.Errorf("Load file URL: %v", err)
+	}
+}
+
+func TestLoad_Errors(t *testing.T) {
+	srv := httptest.NewServer(http.NotFoundHandler())
+	defer srv.Close()
+	if _, err := Load(context.Background(), srv.URL+"/proxy.pac"); err == nil || !strings.Contains(err.Error(), "404") {
+		t.Errorf("Load 404 = %v", err)
+	}
+	if _, err := Parse("test.pac", "function notIt() {}"); err == nil {
+		t.Error("script without FindProxyForURL accepted")
+	}
+	if _, err := Parse("test.pac", "function FindProxyForURL(url, host) {"); err == nil {
+		t.Error("syntax error accepted")
+	}
+}
+
+func TestFindProxyForURL_Helpers(t *testing.T) {
+	s, err := Parse("test.pac", corpPAC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.LookupHost = noDNS(map[string]string{"build.example.net": "10.1.2.3"})
+	tests := map[string]string{
+		"http://intranet/":                  "DIRECT",
+		"http://localhost:8080/":            "DIRECT",
+		"https://git.corp.example/":         "DIRECT",
+		"https://wiki.internal.example/":    "DIRECT",
+		"https://build.example.net/":        "DIRECT", // isInNet via dnsResolve
+		"https://10.9.9.9/":                 "DIRECT",
+		"http://example.com/":               "PROXY proxy.corp.example:8080; DIRECT",
+		"https://notcorp.example/":          "PROXY secure.corp.example:3128; DIRECT",
+		"https://corp.example.attacker.io/": "PROXY secure.corp.example:3128; DIRECT",
+	}
+	for u, want := range tests {
+		if got, err := s.FindProxyForURL(u, ""); err != nil || got != want {
+			t.Errorf("FindProxyForURL(%s) = %q, %v; want %q", u, got, err, want)
+		}
+	}
+}
+
+func TestFindProxyForURL_Timeout(t *testing.T) {
+	s, err := Parse("loop.pac", "function FindProxyForURL(url, host) { for (;;) {} }")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Timeout = 50 * time.Millisecond
+	if _, err := s.FindProxyForURL("http://example.com/", ""); err == nil {
+		t.Fatal("endless script did not time out")
+	}
+	// The interrupt must not stick to the next call.
+	s2, _ := Parse("ok.pac", `function FindProxyForURL(url, host) { return "DIRECT"; }`)
+	s2.Timeout = time.Second
+	if got, err := s2.FindProxyForURL("http://example.com/", ""); err != nil || got != "DIRECT" {
+		t.Errorf("after timeout = %q, %v", got, err)
+	}
+}
+
+func TestParse_TopLevelTimeout(t *testing.T) {
+	saved := defaultTimeout
+	defaultTimeout = 50 * time.Millisecond
+	defer func() { defaultTimeout = saved }()
+	done := make(chan error, 1)
+	go func() {
+		_, err := Parse("loop.pac", "while (1) {}\nfunction FindProxyForURL(url, host) { return \"DIRECT\"; }")
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Error("endless top-level code parsed without error")
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("endless top-level code was not interrupted")
+	}
+}
+
+func TestParseResult(t *testing.T) {
+	got := ParseResult("PROXY a:8080;  proxy b:8080 ; SOCKS5 s:1080; DIRECT")
+	want := []Proxy{{"PROXY", "a:8080"}, {"PROXY", "b:8080"}, {"SOCKS5", "s:1080"}, {"DIRECT", ""}}
+	if len(got) != len(want) {
+		t.Fatalf("ParseResult = %v", got)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("entry %d = %v, want %v", i, got[i], want[i])
+		}
+	}
+	if got[0].URL() != "http://a:8080" || got[2].URL() != "socks5://s:1080" || got[3].URL() != "" {
+		t.Errorf("URLs = %q %q %q", got[0].URL(), got[2].URL(), got[3].URL())
+	}
+	if First("").Type != "DIRECT" {
+		t.Error("empty result should mean DIRECT")
+	}
+}
@@ -0,0 +1,93 @@
+package pac
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"golang.org/x/net/publicsuffix"
+)
+
+// Discover finds the network's PAC file the way WPAD does over DNS: it
+// tries http://wpad.<domain>/wpad.dat for each local domain and its parent
+// domains up to the organisation's own, and loads the first one that
+// serves a valid script.
+func Discover(ctx context.Context) (*Script, error) {
+	return discover(ctx, directClient, LocalDomains())
+}
+
+func discover(ctx context.Context, client *http.Client, domains []string) (*Script, error) {
+	urls := wpadURLs(domains)
+	if len(urls) == 0 {
+		return nil, errors.New("WPAD: no DNS domain found (set a search domain or give the PAC URL)")
+	}
+	var errs []error
+	for _, u := range urls {
+		data, err := fetch(ctx, client, u)
+		if err == nil {
+			var s *Script
+			if s, err = Parse(u, string(data)); err == nil {
+				return s, nil
+			}
+		}
+		errs = append(errs, err)
+	}
+	return nil, fmt.Errorf("WPAD: no PAC file found: %w", errors.Join(errs...))
+}
+
+// wpadURLs returns the WPAD candidates for each domain, most specific
+// first, stopping at the organisation's own domain, the one just below a
+// public suffix: eng.corp.com gives wpad.eng.corp.com and wpad.corp.com,
+// and corp.example.co.uk stops at wpad.example.co.uk rather than trying
+// wpad.co.uk, a name anyone could register to hand out a proxy.
+func wpadURLs(domains []string) []string {
+	var urls []string
+	seen := make(map[string]bool)
+	for _, domain := range domains {
+		domain = strings.Trim(strings.ToLower(domain), ".")
+		org, err := publicsuffix.EffectiveTLDPlusOne(domain)
+		if err != nil {
+			continue
+		}
+		for {
+			u := "http://wpad." + domain + "/wpad.dat"
+			if !seen[u] {
+				seen[u] = true
+				urls = append(urls, u)
+			}
+			if domain == org {
+				break
+			}
+			_, domain, _ = strings.Cut(domain, ".")
+		}
+	}
+	return urls
+}
+
+// LocalDomains returns the domain of this host's name and the DNS search
+// domains from /etc/resolv.conf.
+func LocalDomains() []string {
+	var domains []string
+	if name, err := os.Hostname(); err == nil {
+		if _, domain, ok := strings.Cut(name, "."); ok {
+			domains = append(domains, domain)
+		}
+	}
+	f, err := os.Open("/etc/resolv.conf")
+	if err != nil {
+		return domains
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) > 1 && (fields[0] == "search" || fields[0] == "domain") {
+			domains = append(domains, fields[1:]...)
+		}
+	}
+	return domains
+}
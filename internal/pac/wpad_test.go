@@ -0,0 +1,63 @@
+package pac
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestWPADURLs(t *testing.T) {
+	got := wpadURLs([]string{"eng.corp.example", "corp.example.", "localdomain"})
+	want := []string{"http://wpad.eng.corp.example/wpad.dat", "http://wpad.corp.example/wpad.dat"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("wpadURLs = %v, want %v", got, want)
+	}
+}
+
+func TestWPADURLs_StopsAtPublicSuffix(t *testing.T) {
+	got := wpadURLs([]string{"corp.example.co.uk", "co.uk"})
+	want := []string{"http://wpad.corp.example.co.uk/wpad.dat", "http://wpad.example.co.uk/wpad.dat"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("wpadURLs = %v, want %v", got, want)
+	}
+}
+
+func TestDiscover(t *testing.T) {
+	var asked []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		asked = append(asked, r.Host+r.URL.Path)
+		if r.Host != "wpad.corp.example" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte(corpPAC))
+	}))
+	defer srv.Close()
+
+	// Every wpad.* name resolves to the test server.
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, network, srv.Listener.Addr().String())
+		},
+	}}
+	s, err := discover(context.Background(), client, []string{"eng.corp.example"})
+	if err != nil {
+		t.Fatalf("discover: %v", err)
+	}
+	if s.Source != "http://wpad.corp.example/wpad.dat" {
+		t.Errorf("Source = %q", s.Source)
+	}
+	if want := []string{"wpad.eng.corp.example/wpad.dat", "wpad.corp.example/wpad.dat"}; !reflect.DeepEqual(asked, want) {
+		t.Errorf("asked %v, want %v", asked, want)
+	}
+
+	if _, err := discover(context.Background(), client, []string{"other.example"}); err == nil {
+		t.Error("discover without a PAC file succeeded")
+	}
+	if _, err := discover(context.Background(), client, nil); err == nil {
+		t.Error("discover without domains succeeded")
+	}
+}
@@ -0,0 +1,393 @@
+// Package policy reads the organisation policy an administrator puts in
+// /etc/ezproxy/policy.yaml on managed machines. It marks tools as required
+// (must stay enabled) or forbidden (must stay disabled), and settings as
+// locked to a value, required to contain entries or forbidden to contain
+// them. init, enable, disable and manage refuse to break it, and status
+// reports any config that does.
+//
+//	message: Proxy settings are managed by IT; see https://wiki.corp.com/proxy
+//	tools:
+//	  system_ca: required
+//	  env_vars: required
+//	  snap: forbidden
+//	fields:
+//	  http:
+//	    locked: http://proxy.corp.com:8080
+//	  no_proxy:
+//	    required: [.corp.com, 10.0.0.0/8]
+//	    forbidden: ["*"]
+//	  ca_certs:
+//	    required: [/etc/pki/corp/root.pem]
+package policy
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/andrew/ezproxy/internal/certs"
+	"github.com/andrew/ezproxy/internal/config"
+)
+
+// Path is where the system policy lives.
+var Path = "/etc/ezproxy/policy.yaml"
+
+// Rule is what the policy says about a tool.
+type Rule string
+
+const (
+	Required  Rule = "required"
+	Forbidden Rule = "forbidden"
+)
+
+// Field rules apply to these settings. no_proxy is a list; ca_certs only
+// takes required, naming cert files whose certificates must be trusted.
+const (
+	FieldHTTP    = "http"
+	FieldHTTPS   = "https"
+	FieldNoProxy = "no_proxy"
+	FieldPACURL  = "pac_url"
+	FieldCACerts = "ca_certs"
+)
+
+// FieldRule restricts one setting.
+type FieldRule struct {
+	Locked    *string  `yaml:"locked"`    // the only value allowed
+	Required  []string `yaml:"required"`  // entries the list must contain
+	Forbidden []string `yaml:"forbidden"` // values or entries not allowed
+}
+
+// Policy is a loaded policy file. The zero value allows everything.
+type Policy struct {
+	Message string               `yaml:"message"` // shown with refusals, e.g. who to contact
+	Tools   map[string]Rule      `yaml:"tools"`
+	Fields  map[string]FieldRule `yaml:"fields"`
+
+	// Source is the file the policy was read from.
+	Source string `yaml:"-"`
+
+	requiredCAs []*certs.CA
+}
+
+// Violation is one way a config breaks the policy.
+type Violation struct {
+	Subject string // tool name or field
+	Problem string
+}
+
+func (v Violation) String() string {
+	return v.Subject + ": " + v.Problem
+}
+
+// Load reads the policy at path. A missing file is an empty policy. Any
+// other problem is an error, so a broken policy never means "no policy".
+func Load(path string) (*Policy, error) {
+	p := &Policy{Source: path}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return p, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(p); err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if err := p.validate(); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return p, nil
+}
+
+func (p *Policy) validate() error {
+	known := config.DefaultTools()
+	for name, rule := range p.Tools {
+		if _, ok := known[name]; !ok {
+			return fmt.Errorf("tools: unknown tool %q", name)
+		}
+		if rule != Required && rule != Forbidden {
+			return fmt.Errorf("tools: %s: rule must be %q or %q, not %q", name, Required, Forbidden, rule)
+		}
+	}
+	for name, f := range p.Fields {
+		switch name {
+		case FieldHTTP, FieldHTTPS, FieldPACURL:
+			if len(f.Required) > 0 {
+				return fmt.Errorf("fields: %s takes locked or forbidden, not required", name)
+			}
+		case FieldNoProxy:
+		case FieldCACerts:
+			if f.Locked != nil || len(f.Forbidden) > 0 {
+				return fmt.Errorf("fields: %s only takes required", name)
+			}
+			cas, err := certs.Load(f.Required)
+			if err != nil {
+				return fmt.Errorf("fields: %s: %w", name, err)
+			}
+			p.requiredCAs = cas
+		default:
+			return fmt.Errorf("fields: unknown field %q (known: http, https, no_proxy, pac_url, ca_certs)", name)
+		}
+	}
+	return nil
+}
+
+// IsZero reports whether the policy has no rules.
+func (p *Policy) IsZero() bool {
+	return len(p.Tools) == 0 && len(p.Fields) == 0
+}
+
+// Tool returns the rule for a tool, or "" if the policy has none.
+func (p *Policy) Tool(name string) Rule {
+	return p.Tools[name]
+}
+
+// CheckTool returns an error if setting the tool to enabled breaks the
+// policy.
+func (p *Policy) CheckTool(name string, enabled bool) error {
+	switch rule := p.Tools[name]; {
+	case rule == Required && !enabled:
+		return fmt.Errorf("%s is required by %s and cannot be disabled", name, p.Source)
+	case rule == Forbidden && enabled:
+		return fmt.Errorf("%s is forbidden by %s and cannot be enabled", name, p.Source)
+	}
+	return nil
+}
+
+// CheckTools returns an error if enabling exactly the given tools breaks
+// the policy.
+func (p *Policy) CheckTools(enabled []string) error {
+	set := make(map[string]bool, len(enabled))
+	for _, name := range enabled {
+		set[name] = true
+	}
+	for _, name := range sortedKeys(p.Tools) {
+		if err := p.CheckTool(name, set[name]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// AdjustTools returns a default tool selection brought in line with the
+// policy: required tools added, forbidden ones dropped.
+func (p *Policy) AdjustTools(tools []string) []string {
+	var out []string
+	seen := make(map[string]bool)
+	for _, name := range tools {
+		if p.Tools[name] != Forbidden && !seen[name] {
+			seen[name] = true
+			out = append(out, name)
+		}
+	}
+	for _, name := range sortedKeys(p.Tools) {
+		if p.Tools[name] == Required && !seen[name] {
+			out = append(out, name)
+		}
+	}
+	return out
+}
+
+// CheckField returns an error if value is not allowed for field. For
+// no_proxy the value is a comma-separated list.
+func (p *Policy) CheckField(field, value string) error {
+	f, ok := p.Fields[field]
+	if !ok {
+		return nil
+	}
+	label := fieldLabel(field)
+	if f.Locked != nil && !sameValue(field, value, *f.Locked) {
+		return fmt.Errorf("%s is locked to %q by %s", label, *f.Locked, p.Source)
+	}
+	if field != FieldNoProxy {
+		for _, v := range f.Forbidden {
+			if strings.EqualFold(strings.TrimSpace(value), strings.TrimSpace(v)) {
+				return fmt.Errorf("%s %q is forbidden by %s", label, value, p.Source)
+			}
+		}
+		return nil
+	}
+
+	entries := make(map[string]bool)
+	for _, e := range config.SplitList(value) {
+		entries[strings.ToLower(e)] = true
+	}
+	var missing, forbidden []string
+	for _, e := range f.Required {
+		if !entries[strings.ToLower(strings.TrimSpace(e))] {
+			missing = append(missing, e)
+		}
+	}
+	for _, e := range f.Forbidden {
+		if entries[strings.ToLower(strings.TrimSpace(e))] {
+			forbidden = append(forbidden, e)
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("%s must include %s (required by %s)", label, strings.Join(missing, ", "), p.Source)
+	}
+	if len(forbidden) > 0 {
+		return fmt.Errorf("%s must not include %s (forbidden by %s)", label, strings.Join(forbidden, ", "), p.Source)
+	}
+	return nil
+}
+
+// CheckCACerts returns an error unless the cert files at paths hold every
+// certificate the policy requires.
+func (p *Policy) CheckCACerts(paths []string) error {
+	if len(p.requiredCAs) == 0 {
+		return nil
+	}
+	have := make(map[string]bool)
+	if cas, err := certs.Load(paths); err == nil {
+		for _, ca := range cas {
+			have[ca.Fingerprint()] = true
+		}
+	}
+	for _, ca := range p.requiredCAs {
+		if !have[ca.Fingerprint()] {
+			return fmt.Errorf("CA certificate %q from %s is required by %s", ca.Cert.Subject.CommonName, ca.Source, p.Source)
+		}
+	}
+	return nil
+}
+
+// Fill pre-fills settings so that the defaults offered by init already
+// follow the policy: locked values are set and required NO_PROXY entries
+// are added.
+func (p *Policy) Fill(httpProxy, httpsProxy, noProxy, pacURL *string) {
+	for field, dst := range map[string]*string{FieldHTTP: httpProxy, FieldHTTPS: httpsProxy, FieldNoProxy: noProxy, FieldPACURL: pacURL} {
+		if f, ok := p.Fields[field]; ok && f.Locked != nil {
+			*dst = *f.Locked
+		}
+	}
+	entries := config.SplitList(*noProxy)
+	have := make(map[string]bool)
+	for _, e := range entries {
+		have[strings.ToLower(e)] = true
+	}
+	for _, e := range p.Fields[FieldNoProxy].Required {
+		if !have[strings.ToLower(e)] {
+			entries = append(entries, e)
+		}
+	}
+	*noProxy = strings.Join(entries, ",")
+}
+
+// Check returns every way cfg breaks the policy.
+func (p *Policy) Check(cfg *config.Config) []Violation {
+	var out []Violation
+	for _, name := range sortedKeys(p.Tools) {
+		switch enabled := cfg.Tools[name].Enabled; {
+		case p.Tools[name] == Required && !enabled:
+			out = append(out, Violation{Subject: name, Problem: "required but disabled"})
+		case p.Tools[name] == Forbidden && enabled:
+			out = append(out, Violation{Subject: name, Problem: "forbidden but enabled"})
+		}
+	}
+	up := cfg.Upstream()
+	https := up.HTTPS
+	if https == "" {
+		https = up.HTTP
+	}
+	for _, f := range []struct{ name, value string }{
+		{FieldHTTP, up.HTTP}, {FieldHTTPS, https}, {FieldNoProxy, up.NoProxy}, {FieldPACURL, cfg.PACURL},
+	} {
+		if err := p.CheckField(f.name, f.value); err != nil {
+			out = append(out, Violation{Subject: f.name, Problem: err.Error()})
+		}
+	}
+	if err := p.CheckCACerts(cfg.CACertPaths()); err != nil {
+		out = append(out, Violation{Subject: FieldCACerts, Problem: err.Error()})
+	}
+	for _, name := range sortedKeys(cfg.Tools) {
+		if t := cfg.Tools[name]; t.Enabled && (t.Direct || t.HasOverrides()) {
+			out = append(out, p.checkToolSettings(cfg, name)...)
+		}
+	}
+	return out
+}
+
+// checkToolSettings checks the settings a tool with its own proxy or CA,
+// or set to direct, ends up with. A direct tool has no proxy, which breaks
+// a locked one.
+func (p *Policy) checkToolSettings(cfg *config.Config, name string) []Violation {
+	var out []Violation
+	if cfg.Tools[name].Direct {
+		for _, field := range []string{FieldHTTP, FieldHTTPS} {
+			if f, ok := p.Fields[field]; ok && f.Locked != nil {
+				out = append(out, Violation{Subject: name, Problem: fmt.Sprintf("set to direct, but the %s is locked to %q by %s", fieldLabel(field), *f.Locked, p.Source)})
+			}
+		}
+		return out
+	}
+	t, tc := cfg.Tools[name], cfg.ForTool(name)
+	for _, f := range []struct {
+		name, value string
+		set         bool
+	}{
+		{FieldHTTP, tc.Proxy.HTTP, t.HTTP != ""},
+		{FieldHTTPS, tc.Proxy.HTTPS, t.HTTP != "" || t.HTTPS != ""},
+		{FieldNoProxy, tc.Proxy.NoProxy, t.NoProxy != ""},
+	} {
+		if !f.set {
+			continue
+		}
+		if err := p.CheckField(f.name, f.value); err != nil {
+			out = append(out, Violation{Subject: name, Problem: err.Error()})
+		}
+	}
+	if t.CACert != "" {
+		if err := p.CheckCACerts(tc.CACertPaths()); err != nil {
+			out = append(out, Violation{Subject: name, Problem: err.Error()})
+		}
+	}
+	return out
+}
+
+// sameValue compares settings the way tools do: proxy URLs ignoring case
+// and a trailing slash, NO_PROXY as a set of entries.
+func sameValue(field, a, b string) bool {
+	if field != FieldNoProxy {
+		norm := func(s string) string { return strings.TrimSuffix(strings.ToLower(strings.TrimSpace(s)), "/") }
+		return norm(a) == norm(b)
+	}
+	set := func(s string) string {
+		entries := config.SplitList(strings.ToLower(s))
+		sort.Strings(entries)
+		return strings.Join(entries, ",")
+	}
+	return set(a) == set(b)
+}
+
+func fieldLabel(field string) string {
+	switch field {
+	case FieldHTTP:
+		return "HTTP proxy"
+	case FieldHTTPS:
+		return "HTTPS proxy"
+	case FieldNoProxy:
+		return "NO_PROXY"
+	case FieldPACURL:
+		return "PAC file"
+	}
+	return field
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
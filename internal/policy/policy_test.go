@@ -0,0 +1,214 @@
+package policy
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/andrew/ezproxy/internal/config"
+)
+
+// writeCA writes a self-signed CA certificate in PEM form to dir/name.
+func writeCA(t *testing.T, dir, name string) string {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func writePolicy(t *testing.T, dir, content string) string {
+	t.Helper()
+	path := filepath.Join(dir, "policy.yaml")
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func mustLoad(t *testing.T, path string) *Policy {
+	t.Helper()
+	p, err := Load(path)
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	return p
+}
+
+const corpPolicy = `message: Contact it-help@corp.example.
+tools:
+  system_ca: required
+  env_vars: required
+  snap: forbidden
+fields:
+  http:
+    locked: http://proxy.corp.example:8080
+  no_proxy:
+    required: [.corp.example, 10.0.0.0/8]
+    forbidden: ["*"]
+`
+
+func TestLoad_Missing(t *testing.T) {
+	p := mustLoad(t, filepath.Join(t.TempDir(), "policy.yaml"))
+	if !p.IsZero() {
+		t.Errorf("missing policy = %+v", p)
+	}
+	if err := p.CheckTool("system_ca", false); err != nil {
+		t.Errorf("empty policy refused: %v", err)
+	}
+}
+
+func TestLoad_Invalid(t *testing.T) {
+	for name, content := range map[string]string{
+		"unknown tool":       "tools:\n  gti: required\n",
+		"unknown rule":       "tools:\n  git: mandatory\n",
+		"unknown field":      "fields:\n  proxy:\n    locked: x\n",
+		"unknown key":        "tool:\n  git: required\n",
+		"required scalar":    "fields:\n  http:\n    required: [x]\n",
+		"missing ca file":    "fields:\n  ca_certs:\n    required: [/nonexistent/root.pem]\n",
+		"locked ca_certs":    "fields:\n  ca_certs:\n    locked: x\n",
+		"not a yaml mapping": "- git\n",
+	} {
+		if _, err := Load(writePolicy(t, t.TempDir(), content)); err == nil {
+			t.Errorf("%s: Load accepted %q", name, content)
+		}
+	}
+}
+
+func TestCheckTool(t *testing.T) {
+	p := mustLoad(t, writePolicy(t, t.TempDir(), corpPolicy))
+
+	err := p.CheckTool("system_ca", false)
+	if err == nil || !strings.Contains(err.Error(), "required by") || !strings.Contains(err.Error(), p.Source) {
+		t.Errorf("disable system_ca = %v", err)
+	}
+	if err := p.CheckTool("snap", true); err == nil || !strings.Contains(err.Error(), "forbidden") {
+		t.Errorf("enable snap = %v", err)
+	}
+	if err := p.CheckTool("git", false); err != nil {
+		t.Errorf("disable git = %v", err)
+	}
+	if err := p.CheckTools([]string{"git", "env_vars"}); err == nil {
+		t.Error("CheckTools accepted a selection without system_ca")
+	}
+	if got := p.AdjustTools([]string{"git", "snap"}); strings.Join(got, ",") != "git,env_vars,system_ca" {
+		t.Errorf("AdjustTools = %v", got)
+	}
+}
+
+func TestCheckField(t *testing.T) {
+	p := mustLoad(t, writePolicy(t, t.TempDir(), corpPolicy))
+
+	if err := p.CheckField(FieldHTTP, "HTTP://proxy.corp.example:8080/"); err != nil {
+		t.Errorf("locked value refused: %v", err)
+	}
+	if err := p.CheckField(FieldHTTP, "http://other:3128"); err == nil || !strings.Contains(err.Error(), "locked") {
+		t.Errorf("other proxy = %v", err)
+	}
+	if err := p.CheckField(FieldNoProxy, "localhost, 10.0.0.0/8"); err == nil || !strings.Contains(err.Error(), ".corp.example") {
+		t.Errorf("missing entry = %v", err)
+	}
+	if err := p.CheckField(FieldNoProxy, ".corp.example,10.0.0.0/8,*"); err == nil || !strings.Contains(err.Error(), "must not include *") {
+		t.Errorf("forbidden entry = %v", err)
+	}
+	if err := p.CheckField(FieldNoProxy, "localhost,.CORP.example,10.0.0.0/8"); err != nil {
+		t.Errorf("compliant NO_PROXY refused: %v", err)
+	}
+	if err := p.CheckField(FieldPACURL, "anything"); err != nil {
+		t.Errorf("unrestricted field refused: %v", err)
+	}
+}
+
+func TestFill(t *testing.T) {
+	p := mustLoad(t, writePolicy(t, t.TempDir(), corpPolicy))
+
+	httpProxy, httpsProxy, noProxy, pacURL := "http://old:1", "", "localhost,10.0.0.0/8", ""
+	p.Fill(&httpProxy, &httpsProxy, &noProxy, &pacURL)
+	if httpProxy != "http://proxy.corp.example:8080" || httpsProxy != "" || pacURL != "" {
+		t.Errorf("Fill = %q, %q, %q", httpProxy, httpsProxy, pacURL)
+	}
+	if noProxy != "localhost,10.0.0.0/8,.corp.example" {
+		t.Errorf("NO_PROXY = %q", noProxy)
+	}
+	if err := p.CheckField(FieldNoProxy, noProxy); err != nil {
+		t.Errorf("filled NO_PROXY refused: %v", err)
+	}
+}
+
+func TestCheck(t *testing.T) {
+	dir := t.TempDir()
+	root := writeCA(t, dir, "root.pem")
+	other := writeCA(t, dir, "other.pem")
+	p := mustLoad(t, writePolicy(t, dir, corpPolicy+"  ca_certs:\n    required: ["+root+"]\n"))
+
+	cfg := &config.Config{
+		Proxy:  config.ProxyConfig{HTTP: "http://proxy.corp.example:8080", NoProxy: ".corp.example,10.0.0.0/8"},
+		CACert: root,
+		Tools:  config.ToolsEnabled(map[string]bool{"system_ca": true, "env_vars": true, "git": true}),
+	}
+	if v := p.Check(cfg); len(v) != 0 {
+		t.Errorf("compliant config: %v", v)
+	}
+
+	cfg.SetToolEnabled("system_ca", false)
+	cfg.SetToolEnabled("snap", true)
+	cfg.Proxy.HTTP = "http://other:3128"
+	cfg.CACert = other
+	var got []string
+	for _, v := range p.Check(cfg) {
+		got = append(got, v.Subject)
+	}
+	if strings.Join(got, ",") != "snap,system_ca,http,ca_certs" {
+		t.Errorf("violations for %v", got)
+	}
+}
+
+func TestCheck_ToolSettings(t *testing.T) {
+	p := mustLoad(t, writePolicy(t, t.TempDir(), corpPolicy))
+	cfg := &config.Config{
+		Proxy: config.ProxyConfig{HTTP: "http://proxy.corp.example:8080", NoProxy: ".corp.example,10.0.0.0/8"},
+		Tools: map[string]config.ToolConfig{
+			"system_ca": {Enabled: true},
+			"env_vars":  {Enabled: true},
+			"maven":     {Enabled: true, Direct: true},
+			"docker":    {Enabled: true, HTTP: "http://egress:3128"},
+			"apt":       {Enabled: true, NoProxy: "localhost"},
+			"npm":       {Enabled: true, HTTPS: "http://other:3128"}, // https isn't locked
+			"pip":       {HTTP: "http://egress:3128"},                // disabled
+		},
+	}
+	var got []string
+	for _, v := range p.Check(cfg) {
+		got = append(got, v.Subject)
+	}
+	if strings.Join(got, ",") != "apt,docker,maven" {
+		t.Errorf("violations for %v", got)
+	}
+}
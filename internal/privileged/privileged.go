@@ -0,0 +1,446 @@
+// Package privileged makes the changes ezproxy needs root for: system-wide
+// config files, trust stores and services. Configurators queue typed
+// actions here instead of running commands, and cmd/ezproxy runs the queue
+// once at the end of a command, behind a single confirmation that lists
+// every action with the exact content of every file it writes.
+//
+// Actions run directly when ezproxy is already root, and otherwise through
+// sudo, doas or pkexec. Either way a program is started with an argument
+// vector and file content travels in a file or on stdin, never through a
+// shell, so nothing in a proxy URL or a certificate can become a command.
+package privileged
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/charmbracelet/huh"
+
+	"github.com/andrew/ezproxy/internal/escape"
+	"github.com/andrew/ezproxy/internal/fileutil"
+	"github.com/andrew/ezproxy/internal/report"
+)
+
+// Action is one change that needs root.
+type Action interface {
+	// String describes the action on one line, for the confirmation list
+	// and error messages.
+	String() string
+	// run carries out the action, prefixing every program it starts
+	// with escalate (empty when already root).
+	run(escalate []string) error
+}
+
+// WriteFile replaces Path with Content and gives it Mode, creating the
+// directories above it if needed.
+type WriteFile struct {
+	Path    string
+	Content string
+	Mode    os.FileMode
+}
+
+func (w WriteFile) String() string {
+	return fmt.Sprintf("write %s (mode %04o)", w.Path, w.Mode)
+}
+
+func (w WriteFile) run(escalate []string) error {
+	if len(escalate) == 0 {
+		if err := fileutil.AtomicWrite(w.Path, []byte(w.Content), w.Mode); err != nil {
+			return err
+		}
+		return os.Chmod(w.Path, w.Mode)
+	}
+	// The content is staged in a file of our own, which root then
+	// installs; install sets the mode and takes the new file's owner
+	// from the user it runs as.
+	f, err := os.CreateTemp("", "ezproxy-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.WriteString(w.Content); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := command(escalate, []string{"mkdir", "-p", filepath.Dir(w.Path)}, nil).Run(); err != nil {
+		return err
+	}
+	return command(escalate, []string{"install", "-m", fmt.Sprintf("%04o", w.Mode), f.Name(), w.Path}, nil).Run()
+}
+
+// RemoveFile deletes Path. A missing file is not an error.
+type RemoveFile struct {
+	Path string
+}
+
+func (r RemoveFile) String() string {
+	return "delete " + r.Path
+}
+
+func (r RemoveFile) run(escalate []string) error {
+	if len(escalate) == 0 {
+		if err := os.Remove(r.Path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	return command(escalate, []string{"rm", "-f", "--", r.Path}, nil).Run()
+}
+
+// Run runs the program Argv[0] with the arguments in the rest of Argv.
+// Stdin, if set, is passed to it on standard input.
+type Run struct {
+	Argv  []string
+	Stdin string
+}
+
+func (r Run) String() string {
+	words := make([]string, len(r.Argv))
+	for i, arg := range r.Argv {
+		words[i] = escape.Shell(arg)
+	}
+	s := "run " + strings.Join(words, " ")
+	if r.Stdin != "" {
+		s += " (with input below)"
+	}
+	return s
+}
+
+func (r Run) run(escalate []string) error {
+	var stdin io.Reader
+	if r.Stdin != "" {
+		stdin = strings.NewReader(r.Stdin)
+	}
+	return command(escalate, r.Argv, stdin).Run()
+}
+
+// RestartUnit reloads the systemd unit files and restarts Unit, so a
+// drop-in written before it takes effect.
+type RestartUnit struct {
+	Unit string
+}
+
+func (r RestartUnit) String() string {
+	return "restart " + r.Unit + " (systemctl daemon-reload, then systemctl restart " + r.Unit + ")"
+}
+
+func (r RestartUnit) run(escalate []string) error {
+	if err := command(escalate, []string{"systemctl", "daemon-reload"}, nil).Run(); err != nil {
+		return err
+	}
+	return command(escalate, []string{"systemctl", "restart", r.Unit}, nil).Run()
+}
+
+// command returns argv run through escalate. Its output goes with the
+// report's; without stdin it reads ours, so sudo can ask for a password.
+func command(escalate, argv []string, stdin io.Reader) *exec.Cmd {
+	argv = append(append([]string{}, escalate...), argv...)
+	c := exec.Command(argv[0], argv[1:]...)
+	if stdin == nil {
+		stdin = os.Stdin
+	}
+	c.Stdin = stdin
+	c.Stdout = report.Output()
+	c.Stderr = os.Stderr
+	return c
+}
+
+// entry is a queued action and the tool it is for, or, with then set, a
+// function to call once the tool's actions before it have succeeded.
+type entry struct {
+	tool    string
+	action  Action
+	removal bool
+	then    func()
+}
+
+var queue []entry
+
+// Add queues actions that apply tool's configuration. They run in order,
+// and if one fails the rest of tool's are skipped and the tool is
+// reported as failed.
+func Add(tool string, actions ...Action) {
+	for _, a := range actions {
+		queue = append(queue, entry{tool: tool, action: a})
+	}
+}
+
+// AddRemoval queues actions that undo tool's configuration. They are
+// best-effort: a failure is a warning and the rest still run.
+func AddRemoval(tool string, actions ...Action) {
+	for _, a := range actions {
+		queue = append(queue, entry{tool: tool, action: a, removal: true})
+	}
+}
+
+// Backup records each file that actions write or delete in the active
+// snapshot, as it is now, so that a rollback can put it back (see
+// fileutil.BackupRootFile).
+func Backup(actions ...Action) error {
+	for _, a := range actions {
+		var path string
+		switch a := a.(type) {
+		case WriteFile:
+			path = a.Path
+		case RemoveFile:
+			path = a.Path
+		default:
+			continue
+		}
+		if err := fileutil.BackupRootFile(path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// AddRestore queues the actions that put back the files in s that only
+// root can write, which s.Restore skips. Like Restore, it records them in
+// the active snapshot first.
+func AddRestore(s *fileutil.Snapshot) error {
+	var actions []Action
+	for i := len(s.Entries) - 1; i >= 0; i-- {
+		e := s.Entries[i]
+		if !e.Root {
+			continue
+		}
+		if !e.Existed {
+			actions = append(actions, RemoveFile{Path: e.Path})
+			continue
+		}
+		data, err := s.ReadBackup(e)
+		if err != nil {
+			return fmt.Errorf("restoring %s: %w", e.Path, err)
+		}
+		actions = append(actions, WriteFile{Path: e.Path, Content: string(data), Mode: e.Mode})
+	}
+	if err := Backup(actions...); err != nil {
+		return err
+	}
+	Add("rollback", actions...)
+	return nil
+}
+
+// Then queues fn to be called once the actions already queued for tool
+// have been carried out, so that what they did can be recorded. fn is not
+// called in a dry run, nor if one of tool's apply actions failed or the
+// actions were not run at all.
+func Then(tool string, fn func()) {
+	queue = append(queue, entry{tool: tool, then: fn})
+}
+
+// Escalation returns the command that runs a program as root: nothing when
+// ezproxy already is root, otherwise the first of sudo, doas and pkexec
+// that is installed. Tests may replace it.
+var Escalation = func() ([]string, error) {
+	if os.Geteuid() == 0 {
+		return nil, nil
+	}
+	for _, name := range []string{"sudo", "doas", "pkexec"} {
+		if _, err := exec.LookPath(name); err == nil {
+			return []string{name}, nil
+		}
+	}
+	return nil, errors.New("none of sudo, doas or pkexec is installed; re-run ezproxy as root to make these changes")
+}
+
+// Flush lists the queued actions, asks once whether to carry them out, and
+// runs them, then empties the queue. Failures are reported against the
+// tool each action was for. It returns the number of tools whose apply
+// actions failed, plus, when the actions couldn't run or the user
+// declined them, every tool that had actions queued. With fileutil.DryRun
+// it only shows the files as diffs and lists the actions.
+func Flush() int {
+	if len(queue) == 0 {
+		return 0
+	}
+	var pending []entry
+	for _, e := range queue {
+		if e.then == nil {
+			pending = append(pending, e)
+		}
+	}
+	all := queue
+	queue = nil
+	if len(pending) == 0 {
+		if !fileutil.DryRun {
+			for _, e := range all {
+				e.then()
+			}
+		}
+		return 0
+	}
+
+	escalate, escErr := Escalation()
+	via := "as root"
+	if len(escalate) > 0 {
+		via = "with " + escalate[0]
+	}
+	if fileutil.DryRun {
+		previewFiles(pending)
+		report.Printf("\n[dry-run] Would make these changes %s:\n", via)
+		summarize(pending)
+		return 0
+	}
+	if escErr != nil {
+		report.Printf("\nThese changes need root:\n")
+		list(pending)
+		report.Errorf("Error: %v\n", escErr)
+		return notRun(pending, "error")
+	}
+
+	report.Printf("\nThese changes need root and will be made %s:\n", via)
+	list(pending)
+	if !confirm() {
+		return notRun(pending, "skipped")
+	}
+
+	failedTools := map[string]bool{}
+	failed := 0
+	for _, e := range all {
+		if failedTools[e.tool] {
+			continue
+		}
+		if e.then != nil {
+			e.then()
+			continue
+		}
+		err := e.action.run(escalate)
+		if err == nil {
+			continue
+		}
+		t := report.ResumeTool(e.tool)
+		if e.removal {
+			report.Warnf("  [%s] Warning: %s: %v\n", e.tool, e.action, err)
+		} else {
+			t.Status = "error"
+			report.Errorf("  [%s] ERROR: %s: %v\n", e.tool, e.action, err)
+			failedTools[e.tool] = true
+			failed++
+		}
+		report.EndTool()
+	}
+	return failed
+}
+
+// notRun reports that none of pending ran, giving each tool status, and
+// returns the number of tools. A tool with apply actions is reported as
+// not applied; one with only removals as not fully removed.
+func notRun(pending []entry, status string) int {
+	var tools []string
+	applying := map[string]bool{}
+	for _, e := range pending {
+		if _, seen := applying[e.tool]; !seen {
+			tools = append(tools, e.tool)
+		}
+		applying[e.tool] = applying[e.tool] || !e.removal
+	}
+	for _, tool := range tools {
+		report.ResumeTool(tool).Status = status
+		if applying[tool] {
+			report.Errorf("  [%s] not applied: its changes that need root were not made\n", tool)
+		} else {
+			report.Warnf("  [%s] not fully removed: its changes that need root were not made\n", tool)
+		}
+		report.EndTool()
+	}
+	return len(tools)
+}
+
+// list prints pending, with the content of each file to be written and
+// the input of each program, line for line.
+func list(pending []entry) {
+	for _, e := range pending {
+		report.Printf("  [%s] %s\n", e.tool, e.action)
+		switch a := e.action.(type) {
+		case WriteFile:
+			printContent(a.Content)
+		case Run:
+			printContent(a.Stdin)
+		}
+	}
+}
+
+// previewFiles shows, as diffs against their current content, the files
+// pending would write or delete, each against the tool it is for.
+func previewFiles(pending []entry) {
+	for _, e := range pending {
+		var err error
+		switch a := e.action.(type) {
+		case WriteFile:
+			report.ResumeTool(e.tool)
+			err = fileutil.WriteFile(a.Path, []byte(a.Content), a.Mode)
+		case RemoveFile:
+			report.ResumeTool(e.tool)
+			err = fileutil.RemoveFile(a.Path)
+		default:
+			continue
+		}
+		if err != nil {
+			report.Warnf("  [%s] Warning: can't preview %s: %v\n", e.tool, e.action, err)
+		}
+		report.EndTool()
+	}
+}
+
+// summarize prints pending one action a line, as a dry run does after the
+// diffs of the files, with the input of each program.
+func summarize(pending []entry) {
+	for _, e := range pending {
+		report.Printf("  [%s] %s\n", e.tool, e.action)
+		if r, ok := e.action.(Run); ok {
+			printContent(r.Stdin)
+		}
+	}
+}
+
+// printContent prints s indented behind a bar, so that leading and
+// trailing whitespace shows, and notes a missing final newline.
+func printContent(s string) {
+	if s == "" {
+		return
+	}
+	lines := strings.SplitAfter(s, "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	for _, line := range lines {
+		report.Printf("      | %s\n", strings.TrimSuffix(line, "\n"))
+	}
+	if !strings.HasSuffix(s, "\n") {
+		report.Printf("      (no newline at end of file)\n")
+	}
+}
+
+// confirm asks whether to make the changes just listed. With --yes it
+// doesn't ask; in JSON mode without --yes there is no one to ask, so the
+// changes are skipped.
+func confirm() bool {
+	if fileutil.AutoYes {
+		return true
+	}
+	if report.JSON {
+		report.Warnf("changes that need root were skipped; re-run with --yes to make them")
+		return false
+	}
+	var ok bool
+	err := huh.NewConfirm().
+		Title("Make these changes now?").
+		Affirmative("Yes").
+		Negative("No").
+		Value(&ok).
+		Run()
+	if err != nil || !ok {
+		report.Warnf("  Skipped. Make the changes above as root yourself.\n")
+		return false
+	}
+	return true
+}
@@ -0,0 +1,249 @@
+package privileged
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/andrew/ezproxy/internal/fileutil"
+	"github.com/andrew/ezproxy/internal/report"
+)
+
+// hostileContent would run a command if it were pasted into a shell.
+const hostileContent = "[Service]\nEnvironment=\"HTTP_PROXY=http://a'b:$(touch pwned)@proxy:8080\"\n'; touch pwned; echo '\n%s %d\n"
+
+// withEscalation runs Flush with escalate standing in for sudo, --yes and
+// the report collected as JSON, and returns the number of failed tools.
+func withEscalation(t *testing.T, escalate []string) (int, *report.Run) {
+	t.Helper()
+	saved := Escalation
+	Escalation = func() ([]string, error) { return escalate, nil }
+	fileutil.AutoYes = true
+	report.JSON = true
+	defer func() {
+		Escalation = saved
+		fileutil.AutoYes = false
+		report.JSON = false
+	}()
+	r := report.Start("apply")
+	return Flush(), r
+}
+
+func TestFlushWritesWithoutAShell(t *testing.T) {
+	// "env" runs the program it is given as it is, like sudo does.
+	for name, escalate := range map[string][]string{"escalated": {"env"}, "root": nil} {
+		t.Run(name, func(t *testing.T) {
+			dir := t.TempDir()
+			t.Chdir(dir)
+			path := filepath.Join(dir, "it's a $dir", "drop-in.conf")
+			copied := filepath.Join(dir, "copied")
+			Add("docker",
+				WriteFile{Path: path, Content: hostileContent, Mode: 0640},
+				Run{Argv: []string{"cp", "/dev/stdin", copied}, Stdin: hostileContent},
+			)
+			if failed, r := withEscalation(t, escalate); failed != 0 {
+				t.Fatalf("failed = %d: %+v", failed, r)
+			}
+			for _, p := range []string{path, copied} {
+				if data, _ := os.ReadFile(p); string(data) != hostileContent {
+					t.Errorf("%s holds\n%s\nwant\n%s", p, data, hostileContent)
+				}
+			}
+			if info, err := os.Stat(path); err != nil || info.Mode().Perm() != 0640 {
+				t.Errorf("mode = %v, %v", info.Mode(), err)
+			}
+			if _, err := os.Stat(filepath.Join(dir, "pwned")); err == nil {
+				t.Error("the content ran a command")
+			}
+
+			AddRemoval("docker", RemoveFile{Path: path}, RemoveFile{Path: path})
+			if failed, _ := withEscalation(t, escalate); failed != 0 {
+				t.Errorf("remove failed = %d", failed)
+			}
+			if _, err := os.Stat(path); !os.IsNotExist(err) {
+				t.Errorf("%s not deleted: %v", path, err)
+			}
+		})
+	}
+}
+
+func TestFlushAttributesFailures(t *testing.T) {
+	dir := t.TempDir()
+	report.Start("apply")
+	report.BeginTool("apt")
+	report.EndTool()
+	Add("apt", Run{Argv: []string{"false"}}, WriteFile{Path: filepath.Join(dir, "skipped"), Content: "x\n", Mode: 0644})
+	AddRemoval("snap", Run{Argv: []string{"false"}}, WriteFile{Path: filepath.Join(dir, "written"), Content: "x\n", Mode: 0644})
+
+	saved := Escalation
+	Escalation = func() ([]string, error) { return []string{"env"}, nil }
+	defer func() { Escalation = saved }()
+	fileutil.AutoYes = true
+	report.JSON = true
+	defer func() {
+		fileutil.AutoYes = false
+		report.JSON = false
+	}()
+	if failed := Flush(); failed != 1 {
+		t.Errorf("failed = %d, want 1", failed)
+	}
+	tools := report.Current().Tools
+	if len(tools) != 2 || tools[0].Name != "apt" || tools[0].Status != "error" || len(tools[0].Errors) != 1 {
+		t.Fatalf("apt result = %+v", tools[0])
+	}
+	if tools[1].Name != "snap" || len(tools[1].Warnings) != 1 || len(tools[1].Errors) != 0 {
+		t.Errorf("snap result = %+v", tools[1])
+	}
+	if _, err := os.Stat(filepath.Join(dir, "skipped")); err == nil {
+		t.Error("apt's next action ran after one failed")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "written")); err != nil {
+		t.Error("a failed removal stopped the rest")
+	}
+}
+
+func TestThenRunsAfterSuccess(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "drop-in.conf")
+	var recorded []string
+	record := func(tool string) func() {
+		return func() {
+			if _, err := os.Stat(path); err != nil {
+				t.Errorf("%s recorded before the file was written", tool)
+			}
+			recorded = append(recorded, tool)
+		}
+	}
+	Add("docker", WriteFile{Path: path, Content: "x\n", Mode: 0644})
+	Then("docker", record("docker"))
+	Add("apt", Run{Argv: []string{"false"}})
+	Then("apt", record("apt"))
+	withEscalation(t, nil)
+	if strings.Join(recorded, ",") != "docker" {
+		t.Errorf("recorded = %q, want only docker", recorded)
+	}
+
+	recorded = nil
+	Add("docker", WriteFile{Path: path, Content: "x\n", Mode: 0644})
+	Then("docker", record("docker"))
+	fileutil.DryRun = true
+	defer func() { fileutil.DryRun = false }()
+	withEscalation(t, nil)
+	if len(recorded) != 0 {
+		t.Error("a dry run recorded the change")
+	}
+}
+
+func TestFlushCountsSkippedTools(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "99ezproxy")
+	report.JSON = true
+	defer func() { report.JSON = false }()
+	report.Start("apply")
+	Add("apt", WriteFile{Path: path, Content: "x\n", Mode: 0644})
+	Then("apt", func() { t.Error("recorded a skipped change") })
+	AddRemoval("snap", Run{Argv: []string{"snap", "unset", "system", "proxy.http"}})
+
+	// Without --yes, JSON mode has no one to confirm the changes.
+	if skipped := Flush(); skipped != 2 {
+		t.Errorf("skipped = %d, want 2", skipped)
+	}
+	tools := report.Current().Tools
+	if len(tools) != 2 || tools[0].Status != "skipped" || len(tools[0].Errors) != 1 || len(tools[1].Warnings) != 1 {
+		t.Errorf("tools = %+v", tools)
+	}
+	if _, err := os.Stat(path); err == nil {
+		t.Error("a skipped action ran")
+	}
+}
+
+func TestRollbackRestoresRootFiles(t *testing.T) {
+	dir := t.TempDir()
+	existing, created := filepath.Join(dir, "yum.conf"), filepath.Join(dir, "99ezproxy")
+	os.WriteFile(existing, []byte("[main]\n"), 0644)
+
+	snap := fileutil.BeginSnapshot(filepath.Join(dir, "backups"), "apply")
+	actions := []Action{
+		WriteFile{Path: existing, Content: "[main]\nproxy=http://proxy:8080\n", Mode: 0644},
+		WriteFile{Path: created, Content: "x\n", Mode: 0644},
+	}
+	if err := Backup(actions...); err != nil {
+		t.Fatal(err)
+	}
+	Add("yum", actions...)
+	withEscalation(t, nil)
+	fileutil.EndSnapshot()
+
+	// Restore leaves root's files to AddRestore.
+	if err := snap.Restore(); err != nil {
+		t.Fatal(err)
+	}
+	if !fileutil.Exists(created) {
+		t.Fatal("Restore wrote a root file itself")
+	}
+	if err := AddRestore(snap); err != nil {
+		t.Fatal(err)
+	}
+	if failed, r := withEscalation(t, nil); failed != 0 {
+		t.Fatalf("failed = %d: %+v", failed, r)
+	}
+	if data, _ := os.ReadFile(existing); string(data) != "[main]\n" {
+		t.Errorf("%s holds %q", existing, data)
+	}
+	if fileutil.Exists(created) {
+		t.Errorf("%s not deleted", created)
+	}
+}
+
+func TestDryRunShowsDiffs(t *testing.T) {
+	dir := t.TempDir()
+	conf, dropIn := filepath.Join(dir, "dnf.conf"), filepath.Join(dir, "ezproxy.conf")
+	os.WriteFile(conf, []byte("[main]\ngpgcheck=1\n"), 0644)
+	os.WriteFile(dropIn, []byte("[Service]\n"), 0644)
+	Add("yum", WriteFile{Path: conf, Content: "[main]\ngpgcheck=1\nproxy=http://proxy:8080\n", Mode: 0644})
+	AddRemoval("docker", RemoveFile{Path: dropIn})
+	AddRemoval("snap", Run{Argv: []string{"snap", "unset", "system", "proxy.http"}})
+	fileutil.DryRun = true
+	defer func() {
+		fileutil.DryRun = false
+		fileutil.ResetPreview()
+	}()
+	_, r := withEscalation(t, []string{"sudo"})
+
+	var diffs []string
+	for _, tool := range r.Tools {
+		diffs = append(diffs, tool.Messages...)
+	}
+	for _, want := range []string{
+		"--- " + conf + "\n+++ " + conf,
+		" gpgcheck=1\n+proxy=http://proxy:8080",
+		"+++ /dev/null",
+		"-[Service]",
+	} {
+		if !strings.Contains(strings.Join(diffs, "\n"), want) {
+			t.Errorf("dry run diffs lack %q:\n%s", want, strings.Join(diffs, "\n"))
+		}
+	}
+	summary := strings.Join(r.Messages, "\n")
+	for _, want := range []string{
+		"[dry-run] Would make these changes with sudo:",
+		"[yum] write " + conf + " (mode 0644)",
+		"[docker] delete " + dropIn,
+		"[snap] run snap unset system proxy.http",
+	} {
+		if !strings.Contains(summary, want) {
+			t.Errorf("dry run summary lacks %q:\n%s", want, summary)
+		}
+	}
+	if strings.Contains(summary, "| [main]") {
+		t.Errorf("dry run summary repeats the file content:\n%s", summary)
+	}
+	if data, _ := os.ReadFile(conf); string(data) != "[main]\ngpgcheck=1\n" {
+		t.Error("dry run wrote the file")
+	}
+	if _, err := os.Stat(dropIn); err != nil {
+		t.Error("dry run deleted the file")
+	}
+	if len(queue) != 0 {
+		t.Error("queue not emptied")
+	}
+}
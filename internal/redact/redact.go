@@ -0,0 +1,76 @@
+// Package redact hides proxy credentials in everything ezproxy prints or
+// records for people to read. A password shows as user:****, whether it
+// sits in a proxy URL or, once registered with Secret, anywhere else, such
+// as a <password> element in a dry-run preview of settings.xml.
+package redact
+
+import (
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// Mask replaces a password.
+const Mask = "****"
+
+// minSecret is the shortest registered secret masked outside URLs; shorter
+// ones would mask ordinary text.
+const minSecret = 4
+
+var (
+	// userinfoRe matches the user:password@ part of a URL.
+	userinfoRe = regexp.MustCompile(`([a-zA-Z][a-zA-Z0-9+.-]*://)([^:@/\s"'<>]*):([^@/\s"'<>]+)@`)
+
+	mu      sync.Mutex
+	secrets []string
+)
+
+// Secret registers a password to be masked wherever it appears, as well
+// as in its URL-encoded form.
+func Secret(s string) {
+	if len(s) < minSecret {
+		return
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	encoded := strings.TrimPrefix(url.UserPassword("", s).String(), ":")
+	for _, v := range []string{s, encoded} {
+		if !contains(secrets, v) {
+			secrets = append(secrets, v)
+		}
+	}
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// URL returns a proxy URL with its password masked. Other strings are
+// returned unchanged.
+func URL(s string) string {
+	return userinfoRe.ReplaceAllString(s, "${1}${2}:"+Mask+"@")
+}
+
+// String masks URL passwords and registered secrets in s.
+func String(s string) string {
+	s = URL(s)
+	mu.Lock()
+	defer mu.Unlock()
+	for _, secret := range secrets {
+		s = strings.ReplaceAll(s, secret, Mask)
+	}
+	return s
+}
+
+// Reset forgets the registered secrets.
+func Reset() {
+	mu.Lock()
+	defer mu.Unlock()
+	secrets = nil
+}
@@ -0,0 +1,100 @@
+package relay
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"strings"
+	"testing"
+	"unicode/utf16"
+)
+
+func TestMD4(t *testing.T) {
+	// RFC 1320 appendix A.5.
+	tests := map[string]string{
+		"":    "31d6cfe0d16ae931b73c59d7e0c089c0",
+		"abc": "a448017aaf21d8525fc10ae87aa6729d",
+		"12345678901234567890123456789012345678901234567890123456789012345678901234567890": "e33b4ddc9c38f2199c3e7b164fcc0536",
+	}
+	for in, want := range tests {
+		got := md4([]byte(in))
+		if hex.EncodeToString(got[:]) != want {
+			t.Errorf("md4(%q) = %x, want %s", in, got, want)
+		}
+	}
+}
+
+// Test vectors from MS-NLMP section 4.2.4.
+func TestNTLMv2(t *testing.T) {
+	hash := ntlmV2Hash("Password", "User", "Domain")
+	if got := hex.EncodeToString(hash); got != "0c868a403bfd7a93a3001ef22ef02e3f" {
+		t.Errorf("NTOWFv2 = %s", got)
+	}
+	serverChallenge, _ := hex.DecodeString("0123456789abcdef")
+	clientChallenge := bytes.Repeat([]byte{0xaa}, 8)
+	targetInfo, _ := hex.DecodeString("02000c0044006f006d00610069006e0001000c0053006500720076006500720000000000")
+
+	nt := ntlmV2Response(hash, serverChallenge, clientChallenge, 0, targetInfo)
+	if got := hex.EncodeToString(nt[:16]); got != "68cd0ab851e51c96aabc927bebef6a1c" {
+		t.Errorf("NTProofStr = %s", got)
+	}
+	lm := hmacMD5(hash, serverChallenge, clientChallenge)
+	if got := hex.EncodeToString(lm); got != "86c35097ac9cec102554764a57cccc19" {
+		t.Errorf("LMv2 = %s", got)
+	}
+}
+
+// challengeMessage builds an NTLM type 2 message for tests.
+func challengeMessage(challenge, targetInfo []byte) string {
+	msg := make([]byte, 48)
+	copy(msg, ntlmSignature)
+	binary.LittleEndian.PutUint32(msg[8:], 2)
+	binary.LittleEndian.PutUint32(msg[16:], 48)
+	binary.LittleEndian.PutUint32(msg[20:], ntlmFlags)
+	copy(msg[24:], challenge)
+	binary.LittleEndian.PutUint16(msg[40:], uint16(len(targetInfo)))
+	binary.LittleEndian.PutUint16(msg[42:], uint16(len(targetInfo)))
+	binary.LittleEndian.PutUint32(msg[44:], 48)
+	return "NTLM " + base64.StdEncoding.EncodeToString(append(msg, targetInfo...))
+}
+
+// authenticateUser returns the domain and user name from an NTLM type 3
+// header value.
+func authenticateUser(t *testing.T, header string) (domain, user string) {
+	t.Helper()
+	data, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(header, "NTLM "))
+	if err != nil || len(data) < 64 || binary.LittleEndian.Uint32(data[8:]) != 3 {
+		t.Fatalf("not an NTLM authenticate message: %q", header)
+	}
+	field := func(pos int) string {
+		length := binary.LittleEndian.Uint16(data[pos:])
+		offset := binary.LittleEndian.Uint32(data[pos+4:])
+		raw := data[offset : offset+uint32(length)]
+		u := make([]uint16, len(raw)/2)
+		for i := range u {
+			u[i] = binary.LittleEndian.Uint16(raw[2*i:])
+		}
+		return string(utf16.Decode(u))
+	}
+	return field(28), field(36)
+}
+
+func TestNTLM_Handshake(t *testing.T) {
+	n := &NTLM{Domain: "CORP", Username: "alice", Password: "secret", clientChallenge: bytes.Repeat([]byte{1}, 8)}
+	start, _ := n.Start()
+	if !strings.HasPrefix(start, "NTLM ") {
+		t.Fatalf("Start = %q", start)
+	}
+	if next, err := n.Next([]string{"Basic realm=x"}); err != nil || next != "" {
+		t.Errorf("Next without NTLM challenge = %q, %v", next, err)
+	}
+	next, err := n.Next([]string{"Basic realm=x", challengeMessage([]byte("12345678"), nil)})
+	if err != nil {
+		t.Fatalf("Next: %v", err)
+	}
+	domain, user := authenticateUser(t, next)
+	if domain != "CORP" || user != "alice" {
+		t.Errorf("authenticate carries %s\\%s, want CORP\\alice", domain, user)
+	}
+}
@@ -0,0 +1,288 @@
+// Package relay implements the local forward proxy run by "ezproxy serve".
+// Tools are pointed at it on 127.0.0.1 and need no credentials of their
+// own: the relay adds Basic or NTLM authentication when it forwards to the
+// upstream proxy, and sends NO_PROXY destinations direct. It replaces a
+// separate cntlm setup.
+package relay
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/andrew/ezproxy/internal/noproxy"
+)
+
+// Server is an HTTP forward proxy handling CONNECT and plain HTTP.
+type Server struct {
+	// HTTP is the upstream proxy for plain HTTP requests and HTTPS the
+	// one for CONNECT; either falls back to the other. With neither set
+	// every request goes direct.
+	HTTP  *url.URL
+	HTTPS *url.URL
+
+	NoProxy string        // destinations reached directly
+	Auth    Authenticator // nil sends no credentials upstream
+	Logf    func(format string, args ...any)
+
+	dialer net.Dialer
+}
+
+func (s *Server) logf(format string, args ...any) {
+	if s.Logf != nil {
+		s.Logf(format, args...)
+	}
+}
+
+func (s *Server) upstream(connect bool) *url.URL {
+	if connect && s.HTTPS != nil {
+		return s.HTTPS
+	}
+	if s.HTTP != nil {
+		return s.HTTP
+	}
+	return s.HTTPS
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case r.Method == http.MethodConnect:
+		s.serveConnect(w, r)
+	case r.URL.IsAbs():
+		s.serveHTTP(w, r)
+	default:
+		http.Error(w, "ezproxy relay: this is a proxy; send absolute URLs or CONNECT", http.StatusBadRequest)
+	}
+}
+
+func (s *Server) serveConnect(w http.ResponseWriter, r *http.Request) {
+	target := r.Host
+	up := s.upstream(true)
+	var (
+		conn net.Conn
+		err  error
+	)
+	if up == nil || Bypass(s.NoProxy, target) {
+		s.logf("CONNECT %s direct", target)
+		conn, err = s.dialer.DialContext(r.Context(), "tcp", target)
+	} else {
+		s.logf("CONNECT %s via %s", target, up.Host)
+		conn, err = s.connectUpstream(r.Context(), up, target)
+	}
+	if err != nil {
+		s.logf("CONNECT %s: %v", target, err)
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	client, buf, err := w.(http.Hijacker).Hijack()
+	if err != nil {
+		conn.Close()
+		return
+	}
+	if _, err := io.WriteString(client, "HTTP/1.1 200 Connection established\r\n\r\n"); err != nil {
+		client.Close()
+		conn.Close()
+		return
+	}
+	// Anything the client sent after the CONNECT request belongs to the
+	// tunnel.
+	if n := buf.Reader.Buffered(); n > 0 {
+		data, _ := buf.Reader.Peek(n)
+		conn.Write(data)
+	}
+	pipe(client, conn)
+}
+
+// pipe copies between a and b until either side closes.
+func pipe(a, b net.Conn) {
+	done := make(chan struct{})
+	go func() {
+		io.Copy(a, b)
+		a.Close()
+		close(done)
+	}()
+	io.Copy(b, a)
+	b.Close()
+	<-done
+}
+
+// connectUpstream opens a tunnel to target through the upstream proxy.
+func (s *Server) connectUpstream(ctx context.Context, up *url.URL, target string) (net.Conn, error) {
+	conn, err := s.dialer.DialContext(ctx, "tcp", hostPort(up))
+	if err != nil {
+		return nil, err
+	}
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: target},
+		Host:   target,
+		Header: make(http.Header),
+	}
+	br := bufio.NewReader(conn)
+	resp, err := s.exchange(conn, br, req, nil, req.Write)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, fmt.Errorf("upstream proxy answered CONNECT with %s", resp.Status)
+	}
+	if br.Buffered() > 0 {
+		conn.Close()
+		return nil, fmt.Errorf("upstream proxy sent data before the tunnel was established")
+	}
+	return conn, nil
+}
+
+// exchange sends req on conn and reads the response, answering 407
+// challenges with s.Auth on the same connection. body is replayed on each
+// attempt.
+func (s *Server) exchange(conn net.Conn, br *bufio.Reader, req *http.Request, body []byte, write func(io.Writer) error) (*http.Response, error) {
+	auth := ""
+	if s.Auth != nil {
+		var err error
+		if auth, err = s.Auth.Start(); err != nil {
+			return nil, err
+		}
+	}
+	for attempt := 0; ; attempt++ {
+		if auth != "" {
+			req.Header.Set("Proxy-Authorization", auth)
+		}
+		if body != nil {
+			req.Body = io.NopCloser(bytes.NewReader(body))
+			req.ContentLength = int64(len(body))
+		}
+		if err := write(conn); err != nil {
+			return nil, err
+		}
+		resp, err := http.ReadResponse(br, req)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode != http.StatusProxyAuthRequired || s.Auth == nil || attempt >= 2 {
+			return resp, nil
+		}
+		next, err := s.Auth.Next(resp.Header.Values("Proxy-Authenticate"))
+		if err != nil || next == "" || resp.Close {
+			return resp, err
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		auth = next
+	}
+}
+
+// hopHeaders are removed before forwarding (RFC 9110 section 7.6.1).
+var hopHeaders = []string{
+	"Connection", "Keep-Alive", "Proxy-Authenticate", "Proxy-Authorization",
+	"Proxy-Connection", "Te", "Trailer", "Transfer-Encoding", "Upgrade",
+}
+
+func (s *Server) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	out := r.Clone(r.Context())
+	out.RequestURI = ""
+	for _, h := range hopHeaders {
+		out.Header.Del(h)
+	}
+
+	up := s.upstream(false)
+	var (
+		resp *http.Response
+		err  error
+	)
+	if up == nil || Bypass(s.NoProxy, r.URL.Host) {
+		s.logf("%s %s direct", r.Method, r.URL)
+		resp, err = directTransport.RoundTrip(out)
+	} else {
+		s.logf("%s %s via %s", r.Method, r.URL, up.Host)
+		resp, err = s.forward(out, up)
+	}
+	if err != nil {
+		s.logf("%s %s: %v", r.Method, r.URL, err)
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+
+	for _, h := range hopHeaders {
+		resp.Header.Del(h)
+	}
+	for k, vs := range resp.Header {
+		for _, v := range vs {
+			w.Header().Add(k, v)
+		}
+	}
+	w.WriteHeader(resp.StatusCode)
+	io.Copy(w, resp.Body)
+}
+
+var directTransport = &http.Transport{
+	Proxy:                 nil,
+	DialContext:           (&net.Dialer{Timeout: 30 * time.Second}).DialContext,
+	ResponseHeaderTimeout: 2 * time.Minute,
+}
+
+// forward sends a plain HTTP request through the upstream proxy on a
+// connection of its own, which NTLM needs for its handshake. The request
+// body is buffered so it can be resent after a challenge.
+func (s *Server) forward(req *http.Request, up *url.URL) (*http.Response, error) {
+	var body []byte
+	if req.Body != nil {
+		var err error
+		if body, err = io.ReadAll(req.Body); err != nil {
+			return nil, err
+		}
+		req.Body.Close()
+	}
+	conn, err := s.dialer.DialContext(req.Context(), "tcp", hostPort(up))
+	if err != nil {
+		return nil, err
+	}
+	req.Close = true
+	br := bufio.NewReader(conn)
+	resp, err := s.exchange(conn, br, req, body, req.WriteProxy)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	resp.Body = &closeBoth{ReadCloser: resp.Body, conn: conn}
+	return resp, nil
+}
+
+type closeBoth struct {
+	io.ReadCloser
+	conn net.Conn
+}
+
+func (c *closeBoth) Close() error {
+	c.ReadCloser.Close()
+	return c.conn.Close()
+}
+
+func hostPort(u *url.URL) string {
+	port := u.Port()
+	if port == "" {
+		port = "80"
+		if u.Scheme == "https" {
+			port = "443"
+		}
+	}
+	return net.JoinHostPort(u.Hostname(), port)
+}
+
+// Bypass reports whether addr (host or host:port) matches a NO_PROXY
+// entry: "*", an exact host, a domain suffix (".corp.com" or "corp.com"
+// also match subdomains), an IP, or a CIDR range.
+func Bypass(noProxy, addr string) bool {
+	return noproxy.Parse(noProxy).Match(addr)
+}
@@ -0,0 +1,223 @@
+package relay
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// upstreamProxy is a test forward proxy that requires the given
+// Proxy-Authorization value ("" = none) and handles CONNECT and plain HTTP.
+func upstreamProxy(t *testing.T, wantAuth string) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if wantAuth != "" && r.Header.Get("Proxy-Authorization") != wantAuth {
+			w.Header().Set("Proxy-Authenticate", `Basic realm="corp"`)
+			http.Error(w, "auth required", http.StatusProxyAuthRequired)
+			return
+		}
+		tunnel(w, r)
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// tunnel completes a CONNECT or forwards a plain HTTP request.
+func tunnel(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodConnect {
+		r.RequestURI = ""
+		r.Header.Del("Proxy-Authorization")
+		resp, err := http.DefaultTransport.RoundTrip(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		defer resp.Body.Close()
+		w.Header().Set("X-Via-Upstream", "1")
+		w.WriteHeader(resp.StatusCode)
+		io.Copy(w, resp.Body)
+		return
+	}
+	upstream, err := net.Dial("tcp", r.Host)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	conn, _, _ := w.(http.Hijacker).Hijack()
+	io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n")
+	pipe(conn, upstream)
+}
+
+// startRelay serves s and returns an HTTP client that uses it as proxy.
+func startRelay(t *testing.T, s *Server, roots *x509.CertPool) *http.Client {
+	t.Helper()
+	srv := httptest.NewServer(s)
+	t.Cleanup(srv.Close)
+	u, _ := url.Parse(srv.URL)
+	tr := &http.Transport{Proxy: http.ProxyURL(u)}
+	if roots != nil {
+		tr.TLSClientConfig = &tls.Config{RootCAs: roots}
+	}
+	t.Cleanup(tr.CloseIdleConnections)
+	return &http.Client{Transport: tr}
+}
+
+func mustParse(t *testing.T, raw string) *url.URL {
+	t.Helper()
+	u, err := url.Parse(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return u
+}
+
+func get(t *testing.T, c *http.Client, target string) (*http.Response, string) {
+	t.Helper()
+	resp, err := c.Get(target)
+	if err != nil {
+		t.Fatalf("GET %s: %v", target, err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	return resp, string(body)
+}
+
+func TestRelay_BasicAuthConnectAndHTTP(t *testing.T) {
+	basic := &Basic{Username: "alice", Password: "s3cr&t"}
+	want, _ := basic.Start()
+	up := upstreamProxy(t, want)
+
+	tlsTarget := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "secure")
+	}))
+	defer tlsTarget.Close()
+	plainTarget := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Proxy-Authorization") != "" {
+			t.Error("credentials leaked to the origin server")
+		}
+		io.WriteString(w, "plain")
+	}))
+	defer plainTarget.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(tlsTarget.Certificate())
+	client := startRelay(t, &Server{HTTP: mustParse(t, up.URL), Auth: basic}, roots)
+
+	if resp, body := get(t, client, tlsTarget.URL); resp.StatusCode != 200 || body != "secure" {
+		t.Errorf("HTTPS via relay = %d %q", resp.StatusCode, body)
+	}
+	resp, body := get(t, client, plainTarget.URL)
+	if resp.StatusCode != 200 || body != "plain" {
+		t.Errorf("HTTP via relay = %d %q", resp.StatusCode, body)
+	}
+	if resp.Header.Get("X-Via-Upstream") == "" {
+		t.Error("plain HTTP request did not go through the upstream proxy")
+	}
+}
+
+func TestRelay_WithoutCredentialsGets407(t *testing.T) {
+	up := upstreamProxy(t, "Basic c29tZW9uZQ==")
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer target.Close()
+
+	client := startRelay(t, &Server{HTTP: mustParse(t, up.URL)}, nil)
+	if resp, _ := get(t, client, target.URL); resp.StatusCode != http.StatusProxyAuthRequired {
+		t.Errorf("status = %d, want 407", resp.StatusCode)
+	}
+}
+
+func TestRelay_NTLMConnect(t *testing.T) {
+	var (
+		mu    sync.Mutex
+		steps []string // remote address of each step
+		user  string
+	)
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth := r.Header.Get("Proxy-Authorization")
+		mu.Lock()
+		steps = append(steps, r.RemoteAddr)
+		mu.Unlock()
+		switch {
+		case auth == "":
+			w.Header().Set("Proxy-Authenticate", "NTLM")
+			http.Error(w, "auth", http.StatusProxyAuthRequired)
+		case strings.HasPrefix(auth, "NTLM TlRMTVNTUAABAAAA"): // type 1
+			w.Header().Set("Proxy-Authenticate", challengeMessage([]byte("servchal"), nil))
+			http.Error(w, "auth", http.StatusProxyAuthRequired)
+		default:
+			var domain string
+			domain, user = authenticateUser(t, auth)
+			user = domain + `\` + user
+			tunnel(w, r)
+		}
+	}))
+	defer up.Close()
+
+	tlsTarget := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ok")
+	}))
+	defer tlsTarget.Close()
+	roots := x509.NewCertPool()
+	roots.AddCert(tlsTarget.Certificate())
+
+	ntlm := &NTLM{Domain: "CORP", Username: "alice", Password: "pw"}
+	client := startRelay(t, &Server{HTTPS: mustParse(t, up.URL), Auth: ntlm}, roots)
+	if resp, body := get(t, client, tlsTarget.URL); resp.StatusCode != 200 || body != "ok" {
+		t.Fatalf("HTTPS via NTLM relay = %d %q", resp.StatusCode, body)
+	}
+	if user != `CORP\alice` {
+		t.Errorf("upstream saw user %q", user)
+	}
+	if len(steps) != 2 || steps[0] != steps[1] {
+		t.Errorf("NTLM handshake steps %v, want 2 on one connection", steps)
+	}
+}
+
+func TestRelay_NoProxyGoesDirect(t *testing.T) {
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "should not be used", http.StatusForbidden)
+	}))
+	defer up.Close()
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "direct")
+	}))
+	defer target.Close()
+
+	client := startRelay(t, &Server{HTTP: mustParse(t, up.URL), NoProxy: "localhost,127.0.0.0/8"}, nil)
+	if resp, body := get(t, client, target.URL); resp.StatusCode != 200 || body != "direct" {
+		t.Errorf("NO_PROXY request = %d %q", resp.StatusCode, body)
+	}
+}
+
+func TestBypass(t *testing.T) {
+	noProxy := "localhost, .corp.com,example.org,10.0.0.0/8,::1,intranet:8443"
+	tests := map[string]bool{
+		"localhost:80":        true,
+		"git.corp.com:443":    true,
+		"corp.com":            true,
+		"notcorp.com":         false,
+		"a.example.org":       true,
+		"10.1.2.3:22":         true,
+		"11.1.2.3":            false,
+		"[::1]:8080":          true,
+		"intranet":            true,
+		"www.google.com:443":  false,
+		"LOCALHOST":           true,
+		"evil.com.corp.com.x": false,
+	}
+	for addr, want := range tests {
+		if got := Bypass(noProxy, addr); got != want {
+			t.Errorf("Bypass(%q) = %v, want %v", addr, got, want)
+		}
+	}
+	if !Bypass("*", "anything") {
+		t.Error(`"*" should bypass everything`)
+	}
+}
@@ -0,0 +1,188 @@
+// Package report collects what ezproxy does to each tool during a command.
+// Configurators send their messages here instead of printing directly, so
+// the same run can be shown as the usual text output or emitted as one JSON
+// document with --output json. Proxy passwords are masked in both.
+package report
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/andrew/ezproxy/internal/redact"
+)
+
+// JSON switches from printing messages as they happen to collecting them
+// for Flush.
+var JSON bool
+
+// Run is the result of one ezproxy command.
+type Run struct {
+	Command  string   `json:"command"`
+	Profile  string   `json:"profile,omitempty"`
+	DryRun   bool     `json:"dry_run"`
+	Backup   string   `json:"backup,omitempty"`
+	Tools    []*Tool  `json:"tools"`
+	Policy   []string `json:"policy_violations,omitempty"`
+	Messages []string `json:"messages,omitempty"`
+	Warnings []string `json:"warnings,omitempty"`
+	Errors   []string `json:"errors,omitempty"`
+}
+
+// Tool is the result for a single configurator.
+type Tool struct {
+	Name      string   `json:"name"`
+	Enabled   bool     `json:"enabled"`
+	Available bool     `json:"available"`
+	Action    string   `json:"action"` // apply, remove, status or skip
+	Status    string   `json:"status,omitempty"`
+	Files     []string `json:"files,omitempty"`
+	Messages  []string `json:"messages,omitempty"`
+	Warnings  []string `json:"warnings,omitempty"`
+	Errors    []string `json:"errors,omitempty"`
+}
+
+var (
+	run     = &Run{Tools: []*Tool{}}
+	current *Tool
+)
+
+// Start begins collecting results for command, discarding earlier ones.
+func Start(command string) *Run {
+	run = &Run{Command: command, Tools: []*Tool{}}
+	current = nil
+	return run
+}
+
+// Current returns the run being collected.
+func Current() *Run {
+	return run
+}
+
+// BeginTool starts the result for a tool. Messages, warnings and files are
+// attributed to it until EndTool or the next BeginTool.
+func BeginTool(name string) *Tool {
+	current = &Tool{Name: name}
+	run.Tools = append(run.Tools, current)
+	return current
+}
+
+// ResumeTool makes the result for name current again, for work done on a
+// tool's behalf after it ended, such as the privileged changes made at the
+// end of a command. If there is no result for name it begins one.
+func ResumeTool(name string) *Tool {
+	for _, t := range run.Tools {
+		if t.Name == name {
+			current = t
+			return t
+		}
+	}
+	return BeginTool(name)
+}
+
+// EndTool stops attributing messages to the current tool.
+func EndTool() {
+	current = nil
+}
+
+// Printf reports an informational message. In text mode it is printed as
+// is; in JSON mode it is stored with surrounding whitespace trimmed.
+func Printf(format string, args ...any) {
+	msg := redact.String(fmt.Sprintf(format, args...))
+	if !JSON {
+		fmt.Print(msg)
+		return
+	}
+	if msg = strings.TrimSpace(msg); msg == "" {
+		return
+	}
+	if current != nil {
+		current.Messages = append(current.Messages, msg)
+	} else {
+		run.Messages = append(run.Messages, msg)
+	}
+}
+
+// Warnf reports something the user should act on, such as a manual step
+// or a missing dependency.
+func Warnf(format string, args ...any) {
+	msg := redact.String(fmt.Sprintf(format, args...))
+	if !JSON {
+		fmt.Print(msg)
+		return
+	}
+	if msg = strings.TrimSpace(msg); msg == "" {
+		return
+	}
+	if current != nil {
+		current.Warnings = append(current.Warnings, msg)
+	} else {
+		run.Warnings = append(run.Warnings, msg)
+	}
+}
+
+// Errorf records an error. In text mode it is printed to stderr.
+func Errorf(format string, args ...any) {
+	msg := redact.String(fmt.Sprintf(format, args...))
+	if !JSON {
+		fmt.Fprint(os.Stderr, msg)
+		return
+	}
+	msg = strings.TrimSpace(msg)
+	if current != nil {
+		current.Errors = append(current.Errors, msg)
+	} else {
+		run.Errors = append(run.Errors, msg)
+	}
+}
+
+// File records that path was written or deleted by the current tool.
+func File(path string) {
+	if current == nil {
+		return
+	}
+	for _, f := range current.Files {
+		if f == path {
+			return
+		}
+	}
+	current.Files = append(current.Files, path)
+}
+
+// Output returns where command output that isn't a report (e.g. from
+// programs run on the user's behalf) should go: stdout normally, stderr in
+// JSON mode so stdout stays valid JSON.
+func Output() io.Writer {
+	if JSON {
+		return os.Stderr
+	}
+	return os.Stdout
+}
+
+// Color reports whether messages may use terminal colours: in text mode,
+// with stdout a terminal and NO_COLOR (https://no-color.org) unset.
+func Color() bool {
+	if JSON || os.Getenv("NO_COLOR") != "" {
+		return false
+	}
+	info, err := os.Stdout.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// Flush writes the collected run as JSON to w. It does nothing in text mode.
+func Flush(w io.Writer) error {
+	if !JSON {
+		return nil
+	}
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(run); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, redact.String(buf.String()))
+	return err
+}
@@ -0,0 +1,205 @@
+// Package state keeps a manifest of everything ezproxy has written, stored
+// in ~/.ezproxy/state.json. Configurators record the files they touch and
+// the previous value of every setting they overwrite, so that "remove" can
+// put back exactly what was there before instead of guessing.
+package state
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"time"
+
+	"github.com/andrew/ezproxy/internal/fileutil"
+)
+
+const currentVersion = 1
+
+// Manifest is the full state file, keyed by tool name.
+type Manifest struct {
+	Version int                   `json:"version"`
+	Tools   map[string]*ToolState `json:"tools"`
+}
+
+// ToolState records what one configurator applied.
+type ToolState struct {
+	Applied  time.Time   `json:"applied"`
+	Files    []FileState `json:"files,omitempty"`
+	Settings []Setting   `json:"settings,omitempty"`
+	Commands [][]string  `json:"commands,omitempty"`
+}
+
+// FileState describes a file ezproxy wrote to.
+type FileState struct {
+	Path    string `json:"path"`
+	Created bool   `json:"created"` // file did not exist before ezproxy wrote it
+	Hash    string `json:"hash"`    // sha256 of the content right after apply
+}
+
+// Setting is a single key ezproxy set, either in a file or through a tool's
+// own CLI (File is empty then, e.g. "git config --global").
+type Setting struct {
+	File     string  `json:"file,omitempty"`
+	Key      string  `json:"key"`
+	Value    string  `json:"value"`
+	Previous *string `json:"previous"` // nil means the key was not set
+}
+
+// New returns an empty manifest.
+func New() *Manifest {
+	return &Manifest{Version: currentVersion, Tools: make(map[string]*ToolState)}
+}
+
+// Load reads the manifest at path. A missing file yields an empty manifest.
+func Load(path string) (*Manifest, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return New(), nil
+		}
+		return nil, err
+	}
+	m := New()
+	if err := json.Unmarshal(data, m); err != nil {
+		return nil, err
+	}
+	if m.Tools == nil {
+		m.Tools = make(map[string]*ToolState)
+	}
+	return m, nil
+}
+
+// Save writes the manifest to path. It goes through fileutil.WriteFile so
+// the state is part of the run's backup snapshot and a rollback restores
+// state and files together.
+func Save(path string, m *Manifest) error {
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	return fileutil.WriteFile(path, append(data, '\n'), 0600)
+}
+
+// Tool returns the state for the named tool, creating it if needed.
+func (m *Manifest) Tool(name string) *ToolState {
+	t, ok := m.Tools[name]
+	if !ok {
+		t = &ToolState{}
+		m.Tools[name] = t
+	}
+	t.Applied = time.Now()
+	return t
+}
+
+// Lookup returns the recorded state for a tool, if any.
+func (m *Manifest) Lookup(name string) (*ToolState, bool) {
+	t, ok := m.Tools[name]
+	return t, ok
+}
+
+// Forget drops everything recorded for a tool, typically after Remove.
+func (m *Manifest) Forget(name string) {
+	delete(m.Tools, name)
+}
+
+// RecordSetting notes that key was set to value. current is the value found
+// before writing (nil if unset). On re-apply the original previous value is
+// kept, unless the user changed the key since ezproxy last wrote it, in
+// which case their value becomes the one to restore.
+func (t *ToolState) RecordSetting(file, key string, current *string, value string) {
+	for i := range t.Settings {
+		s := &t.Settings[i]
+		if s.File != file || s.Key != key {
+			continue
+		}
+		if current == nil || *current != s.Value {
+			s.Previous = copyString(current)
+		}
+		s.Value = value
+		return
+	}
+	t.Settings = append(t.Settings, Setting{
+		File:     file,
+		Key:      key,
+		Value:    value,
+		Previous: copyString(current),
+	})
+}
+
+// Setting returns the recorded setting for file and key.
+func (t *ToolState) Setting(file, key string) (Setting, bool) {
+	for _, s := range t.Settings {
+		if s.File == file && s.Key == key {
+			return s, true
+		}
+	}
+	return Setting{}, false
+}
+
+// RecordFile notes that path was written. existedBefore reports whether the
+// file existed before this write; a file ezproxy created on an earlier
+// apply stays marked as created. Missing files are not recorded.
+func (t *ToolState) RecordFile(path string, existedBefore bool) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return
+	}
+	for i := range t.Files {
+		if t.Files[i].Path == path {
+			t.Files[i].Hash = Hash(data)
+			return
+		}
+	}
+	t.Files = append(t.Files, FileState{
+		Path:    path,
+		Created: !existedBefore,
+		Hash:    Hash(data),
+	})
+}
+
+// File returns the recorded state for path.
+func (t *ToolState) File(path string) (FileState, bool) {
+	for _, f := range t.Files {
+		if f.Path == path {
+			return f, true
+		}
+	}
+	return FileState{}, false
+}
+
+// RecordCommand notes a command that was run to apply the configuration.
+func (t *ToolState) RecordCommand(args ...string) {
+	for _, c := range t.Commands {
+		if equalArgs(c, args) {
+			return
+		}
+	}
+	t.Commands = append(t.Commands, args)
+}
+
+func equalArgs(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// Hash returns the hex sha256 of data.
+func Hash(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func copyString(s *string) *string {
+	if s == nil {
+		return nil
+	}
+	v := *s
+	return &v
+}
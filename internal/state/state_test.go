@@ -0,0 +1,112 @@
+package state
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func strPtr(s string) *string { return &s }
+
+func TestRecordSettingKeepsOriginalPrevious(t *testing.T) {
+	m := New()
+	tool := m.Tool("git")
+
+	// First apply: user had their own proxy configured.
+	tool.RecordSetting("", "http.proxy", strPtr("http://mine:3128"), "http://proxy:8080")
+	// Re-apply: the current value is ezproxy's own, so the original is kept.
+	tool.RecordSetting("", "http.proxy", strPtr("http://proxy:8080"), "http://proxy:9090")
+
+	s, ok := tool.Setting("", "http.proxy")
+	if !ok {
+		t.Fatal("setting not recorded")
+	}
+	if s.Value != "http://proxy:9090" {
+		t.Errorf("Value = %q", s.Value)
+	}
+	if s.Previous == nil || *s.Previous != "http://mine:3128" {
+		t.Errorf("Previous = %v, want original user value", s.Previous)
+	}
+}
+
+func TestRecordSettingUserChangedSinceApply(t *testing.T) {
+	m := New()
+	tool := m.Tool("bundler")
+	tool.RecordSetting("/cfg", "KEY", nil, "/a.pem")
+	tool.RecordSetting("/cfg", "KEY", strPtr("/user.pem"), "/a.pem")
+
+	s, _ := tool.Setting("/cfg", "KEY")
+	if s.Previous == nil || *s.Previous != "/user.pem" {
+		t.Errorf("Previous = %v, want the user's newer value", s.Previous)
+	}
+}
+
+func TestRecordFileKeepsCreated(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, ".npmrc")
+	m := New()
+	tool := m.Tool("npm")
+
+	tool.RecordFile(path, false) // missing files are not recorded
+	if _, ok := tool.File(path); ok {
+		t.Fatal("missing file should not be recorded")
+	}
+
+	writeFile(t, path, "a\n")
+	tool.RecordFile(path, false)
+	writeFile(t, path, "b\n")
+	tool.RecordFile(path, true)
+
+	f, ok := tool.File(path)
+	if !ok {
+		t.Fatal("file not recorded")
+	}
+	if !f.Created {
+		t.Error("file created on first apply should stay marked as created")
+	}
+	if f.Hash != Hash([]byte("b\n")) {
+		t.Error("hash should reflect the latest write")
+	}
+}
+
+func TestSaveLoadRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "state.json")
+
+	m := New()
+	m.Tool("docker").RecordSetting("/d/config.json", "proxies", nil, `{"default":{}}`)
+	m.Tool("apt").RecordCommand("rm", "-f", "/etc/apt/apt.conf.d/99ezproxy")
+	m.Tool("apt").RecordCommand("rm", "-f", "/etc/apt/apt.conf.d/99ezproxy")
+	if err := Save(path, m); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+
+	loaded, err := Load(path)
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	s, ok := loaded.Tools["docker"].Setting("/d/config.json", "proxies")
+	if !ok || s.Previous != nil {
+		t.Errorf("docker setting not round-tripped: %+v", s)
+	}
+	if n := len(loaded.Tools["apt"].Commands); n != 1 {
+		t.Errorf("expected duplicate command to be recorded once, got %d", n)
+	}
+
+	loaded.Forget("docker")
+	if _, ok := loaded.Lookup("docker"); ok {
+		t.Error("Forget should drop the tool")
+	}
+
+	missing, err := Load(filepath.Join(dir, "nope.json"))
+	if err != nil || len(missing.Tools) != 0 {
+		t.Errorf("missing file should load as empty manifest, got %v, %v", missing, err)
+	}
+}
+
+func writeFile(t *testing.T, path, content string) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}